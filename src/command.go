@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+const (
+	USAGE_PUB    string = "Publish a message to a broker"
+	USAGE_SUB    string = "Subscribe to topics and print received messages"
+	USAGE_BENCH  string = "Generate publish load and report throughput/latency"
+	USAGE_BROKER string = "Run an embedded MQTT 3.1.1 broker for local development"
+	USAGE_REPLAY string = "Replay a recording into the Dispatcher or to a broker"
+)
+
+type (
+	// command represents a subcommand of the binary
+	command struct {
+		usage string
+		run   func(args []string) error
+	}
+
+	// topicFlags collects repeated -t flags
+	topicFlags []string
+
+	// qosFlag is a -q flag limited to QoS 0, 1 and 2
+	qosFlag byte
+)
+
+var (
+	commands = map[string]command{
+		"pub":    {usage: USAGE_PUB, run: runPub},
+		"sub":    {usage: USAGE_SUB, run: runSub},
+		"bench":  {usage: USAGE_BENCH, run: runBench},
+		"broker": {usage: USAGE_BROKER, run: runBroker},
+		"replay": {usage: USAGE_REPLAY, run: runReplay},
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// runCommand
+func runCommand(name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for key := range commands {
+			names = append(names, key)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return cmd.run(args)
+}
+
+// *--------------------------------------------------------------------------------------
+// newCommandFlags
+func newCommandFlags(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [-m mode] [-env path] %s [options]\n  %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// *--------------------------------------------------------------------------------------
+// commandContext
+// DEV: Ctrl+C / SIGTERMでキャンセルされるコンテキスト
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// *--------------------------------------------------------------------------------------
+// brokerConfig
+// DEV: config.jsonから名前でBrokerの設定を取得する (1つだけなら省略可)
+func brokerConfig(name string) (string, mqttm.Config, error) {
+	if name == "" {
+		if len(conf.MQTT) != 1 {
+			return "", mqttm.Config{}, fmt.Errorf("-b is required when %d brokers are configured", len(conf.MQTT))
+		}
+		for hostName := range conf.MQTT {
+			name = hostName
+		}
+	}
+	mqttConf, ok := conf.MQTT[name]
+	if !ok || mqttConf == nil {
+		return "", mqttm.Config{}, fmt.Errorf("broker %s is not configured", name)
+	}
+	return name, *mqttConf, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// connectModule
+func connectModule(ctx context.Context, clientID, hostName string, mqttConf mqttm.Config) (*mqttm.Module, error) {
+	mqttModule, err := mqttm.New(ctx, clientID, hostName, mqttConf)
+	if err != nil {
+		return nil, err
+	}
+	if err := mqttModule.Run(); err != nil {
+		return nil, err
+	}
+	return mqttModule, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// commandClientID
+func commandClientID(id, suffix string) string {
+	if id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s-%s-%d", deviceIDEnv, suffix, os.Getpid())
+}
+
+// *--------------------------------------------------------------------------------------
+// readPayload
+// DEV: 引数 > ファイル > 標準入力 ("-") の順で送信データを決める
+func readPayload(message, file string) ([]byte, error) {
+	switch {
+	case message != "":
+		return []byte(message), nil
+	case file == "-":
+		return io.ReadAll(os.Stdin)
+	case file != "":
+		return os.ReadFile(file)
+	default:
+		return nil, fmt.Errorf("payload is required (-msg, -f or -f - for stdin)")
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// String (flag.Value)
+func (t *topicFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+// *--------------------------------------------------------------------------------------
+// Set (flag.Value)
+func (t *topicFlags) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// String (flag.Value)
+func (q *qosFlag) String() string {
+	return strconv.Itoa(int(*q))
+}
+
+// *--------------------------------------------------------------------------------------
+// Set (flag.Value)
+// DEV: 範囲外の値はbyteへの変換で別のQoSにならないよう、使い方のエラーにする
+func (q *qosFlag) Set(value string) error {
+	level, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || level > 2 {
+		return fmt.Errorf("QoS must be 0, 1 or 2")
+	}
+	*q = qosFlag(level)
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+type (
+	// benchResult holds the measurements of a single bench client
+	benchResult struct {
+		sent      int
+		errors    int
+		latencies []time.Duration
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// runBench
+func runBench(args []string) error {
+	var qos qosFlag
+	fs := newCommandFlags("bench", USAGE_BENCH)
+	broker := fs.String("b", "", "Broker name in config.json")
+	topic := fs.String("t", "bench", "Topic to publish to")
+	fs.Var(&qos, "q", "QoS level (0/1/2)")
+	size := fs.Int("s", 256, "Payload size in bytes")
+	rate := fs.Float64("r", 0, "Total publish rate in messages/sec (0 = unlimited)")
+	concurrency := fs.Int("c", 1, "Number of concurrent clients")
+	duration := fs.Duration("d", 10*time.Second, "Duration of the benchmark")
+	count := fs.Int("n", 0, "Total number of messages (0 = until -d elapses)")
+	fs.Parse(args)
+
+	if *concurrency < 1 || *size < 0 {
+		return fmt.Errorf("-c must be >= 1 and -s must be >= 0")
+	}
+	hostName, mqttConf, err := brokerConfig(*broker)
+	if err != nil {
+		return err
+	}
+	mqttConf.SubscribeTopics = nil
+
+	ctx, cancelFn := commandContext()
+	defer cancelFn()
+
+	// Connect all clients before the measurement starts
+	clients := make([]*mqttm.Module, 0, *concurrency)
+	defer func() {
+		for _, client := range clients {
+			client.Stop()
+		}
+	}()
+	for i := 0; i < *concurrency; i++ {
+		client, err := connectModule(ctx, commandClientID("", fmt.Sprintf("bench%d", i)), hostName, mqttConf)
+		if err != nil {
+			return fmt.Errorf("failed to connect client %d: %w", i, err)
+		}
+		clients = append(clients, client)
+	}
+
+	payload := make([]byte, *size)
+	rand.Read(payload)
+
+	benchCtx, benchCancel := context.WithTimeout(ctx, *duration)
+	defer benchCancel()
+	tokens := benchTokens(benchCtx, *rate, *count)
+
+	zap.S().Infof("Benchmark started: %d client(s), %d bytes, QoS %d, rate %.0f msg/s", *concurrency, *size, qos, *rate)
+	results := make([]benchResult, len(clients))
+	wg := &sync.WaitGroup{}
+	start := time.Now()
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *mqttm.Module) {
+			defer wg.Done()
+			for range tokens {
+				begin := time.Now()
+				if err := client.Publish(*topic, byte(qos), payload); err != nil {
+					results[i].errors++
+					continue
+				}
+				results[i].sent++
+				results[i].latencies = append(results[i].latencies, time.Since(begin))
+			}
+		}(i, client)
+	}
+	wg.Wait()
+
+	reportBench(results, time.Since(start), *size)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// benchTokens
+// DEV: 送信タイミングを配るチャネル (rate=0なら無制限、countに達するか終了で閉じる)
+func benchTokens(ctx context.Context, rate float64, count int) <-chan struct{} {
+	tokens := make(chan struct{})
+	go func() {
+		defer close(tokens)
+		var ticker *time.Ticker
+		if rate > 0 {
+			ticker = time.NewTicker(time.Duration(float64(time.Second) / rate))
+			defer ticker.Stop()
+		}
+		for issued := 0; count == 0 || issued < count; issued++ {
+			if ticker != nil {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case tokens <- struct{}{}:
+			}
+		}
+	}()
+	return tokens
+}
+
+// *--------------------------------------------------------------------------------------
+// reportBench
+func reportBench(results []benchResult, elapsed time.Duration, size int) {
+	var sent, errors int
+	var latencies []time.Duration
+	for _, result := range results {
+		sent += result.sent
+		errors += result.errors
+		latencies = append(latencies, result.latencies...)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	fmt.Fprintf(os.Stdout, "messages   : %d sent, %d failed in %s\n", sent, errors, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(os.Stdout, "throughput : %.1f msg/s, %.3f MB/s\n", float64(sent)/seconds, float64(sent*size)/seconds/1e6)
+	if len(latencies) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "latency    : p50 %s, p90 %s, p99 %s, max %s\n",
+		percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[len(latencies)-1])
+}
+
+// *--------------------------------------------------------------------------------------
+// percentile
+func percentile(sorted []time.Duration, p int) time.Duration {
+	index := (len(sorted)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"github.com/tinayla696/mqtt_protocol_golang/module/broker"
+	"go.uber.org/zap"
+)
+
+// *--------------------------------------------------------------------------------------
+// runBroker
+func runBroker(args []string) error {
+	fs := newCommandFlags("broker", USAGE_BROKER)
+	listen := fs.String("l", broker.DEFAULT_LISTEN, "Listen address (host:port)")
+	fs.Parse(args)
+
+	ctx, cancelFn := commandContext()
+	defer cancelFn()
+
+	embedded := broker.New(broker.Config{Listen: *listen})
+	if err := embedded.Start(); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	zap.S().Info("Received interrupt signal, stopping the embedded broker...")
+	return embedded.Close()
+}
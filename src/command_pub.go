@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// *--------------------------------------------------------------------------------------
+// runPub
+func runPub(args []string) error {
+	var qos qosFlag
+	fs := newCommandFlags("pub", USAGE_PUB)
+	broker := fs.String("b", "", "Broker name in config.json")
+	clientID := fs.String("id", "", "Client ID (default <DEVICE_ID>-pub-<pid>)")
+	topic := fs.String("t", "", "Topic to publish to")
+	fs.Var(&qos, "q", "QoS level (0/1/2)")
+	message := fs.String("msg", "", "Payload given as an argument")
+	file := fs.String("f", "", "Payload file (- for stdin)")
+	count := fs.Int("n", 1, "Number of times to publish the payload")
+	fs.Parse(args)
+
+	if *topic == "" {
+		return fmt.Errorf("-t is required")
+	}
+	payload, err := readPayload(*message, *file)
+	if err != nil {
+		return err
+	}
+	hostName, mqttConf, err := brokerConfig(*broker)
+	if err != nil {
+		return err
+	}
+	mqttConf.SubscribeTopics = nil
+
+	ctx, cancelFn := commandContext()
+	defer cancelFn()
+	mqttModule, err := connectModule(ctx, commandClientID(*clientID, "pub"), hostName, mqttConf)
+	if err != nil {
+		return err
+	}
+	defer mqttModule.Stop()
+
+	for i := 0; i < *count; i++ {
+		if err := mqttModule.Publish(*topic, byte(qos), payload); err != nil {
+			return err
+		}
+	}
+	zap.S().Infof("Published %d message(s) (%d bytes) to %s on %s", *count, len(payload), *topic, hostName)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/develop"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service"
+	"go.uber.org/zap"
+)
+
+const (
+	REPLAY_HOSTNAME string = "replay"
+)
+
+// *--------------------------------------------------------------------------------------
+// runReplay
+// DEV: -bがあればBrokerへ再送信、無ければローカルのDispatcherへ流す
+func runReplay(args []string) error {
+	var topics topicFlags
+	fs := newCommandFlags("replay", USAGE_REPLAY)
+	file := fs.String("f", "", "Recording file (created with -record)")
+	broker := fs.String("b", "", "Republish to this broker instead of feeding a local Dispatcher")
+	speed := fs.Float64("speed", 1, "Replay speed (1 = original, 2 = twice as fast, 0 = max)")
+	fs.Var(&topics, "t", "Topic filter to replay (repeatable, default all)")
+	includePub := fs.Bool("pub", false, "Replay recorded publishes as well")
+	workers := fs.Int("w", 1, "Number of workers of the local Dispatcher")
+	fs.Parse(args)
+
+	if *file == "" {
+		return fmt.Errorf("-f is required")
+	}
+	replayConf := develop.ReplayConfig{Speed: *speed, Filters: topics, IncludePub: *includePub}
+
+	ctx, cancelFn := commandContext()
+	defer cancelFn()
+
+	// Republish to a broker
+	if *broker != "" {
+		hostName, mqttConf, err := brokerConfig(*broker)
+		if err != nil {
+			return err
+		}
+		mqttConf.SubscribeTopics = nil
+		mqttModule, err := connectModule(ctx, commandClientID("", "replay"), hostName, mqttConf)
+		if err != nil {
+			return err
+		}
+		defer mqttModule.Stop()
+
+		replayed, err := develop.Replay(ctx, *file, replayConf, func(record develop.Record) error {
+			return mqttModule.Publish(record.Contents.Topic, record.Contents.QoS, record.Contents.Payload)
+		})
+		zap.S().Infof("Replayed %d message(s) to %s", replayed, hostName)
+		return err
+	}
+
+	// Feed a local Dispatcher
+	client := develop.NewReplayClient(REPLAY_HOSTNAME)
+	// DEV: 記録は一度に流れ込むため、キューが満杯でも破棄せずに待つ
+	dw := service.NewDispatcher(ctx, map[string]mqttm.Client{REPLAY_HOSTNAME: client}, *workers, service.WithBackpressure())
+	dw.Start()
+	replayed, err := develop.Replay(ctx, *file, replayConf, func(record develop.Record) error {
+		return client.Feed(ctx, record)
+	})
+	client.Close()
+	report := dw.Drain(ctx)
+	dw.Stop()
+	zap.S().Infof("Replayed %d message(s) into the Dispatcher (%s)", replayed, report)
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+const (
+	FORMAT_RAW  string = "raw"
+	FORMAT_JSON string = "json"
+	FORMAT_HEX  string = "hex"
+)
+
+// *--------------------------------------------------------------------------------------
+// runSub
+func runSub(args []string) error {
+	var topics topicFlags
+	var qos qosFlag
+	fs := newCommandFlags("sub", USAGE_SUB)
+	broker := fs.String("b", "", "Broker name in config.json")
+	clientID := fs.String("id", "", "Client ID (default <DEVICE_ID>-sub-<pid>)")
+	fs.Var(&topics, "t", "Topic filter to subscribe to (repeatable, default subscribe_topics of the broker)")
+	fs.Var(&qos, "q", "QoS level for -t topics (0/1/2)")
+	format := fs.String("o", FORMAT_RAW, "Output format (raw/json/hex)")
+	count := fs.Int("n", 0, "Exit after receiving N messages (0 = unlimited)")
+	fs.Parse(args)
+
+	if *format != FORMAT_RAW && *format != FORMAT_JSON && *format != FORMAT_HEX {
+		return fmt.Errorf("unsupported output format %q", *format)
+	}
+	hostName, mqttConf, err := brokerConfig(*broker)
+	if err != nil {
+		return err
+	}
+	if len(topics) > 0 {
+		mqttConf.SubscribeTopics = make(map[string]byte, len(topics))
+		for _, topic := range topics {
+			mqttConf.SubscribeTopics[topic] = byte(qos)
+		}
+	}
+	if len(mqttConf.SubscribeTopics) == 0 {
+		return fmt.Errorf("no topics to subscribe to (-t)")
+	}
+
+	ctx, cancelFn := commandContext()
+	defer cancelFn()
+	mqttModule, err := connectModule(ctx, commandClientID(*clientID, "sub"), hostName, mqttConf)
+	if err != nil {
+		return err
+	}
+	defer mqttModule.Stop()
+
+	for received := 0; *count == 0 || received < *count; received++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case contents := <-mqttModule.SubCh:
+			if err := printContents(contents, *format); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// printContents
+func printContents(contents mqttm.Contents, format string) error {
+	switch format {
+	case FORMAT_JSON:
+		record := map[string]interface{}{
+			"timestamp": contents.Timestamp.Format(time.RFC3339Nano),
+			"hostname":  contents.Hostname,
+			"topic":     contents.Topic,
+			"qos":       contents.QoS,
+		}
+		// DEV: JSONはそのまま埋め込み、文字列はstring、それ以外はbase64になる
+		switch {
+		case json.Valid(contents.Payload):
+			record["payload"] = json.RawMessage(contents.Payload)
+		case utf8.Valid(contents.Payload):
+			record["payload"] = string(contents.Payload)
+		default:
+			record["payload"] = contents.Payload
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(line))
+
+	case FORMAT_HEX:
+		fmt.Fprintf(os.Stdout, "%s (%d bytes)\n%s", contents.Topic, len(contents.Payload), hex.Dump(contents.Payload))
+
+	default:
+		os.Stdout.Write(contents.Payload)
+		fmt.Fprintln(os.Stdout)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestQoSFlag(t *testing.T) {
+	for value, want := range map[string]qosFlag{"0": 0, "1": 1, "2": 2} {
+		var qos qosFlag
+		fs := flag.NewFlagSet("pub", flag.ContinueOnError)
+		fs.Var(&qos, "q", "")
+		if err := fs.Parse([]string{"-q", value}); err != nil || qos != want {
+			t.Errorf("-q %s = %d, %v, want %d", value, qos, err, want)
+		}
+	}
+
+	// DEV: 256はbyteへの変換でQoS 0にならないこと
+	for _, value := range []string{"3", "256", "-1", "one"} {
+		var qos qosFlag
+		fs := flag.NewFlagSet("pub", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.Var(&qos, "q", "")
+		if err := fs.Parse([]string{"-q", value}); err == nil {
+			t.Errorf("-q %s was accepted as %d", value, qos)
+		}
+	}
+}
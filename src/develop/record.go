@@ -0,0 +1,377 @@
+// develop/record.go
+// DEV: 受信・送信メッセージを記録するコンパクトなバイナリ形式
+//
+//	header : "MQRC" + version(1byte)
+//	frame  : uvarint(timestamp delta ns) | flags(1byte: bit0=publish, bit1-2=QoS)
+//	         | uvarint(len)+hostname | uvarint(len)+topic | uvarint(len)+payload
+package develop
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	RECORD_MAGIC   string = "MQRC"
+	RECORD_VERSION byte   = 1
+
+	FLAG_PUBLISH byte = 0x01
+
+	RECORD_MAX_FIELD_SIZE uint64        = 256 << 20 // MQTTの最大パケットサイズ (これを超える長さは壊れたファイル)
+	RECORD_FLUSH_INTERVAL time.Duration = time.Second
+)
+
+type (
+	// Direction tells whether a record was received (SubCh) or sent (PubCh)
+	Direction byte
+
+	// Record is a single recorded message
+	Record struct {
+		Direction Direction
+		Contents  mqttm.Contents
+	}
+)
+
+const (
+	DirectionSubscribe Direction = 0
+	DirectionPublish   Direction = 1
+)
+
+// *--------------------------------------------------------------------------------------
+// String
+func (d Direction) String() string {
+	if d == DirectionPublish {
+		return "pub"
+	}
+	return "sub"
+}
+
+// *--------------------------------------------------------------------------------------
+// Recorder
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	w       *bufio.Writer
+	last    int64
+	filters []string
+
+	done    chan struct{}
+	flushed sync.WaitGroup
+}
+
+// *--------------------------------------------------------------------------------------
+// NewRecorder (constructor)
+// DEV: filtersが空なら全トピックを記録する。異常終了で失わないよう定期的に書き出す
+func NewRecorder(path string, filters []string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(RECORD_MAGIC)
+	w.WriteByte(RECORD_VERSION)
+	r := &Recorder{file: file, w: w, filters: filters, done: make(chan struct{})}
+	r.flushed.Add(1)
+	go r.flushLoop()
+	return r, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// flushLoop
+func (r *Recorder) flushLoop() {
+	defer r.flushed.Done()
+	ticker := time.NewTicker(RECORD_FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				zap.S().Errorf("Failed to flush recording %s: %v", r.file.Name(), err)
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Record
+func (r *Recorder) Record(direction Direction, contents mqttm.Contents) error {
+	if !matchFilters(r.filters, contents.Topic) {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	timestamp := contents.Timestamp.UnixNano()
+	if contents.Timestamp.IsZero() {
+		timestamp = time.Now().UnixNano()
+	}
+	delta := timestamp - r.last
+	if delta < 0 {
+		delta = 0
+		timestamp = r.last
+	}
+	r.last = timestamp
+
+	flags := contents.QoS << 1
+	if direction == DirectionPublish {
+		flags |= FLAG_PUBLISH
+	}
+	buf := binary.AppendUvarint(nil, uint64(delta))
+	buf = append(buf, flags)
+	buf = appendBytes(buf, []byte(contents.Hostname))
+	buf = appendBytes(buf, []byte(contents.Topic))
+	buf = appendBytes(buf, contents.Payload)
+	_, err := r.w.Write(buf)
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// Flush
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+func (r *Recorder) Close() error {
+	close(r.done)
+	r.flushed.Wait()
+	if err := r.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// *--------------------------------------------------------------------------------------
+// RecordReader
+type RecordReader struct {
+	file *os.File
+	r    *bufio.Reader
+	last int64
+}
+
+// *--------------------------------------------------------------------------------------
+// OpenRecording
+func OpenRecording(path string) (*RecordReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(file)
+	header := make([]byte, len(RECORD_MAGIC)+1)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(RECORD_MAGIC)]) != RECORD_MAGIC {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a recording", path)
+	}
+	if version := header[len(RECORD_MAGIC)]; version != RECORD_VERSION {
+		file.Close()
+		return nil, fmt.Errorf("unsupported recording version %d", version)
+	}
+	return &RecordReader{file: file, r: r}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Next
+// DEV: 終端ではio.EOFを返す
+func (rr *RecordReader) Next() (Record, error) {
+	delta, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return Record{}, err
+	}
+	flags, err := rr.r.ReadByte()
+	if err != nil {
+		return Record{}, unexpectedEOF(err)
+	}
+	hostname, err := readBytes(rr.r)
+	if err != nil {
+		return Record{}, err
+	}
+	topic, err := readBytes(rr.r)
+	if err != nil {
+		return Record{}, err
+	}
+	payload, err := readBytes(rr.r)
+	if err != nil {
+		return Record{}, err
+	}
+
+	rr.last += int64(delta)
+	direction := DirectionSubscribe
+	if flags&FLAG_PUBLISH != 0 {
+		direction = DirectionPublish
+	}
+	return Record{
+		Direction: direction,
+		Contents: mqttm.Contents{
+			Timestamp: time.Unix(0, rr.last),
+			Hostname:  string(hostname),
+			Topic:     string(topic),
+			QoS:       (flags >> 1) & 0x03,
+			Payload:   payload,
+		},
+	}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+func (rr *RecordReader) Close() error {
+	return rr.file.Close()
+}
+
+// *--------------------------------------------------------------------------------------
+// RecordClient
+// DEV: mqttm.Clientを包み、受信 (と任意で送信) を記録する
+type RecordClient struct {
+	mqttm.Client
+	recorder   *Recorder
+	recordPub  bool
+	subscribed chan mqttm.Contents
+}
+
+// *--------------------------------------------------------------------------------------
+// NewRecordClient (constructor)
+func NewRecordClient(ctx context.Context, client mqttm.Client, recorder *Recorder, recordPub bool) *RecordClient {
+	rc := &RecordClient{
+		Client:     client,
+		recorder:   recorder,
+		recordPub:  recordPub,
+		subscribed: make(chan mqttm.Contents, mqttm.QUEUE_SIZE),
+	}
+	go rc.tee(ctx)
+	return rc
+}
+
+// *--------------------------------------------------------------------------------------
+// Subscription
+func (rc *RecordClient) Subscription() <-chan mqttm.Contents {
+	return rc.subscribed
+}
+
+// *--------------------------------------------------------------------------------------
+// Enqueue
+func (rc *RecordClient) Enqueue(ctx context.Context, contents mqttm.Contents) error {
+	if err := rc.Client.Enqueue(ctx, contents); err != nil {
+		return err
+	}
+	if rc.recordPub {
+		if contents.Timestamp.IsZero() {
+			contents.Timestamp = time.Now()
+		}
+		rc.record(DirectionPublish, contents)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Publish
+func (rc *RecordClient) Publish(topic string, qos byte, payload []byte) error {
+	if err := rc.Client.Publish(topic, qos, payload); err != nil {
+		return err
+	}
+	if rc.recordPub {
+		rc.record(DirectionPublish, mqttm.Contents{
+			Timestamp: time.Now(),
+			Hostname:  rc.Hostname(),
+			Topic:     topic,
+			QoS:       qos,
+			Payload:   payload,
+		})
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// tee
+func (rc *RecordClient) tee(ctx context.Context) {
+	defer close(rc.subscribed)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case contents, ok := <-rc.Client.Subscription():
+			if !ok {
+				return
+			}
+			rc.record(DirectionSubscribe, contents)
+			select {
+			case rc.subscribed <- contents:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// record
+func (rc *RecordClient) record(direction Direction, contents mqttm.Contents) {
+	if err := rc.recorder.Record(direction, contents); err != nil {
+		zap.S().Errorf("Failed to record %s message on %s: %v", direction, contents.Topic, err)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// appendBytes
+func appendBytes(buf, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// *--------------------------------------------------------------------------------------
+// readBytes
+// DEV: 長さはファイルの値をそのまま信用せず、上限を超えれば確保せずにエラーにする
+func readBytes(r *bufio.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if length > RECORD_MAX_FIELD_SIZE {
+		return nil, fmt.Errorf("recorded field of %d bytes exceeds %d bytes, the recording is corrupt", length, RECORD_MAX_FIELD_SIZE)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return data, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// unexpectedEOF
+// DEV: フレームの途中で終わった場合はio.EOFと区別する
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// matchFilters
+func matchFilters(filters []string, topic string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, filter := range filters {
+		if mqttm.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
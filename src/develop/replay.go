@@ -0,0 +1,146 @@
+package develop
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+type (
+	// ReplayConfig controls the pace and the selection of replayed records
+	ReplayConfig struct {
+		Speed      float64  // 1 = original pace, 2 = twice as fast, 0 = as fast as possible
+		Filters    []string // Topic filters (empty = all)
+		IncludePub bool     // Replay recorded publishes as well
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Replay
+// DEV: 記録を読み出し、元の間隔 (Speedで伸縮) を保ってemitに渡す
+func Replay(ctx context.Context, path string, conf ReplayConfig, emit func(Record) error) (int, error) {
+	reader, err := OpenRecording(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var first time.Time
+	start := time.Now()
+	replayed := 0
+	for {
+		record, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if record.Direction == DirectionPublish && !conf.IncludePub {
+			continue
+		}
+		if !matchFilters(conf.Filters, record.Contents.Topic) {
+			continue
+		}
+
+		if first.IsZero() {
+			first = record.Contents.Timestamp
+		}
+		if conf.Speed > 0 {
+			offset := time.Duration(float64(record.Contents.Timestamp.Sub(first)) / conf.Speed)
+			if wait := time.Until(start.Add(offset)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return replayed, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return replayed, ctx.Err()
+		default:
+		}
+		if err := emit(record); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// ReplayClient
+// DEV: 記録を受信メッセージとして流すmqttm.Client (Dispatcherへの入力用)
+type ReplayClient struct {
+	hostname string
+	inbound  chan mqttm.Contents
+}
+
+var _ mqttm.Client = (*ReplayClient)(nil)
+
+// *--------------------------------------------------------------------------------------
+// NewReplayClient (constructor)
+func NewReplayClient(hostname string) *ReplayClient {
+	return &ReplayClient{
+		hostname: hostname,
+		inbound:  make(chan mqttm.Contents, mqttm.QUEUE_SIZE),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Feed
+// DEV: 記録時刻ではなく再生時刻を受信時刻とする
+func (rc *ReplayClient) Feed(ctx context.Context, record Record) error {
+	contents := record.Contents
+	contents.Timestamp = time.Now()
+	contents.Hostname = rc.hostname
+	select {
+	case rc.inbound <- contents:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+func (rc *ReplayClient) Close() {
+	close(rc.inbound)
+}
+
+// *--------------------------------------------------------------------------------------
+// Hostname
+func (rc *ReplayClient) Hostname() string {
+	return rc.hostname
+}
+
+// *--------------------------------------------------------------------------------------
+// Subscription
+func (rc *ReplayClient) Subscription() <-chan mqttm.Contents {
+	return rc.inbound
+}
+
+// *--------------------------------------------------------------------------------------
+// Enqueue
+func (rc *ReplayClient) Enqueue(ctx context.Context, contents mqttm.Contents) error {
+	zap.S().Debugf("Replay: discarding publish to %s", contents.Topic)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Publish
+func (rc *ReplayClient) Publish(topic string, qos byte, payload []byte) error {
+	zap.S().Debugf("Replay: discarding publish to %s", topic)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// IsConnected
+func (rc *ReplayClient) IsConnected() bool {
+	return true
+}
@@ -8,12 +8,19 @@ import (
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/tinayla696/mqtt_protocol_golang/develop"
 	"github.com/tinayla696/mqtt_protocol_golang/module"
+	"github.com/tinayla696/mqtt_protocol_golang/module/admin"
+	"github.com/tinayla696/mqtt_protocol_golang/module/codec"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
 	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/sparkplug"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
 	"github.com/tinayla696/mqtt_protocol_golang/service"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
 	"go.uber.org/zap"
 )
 
@@ -28,6 +35,8 @@ var (
 	// Arguments
 	appModeArg *string = flag.String("m", "proc", "Mode of operation (proc/debug/test)")
 	envPathArg *string = flag.String("env", ENV_PATH, "Path to the environment configuration file")
+	recordArg  *string = flag.String("record", "", "Record received messages to this file (debugging)")
+	recordPub  *bool   = flag.Bool("record-pub", false, "Record published messages as well (with -record)")
 
 	// Environment variables
 	deviceIDEnv   string = "test00"
@@ -41,7 +50,18 @@ var (
 
 type (
 	Config struct {
-		MQTT map[string]*mqttm.Config `json:"MQTT"`
+		MQTT       map[string]*mqttm.Config `json:"MQTT"`
+		Metrics    metrics.Config           `json:"Metrics"`
+		Codec      codec.Config             `json:"Codec"`
+		DeadLetter service.DeadLetterConfig `json:"DeadLetter"`
+		Sparkplug  *sparkplug.HostConfig    `json:"Sparkplug"`
+		Schema     service.SchemaConfig     `json:"Schema"`
+		Dedup      service.DedupConfig      `json:"Dedup"`
+		Dispatch   service.DispatchConfig   `json:"Dispatch"`
+		Admin      admin.Config             `json:"Admin"`
+		Middleware service.MiddlewareConfig `json:"Middleware"`
+		Tracing    tracing.Config           `json:"Tracing"`
+		Breakers   []service.BreakerConfig  `json:"Breakers"`
 	}
 )
 
@@ -83,6 +103,30 @@ func main() {
 	}
 	// zap.S().Debugf("Configuration loaded successfully \n %+v", conf)
 
+	// Subcommands (pub / sub / bench / broker / replay)
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Arg(0), flag.Args()[1:]); err != nil {
+			zap.S().Fatalf("Command %s failed: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
+	// Metrics endpoint
+	if err := metrics.Serve(conf.Metrics); err != nil {
+		zap.S().Warnf("Failed to start metrics server: %v", err)
+	}
+
+	// Admin API
+	if err := admin.Serve(conf.Admin); err != nil {
+		zap.S().Warnf("Failed to start admin server: %v", err)
+	}
+
+	// Tracing (OpenTelemetry)
+	shutdownTracing, err := tracing.Setup(context.Background(), conf.Tracing)
+	if err != nil {
+		zap.S().Fatalf("Failed to set up tracing: %v", err)
+	}
+
 	// Context & Interrupt handling
 	ctx, cancelFn := context.WithCancel(context.Background())
 	interrupt := make(chan os.Signal, 1)
@@ -90,7 +134,19 @@ func main() {
 
 	// Setup MQTT Module
 	for hostName, mqttConf := range conf.MQTT {
-		mqttModule, err := mqttm.New(ctx, deviceIDEnv, hostName, *mqttConf)
+		var opts []mqttm.Option
+		if sp := conf.Sparkplug; sp != nil && sp.Broker == hostName {
+			topics := make(map[string]byte)
+			for topic, qos := range mqttConf.SubscribeTopics {
+				topics[topic] = qos
+			}
+			for topic, qos := range sp.Topics() {
+				topics[topic] = qos
+			}
+			mqttConf.SubscribeTopics = topics
+			opts = sp.ModuleOptions()
+		}
+		mqttModule, err := mqttm.New(ctx, deviceIDEnv, hostName, *mqttConf, opts...)
 		if err != nil {
 			zap.S().Warnf("Failed to create MQTT module for %s: %v", hostName, err)
 			continue
@@ -104,12 +160,158 @@ func main() {
 	}
 
 	// Start Dispatcher / Worker
-	dw := service.NewDispatcher(ctx, mqttClients, 1)
+	dispatchClients := make(map[string]mqttm.Client, len(mqttClients))
+	for hostName, mqttModule := range mqttClients {
+		dispatchClients[hostName] = mqttModule
+	}
+
+	// Record traffic (debugging)
+	if *recordArg != "" {
+		recorder, err := develop.NewRecorder(*recordArg, nil)
+		if err != nil {
+			zap.S().Fatalf("Failed to create recording %s: %v", *recordArg, err)
+		}
+		defer recorder.Close()
+		for hostName, client := range dispatchClients {
+			dispatchClients[hostName] = develop.NewRecordClient(ctx, client, recorder, *recordPub)
+		}
+		zap.S().Infof("Recording messages to %s", *recordArg)
+	}
+
+	// Sparkplug host application
+	if sp := conf.Sparkplug; sp != nil {
+		if client, ok := dispatchClients[sp.Broker]; ok {
+			dispatchClients[sp.Broker] = sparkplug.NewHost(ctx, client, *sp)
+			zap.S().Infof("Consuming Sparkplug B messages from %s", sp.Broker)
+		} else {
+			zap.S().Warnf("Sparkplug broker %s is not running", sp.Broker)
+		}
+	}
+
+	// Payload codecs & dead-letter
+	codecs, err := codec.NewRegistry(conf.Codec)
+	if err != nil {
+		zap.S().Fatalf("Failed to load codecs: %v", err)
+	}
+	codecs.Register(sparkplug.Codec{})
+	deadLetters, err := service.NewDeadLetter(conf.DeadLetter, dispatchClients)
+	if err != nil {
+		zap.S().Fatalf("Failed to set up dead-letter: %v", err)
+	}
+	schemas, err := service.NewSchemaValidator(conf.Schema)
+	if err != nil {
+		zap.S().Fatalf("Failed to load schemas: %v", err)
+	}
+	var rejections service.DeadLetter
+	if conf.Schema.Reject.Path != "" || conf.Schema.Reject.Topic != "" {
+		if rejections, err = service.NewDeadLetter(conf.Schema.Reject, dispatchClients); err != nil {
+			zap.S().Fatalf("Failed to set up schema rejections: %v", err)
+		}
+	}
+	dedup, err := service.NewDeduplicator(conf.Dedup)
+	if err != nil {
+		zap.S().Fatalf("Failed to set up deduplication: %v", err)
+	}
+	ordering, err := service.NewOrderKey(conf.Dispatch.OrderKey)
+	if err != nil {
+		zap.S().Fatalf("Invalid dispatch order key: %v", err)
+	}
+	lanes, err := service.NewLanes(conf.Dispatch.Priority)
+	if err != nil {
+		zap.S().Fatalf("Invalid dispatch priority: %v", err)
+	}
+	if ordering != nil && lanes != nil {
+		zap.S().Fatalf("Dispatch priority lanes cannot be combined with order_key")
+	}
+	batcher, err := service.NewBatcher(conf.Dispatch.Batches, nil)
+	if err != nil {
+		zap.S().Fatalf("Invalid dispatch batches: %v", err)
+	}
+	if err := service.ValidateTimeouts(conf.Dispatch.Timeouts); err != nil {
+		zap.S().Fatalf("Invalid dispatch timeouts: %v", err)
+	}
+	if err := service.ValidateRateLimits(conf.Dispatch); err != nil {
+		zap.S().Fatalf("Invalid dispatch rate limits: %v", err)
+	}
+	// DEV: サーキットブレーカーはMiddleware名 breaker:<name> でタスクに適用する
+	breakers, namedMiddlewares, err := service.NewCircuitBreakers(conf.Breakers)
+	if err != nil {
+		zap.S().Fatalf("Invalid circuit breakers: %v", err)
+	}
+	for name, breaker := range breakers {
+		pause := breaker.Config().Pause
+		if pause == nil {
+			continue
+		}
+		if mqttModule, ok := mqttClients[pause.Host]; ok {
+			service.PauseWhileOpen(breaker, mqttModule, pause.Topics...)
+		} else {
+			zap.S().Warnf("Circuit breaker %s cannot pause %s, the MQTT module is not running", name, pause.Host)
+		}
+	}
+	// DEV: トレースが有効な場合はタスク実行をOpenTelemetryのSpanとして記録する
+	if conf.Tracing.Enabled() {
+		namedMiddlewares[service.MIDDLEWARE_TRACING] = service.Tracing(service.OtelTracer{})
+		conf.Middleware = conf.Middleware.WithTracing()
+	}
+	middleware, err := service.NewMiddlewareChain(conf.Middleware, namedMiddlewares)
+	if err != nil {
+		zap.S().Fatalf("Invalid middleware: %v", err)
+	}
+	workers := conf.Dispatch.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	dispatchOpts := []service.Option{
+		service.WithCodecs(codecs),
+		service.WithDeadLetter(deadLetters),
+		service.WithSchemas(schemas, rejections),
+		service.WithDedup(dedup),
+		service.WithOrdering(ordering),
+		service.WithPriority(lanes),
+		service.WithBatcher(batcher),
+		service.WithPool(conf.Dispatch.PoolConfig),
+		service.WithTimeouts(conf.Dispatch.Timeouts),
+		service.WithMiddleware(middleware),
+	}
+	for taskType, poolConf := range conf.Dispatch.Pools {
+		if taskType == task.MqttTaskType {
+			zap.S().Warnf("Ignoring Dispatch.pools.%s, the MQTT pool is configured in Dispatch itself", taskType)
+			continue
+		}
+		dispatchOpts = append(dispatchOpts, service.WithTaskPool(taskType, poolConf))
+	}
+	dw := service.NewDispatcher(ctx, dispatchClients, workers, dispatchOpts...)
+	admin.Handle("/workers", dw.AdminHandler())
+	admin.Handle("/breakers", service.BreakersHandler(breakers))
 	dw.Start()
 
 	// Handle interrupt signal
 	<-interrupt
 	zap.S().Info("Received interrupt signal, shutting down...")
+	drainSec := conf.Dispatch.DrainTimeoutSec
+	if drainSec <= 0 {
+		drainSec = service.DEFAULT_DRAIN_TIMEOUT_SEC
+	}
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(drainSec)*time.Second)
+	defer drainCancel()
+
+	// DEV: No.1 新しい受信を止める
+	for hostName, mqttModule := range mqttClients {
+		if err := mqttModule.Unsubscribe(); err != nil {
+			zap.S().Warnf("Failed to unsubscribe %s: %v", hostName, err)
+		}
+	}
+	// DEV: No.2 キューのタスクを期限まで実行し、残りを退避する
+	report := dw.Drain(drainCtx)
+	zap.S().Infof("Drained tasks: %s", report)
+
+	// DEV: No.3 未送信のメッセージを送信・退避してから、off-lineを通知して切断する
+	for hostName, mqttModule := range mqttClients {
+		flushed, pending := mqttModule.Drain(drainCtx)
+		dw.PersistUnsent(pending)
+		zap.S().Infof("Drained publishes on %s: flushed %d, persisted %d", hostName, flushed, len(pending))
+	}
 	for hostName, mqttModule := range mqttClients {
 		mqttModule.Stop()
 		zap.S().Infof("MQTT module for %s has been stopped", hostName)
@@ -117,5 +319,17 @@ func main() {
 	cancelFn()
 
 	dw.Stop() // Stop the dispatcher and wait for workers to finish
+	if batcher != nil {
+		if err := batcher.Close(); err != nil {
+			zap.S().Warnf("Failed to close batch files: %v", err)
+		}
+	}
+
+	// DEV: 未送信のSpanを送り切る
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer flushCancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		zap.S().Warnf("Failed to flush traces: %v", err)
+	}
 
 }
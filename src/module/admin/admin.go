@@ -0,0 +1,106 @@
+// module/admin/admin.go
+// DEV: 実行中のプロセスを操作する管理用HTTP API (各モジュールがHandleでルートを登録する)
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ADMIN_PATH string = "/admin"
+)
+
+var (
+	mux = http.NewServeMux()
+)
+
+type (
+	// Config holds the admin endpoint settings
+	Config struct {
+		Listen string `json:"listen"` // e.g. 127.0.0.1:9101 (empty = disabled)
+		Token  string `json:"token"`  // Required as "Authorization: Bearer <token>"; may be empty only on a loopback address
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Handle
+// DEV: /admin<path> にハンドラを登録する (Serveの前後どちらでも可)
+func Handle(path string, handler http.Handler) {
+	mux.Handle(ADMIN_PATH+path, handler)
+}
+
+// *--------------------------------------------------------------------------------------
+// Serve
+func Serve(conf Config) error {
+	if conf.Listen == "" {
+		return nil
+	}
+	if conf.Token == "" && !loopback(conf.Listen) {
+		return fmt.Errorf("admin token is required to listen on %s (non-loopback address)", conf.Listen)
+	}
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: authorize(conf.Token, mux)}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			zap.S().Errorf("Admin server stopped: %v", err)
+		}
+	}()
+	zap.S().Infof("Admin API available at http://%s%s", conf.Listen, ADMIN_PATH)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// loopback
+// DEV: ":9101" のようにホストが無い場合は全てのインターフェースで待ち受けるため対象外
+func loopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// *--------------------------------------------------------------------------------------
+// authorize
+func authorize(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			WriteError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// *--------------------------------------------------------------------------------------
+// WriteJSON
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.S().Warnf("Failed to write admin response: %v", err)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// WriteError
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]string{"error": message})
+}
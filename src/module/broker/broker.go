@@ -0,0 +1,222 @@
+// module/broker/broker.go
+// DEV: テスト・ローカル開発用の軽量なMQTT 3.1.1ブローカー (インプロセス)
+package broker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_LISTEN string = "127.0.0.1:1883"
+)
+
+type (
+	// Config holds the embedded broker settings
+	Config struct {
+		Listen string `json:"listen"` // e.g. 127.0.0.1:1883 (127.0.0.1:0 picks a free port)
+	}
+
+	// Broker is an in-process MQTT 3.1.1 broker
+	Broker struct {
+		conf     Config
+		listener net.Listener
+
+		mu       sync.RWMutex
+		sessions map[string]*session               // 接続中のセッション
+		stored   map[string]storedSession          // CleanSession=falseで切断したセッション
+		retained map[string]*packets.PublishPacket // Retainメッセージ
+
+		wg     sync.WaitGroup
+		closed chan struct{}
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// New (constructor)
+func New(conf Config) *Broker {
+	if conf.Listen == "" {
+		conf.Listen = DEFAULT_LISTEN
+	}
+	return &Broker{
+		conf:     conf,
+		sessions: make(map[string]*session),
+		stored:   make(map[string]storedSession),
+		retained: make(map[string]*packets.PublishPacket),
+		closed:   make(chan struct{}),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Start
+// DEV: TCPリスナーを開いて接続の受け付けを開始する
+func (b *Broker) Start() error {
+	listener, err := net.Listen("tcp", b.conf.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", b.conf.Listen, err)
+	}
+	b.listener = listener
+	zap.S().Infof("Embedded MQTT broker listening on %s", listener.Addr())
+
+	b.wg.Add(1)
+	go b.acceptLoop()
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Addr
+// DEV: 実際に待ち受けているアドレス ("host:port")
+func (b *Broker) Addr() string {
+	if b.listener == nil {
+		return b.conf.Listen
+	}
+	return b.listener.Addr().String()
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+func (b *Broker) Close() error {
+	select {
+	case <-b.closed:
+		return nil
+	default:
+		close(b.closed)
+	}
+
+	var err error
+	if b.listener != nil {
+		err = b.listener.Close()
+	}
+	b.mu.RLock()
+	for _, s := range b.sessions {
+		s.conn.Close()
+	}
+	b.mu.RUnlock()
+
+	b.wg.Wait()
+	zap.S().Info("Embedded MQTT broker stopped")
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// acceptLoop
+func (b *Broker) acceptLoop() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.closed:
+			default:
+				zap.S().Errorf("Embedded broker failed to accept connection: %v", err)
+			}
+			return
+		}
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			newSession(b, conn).serve()
+		}()
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// register
+// DEV: 同じClient IDの既存接続は切断する (セッションの引き継ぎ)。
+// CleanSession=falseで保存済みのセッションがあれば、購読と応答待ちのメッセージを引き継いでtrueを返す。
+// 登録後すぐに配信対象になるが、CONNACKを送るまでの配信はsession側で溜めておく
+func (b *Broker) register(s *session, clean bool) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if previous, ok := b.sessions[s.clientID]; ok {
+		zap.S().Infof("Embedded broker: client %s taken over by a new connection", s.clientID)
+		previous.conn.Close()
+		if !previous.clean {
+			b.stored[s.clientID] = previous.store()
+		}
+	}
+	b.sessions[s.clientID] = s
+
+	stored, present := b.stored[s.clientID]
+	delete(b.stored, s.clientID)
+	if clean || !present {
+		return false
+	}
+	s.restore(stored)
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// unregister
+func (b *Broker) unregister(s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sessions[s.clientID] != s {
+		return
+	}
+	delete(b.sessions, s.clientID)
+	if !s.clean {
+		b.stored[s.clientID] = s.store()
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// route
+// DEV: 一致する購読を持つ全セッションへ配信する (重複購読は最大QoSで1回だけ)
+func (b *Broker) route(pkt *packets.PublishPacket) {
+	if pkt.Retain {
+		b.retain(pkt)
+	}
+
+	b.mu.RLock()
+	targets := make(map[*session]byte)
+	for _, s := range b.sessions {
+		if qos, ok := s.matchQoS(pkt.TopicName); ok {
+			targets[s] = min(qos, pkt.Qos)
+		}
+	}
+	b.mu.RUnlock()
+
+	for s, qos := range targets {
+		if err := s.deliver(pkt.TopicName, pkt.Payload, qos, false); err != nil {
+			zap.S().Warnf("Embedded broker failed to deliver %s to %s: %v", pkt.TopicName, s.clientID, err)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// retain
+// DEV: 空のペイロードはRetainメッセージの削除
+func (b *Broker) retain(pkt *packets.PublishPacket) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(pkt.Payload) == 0 {
+		delete(b.retained, pkt.TopicName)
+		return
+	}
+	b.retained[pkt.TopicName] = &packets.PublishPacket{
+		FixedHeader: packets.FixedHeader{MessageType: packets.Publish, Qos: pkt.Qos, Retain: true},
+		TopicName:   pkt.TopicName,
+		Payload:     append([]byte(nil), pkt.Payload...),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// retainedFor
+func (b *Broker) retainedFor(filter string) []*packets.PublishPacket {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var matched []*packets.PublishPacket
+	for topic, pkt := range b.retained {
+		if mqttm.MatchTopic(filter, topic) {
+			matched = append(matched, pkt)
+		}
+	}
+	return matched
+}
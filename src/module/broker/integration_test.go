@@ -0,0 +1,162 @@
+package broker_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/tinayla696/mqtt_protocol_golang/module/broker"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+// received records the contents of the MQTT tasks executed by the Dispatcher
+type received struct {
+	mu     sync.Mutex
+	topics map[string]mqttm.Contents
+	notify chan struct{}
+}
+
+func (r *received) middleware() service.Middleware {
+	return func(next service.Handler) service.Handler {
+		return func(ctx context.Context, t task.Task) error {
+			if mqttTask, ok := t.(*task.MqttTask); ok {
+				r.mu.Lock()
+				r.topics[mqttTask.Contents.Topic] = mqttTask.Contents
+				r.mu.Unlock()
+				select {
+				case r.notify <- struct{}{}:
+				default:
+				}
+			}
+			return next(ctx, t)
+		}
+	}
+}
+
+// wait blocks until every topic has been executed
+func (r *received) wait(t *testing.T, topics ...string) map[string]mqttm.Contents {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		r.mu.Lock()
+		missing := ""
+		for _, topic := range topics {
+			if _, ok := r.topics[topic]; !ok {
+				missing = topic
+				break
+			}
+		}
+		r.mu.Unlock()
+		if missing == "" {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.topics
+		}
+		select {
+		case <-r.notify:
+		case <-deadline:
+			t.Fatalf("%s was not executed", missing)
+		}
+	}
+}
+
+func runModule(t *testing.T, ctx context.Context, b *broker.Broker, clientID string, topics map[string]byte, opts ...mqttm.Option) *mqttm.Module {
+	t.Helper()
+	module, err := mqttm.New(ctx, clientID, clientID, mqttm.Config{Endpoint: b.Addr(), SubscribeTopics: topics}, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := module.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(module.Stop)
+	return module
+}
+
+func TestModuleAndDispatcherOverBroker(t *testing.T) {
+	b := broker.New(broker.Config{Listen: "127.0.0.1:0"})
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	ctx := context.Background()
+
+	// DEV: 購読前に送ったRetainメッセージは購読時に届く
+	publisher := runModule(t, ctx, b, "publisher", nil)
+	if err := publisher.PublishRetained("status/dev1", 1, []byte(`{"online":true}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := runModule(t, ctx, b, "subscriber", map[string]byte{
+		"sensors/+/temp": 1,
+		"cmd/#":          2,
+		"status/#":       1,
+		"wills/+":        1,
+	})
+	r := &received{topics: map[string]mqttm.Contents{}, notify: make(chan struct{}, 1)}
+	chain := &service.MiddlewareChain{}
+	chain.Use(r.middleware())
+	d := service.NewDispatcher(ctx, map[string]mqttm.Client{subscriber.Hostname(): subscriber}, 2, service.WithMiddleware(chain))
+	d.Start()
+	t.Cleanup(d.Stop)
+	r.wait(t, "status/dev1")
+
+	// Will: 接続を引き継がれて異常切断されたクライアントのWillが配信される
+	willCtx, cancelWill := context.WithCancel(ctx)
+	runModule(t, willCtx, b, "dev3", nil, mqttm.WithWill(func() mqttm.Will {
+		return mqttm.Will{Topic: "wills/dev3", Payload: []byte(`{"online":false}`), QoS: 1}
+	}))
+	cancelWill() // 再接続させない
+	takeOver(t, b, "dev3")
+
+	if err := publisher.Publish("sensors/dev1/temp", 1, []byte(`{"value":21.5}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("sensors/dev1/humidity", 1, []byte(`{"value":40}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Publish("cmd/dev1/reboot", 2, []byte(`{"delay":0}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := r.wait(t, "status/dev1", "sensors/dev1/temp", "cmd/dev1/reboot", "wills/dev3")
+	for topic, qos := range map[string]byte{"status/dev1": 1, "sensors/dev1/temp": 1, "cmd/dev1/reboot": 2, "wills/dev3": 1} {
+		if got[topic].QoS != qos {
+			t.Errorf("%s QoS = %d, want %d", topic, got[topic].QoS, qos)
+		}
+	}
+	if string(got["wills/dev3"].Payload) != `{"online":false}` {
+		t.Errorf("will payload = %s", got["wills/dev3"].Payload)
+	}
+	if _, ok := got["sensors/dev1/humidity"]; ok {
+		t.Error("sensors/dev1/humidity matched sensors/+/temp")
+	}
+}
+
+// takeOver connects with an existing client ID so the broker drops the old connection without DISCONNECT
+func takeOver(t *testing.T, b *broker.Broker, clientID string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = clientID
+	connect.CleanSession = true
+	if err := connect.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := packets.ReadPacket(conn); err != nil {
+		t.Fatal(err)
+	}
+	packets.NewControlPacket(packets.Disconnect).Write(conn)
+}
@@ -0,0 +1,459 @@
+package broker
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	CONNECT_TIMEOUT time.Duration = 10 * time.Second
+	WRITE_TIMEOUT   time.Duration = 10 * time.Second
+
+	SUBACK_FAILURE byte = 0x80
+)
+
+var (
+	autoClientID atomic.Uint64
+
+	connectTimeout = CONNECT_TIMEOUT // CONNECTを待つ時間 (テストで短くする)
+)
+
+// *--------------------------------------------------------------------------------------
+// session
+// DEV: 1つのクライアント接続の状態
+type (
+	session struct {
+		broker   *Broker
+		conn     net.Conn
+		clientID string
+		clean    bool
+		will     *packets.PublishPacket
+
+		writeMu sync.Mutex
+
+		mu            sync.Mutex
+		subscriptions map[string]byte
+		nextID        uint16
+		inflight      map[uint16]*inflightMessage // 送信済みで応答待ちのQoS1/2メッセージ (再接続時に再送する)
+		received      map[uint16]struct{}         // PUBREL待ちの受信QoS2メッセージ
+		online        bool                        // CONNACKと再送の完了後にtrue
+		pending       []*packets.PublishPacket    // online前に配信されたメッセージ (CONNACKより先に送らない)
+	}
+
+	// inflightMessage is a QoS 1/2 message sent to the client and not acknowledged yet
+	inflightMessage struct {
+		pkt      *packets.PublishPacket
+		released bool // QoS2でPUBRECを受けてPUBCOMP待ち (再送はPUBREL)
+	}
+
+	// storedSession is the state kept for a disconnected client with CleanSession=false
+	// DEV: 切断中に配信されたメッセージは溜めない (接続中に送った応答待ちのものだけ再送する)
+	storedSession struct {
+		subscriptions map[string]byte
+		inflight      map[uint16]*inflightMessage
+		nextID        uint16
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// newSession (constructor)
+func newSession(b *Broker, conn net.Conn) *session {
+	return &session{
+		broker:        b,
+		conn:          conn,
+		subscriptions: make(map[string]byte),
+		inflight:      make(map[uint16]*inflightMessage),
+		received:      make(map[uint16]struct{}),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// serve
+func (s *session) serve() {
+	defer s.conn.Close()
+
+	keepalive, err := s.handshake()
+	if err != nil {
+		zap.S().Debugf("Embedded broker rejected connection from %s: %v", s.conn.RemoteAddr(), err)
+		return
+	}
+	defer s.broker.unregister(s)
+
+	graceful := false
+	for {
+		// DEV: Keep Alive 0はタイムアウト無し (handshakeで設定した期限を解除する)
+		if keepalive > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(keepalive * 3 / 2))
+		} else {
+			s.conn.SetReadDeadline(time.Time{})
+		}
+		pkt, err := packets.ReadPacket(s.conn)
+		if err != nil {
+			break
+		}
+		if _, ok := pkt.(*packets.DisconnectPacket); ok {
+			graceful = true
+			break
+		}
+		if err := s.handle(pkt); err != nil {
+			zap.S().Debugf("Embedded broker closing %s: %v", s.clientID, err)
+			break
+		}
+	}
+
+	// DEV: DISCONNECTを受けずに切断された場合のみWillを配信する
+	if !graceful && s.will != nil {
+		s.broker.route(s.will)
+	}
+	zap.S().Debugf("Embedded broker: client %s disconnected", s.clientID)
+}
+
+// *--------------------------------------------------------------------------------------
+// handshake
+func (s *session) handshake() (time.Duration, error) {
+	s.conn.SetReadDeadline(time.Now().Add(connectTimeout))
+	pkt, err := packets.ReadPacket(s.conn)
+	if err != nil {
+		return 0, err
+	}
+	connect, ok := pkt.(*packets.ConnectPacket)
+	if !ok {
+		return 0, fmt.Errorf("first packet is not CONNECT")
+	}
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	if code := connect.Validate(); code != packets.Accepted {
+		connack.ReturnCode = code
+		s.write(connack)
+		return 0, fmt.Errorf("connect refused: %s", packets.ConnackReturnCodes[code])
+	}
+
+	s.clientID = connect.ClientIdentifier
+	if s.clientID == "" {
+		s.clientID = fmt.Sprintf("auto-%d", autoClientID.Add(1))
+	}
+	s.clean = connect.CleanSession
+	if connect.WillFlag {
+		s.will = &packets.PublishPacket{
+			FixedHeader: packets.FixedHeader{MessageType: packets.Publish, Qos: connect.WillQos, Retain: connect.WillRetain},
+			TopicName:   connect.WillTopic,
+			Payload:     connect.WillMessage,
+		}
+	}
+
+	connack.SessionPresent = s.broker.register(s, s.clean)
+	if err := s.write(connack); err != nil {
+		return 0, err
+	}
+	if connack.SessionPresent {
+		if err := s.redeliver(); err != nil {
+			return 0, err
+		}
+	}
+	if err := s.goOnline(); err != nil {
+		return 0, err
+	}
+	zap.S().Debugf("Embedded broker: client %s connected", s.clientID)
+	return time.Duration(connect.Keepalive) * time.Second, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// handle
+func (s *session) handle(pkt packets.ControlPacket) error {
+	switch p := pkt.(type) {
+	case *packets.PublishPacket:
+		return s.handlePublish(p)
+
+	case *packets.PubackPacket:
+		s.ack(p.MessageID)
+
+	case *packets.PubrecPacket:
+		s.mu.Lock()
+		if message, ok := s.inflight[p.MessageID]; ok {
+			message.released = true
+		}
+		s.mu.Unlock()
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = p.MessageID
+		return s.write(pubrel)
+
+	case *packets.PubcompPacket:
+		s.ack(p.MessageID)
+
+	case *packets.PubrelPacket:
+		s.mu.Lock()
+		delete(s.received, p.MessageID)
+		s.mu.Unlock()
+		pubcomp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+		pubcomp.MessageID = p.MessageID
+		return s.write(pubcomp)
+
+	case *packets.SubscribePacket:
+		return s.handleSubscribe(p)
+
+	case *packets.UnsubscribePacket:
+		s.mu.Lock()
+		for _, topic := range p.Topics {
+			delete(s.subscriptions, topic)
+		}
+		s.mu.Unlock()
+		unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+		unsuback.MessageID = p.MessageID
+		return s.write(unsuback)
+
+	case *packets.PingreqPacket:
+		return s.write(packets.NewControlPacket(packets.Pingresp))
+
+	case *packets.ConnectPacket:
+		return fmt.Errorf("duplicate CONNECT")
+
+	default:
+		return fmt.Errorf("unexpected packet %T", pkt)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// handlePublish
+func (s *session) handlePublish(p *packets.PublishPacket) error {
+	if !mqttm.ValidTopicName(p.TopicName) || p.Qos > 2 {
+		return fmt.Errorf("invalid publish to %q with QoS %d", p.TopicName, p.Qos)
+	}
+
+	switch p.Qos {
+	case 0:
+		s.broker.route(p)
+
+	case 1:
+		s.broker.route(p)
+		puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+		puback.MessageID = p.MessageID
+		return s.write(puback)
+
+	case 2:
+		// DEV: 再送 (DUP) はPUBRELまで同じIDを配信済みとして扱う
+		s.mu.Lock()
+		_, duplicate := s.received[p.MessageID]
+		s.received[p.MessageID] = struct{}{}
+		s.mu.Unlock()
+		if !duplicate {
+			s.broker.route(p)
+		}
+		pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+		pubrec.MessageID = p.MessageID
+		return s.write(pubrec)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// handleSubscribe
+func (s *session) handleSubscribe(p *packets.SubscribePacket) error {
+	suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+	suback.MessageID = p.MessageID
+
+	accepted := make(map[string]byte)
+	s.mu.Lock()
+	for i, topic := range p.Topics {
+		qos := p.Qoss[i]
+		if !mqttm.ValidTopicFilter(topic) || qos > 2 {
+			suback.ReturnCodes = append(suback.ReturnCodes, SUBACK_FAILURE)
+			continue
+		}
+		s.subscriptions[topic] = qos
+		suback.ReturnCodes = append(suback.ReturnCodes, qos)
+		accepted[topic] = qos
+	}
+	s.mu.Unlock()
+
+	if err := s.write(suback); err != nil {
+		return err
+	}
+
+	// Retained messages
+	for topic, qos := range accepted {
+		for _, pkt := range s.broker.retainedFor(topic) {
+			if err := s.deliver(pkt.TopicName, pkt.Payload, min(pkt.Qos, qos), true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// deliver
+func (s *session) deliver(topic string, payload []byte, qos byte, retain bool) error {
+	pkt := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pkt.TopicName = topic
+	pkt.Payload = payload
+	pkt.Qos = qos
+	pkt.Retain = retain
+
+	s.mu.Lock()
+	if !s.online {
+		s.pending = append(s.pending, pkt)
+		s.mu.Unlock()
+		return nil
+	}
+	s.track(pkt)
+	s.mu.Unlock()
+	return s.write(pkt)
+}
+
+// *--------------------------------------------------------------------------------------
+// track (s.mu must be held)
+// DEV: QoS1/2のメッセージにIDを割り当てて応答待ちとして記録する
+func (s *session) track(pkt *packets.PublishPacket) {
+	if pkt.Qos > 0 {
+		pkt.MessageID = s.allocateID()
+		s.inflight[pkt.MessageID] = &inflightMessage{pkt: pkt}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// goOnline
+// DEV: CONNACKの後、溜まった配信を順に送ってからonlineにする (送信中の配信も順番を守るためpendingに溜まる)
+func (s *session) goOnline() error {
+	for {
+		s.mu.Lock()
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 {
+			s.online = true
+			s.mu.Unlock()
+			return nil
+		}
+		for _, pkt := range pending {
+			s.track(pkt)
+		}
+		s.mu.Unlock()
+
+		for _, pkt := range pending {
+			if err := s.write(pkt); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// redeliver
+// DEV: 引き継いだ応答待ちのメッセージをID順に再送する (PUBLISHはDUP付き、PUBREC済みはPUBREL)
+func (s *session) redeliver() error {
+	s.mu.Lock()
+	ids := make([]uint16, 0, len(s.inflight))
+	for id := range s.inflight {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	resend := make([]packets.ControlPacket, 0, len(ids))
+	for _, id := range ids {
+		message := s.inflight[id]
+		if message.released {
+			pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+			pubrel.MessageID = id
+			resend = append(resend, pubrel)
+			continue
+		}
+		message.pkt.Dup = true
+		resend = append(resend, message.pkt)
+	}
+	s.mu.Unlock()
+
+	for _, pkt := range resend {
+		if err := s.write(pkt); err != nil {
+			return err
+		}
+	}
+	if len(resend) > 0 {
+		zap.S().Debugf("Embedded broker: redelivered %d messages to %s", len(resend), s.clientID)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// allocateID (s.mu must be held)
+func (s *session) allocateID() uint16 {
+	for {
+		s.nextID++
+		if s.nextID == 0 {
+			continue
+		}
+		if _, used := s.inflight[s.nextID]; !used {
+			return s.nextID
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// ack
+func (s *session) ack(id uint16) {
+	s.mu.Lock()
+	delete(s.inflight, id)
+	s.mu.Unlock()
+}
+
+// *--------------------------------------------------------------------------------------
+// matchQoS
+func (s *session) matchQoS(topic string) (byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	matched := false
+	var qos byte
+	for filter, subQoS := range s.subscriptions {
+		if mqttm.MatchTopic(filter, topic) {
+			matched = true
+			qos = max(qos, subQoS)
+		}
+	}
+	return qos, matched
+}
+
+// *--------------------------------------------------------------------------------------
+// store
+// DEV: 切断時に保存するセッションの状態
+func (s *session) store() storedSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored := storedSession{
+		subscriptions: make(map[string]byte, len(s.subscriptions)),
+		inflight:      make(map[uint16]*inflightMessage, len(s.inflight)),
+		nextID:        s.nextID,
+	}
+	for filter, qos := range s.subscriptions {
+		stored.subscriptions[filter] = qos
+	}
+	for id, message := range s.inflight {
+		stored.inflight[id] = message
+	}
+	return stored
+}
+
+// *--------------------------------------------------------------------------------------
+// restore
+// DEV: CONNACKの送信前に呼ばれる (その間の配信はgoOnlineまでpendingに溜まる)
+func (s *session) restore(stored storedSession) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions = stored.subscriptions
+	s.inflight = stored.inflight
+	s.nextID = stored.nextID
+}
+
+// *--------------------------------------------------------------------------------------
+// write
+func (s *session) write(pkt packets.ControlPacket) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	return pkt.Write(s.conn)
+}
@@ -0,0 +1,224 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+func startBroker(t *testing.T) *Broker {
+	t.Helper()
+	b := New(Config{Listen: "127.0.0.1:0"})
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// dial connects a raw MQTT client and returns the connection with its CONNACK
+func dial(t *testing.T, b *Broker, clientID string, clean bool) (net.Conn, *packets.ConnackPacket) {
+	t.Helper()
+	conn, err := net.Dial("tcp", b.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	connect := packets.NewControlPacket(packets.Connect).(*packets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = clientID
+	connect.CleanSession = clean
+	send(t, conn, connect)
+	connack, ok := receive(t, conn).(*packets.ConnackPacket)
+	if !ok || connack.ReturnCode != packets.Accepted {
+		t.Fatalf("connect %s: got %v", clientID, connack)
+	}
+	return conn, connack
+}
+
+func send(t *testing.T, conn net.Conn, pkt packets.ControlPacket) {
+	t.Helper()
+	if err := pkt.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func receive(t *testing.T, conn net.Conn) packets.ControlPacket {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	pkt, err := packets.ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
+func subscribe(t *testing.T, conn net.Conn, filter string, qos byte) {
+	t.Helper()
+	sub := packets.NewControlPacket(packets.Subscribe).(*packets.SubscribePacket)
+	sub.MessageID = 1
+	sub.Topics = []string{filter}
+	sub.Qoss = []byte{qos}
+	send(t, conn, sub)
+	if _, ok := receive(t, conn).(*packets.SubackPacket); !ok {
+		t.Fatal("expected SUBACK")
+	}
+}
+
+// publish sends a message from a separate client and completes its handshake
+func publish(t *testing.T, b *Broker, topic string, qos byte, payload string) {
+	t.Helper()
+	conn, _ := dial(t, b, "publisher", true)
+	pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+	pub.TopicName = topic
+	pub.Qos = qos
+	pub.MessageID = 7
+	pub.Payload = []byte(payload)
+	send(t, conn, pub)
+	if qos == 2 {
+		receive(t, conn)
+		pubrel := packets.NewControlPacket(packets.Pubrel).(*packets.PubrelPacket)
+		pubrel.MessageID = pub.MessageID
+		send(t, conn, pubrel)
+	}
+	if qos > 0 {
+		receive(t, conn)
+	}
+	send(t, conn, packets.NewControlPacket(packets.Disconnect))
+	conn.Close()
+}
+
+func TestRedeliverUnacknowledgedPublish(t *testing.T) {
+	b := startBroker(t)
+	conn, _ := dial(t, b, "sub", false)
+	subscribe(t, conn, "sensors/#", 1)
+	publish(t, b, "sensors/a", 1, "reading")
+
+	first, ok := receive(t, conn).(*packets.PublishPacket)
+	if !ok || first.Dup {
+		t.Fatalf("got %v, want the first delivery", first)
+	}
+	conn.Close() // 未応答のまま切断
+
+	conn, connack := dial(t, b, "sub", false)
+	if !connack.SessionPresent {
+		t.Fatal("session was not resumed")
+	}
+	again, ok := receive(t, conn).(*packets.PublishPacket)
+	if !ok || !again.Dup || again.MessageID != first.MessageID || string(again.Payload) != "reading" {
+		t.Fatalf("got %v, want the same message with DUP set", again)
+	}
+	puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+	puback.MessageID = again.MessageID
+	send(t, conn, puback)
+
+	// DEV: 購読も引き継がれている
+	publish(t, b, "sensors/b", 1, "next")
+	next, ok := receive(t, conn).(*packets.PublishPacket)
+	if !ok || next.Dup || next.TopicName != "sensors/b" {
+		t.Fatalf("got %v, want a new delivery on the resumed subscription", next)
+	}
+}
+
+func TestRedeliverReleaseForReceivedQoS2(t *testing.T) {
+	b := startBroker(t)
+	conn, _ := dial(t, b, "sub", false)
+	subscribe(t, conn, "cmd/+", 2)
+	publish(t, b, "cmd/reboot", 2, "now")
+
+	pub, ok := receive(t, conn).(*packets.PublishPacket)
+	if !ok {
+		t.Fatalf("got %v, want PUBLISH", pub)
+	}
+	pubrec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+	pubrec.MessageID = pub.MessageID
+	send(t, conn, pubrec)
+	if _, ok := receive(t, conn).(*packets.PubrelPacket); !ok {
+		t.Fatal("expected PUBREL")
+	}
+	conn.Close() // PUBCOMPを返さずに切断
+
+	conn, connack := dial(t, b, "sub", false)
+	if !connack.SessionPresent {
+		t.Fatal("session was not resumed")
+	}
+	pubrel, ok := receive(t, conn).(*packets.PubrelPacket)
+	if !ok || pubrel.MessageID != pub.MessageID {
+		t.Fatalf("got %v, want PUBREL for %d instead of the message", pubrel, pub.MessageID)
+	}
+}
+
+func TestCleanSessionDropsInflight(t *testing.T) {
+	b := startBroker(t)
+	conn, _ := dial(t, b, "sub", false)
+	subscribe(t, conn, "sensors/#", 1)
+	publish(t, b, "sensors/a", 1, "reading")
+	receive(t, conn)
+	conn.Close()
+
+	conn, connack := dial(t, b, "sub", true)
+	if connack.SessionPresent {
+		t.Fatal("clean session resumed the stored one")
+	}
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if pkt, err := packets.ReadPacket(conn); err == nil {
+		t.Fatalf("got %v after a clean connect, want nothing", pkt)
+	}
+}
+
+func TestKeepaliveZeroHasNoTimeout(t *testing.T) {
+	connectTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { connectTimeout = CONNECT_TIMEOUT })
+	b := startBroker(t)
+	conn, _ := dial(t, b, "idle", true) // Keep Alive 0
+
+	time.Sleep(3 * connectTimeout)
+	send(t, conn, packets.NewControlPacket(packets.Pingreq))
+	if _, ok := receive(t, conn).(*packets.PingrespPacket); !ok {
+		t.Fatal("idle client with keep alive 0 was disconnected")
+	}
+}
+
+func TestNoPublishBeforeConnack(t *testing.T) {
+	b := New(Config{})
+	server, client := net.Pipe()
+	defer client.Close()
+	s := newSession(b, server)
+	s.clientID = "sub"
+	s.subscriptions["sensors/#"] = 1
+	b.register(s, true)
+
+	// DEV: 登録後・CONNACK前の配信は溜められる (net.Pipeは読まれるまで書き込みが終わらない)
+	b.route(&packets.PublishPacket{
+		FixedHeader: packets.FixedHeader{MessageType: packets.Publish, Qos: 1},
+		TopicName:   "sensors/a",
+		Payload:     []byte("early"),
+	})
+	go func() {
+		s.write(packets.NewControlPacket(packets.Connack))
+		s.goOnline()
+	}()
+
+	if _, ok := receive(t, client).(*packets.ConnackPacket); !ok {
+		t.Fatal("first packet is not CONNACK")
+	}
+	pub, ok := receive(t, client).(*packets.PublishPacket)
+	if !ok || string(pub.Payload) != "early" || pub.MessageID == 0 {
+		t.Fatalf("got %v, want the queued PUBLISH with a message ID", pub)
+	}
+}
+
+func TestTakeoverOfCleanSessionStoresNothing(t *testing.T) {
+	b := startBroker(t)
+	conn, _ := dial(t, b, "sub", true)
+	subscribe(t, conn, "sensors/#", 1)
+
+	_, connack := dial(t, b, "sub", false)
+	if connack.SessionPresent {
+		t.Error("state of a clean session was resumed after a takeover")
+	}
+}
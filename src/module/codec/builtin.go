@@ -0,0 +1,120 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	mapStringType = reflect.TypeOf(map[string]interface{}{})
+
+	// DEV: JSONと同じ形 (map[string]interface{}) で扱えるようにキーを文字列にする
+	cborDecMode = sync.OnceValues(func() (cbor.DecMode, error) {
+		return cbor.DecOptions{DefaultMapType: mapStringType}.DecMode()
+	})
+)
+
+// *--------------------------------------------------------------------------------------
+// JSON
+type JSON struct{}
+
+func (JSON) Name() string        { return CODEC_JSON }
+func (JSON) ContentType() string { return "application/json" }
+
+// *--------------------------------------------------------------------------------------
+// Decode
+func (JSON) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+func (JSON) Encode(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// *--------------------------------------------------------------------------------------
+// CBOR
+type CBOR struct{}
+
+func (CBOR) Name() string        { return CODEC_CBOR }
+func (CBOR) ContentType() string { return "application/cbor" }
+
+// *--------------------------------------------------------------------------------------
+// Decode
+func (CBOR) Decode(data []byte) (interface{}, error) {
+	decMode, err := cborDecMode()
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := decMode.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+func (CBOR) Encode(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+// *--------------------------------------------------------------------------------------
+// MsgPack
+type MsgPack struct{}
+
+func (MsgPack) Name() string        { return CODEC_MSGPACK }
+func (MsgPack) ContentType() string { return "application/msgpack" }
+
+// *--------------------------------------------------------------------------------------
+// Decode
+func (MsgPack) Decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := msgpack.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+func (MsgPack) Encode(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// *--------------------------------------------------------------------------------------
+// Raw
+// DEV: ペイロードを[]byteのまま渡す (デコードに失敗しない)
+type Raw struct{}
+
+func (Raw) Name() string        { return CODEC_RAW }
+func (Raw) ContentType() string { return "application/octet-stream" }
+
+// *--------------------------------------------------------------------------------------
+// Decode
+func (Raw) Decode(data []byte) (interface{}, error) {
+	return data, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+func (Raw) Encode(v interface{}) ([]byte, error) {
+	switch value := v.(type) {
+	case []byte:
+		return value, nil
+	case string:
+		return []byte(value), nil
+	default:
+		return nil, fmt.Errorf("raw codec cannot encode %T", v)
+	}
+}
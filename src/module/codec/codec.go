@@ -0,0 +1,199 @@
+// module/codec/codec.go
+// DEV: トピック・Content-Type毎にペイロードのエンコード/デコード方式を切り替える
+package codec
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+const (
+	CODEC_JSON     string = "json"
+	CODEC_CBOR     string = "cbor"
+	CODEC_MSGPACK  string = "msgpack"
+	CODEC_PROTOBUF string = "protobuf"
+	CODEC_RAW      string = "raw"
+)
+
+type (
+	// Codec converts between payload bytes and Go values
+	Codec interface {
+		Name() string
+		ContentType() string
+		Decode(data []byte) (interface{}, error)
+		Encode(v interface{}) ([]byte, error)
+	}
+
+	// Rule assigns a codec to a topic filter
+	Rule struct {
+		Topic   string `json:"topic"`   // Topic filter (wildcards allowed)
+		Codec   string `json:"codec"`   // json / cbor / msgpack / protobuf / raw
+		Message string `json:"message"` // protobuf: full name of the message type
+	}
+
+	// Config holds the codec registry settings
+	Config struct {
+		Default     string   `json:"default"`     // Codec for unmatched topics (default json)
+		Rules       []Rule   `json:"rules"`       // Evaluated in order, first match wins
+		Descriptors []string `json:"descriptors"` // protobuf FileDescriptorSet files (protoc --descriptor_set_out)
+	}
+
+	// Registry resolves the codec of a message
+	Registry struct {
+		mu            sync.RWMutex
+		byContentType map[string]Codec
+		rules         []topicRule
+		fallback      Codec
+	}
+
+	// topicRule is a compiled Rule
+	topicRule struct {
+		filter string
+		codec  Codec
+	}
+
+	// DecodeError is returned when a payload cannot be decoded
+	DecodeError struct {
+		Codec string
+		Topic string
+		Err   error
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Error
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode %s payload on %s: %v", e.Codec, e.Topic, e.Err)
+}
+
+// *--------------------------------------------------------------------------------------
+// Unwrap
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// *--------------------------------------------------------------------------------------
+// NewRegistry (constructor)
+func NewRegistry(conf Config) (*Registry, error) {
+	r := &Registry{byContentType: make(map[string]Codec)}
+	for _, c := range []Codec{JSON{}, CBOR{}, MsgPack{}, Raw{}} {
+		r.Register(c)
+	}
+
+	var types *protoTypes
+	if len(conf.Descriptors) > 0 {
+		loaded, err := loadDescriptorSets(conf.Descriptors)
+		if err != nil {
+			return nil, err
+		}
+		types = loaded
+	}
+
+	for _, rule := range conf.Rules {
+		if !mqttm.ValidTopicFilter(rule.Topic) {
+			return nil, fmt.Errorf("invalid codec topic filter %q", rule.Topic)
+		}
+		c, err := r.resolve(rule.Codec, rule.Message, types)
+		if err != nil {
+			return nil, fmt.Errorf("codec rule for %s: %w", rule.Topic, err)
+		}
+		r.rules = append(r.rules, topicRule{filter: rule.Topic, codec: c})
+	}
+
+	if conf.Default == "" {
+		conf.Default = CODEC_JSON
+	}
+	fallback, err := r.resolve(conf.Default, "", types)
+	if err != nil {
+		return nil, fmt.Errorf("default codec: %w", err)
+	}
+	r.fallback = fallback
+	return r, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Register
+// DEV: 独自のCodecをContent-Typeで引けるように登録する
+func (r *Registry) Register(c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byContentType[c.ContentType()] = c
+	r.byContentType[c.Name()] = c
+}
+
+// *--------------------------------------------------------------------------------------
+// AddRule
+// DEV: 設定ファイル以外からトピックのルールを追加する (既存ルールより優先)
+func (r *Registry) AddRule(filter string, c Codec) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = append([]topicRule{{filter: filter, codec: c}}, r.rules...)
+}
+
+// *--------------------------------------------------------------------------------------
+// Lookup
+// DEV: Content-Typeが指定されていればそれを優先し、無ければトピックのルールで決める
+func (r *Registry) Lookup(contentType, topic string) Codec {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if contentType != "" {
+		if c, ok := r.byContentType[contentType]; ok {
+			return c
+		}
+	}
+	for _, rule := range r.rules {
+		if mqttm.MatchTopic(rule.filter, topic) {
+			return rule.codec
+		}
+	}
+	return r.fallback
+}
+
+// *--------------------------------------------------------------------------------------
+// Decode
+func (r *Registry) Decode(contents mqttm.Contents) (interface{}, Codec, error) {
+	c := r.Lookup(contents.ContentType, contents.Topic)
+	value, err := c.Decode(contents.Payload)
+	if err != nil {
+		return nil, c, &DecodeError{Codec: c.Name(), Topic: contents.Topic, Err: err}
+	}
+	return value, c, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+// DEV: 送信先トピックのCodecで値をエンコードする
+func (r *Registry) Encode(topic string, v interface{}) ([]byte, error) {
+	return r.Lookup("", topic).Encode(v)
+}
+
+// *--------------------------------------------------------------------------------------
+// resolve
+func (r *Registry) resolve(name, message string, types *protoTypes) (Codec, error) {
+	if name == CODEC_PROTOBUF {
+		if types == nil {
+			return nil, fmt.Errorf("protobuf codec requires descriptors")
+		}
+		return types.codec(message)
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.byContentType[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Publish
+// DEV: 構造体などをトピックのCodecでエンコードして送信する
+func (r *Registry) Publish(client mqttm.Client, topic string, qos byte, v interface{}) error {
+	payload, err := r.Encode(topic, v)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload for %s: %w", topic, err)
+	}
+	return client.Publish(topic, qos, payload)
+}
@@ -0,0 +1,162 @@
+package codec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestBuiltinRoundTrip(t *testing.T) {
+	value := map[string]interface{}{
+		"id":    "sensor-1",
+		"value": 21.5,
+		"tags":  []interface{}{"a", "b"},
+		"meta":  map[string]interface{}{"unit": "C"},
+	}
+	for _, c := range []Codec{JSON{}, CBOR{}, MsgPack{}} {
+		data, err := c.Encode(value)
+		if err != nil {
+			t.Fatalf("%s encode: %v", c.Name(), err)
+		}
+		decoded, err := c.Decode(data)
+		if err != nil {
+			t.Fatalf("%s decode: %v", c.Name(), err)
+		}
+		// DEV: どのCodecでもJSONと同じ形 (map[string]interface{}) になる
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("%s round trip = %#v, want %#v", c.Name(), decoded, value)
+		}
+		if _, err := c.Decode([]byte{0xc1, 0xff, 0x00}); err == nil {
+			t.Errorf("%s decoded garbage", c.Name())
+		}
+	}
+}
+
+func TestRawRoundTrip(t *testing.T) {
+	data := []byte{0x00, 0x01, 0xff}
+	decoded, err := Raw{}.Decode(data)
+	if err != nil || !reflect.DeepEqual(decoded, data) {
+		t.Errorf("decode = %v, %v", decoded, err)
+	}
+	for _, v := range []interface{}{data, string(data)} {
+		if encoded, err := (Raw{}).Encode(v); err != nil || string(encoded) != string(data) {
+			t.Errorf("encode %T = %v, %v", v, encoded, err)
+		}
+	}
+	if _, err := (Raw{}).Encode(42); err == nil {
+		t.Error("raw codec encoded an int")
+	}
+}
+
+// writeDescriptorSet writes a FileDescriptorSet with test.Reading {string id = 1; double value = 2;}
+func writeDescriptorSet(t *testing.T) string {
+	t.Helper()
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     kind.Enum(),
+		}
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("test"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("value", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+			},
+		}},
+	}}}
+	data, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "reading.pb")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	r, err := NewRegistry(Config{
+		Rules:       []Rule{{Topic: "sensors/+/pb", Codec: CODEC_PROTOBUF, Message: "test.Reading"}},
+		Descriptors: []string{writeDescriptorSet(t)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := r.Encode("sensors/a/pb", map[string]interface{}{"id": "sensor-1", "value": 21.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, c, err := r.Decode(mqttm.Contents{Topic: "sensors/a/pb", Payload: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Name() != "protobuf:test.Reading" {
+		t.Errorf("codec = %s", c.Name())
+	}
+	if want := map[string]interface{}{"id": "sensor-1", "value": 21.5}; !reflect.DeepEqual(value, want) {
+		t.Errorf("decoded %#v, want %#v", value, want)
+	}
+
+	if _, err := r.Encode("sensors/a/pb", map[string]interface{}{"unknown": 1}); err == nil {
+		t.Error("value that does not match the message was encoded")
+	}
+}
+
+func TestRegistryLookup(t *testing.T) {
+	r, err := NewRegistry(Config{
+		Default: CODEC_RAW,
+		Rules: []Rule{
+			{Topic: "sensors/+/cbor", Codec: CODEC_CBOR},
+			{Topic: "sensors/#", Codec: CODEC_MSGPACK},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ contentType, topic, want string }{
+		{"", "sensors/a/cbor", CODEC_CBOR},
+		{"", "sensors/a/b", CODEC_MSGPACK},
+		{"", "other", CODEC_RAW},
+		{"application/json", "sensors/a/cbor", CODEC_JSON}, // Content-Typeが優先
+		{"text/plain", "sensors/a/cbor", CODEC_CBOR},       // 未知のContent-Typeはトピックで決める
+	} {
+		if got := r.Lookup(tc.contentType, tc.topic).Name(); got != tc.want {
+			t.Errorf("Lookup(%q, %q) = %s, want %s", tc.contentType, tc.topic, got, tc.want)
+		}
+	}
+
+	_, _, err = r.Decode(mqttm.Contents{Topic: "sensors/a/cbor", Payload: []byte{0xff}})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Codec != CODEC_CBOR || decodeErr.Topic != "sensors/a/cbor" {
+		t.Errorf("err = %v, want a DecodeError for cbor", err)
+	}
+}
+
+func TestRegistryRejectsBadConfig(t *testing.T) {
+	for _, conf := range []Config{
+		{Rules: []Rule{{Topic: "sensors/#/bad", Codec: CODEC_JSON}}},
+		{Rules: []Rule{{Topic: "sensors/#", Codec: "yaml"}}},
+		{Rules: []Rule{{Topic: "sensors/#", Codec: CODEC_PROTOBUF, Message: "test.Reading"}}},
+		{Default: "yaml"},
+	} {
+		if _, err := NewRegistry(conf); err == nil {
+			t.Errorf("config %+v was accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package codec
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type (
+	// protoTypes holds the message types loaded from descriptor sets
+	protoTypes struct {
+		files *protoregistry.Files
+	}
+
+	// Protobuf decodes a single message type without generated code
+	Protobuf struct {
+		desc protoreflect.MessageDescriptor
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// loadDescriptorSets
+// DEV: protoc --descriptor_set_out (--include_imports) の出力を読み込む
+func loadDescriptorSets(paths []string) (*protoTypes, error) {
+	merged := &descriptorpb.FileDescriptorSet{}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		set := &descriptorpb.FileDescriptorSet{}
+		if err := proto.Unmarshal(data, set); err != nil {
+			return nil, fmt.Errorf("failed to parse descriptor set %s: %w", path, err)
+		}
+		for _, file := range set.GetFile() {
+			if !seen[file.GetName()] {
+				seen[file.GetName()] = true
+				merged.File = append(merged.File, file)
+			}
+		}
+	}
+
+	files, err := protodesc.NewFiles(merged)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor sets: %w", err)
+	}
+	return &protoTypes{files: files}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// codec
+func (t *protoTypes) codec(message string) (Codec, error) {
+	if message == "" {
+		return nil, fmt.Errorf("protobuf codec requires a message name")
+	}
+	desc, err := t.files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf message %s: %w", message, err)
+	}
+	msgDesc, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a protobuf message", message)
+	}
+	return NewProtobuf(msgDesc), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// NewProtobuf (constructor)
+func NewProtobuf(desc protoreflect.MessageDescriptor) *Protobuf {
+	return &Protobuf{desc: desc}
+}
+
+// *--------------------------------------------------------------------------------------
+// Name
+func (p *Protobuf) Name() string {
+	return CODEC_PROTOBUF + ":" + string(p.desc.FullName())
+}
+
+// *--------------------------------------------------------------------------------------
+// ContentType
+func (p *Protobuf) ContentType() string {
+	return "application/x-protobuf; messageType=" + string(p.desc.FullName())
+}
+
+// *--------------------------------------------------------------------------------------
+// Decode
+// DEV: JSONと同じ形で扱えるよう、protojson経由でデコードする
+func (p *Protobuf) Decode(data []byte) (interface{}, error) {
+	msg := dynamicpb.NewMessage(p.desc)
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	jsonData, err := protojson.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(jsonData, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+// DEV: proto.Messageはそのまま、それ以外はJSON表現を経由してエンコードする
+func (p *Protobuf) Encode(v interface{}) ([]byte, error) {
+	if msg, ok := v.(proto.Message); ok {
+		return proto.Marshal(msg)
+	}
+	jsonData, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg := dynamicpb.NewMessage(p.desc)
+	if err := protojson.Unmarshal(jsonData, msg); err != nil {
+		return nil, fmt.Errorf("value does not match %s: %w", p.desc.FullName(), err)
+	}
+	return proto.Marshal(msg)
+}
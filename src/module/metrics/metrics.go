@@ -0,0 +1,102 @@
+// module/metrics/metrics.go
+// DEV: expvarを利用した軽量なメトリクス (Counter / Gauge)
+package metrics
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	METRICS_PATH string = "/metrics"
+)
+
+var (
+	mu sync.Mutex
+)
+
+type (
+	// Config holds the metrics endpoint settings
+	Config struct {
+		Listen string `json:"listen"` // e.g. 127.0.0.1:9100 (empty = disabled)
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Counter
+// DEV: name毎のMapにlabel単位の値を保持する
+func Counter(name, label string) *expvar.Int {
+	mu.Lock()
+	defer mu.Unlock()
+	family := getFamily(name)
+	if v, ok := family.Get(label).(*expvar.Int); ok {
+		return v
+	}
+	v := new(expvar.Int)
+	family.Set(label, v)
+	return v
+}
+
+// *--------------------------------------------------------------------------------------
+// Gauge
+func Gauge(name, label string) *expvar.Float {
+	mu.Lock()
+	defer mu.Unlock()
+	family := getFamily(name)
+	if v, ok := family.Get(label).(*expvar.Float); ok {
+		return v
+	}
+	v := new(expvar.Float)
+	family.Set(label, v)
+	return v
+}
+
+// *--------------------------------------------------------------------------------------
+// getFamily
+func getFamily(name string) *expvar.Map {
+	if family, ok := expvar.Get(name).(*expvar.Map); ok {
+		return family
+	}
+	return expvar.NewMap(name)
+}
+
+// *--------------------------------------------------------------------------------------
+// Handler
+func Handler() http.Handler {
+	return expvar.Handler()
+}
+
+// *--------------------------------------------------------------------------------------
+// Serve
+// DEV: メトリクスをJSONで公開するHTTPサーバーを起動する
+func Serve(conf Config) error {
+	if conf.Listen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			zap.S().Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	zap.S().Infof("Metrics available at http://%s%s", conf.Listen, METRICS_PATH)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Label
+// DEV: 複数のラベルを1つのキーにまとめる
+func Label(parts ...string) string {
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,160 @@
+package mqttm
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
+	"go.uber.org/zap"
+)
+
+const (
+	AUTH_TYPE_JWT string = "jwt"
+	AUTH_TYPE_SAS string = "sas"
+
+	DEFAULT_TOKEN_LIFETIME_SEC int = 3600
+)
+
+type (
+	// AuthProvider computes the username/password for each connection attempt
+	AuthProvider interface {
+		Credentials(ctx context.Context) (username string, password string, err error)
+	}
+
+	// AuthConfig holds the settings of the built-in token providers
+	AuthConfig struct {
+		Type        string `json:"type"`         // jwt / sas
+		Username    string `json:"username"`     // Username sent with the token
+		Algorithm   string `json:"algorithm"`    // jwt: RS256 / ES256
+		Audience    string `json:"audience"`     // jwt: aud claim (e.g. cloud project ID)
+		ResourceURI string `json:"resource_uri"` // sas: signed resource (e.g. {hub}/devices/{id})
+		KeyName     string `json:"key_name"`     // sas: shared access policy name (optional)
+		Key         string `json:"key"`          // sas: secret reference of the base64 shared key
+		LifetimeSec int    `json:"lifetime_sec"` // Token lifetime
+
+		RefreshBeforeExpiry bool `json:"refresh_before_expiry"` // Reconnect with a new token before the lifetime ends
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// SetAuthProvider
+// DEV: 独自の認証Providerを差し込む (Run前に呼び出すこと)
+func (m *Module) SetAuthProvider(provider AuthProvider) {
+	m.auth = provider
+}
+
+// *--------------------------------------------------------------------------------------
+// newAuthProvider
+func (m *Module) newAuthProvider(conf Config) (AuthProvider, error) {
+	if conf.Auth == nil {
+		return nil, nil
+	}
+	lifetime := time.Duration(conf.Auth.LifetimeSec) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Duration(DEFAULT_TOKEN_LIFETIME_SEC) * time.Second
+	}
+
+	switch conf.Auth.Type {
+	case AUTH_TYPE_JWT:
+		// DEV: アルゴリズムと鍵の種類は起動時に検証する (接続時の失敗は固定の認証情報に切り替わるため)
+		keyPEM, err := m.privateKeyPEM()
+		if err != nil {
+			return nil, fmt.Errorf("jwt auth requires a private key: %w", err)
+		}
+		key, err := parsePrivateKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt private key: %w", err)
+		}
+		if err := checkSigningKey(conf.Auth.Algorithm, key); err != nil {
+			return nil, err
+		}
+		return &JWTProvider{
+			Username:  conf.Auth.Username,
+			Algorithm: conf.Auth.Algorithm,
+			Audience:  conf.Auth.Audience,
+			Lifetime:  lifetime,
+			KeyPEM:    m.privateKeyPEM,
+		}, nil
+
+	case AUTH_TYPE_SAS:
+		var secretConf secret.Config
+		if conf.Secrets != nil {
+			secretConf = conf.Secrets.Config
+		}
+		key, err := secret.Parse(conf.Auth.Key, secretConf)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sas key: %w", err)
+		}
+		return &SASProvider{
+			Username:    conf.Auth.Username,
+			ResourceURI: conf.Auth.ResourceURI,
+			KeyName:     conf.Auth.KeyName,
+			Key:         key,
+			Lifetime:    lifetime,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported auth type %q", conf.Auth.Type)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// provideCredentials (MQTT.CredentialsProvider)
+// DEV: 接続の度に呼ばれるため、トークンは毎回生成し直す
+func (m *Module) provideCredentials() (string, string) {
+	if m.auth != nil {
+		username, password, err := m.auth.Credentials(m.ctx)
+		if err == nil {
+			return username, password
+		}
+		zap.S().Errorf("Failed to compute credentials for %s: %v", m.hostName, err)
+	}
+
+	// DEV: 固定の認証情報はユーザー名・パスワードが揃っている場合のみ使う
+	if username, password := m.creds.provide(); username != "" && password != "" {
+		return username, password
+	}
+	return "", ""
+}
+
+// *--------------------------------------------------------------------------------------
+// watchTokenExpiry
+// DEV: トークンの期限切れで切断するブローカー向け (refresh_before_expiry)。期限前に再接続して新しいトークンを使う
+func (m *Module) watchTokenExpiry() {
+	lifetime := time.Duration(m.conf.Auth.LifetimeSec) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Duration(DEFAULT_TOKEN_LIFETIME_SEC) * time.Second
+	}
+	ticker := time.NewTicker(lifetime * 9 / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+
+		case <-ticker.C:
+			zap.S().Infof("Refreshing the auth token for %s", m.hostName)
+			if err := m.reconnect(); err != nil {
+				zap.S().Errorf("Failed to reconnect with a refreshed token for %s: %v", m.hostName, err)
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// privateKeyPEM
+// DEV: Secretの鍵を優先し、無ければ設定ファイルのパスから読む
+func (m *Module) privateKeyPEM() ([]byte, error) {
+	m.creds.mu.RLock()
+	keyPEM := m.creds.keyPEM
+	m.creds.mu.RUnlock()
+	if keyPEM != nil {
+		return keyPEM, nil
+	}
+	if m.conf.PrivateKey == "" {
+		return nil, fmt.Errorf("no private key configured")
+	}
+	return os.ReadFile(m.conf.PrivateKey)
+}
@@ -0,0 +1,211 @@
+package mqttm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_CERT_RELOAD_SEC int = 60
+
+	METRIC_CERT_EXPIRY string = "mqttm_cert_expiry_seconds"
+)
+
+// *--------------------------------------------------------------------------------------
+// tlsConfig
+// DEV: 証明書はGetClientCertificate経由で参照し、再接続時に最新のものが使われるようにする
+func (m *Module) tlsConfig(conf Config) (*tls.Config, error) {
+	roots, err := loadCertPool(conf.RootCA)
+	if err != nil {
+		return nil, err
+	}
+	m.creds.mu.Lock()
+	m.creds.roots = roots
+	m.creds.mu.Unlock()
+
+	m.certFiles = make(map[string]time.Time)
+	for _, path := range []string{conf.RootCA, conf.ClientCert, conf.PrivateKey} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			m.certFiles[path] = info.ModTime()
+		}
+	}
+
+	return &tls.Config{
+		RootCAs:              roots,
+		GetClientCertificate: m.creds.clientCertificate,
+		VerifyConnection:     m.verifyConnection,
+		InsecureSkipVerify:   true, // For testing purposes, set to false in production
+		MinVersion:           tls.VersionTLS12,
+	}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// verifyConnection
+// DEV: verify_server有効時は再読み込みされたCAでサーバー証明書を検証する
+func (m *Module) verifyConnection(cs tls.ConnectionState) error {
+	if !m.conf.VerifyServer {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("broker did not present a certificate")
+	}
+
+	m.creds.mu.RLock()
+	roots := m.creds.roots
+	m.creds.mu.RUnlock()
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       cs.ServerName,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// watchCertificates
+// DEV: 証明書・鍵・CAファイルの更新を監視して再読み込みする
+func (m *Module) watchCertificates() {
+	interval := time.Duration(m.conf.CertReloadSec) * time.Second
+	if interval <= 0 {
+		interval = time.Duration(DEFAULT_CERT_RELOAD_SEC) * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+
+		case <-ticker.C:
+			if m.certFilesChanged() {
+				if err := m.reloadCertificates(); err != nil {
+					zap.S().Errorf("Failed to reload certificates for %s: %v", m.hostName, err)
+				}
+			}
+			m.checkCertRenewal()
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// certFilesChanged
+func (m *Module) certFilesChanged() bool {
+	changed := false
+	for path, modTime := range m.certFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(modTime) {
+			m.certFiles[path] = info.ModTime()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// *--------------------------------------------------------------------------------------
+// reloadCertificates
+func (m *Module) reloadCertificates() error {
+	roots, err := loadCertPool(m.conf.RootCA)
+	if err != nil {
+		return err
+	}
+
+	m.creds.mu.RLock()
+	keyPEM := m.creds.keyPEM
+	m.creds.mu.RUnlock()
+	cert, err := m.loadClientCert(keyPEM)
+	if err != nil {
+		return err
+	}
+
+	m.creds.mu.Lock()
+	m.creds.roots = roots
+	m.creds.mu.Unlock()
+	m.setClientCert(cert)
+	zap.S().Infof("Reloaded client certificate for %s", m.hostName)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// setClientCert
+func (m *Module) setClientCert(cert *tls.Certificate) {
+	if cert == nil {
+		return
+	}
+	m.creds.mu.Lock()
+	m.creds.cert = cert
+	m.creds.mu.Unlock()
+
+	if leaf := certLeaf(cert); leaf != nil {
+		metrics.Gauge(METRIC_CERT_EXPIRY, m.hostName).Set(time.Until(leaf.NotAfter).Seconds())
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// checkCertRenewal
+// DEV: 接続中の証明書が期限N日以内かつ新しい証明書が読み込まれていれば再接続する
+func (m *Module) checkCertRenewal() {
+	m.creds.mu.RLock()
+	current, inUse := m.creds.cert, m.creds.inUse
+	m.creds.mu.RUnlock()
+
+	if leaf := certLeaf(current); leaf != nil {
+		metrics.Gauge(METRIC_CERT_EXPIRY, m.hostName).Set(time.Until(leaf.NotAfter).Seconds())
+	}
+	if m.conf.CertRenewDays <= 0 || inUse == nil || inUse == current {
+		return
+	}
+	leaf := certLeaf(inUse)
+	if leaf == nil || time.Until(leaf.NotAfter) > time.Duration(m.conf.CertRenewDays)*24*time.Hour {
+		return
+	}
+
+	zap.S().Infof("Client certificate for %s expires at %s, reconnecting with the renewed one", m.hostName, leaf.NotAfter.Format(time.RFC3339))
+	if err := m.reconnect(); err != nil {
+		zap.S().Errorf("Failed to reconnect with the renewed certificate for %s: %v", m.hostName, err)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// loadCertPool
+func loadCertPool(path string) (*x509.CertPool, error) {
+	certPool := x509.NewCertPool()
+	prmCerts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	certPool.AppendCertsFromPEM(prmCerts)
+	return certPool, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// certLeaf
+func certLeaf(cert *tls.Certificate) *x509.Certificate {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return nil
+	}
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
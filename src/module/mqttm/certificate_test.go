@@ -0,0 +1,214 @@
+package mqttm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate and key PEM for name, valid until notAfter
+func (ca *testCA) issue(t *testing.T, serial int64, name string, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeTLSFiles writes the files and moves their modification time forward so a reload is noticed
+func writeTLSFiles(t *testing.T, files map[string][]byte, modTime time.Time) {
+	t.Helper()
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTLSModule(t *testing.T, conf Config) *Module {
+	t.Helper()
+	m := &Module{ctx: context.Background(), hostName: "h", conf: conf}
+	if err := m.setupSecrets(conf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.tlsConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func presented(t *testing.T, m *Module) *x509.Certificate {
+	t.Helper()
+	cert, err := m.creds.clientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certLeaf(cert)
+}
+
+func TestReloadCertificatesOnChange(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		RootCA:     filepath.Join(dir, "ca.pem"),
+		ClientCert: filepath.Join(dir, "cert.pem"),
+		PrivateKey: filepath.Join(dir, "key.pem"),
+	}
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 10, "device", time.Now().Add(time.Hour))
+	writeTLSFiles(t, map[string][]byte{conf.RootCA: ca.pem, conf.ClientCert: certPEM, conf.PrivateKey: keyPEM}, time.Now().Add(-time.Minute))
+
+	m := newTLSModule(t, conf)
+	if serial := presented(t, m).SerialNumber.Int64(); serial != 10 {
+		t.Fatalf("presented serial %d, want 10", serial)
+	}
+	if m.certFilesChanged() {
+		t.Fatal("unchanged files reported as changed")
+	}
+
+	certPEM, keyPEM = ca.issue(t, 11, "device", time.Now().Add(48*time.Hour))
+	writeTLSFiles(t, map[string][]byte{conf.ClientCert: certPEM, conf.PrivateKey: keyPEM}, time.Now())
+	if !m.certFilesChanged() {
+		t.Fatal("renewed files were not noticed")
+	}
+	if err := m.reloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if serial := presented(t, m).SerialNumber.Int64(); serial != 11 {
+		t.Errorf("presented serial %d after reload, want 11", serial)
+	}
+}
+
+func TestReloadKeepsCertificateOnMismatch(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{
+		RootCA:     filepath.Join(dir, "ca.pem"),
+		ClientCert: filepath.Join(dir, "cert.pem"),
+		PrivateKey: filepath.Join(dir, "key.pem"),
+	}
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, 10, "device", time.Now().Add(time.Hour))
+	writeTLSFiles(t, map[string][]byte{conf.RootCA: ca.pem, conf.ClientCert: certPEM, conf.PrivateKey: keyPEM}, time.Now().Add(-time.Minute))
+	m := newTLSModule(t, conf)
+
+	// DEV: 証明書だけ先に書き換えられた状態 (鍵と一致しない) では前の証明書を使い続ける
+	renewed, _ := ca.issue(t, 11, "device", time.Now().Add(time.Hour))
+	writeTLSFiles(t, map[string][]byte{conf.ClientCert: renewed}, time.Now())
+	if err := m.reloadCertificates(); err == nil {
+		t.Fatal("certificate not matching the key was loaded")
+	}
+	if serial := presented(t, m).SerialNumber.Int64(); serial != 10 {
+		t.Errorf("presented serial %d, want the previous 10", serial)
+	}
+}
+
+func TestVerifyConnectionUsesReloadedRoots(t *testing.T) {
+	dir := t.TempDir()
+	conf := Config{RootCA: filepath.Join(dir, "ca.pem"), VerifyServer: true}
+	ca := newTestCA(t)
+	writeTLSFiles(t, map[string][]byte{conf.RootCA: ca.pem}, time.Now().Add(-time.Minute))
+	m := newTLSModule(t, conf)
+
+	serverPEM, _ := ca.issue(t, 20, "broker.local", time.Now().Add(time.Hour))
+	block, _ := pem.Decode(serverPEM)
+	server, _ := x509.ParseCertificate(block.Bytes)
+	state := tls.ConnectionState{ServerName: "broker.local", PeerCertificates: []*x509.Certificate{server}}
+	if err := m.verifyConnection(state); err != nil {
+		t.Fatalf("broker signed by root_ca was rejected: %v", err)
+	}
+	if err := m.verifyConnection(tls.ConnectionState{ServerName: "broker.local"}); err == nil {
+		t.Error("broker without a certificate was accepted")
+	}
+
+	writeTLSFiles(t, map[string][]byte{conf.RootCA: newTestCA(t).pem}, time.Now())
+	if err := m.reloadCertificates(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.verifyConnection(state); err == nil {
+		t.Error("broker signed by the replaced CA was accepted")
+	}
+}
+
+func TestCertRenewalWaitsForWindow(t *testing.T) {
+	ca := newTestCA(t)
+	m := &Module{hostName: "h", conf: Config{CertRenewDays: 5}, creds: &credentials{}}
+	oldPEM, oldKey := ca.issue(t, 10, "device", time.Now().Add(10*24*time.Hour))
+	old, err := tls.X509KeyPair(oldPEM, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPEM, newKey := ca.issue(t, 11, "device", time.Now().Add(90*24*time.Hour))
+	renewed, err := tls.X509KeyPair(newPEM, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.creds.inUse = &old
+	m.setClientCert(&renewed)
+
+	// DEV: 期限まで10日 > 5日のため再接続しない (クライアントが無いので再接続すればpanicする)
+	m.checkCertRenewal()
+	if m.creds.inUse != &old {
+		t.Error("certificate in use changed without a reconnect")
+	}
+}
@@ -0,0 +1,180 @@
+// module/mqttm/compress.go
+// DEV: MQTT 3.1.1にはContent-Encodingが無いため、圧縮したペイロードには4バイトのヘッダを付ける
+//
+//	header : 0x00 'M' 'Z' + algorithm(1byte: 'g'=gzip, 'z'=zstd, 's'=snappy)
+package mqttm
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	COMPRESS_GZIP   string = "gzip"
+	COMPRESS_ZSTD   string = "zstd"
+	COMPRESS_SNAPPY string = "snappy"
+
+	DEFAULT_COMPRESS_MIN_SIZE int = 128              // これより小さいペイロードは圧縮しない
+	MAX_DECOMPRESSED_SIZE     int = 64 * 1024 * 1024 // 展開後サイズの上限 (圧縮爆弾対策)
+
+	METRIC_COMPRESS_SAVED string = "mqttm_compression_saved_bytes_total"
+)
+
+var (
+	// ErrDecompressedTooLarge is returned when a payload would decompress beyond MAX_DECOMPRESSED_SIZE
+	ErrDecompressedTooLarge = fmt.Errorf("decompressed payload exceeds %d bytes", MAX_DECOMPRESSED_SIZE)
+
+	compressMagic = []byte{0x00, 'M', 'Z'}
+
+	compressIDs = map[string]byte{
+		COMPRESS_GZIP:   'g',
+		COMPRESS_ZSTD:   'z',
+		COMPRESS_SNAPPY: 's',
+	}
+
+	zstdEncoder = sync.OnceValue(func() *zstd.Encoder {
+		encoder, _ := zstd.NewWriter(nil)
+		return encoder
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		decoder, _ := zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(MAX_DECOMPRESSED_SIZE)))
+		return decoder
+	})
+)
+
+type (
+	// CompressionRule enables compression of publishes to a topic filter
+	CompressionRule struct {
+		Topic     string `json:"topic"`     // Topic filter (wildcards allowed)
+		Algorithm string `json:"algorithm"` // gzip / zstd / snappy
+		MinSize   int    `json:"min_size"`  // Payloads smaller than this are sent as is (default 128)
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// validateCompression
+func validateCompression(rules []CompressionRule) error {
+	for _, rule := range rules {
+		if !ValidTopicFilter(rule.Topic) {
+			return fmt.Errorf("invalid compression topic filter %q", rule.Topic)
+		}
+		if _, ok := compressIDs[rule.Algorithm]; !ok {
+			return fmt.Errorf("unknown compression algorithm %q", rule.Algorithm)
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// compressFor
+// DEV: 最初に一致したルールで圧縮する。圧縮しても小さくならない場合はそのまま送る
+func (m *Module) compressFor(topic string, payload []byte) []byte {
+	for _, rule := range m.conf.Compression {
+		if !MatchTopic(rule.Topic, topic) {
+			continue
+		}
+		minSize := rule.MinSize
+		if minSize <= 0 {
+			minSize = DEFAULT_COMPRESS_MIN_SIZE
+		}
+		if len(payload) < minSize {
+			return payload
+		}
+		compressed, err := Compress(rule.Algorithm, payload)
+		if err != nil {
+			zap.S().Warnf("Failed to compress payload for %s: %v", topic, err)
+			return payload
+		}
+		if len(compressed) >= len(payload) {
+			return payload
+		}
+		metrics.Counter(METRIC_COMPRESS_SAVED, rule.Algorithm).Add(int64(len(payload) - len(compressed)))
+		return compressed
+	}
+	return payload
+}
+
+// *--------------------------------------------------------------------------------------
+// Compress
+// DEV: ヘッダ付きで圧縮する
+func Compress(algorithm string, payload []byte) ([]byte, error) {
+	id, ok := compressIDs[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression algorithm %q", algorithm)
+	}
+	out := append(append([]byte{}, compressMagic...), id)
+	switch algorithm {
+	case COMPRESS_GZIP:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case COMPRESS_ZSTD:
+		return zstdEncoder().EncodeAll(payload, out), nil
+	default:
+		return append(out, s2.EncodeSnappy(nil, payload)...), nil
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Decompress
+// DEV: ヘッダが無ければそのまま返す (圧縮されていないペイロード)
+func Decompress(payload []byte) ([]byte, bool, error) {
+	if len(payload) < len(compressMagic)+1 || !bytes.HasPrefix(payload, compressMagic) {
+		return payload, false, nil
+	}
+	id, data := payload[len(compressMagic)], payload[len(compressMagic)+1:]
+	switch id {
+	case compressIDs[COMPRESS_GZIP]:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid gzip payload: %w", err)
+		}
+		out, err := io.ReadAll(io.LimitReader(r, int64(MAX_DECOMPRESSED_SIZE)+1))
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid gzip payload: %w", err)
+		}
+		if len(out) > MAX_DECOMPRESSED_SIZE {
+			return nil, true, ErrDecompressedTooLarge
+		}
+		return out, true, nil
+	case compressIDs[COMPRESS_ZSTD]:
+		out, err := zstdDecoder().DecodeAll(data, nil)
+		if errors.Is(err, zstd.ErrDecoderSizeExceeded) || len(out) > MAX_DECOMPRESSED_SIZE {
+			return nil, true, ErrDecompressedTooLarge
+		}
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid zstd payload: %w", err)
+		}
+		return out, true, nil
+	case compressIDs[COMPRESS_SNAPPY]:
+		// DEV: 展開前にヘッダの長さで上限を確認する
+		size, err := s2.DecodedLen(data)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid snappy payload: %w", err)
+		}
+		if size > MAX_DECOMPRESSED_SIZE {
+			return nil, true, ErrDecompressedTooLarge
+		}
+		out, err := s2.Decode(nil, data)
+		if err != nil {
+			return nil, true, fmt.Errorf("invalid snappy payload: %w", err)
+		}
+		return out, true, nil
+	}
+	return nil, true, fmt.Errorf("unknown compression id %q", id)
+}
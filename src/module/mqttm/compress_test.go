@@ -0,0 +1,94 @@
+package mqttm
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var compressAlgorithms = []string{COMPRESS_GZIP, COMPRESS_ZSTD, COMPRESS_SNAPPY}
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte(`{"sensor":"a","value":21.5}`), 100)
+	for _, algorithm := range compressAlgorithms {
+		compressed, err := Compress(algorithm, payload)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if !bytes.HasPrefix(compressed, append(compressMagic, compressIDs[algorithm])) || len(compressed) >= len(payload) {
+			t.Errorf("%s: compressed to %d bytes with header %x", algorithm, len(compressed), compressed[:4])
+		}
+		decompressed, ok, err := Decompress(compressed)
+		if err != nil || !ok || !bytes.Equal(decompressed, payload) {
+			t.Errorf("%s: Decompress = %d bytes, %v, %v", algorithm, len(decompressed), ok, err)
+		}
+	}
+
+	// DEV: ヘッダの無いペイロードはそのまま
+	if out, ok, err := Decompress([]byte(`{"plain":true}`)); ok || err != nil || string(out) != `{"plain":true}` {
+		t.Errorf("plain payload = %q, %v, %v", out, ok, err)
+	}
+	if _, err := Compress("brotli", payload); err == nil {
+		t.Error("unknown algorithm was accepted")
+	}
+}
+
+func TestCompressForRules(t *testing.T) {
+	m := &Module{conf: Config{Compression: []CompressionRule{
+		{Topic: "logs/#", Algorithm: COMPRESS_ZSTD, MinSize: 16},
+		{Topic: "#", Algorithm: COMPRESS_GZIP},
+	}}}
+	repetitive := bytes.Repeat([]byte("a"), 64)
+	for _, tc := range []struct {
+		topic   string
+		payload []byte
+		id      byte // 0 = 圧縮しない
+	}{
+		{"logs/app", repetitive, 'z'},
+		{"logs/app", []byte("short"), 0},
+		{"sensors/a", repetitive, 0}, // DEFAULT_COMPRESS_MIN_SIZE未満
+		{"sensors/a", bytes.Repeat([]byte("a"), DEFAULT_COMPRESS_MIN_SIZE), 'g'},
+		{"logs/app", []byte("0123456789abcdefghij"), 0}, // 小さくならない
+	} {
+		out := m.compressFor(tc.topic, tc.payload)
+		compressed := bytes.HasPrefix(out, compressMagic)
+		if tc.id == 0 && (compressed || !bytes.Equal(out, tc.payload)) {
+			t.Errorf("%s (%d bytes) was compressed", tc.topic, len(tc.payload))
+		}
+		if tc.id != 0 && (!compressed || out[len(compressMagic)] != tc.id) {
+			t.Errorf("%s (%d bytes) was not compressed with %c", tc.topic, len(tc.payload), tc.id)
+		}
+	}
+}
+
+func TestDecompressRejectsOversizedPayload(t *testing.T) {
+	oversized := make([]byte, MAX_DECOMPRESSED_SIZE+1)
+	for _, algorithm := range compressAlgorithms {
+		compressed, err := Compress(algorithm, oversized)
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if _, ok, err := Decompress(compressed); !ok || !errors.Is(err, ErrDecompressedTooLarge) {
+			t.Errorf("%s: Decompress of %d bytes = %v, %v, want ErrDecompressedTooLarge", algorithm, len(oversized), ok, err)
+		}
+	}
+}
+
+func TestDecompressRejectsCorruptPayload(t *testing.T) {
+	for _, algorithm := range compressAlgorithms {
+		corrupt := append(append([]byte{}, compressMagic...), compressIDs[algorithm], 0xff, 0xfe, 0xfd)
+		_, ok, err := Decompress(corrupt)
+		if !ok || err == nil || errors.Is(err, ErrDecompressedTooLarge) {
+			t.Errorf("%s: Decompress = %v, %v, want a decode error", algorithm, ok, err)
+			continue
+		}
+		if !strings.Contains(err.Error(), algorithm) || strings.Contains(err.Error(), "nil") {
+			t.Errorf("%s: error %q does not describe the decode failure", algorithm, err)
+		}
+	}
+
+	if _, ok, err := Decompress(append(append([]byte{}, compressMagic...), 'x', 0x00)); !ok || err == nil {
+		t.Errorf("unknown compression id = %v, %v", ok, err)
+	}
+}
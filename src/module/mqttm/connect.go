@@ -9,40 +9,60 @@ import (
 
 // *--------------------------------------------------------------------------------------
 func (m *Module) connectToBroker() error {
-	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+	m.refreshWill()
+	if token := m.mqttClient().Connect(); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
 	zap.S().Infof("Connected to MQTT broker: %s", m.hostName)
 	return nil
 }
 
+// *--------------------------------------------------------------------------------------
+// DEV: 認証情報・証明書の差し替え後に新しい値で接続し直す
+func (m *Module) reconnect() error {
+	zap.S().Infof("Reconnecting to MQTT broker: %s", m.hostName)
+	m.mqttClient().Disconnect(250)
+	return m.connectToBroker()
+}
+
 // *--------------------------------------------------------------------------------------
 func (m *Module) connectHandler(subTopics map[string]byte) MQTT.OnConnectHandler {
 	return func(client MQTT.Client) {
 		zap.S().Infof("Connecting to MQTT broker: %+v", m.option.Servers)
 		connectStatus = "on-line"
 		topic := fmt.Sprintf("%s/%s", REGISTER_TOPIC_PREFIX, m.clientID)
-		if err := m.publishFn(topic, byte(0), m.getStatusPayload()); err != nil {
+		if err := m.publishControl(topic, byte(0), false, m.getStatusPayload()); err != nil {
 			zap.S().Errorf("Failed to publish status message: %v", err)
 		}
 
 		// Set up subscriptions
-		if token := client.SubscribeMultiple(subTopics, m.subscribeFn); token.Wait() && token.Error() != nil {
-			zap.S().Errorf("Failed to subscribe to topics: %v", token.Error())
-		} else {
-			zap.S().Infof("Subscribed to topics: %+v", subTopics)
+		// DEV: Drain中 (Unsubscribe後) は再接続しても購読しない。Pause中のトピックも除く
+		active := m.activeSubscriptions(subTopics)
+		if len(active) > 0 && !m.draining.Load() {
+			if token := client.SubscribeMultiple(active, m.subscribeFn); token.Wait() && token.Error() != nil {
+				zap.S().Errorf("Failed to subscribe to topics: %v", token.Error())
+			} else {
+				zap.S().Infof("Subscribed to topics: %+v", active)
+			}
+		}
+
+		for _, fn := range m.onConnect {
+			fn(m)
 		}
 	}
 }
 
 // *--------------------------------------------------------------------------------------
 func (m *Module) disconnectFromBroker() {
+	for _, fn := range m.onDisconnect {
+		fn(m)
+	}
 	connectStatus = "off-line"
 	topic := fmt.Sprintf("%s/%s", REGISTER_TOPIC_PREFIX, m.clientID)
-	if err := m.publishFn(topic, byte(0), m.getStatusPayload()); err != nil {
+	if err := m.publishControl(topic, byte(0), false, m.getStatusPayload()); err != nil {
 		zap.S().Errorf("Failed to publish disconnection message: %v", err)
 	}
 
-	m.client.Disconnect(250)
+	m.mqttClient().Disconnect(250)
 	zap.S().Infof("Disconnecting from MQTT broker: %s", m.clientID)
 }
@@ -0,0 +1,148 @@
+package mqttm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
+	"go.uber.org/zap"
+)
+
+const (
+	SECRET_USERNAME string = "username"
+	SECRET_PASSWORD string = "password"
+	SECRET_KEY      string = "key"
+)
+
+// *--------------------------------------------------------------------------------------
+// credentials
+// DEV: 接続時に参照される認証情報 (ローテーションで差し替えられる)
+type credentials struct {
+	mu       sync.RWMutex
+	username string
+	password string
+	keyPEM   []byte
+	cert     *tls.Certificate
+	inUse    *tls.Certificate // 現在の接続で提示した証明書
+	roots    *x509.CertPool
+}
+
+// *--------------------------------------------------------------------------------------
+// provide (MQTT.CredentialsProvider)
+func (c *credentials) provide() (string, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.username, c.password
+}
+
+// *--------------------------------------------------------------------------------------
+// clientCertificate (tls.Config.GetClientCertificate)
+func (c *credentials) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+	c.inUse = c.cert
+	return c.cert, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// setupSecrets
+// DEV: Secret参照を解決し、ローテーション監視用のWatcherを用意する
+func (m *Module) setupSecrets(conf Config) error {
+	m.creds = &credentials{
+		username: conf.Username,
+		password: conf.Password,
+	}
+	if conf.Secrets == nil {
+		return m.applySecrets(nil)
+	}
+
+	providers := make(map[string]secret.Provider)
+	refs := map[string]string{
+		SECRET_USERNAME: conf.Secrets.Username,
+		SECRET_PASSWORD: conf.Secrets.Password,
+		SECRET_KEY:      conf.Secrets.PrivateKey,
+	}
+	for name, ref := range refs {
+		if ref == "" {
+			continue
+		}
+		provider, err := secret.Parse(ref, conf.Secrets.Config)
+		if err != nil {
+			return fmt.Errorf("invalid %s secret: %w", name, err)
+		}
+		providers[name] = provider
+	}
+
+	interval := time.Duration(conf.Secrets.RefreshSec) * time.Second
+	m.secrets = secret.NewWatcher(providers, interval, m.onSecretsRotated)
+	values, err := m.secrets.Load(m.ctx)
+	if err != nil {
+		return err
+	}
+	return m.applySecrets(values)
+}
+
+// *--------------------------------------------------------------------------------------
+// applySecrets
+func (m *Module) applySecrets(values map[string][]byte) error {
+	var cert *tls.Certificate
+	if m.conf.ClientCert != "" {
+		loaded, err := m.loadClientCert(values[SECRET_KEY])
+		if err != nil {
+			return err
+		}
+		cert = loaded
+	}
+
+	m.creds.mu.Lock()
+	if value, ok := values[SECRET_USERNAME]; ok {
+		m.creds.username = string(value)
+	}
+	if value, ok := values[SECRET_PASSWORD]; ok {
+		m.creds.password = string(value)
+	}
+	m.creds.keyPEM = values[SECRET_KEY]
+	m.creds.mu.Unlock()
+
+	m.setClientCert(cert)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// loadClientCert
+// DEV: 秘密鍵はSecretの値を優先し、無ければ設定ファイルのパスから読む
+func (m *Module) loadClientCert(keyPEM []byte) (*tls.Certificate, error) {
+	if keyPEM == nil {
+		if m.conf.PrivateKey == "" {
+			return nil, nil
+		}
+		cer, err := tls.LoadX509KeyPair(m.conf.ClientCert, m.conf.PrivateKey)
+		return &cer, err
+	}
+
+	certPEM, err := os.ReadFile(m.conf.ClientCert)
+	if err != nil {
+		return nil, err
+	}
+	cer, err := tls.X509KeyPair(certPEM, keyPEM)
+	return &cer, err
+}
+
+// *--------------------------------------------------------------------------------------
+// onSecretsRotated
+func (m *Module) onSecretsRotated(values map[string][]byte) {
+	if err := m.applySecrets(values); err != nil {
+		zap.S().Errorf("Failed to apply rotated secrets for %s: %v", m.hostName, err)
+		return
+	}
+	if err := m.reconnect(); err != nil {
+		zap.S().Errorf("Failed to reconnect with rotated secrets for %s: %v", m.hostName, err)
+	}
+}
@@ -0,0 +1,58 @@
+// module/mqttm/drain.go
+// DEV: 停止時の順序 = Unsubscribe (受信の停止) -> Drain (PubChの送信) -> Stop (off-line通知・切断)
+package mqttm
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"go.uber.org/zap"
+)
+
+// *--------------------------------------------------------------------------------------
+// Unsubscribe
+// DEV: 購読を解除し、以降の再接続でも購読しない (SubChに残ったメッセージはそのまま読める)
+func (m *Module) Unsubscribe() error {
+	m.draining.Store(true)
+	if len(m.conf.SubscribeTopics) == 0 || !m.IsConnected() {
+		return nil
+	}
+	topics := make([]string, 0, len(m.conf.SubscribeTopics))
+	for topic := range m.conf.SubscribeTopics {
+		topics = append(topics, topic)
+	}
+	if token := m.mqttClient().Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to unsubscribe from %s: %w", m.hostName, token.Error())
+	}
+	zap.S().Infof("Unsubscribed from topics on %s: %v", m.hostName, topics)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Drain
+// DEV: 送信制限の退避キューとPubChに残った送信をctxの期限まで送信する。送れなかったものは呼び出し側で退避する
+func (m *Module) Drain(ctx context.Context) (flushed int, pending []Contents) {
+	flushed, pending = m.drainSpill(ctx)
+	for {
+		select {
+		case contents := <-m.PubCh:
+			if ctx.Err() != nil {
+				pending = append(pending, contents)
+				continue
+			}
+			// DEV: 送信制限はdrop・spillでも期限まで待って送る
+			topic := fmt.Sprintf("%s/%s", contents.Topic, m.clientID)
+			unsent := contents
+			unsent.Topic = topic
+			if err := m.sendLimited(tracing.Extract(ctx, contents.Trace), unsent); err != nil {
+				zap.S().Warnf("Failed to flush message to %s: %v", topic, err)
+				pending = append(pending, contents)
+				continue
+			}
+			flushed++
+		default:
+			return flushed, pending
+		}
+	}
+}
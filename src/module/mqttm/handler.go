@@ -2,11 +2,8 @@ package mqttm
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
@@ -15,14 +12,19 @@ import (
 
 // *--------------------------------------------------------------------------------------
 // New
-func New(ctx context.Context, clientID, hostname string, conf Config) (*Module, error) {
+// DEV: optsでWill・接続時の処理などを追加できる
+func New(ctx context.Context, clientID, hostname string, conf Config, opts ...Option) (*Module, error) {
 	module := &Module{
 		ctx:      ctx,
 		clientID: clientID,
 		hostName: hostname,
+		conf:     conf,
 		PubCh:    make(chan Contents, QUEUE_SIZE),
 		SubCh:    make(chan Contents, QUEUE_SIZE),
 	}
+	for _, opt := range opts {
+		opt(module)
+	}
 	option, err := module.setOptions(conf)
 	if err != nil {
 		return module, err
@@ -30,7 +32,13 @@ func New(ctx context.Context, clientID, hostname string, conf Config) (*Module,
 	option.SetOnConnectHandler(module.connectHandler(conf.SubscribeTopics))
 	option.SetConnectionLostHandler(func(client MQTT.Client, err error) {
 		zap.S().Errorf("Connection lost: %v", err)
+		if module.will != nil {
+			go module.redial()
+		}
 	})
+	if module.will != nil {
+		option.SetAutoReconnect(false)
+	}
 	module.option = *option
 	module.client = MQTT.NewClient(option)
 
@@ -40,7 +48,7 @@ func New(ctx context.Context, clientID, hostname string, conf Config) (*Module,
 // *--------------------------------------------------------------------------------------
 // Run
 func (m *Module) Run() error {
-	if m.client == nil || len(m.option.Servers) < 1 {
+	if m.mqttClient() == nil || len(m.option.Servers) < 1 {
 		return fmt.Errorf("MQTT client is already running or no servers configured")
 	}
 
@@ -48,7 +56,19 @@ func (m *Module) Run() error {
 		return fmt.Errorf("failed to connect to MQTT broker: %w", err)
 	}
 
+	if m.secrets != nil {
+		go m.secrets.Run(m.ctx)
+	}
+	if m.certFiles != nil {
+		go m.watchCertificates()
+	}
+	if m.conf.Auth != nil && m.conf.Auth.RefreshBeforeExpiry {
+		go m.watchTokenExpiry()
+	}
 	go m.publishLoop()
+	if m.limits != nil && m.limits.spill != nil {
+		go m.spillLoop()
+	}
 	return nil
 }
 
@@ -58,6 +78,25 @@ func (m *Module) Stop() {
 	m.disconnectFromBroker()
 }
 
+// *--------------------------------------------------------------------------------------
+// Hostname
+func (m *Module) Hostname() string {
+	return m.hostName
+}
+
+// *--------------------------------------------------------------------------------------
+// Subscription
+func (m *Module) Subscription() <-chan Contents {
+	return m.SubCh
+}
+
+// *--------------------------------------------------------------------------------------
+// IsConnected
+func (m *Module) IsConnected() bool {
+	client := m.mqttClient()
+	return client != nil && client.IsConnectionOpen()
+}
+
 // *--------------------------------------------------------------------------------------
 // Setupt MQTT options
 func (m *Module) setOptions(conf Config) (*MQTT.ClientOptions, error) {
@@ -69,38 +108,52 @@ func (m *Module) setOptions(conf Config) (*MQTT.ClientOptions, error) {
 		return &MQTT.ClientOptions{}, fmt.Errorf("MQTT client ID is required")
 	}
 
+	if err := validateCompression(conf.Compression); err != nil {
+		return &MQTT.ClientOptions{}, err
+	}
+
+	if err := validateTracePropagation(conf.TracePropagation); err != nil {
+		return &MQTT.ClientOptions{}, err
+	}
+
+	limits, err := loadRateLimits(m.hostName, conf.RateLimit)
+	if err != nil {
+		return &MQTT.ClientOptions{}, fmt.Errorf("invalid rate limit: %w", err)
+	}
+	m.limits = limits
+
+	protect, err := loadProtection(conf.Protection)
+	if err != nil {
+		return &MQTT.ClientOptions{}, fmt.Errorf("failed to load payload protection: %w", err)
+	}
+	m.protect = protect
+
+	if err := m.setupSecrets(conf); err != nil {
+		return &MQTT.ClientOptions{}, err
+	}
+
 	// option
 	option := MQTT.NewClientOptions()
 	option.SetClientID(m.clientID)
-	if conf.Username != "" && conf.Password != "" {
-		option.SetUsername(conf.Username)
-		option.SetPassword(conf.Password)
+	auth, err := m.newAuthProvider(conf)
+	if err != nil {
+		return option, err
 	}
+	m.auth = auth
+	option.SetCredentialsProvider(m.provideCredentials)
 	option.SetKeepAlive(KEEP_ALIVE_SEC)
 	option.SetMaxReconnectInterval(RECONNECT_INTERVAL_SEC)
 	option.SetAutoReconnect(true)
 	option.SetCleanSession(true)
 
-	if conf.RootCA != "" && conf.PrivateKey != "" && conf.ClientCert != "" {
-		certPool := x509.NewCertPool()
-		prmCerts, err := os.ReadFile(conf.RootCA)
-		if err != nil {
-			return option, err
-		}
-
-		certPool.AppendCertsFromPEM(prmCerts)
-		cer, err := tls.LoadX509KeyPair(conf.ClientCert, conf.PrivateKey)
+	if conf.RootCA != "" && m.creds.cert != nil {
+		tlsConfig, err := m.tlsConfig(conf)
 		if err != nil {
 			return option, err
 		}
-		option.SetTLSConfig(&tls.Config{
-			RootCAs:            certPool,
-			Certificates:       []tls.Certificate{cer},
-			InsecureSkipVerify: true, // For testing purposes, set to false in production
-			MinVersion:         tls.VersionTLS12,
-		})
+		option.SetTLSConfig(tlsConfig)
 		option.AddBroker("ssl://" + conf.Endpoint)
-		return option, err
+		return option, nil
 	}
 
 	// TLS
@@ -2,9 +2,12 @@ package mqttm
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
 )
 
 var (
@@ -31,6 +34,26 @@ type (
 		PrivateKey      string          `json:"key"`
 		ClientCert      string          `json:"cert"`
 		SubscribeTopics map[string]byte `json:"subscribe_topics"`
+		Secrets         *SecretsConfig  `json:"secrets"`
+		CertReloadSec   int             `json:"cert_reload_sec"` // Interval of the certificate file check
+		CertRenewDays   int             `json:"cert_renew_days"` // Reconnect when the certificate in use expires within N days
+		VerifyServer    bool            `json:"verify_server"`   // Verify the broker certificate against root_ca
+		Auth            *AuthConfig     `json:"auth"`            // Token based authentication (jwt / sas)
+
+		Compression []CompressionRule `json:"compression"` // Compression of publishes per topic
+		Protection  *ProtectionConfig `json:"protection"`  // Payload encryption / signing per topic
+
+		TracePropagation []string         `json:"trace_propagation"` // Topic filters whose publishes carry the trace context envelope
+		RateLimit        *RateLimitConfig `json:"rate_limit"`        // Token bucket limits of publishes (module / topic prefix)
+	}
+
+	// SecretsConfig holds secret references that override the plain credentials
+	SecretsConfig struct {
+		Username   string `json:"username"`    // e.g. env:MQTT_USERNAME
+		Password   string `json:"password"`    // e.g. vault:secret/data/mqtt#password
+		PrivateKey string `json:"key"`         // e.g. enc:/etc/mqtt/device.key.enc
+		RefreshSec int    `json:"refresh_sec"` // Interval of the rotation check
+		secret.Config
 	}
 
 	// Module represents the MQTT module with its configuration and handlers
@@ -39,7 +62,23 @@ type (
 		clientID string
 		hostName string
 		client   MQTT.Client
+		clientMu sync.RWMutex
 		option   MQTT.ClientOptions
+		conf     Config
+
+		will         func() Will       // 接続毎に作り直すWill (WithWill)
+		onConnect    []func(m *Module) // 接続毎に呼ぶ処理 (WithOnConnect)
+		onDisconnect []func(m *Module) // Stopの切断前に呼ぶ処理 (WithOnDisconnect)
+		draining     atomic.Bool       // Unsubscribe済み (再接続時に購読しない)
+		paused       map[string]bool   // Pause中の購読 (再接続時に購読しない)
+		pausedMu     sync.Mutex
+
+		creds     *credentials
+		auth      AuthProvider
+		secrets   *secret.Watcher
+		certFiles map[string]time.Time // 監視対象の証明書ファイルと最終更新時刻
+		protect   *protection          // ペイロードの暗号化・署名
+		limits    *publishLimits       // 送信制限 (nil = 制限しない)
 
 		PubCh chan Contents
 		SubCh chan Contents
@@ -53,11 +92,25 @@ type (
 		ClientID  string    `json:"client_id"`
 		QoS       byte      `json:"qos"`
 		Payload   []byte    `json:"payload"`
+		Retained  bool      `json:"retained,omitempty"` // Retain flag of a publish (kept while it is spilled)
+
+		ContentType string            `json:"content_type,omitempty"` // Payload format hint for codec selection
+		Trace       map[string]string `json:"trace,omitempty"`        // W3C trace context (traceparent / tracestate)
+	}
+
+	// Client defines what the service layer needs from an MQTT connection
+	// DEV: Moduleが実装する。テストではmqttmtest.Clientで差し替える
+	Client interface {
+		Hostname() string
+		Subscription() <-chan Contents                        // 受信メッセージのストリーム
+		Enqueue(ctx context.Context, contents Contents) error // PubCh経由の非同期送信
+		Publish(topic string, qos byte, payload []byte) error // 指定トピックへの同期送信
+		IsConnected() bool
 	}
 
 	// Handler defines the interface for handling MQTT messages
 	Handler interface {
-		New(ctx context.Context, clientID string, conf Config) (*Module, error)
+		New(ctx context.Context, clientID string, conf Config, opts ...Option) (*Module, error)
 		Run() error
 		Stop()
 	}
@@ -0,0 +1,195 @@
+// module/mqttm/mqttmtest/client.go
+// DEV: ネットワーク無しでDispatcher・Taskを動かすためのmqttm.Clientの偽実装
+package mqttmtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+var (
+	// ErrNotConnected is returned by publishes while the fake is disconnected
+	ErrNotConnected = errors.New("mqttmtest: client is not connected")
+)
+
+// *--------------------------------------------------------------------------------------
+// Client
+// DEV: 受信メッセージの台本・送信内容の記録・接続失敗の注入ができる
+type Client struct {
+	hostname string
+	clientID string
+	inbound  chan mqttm.Contents
+
+	mu        sync.Mutex
+	connected bool
+	failures  []error
+	published []mqttm.Contents
+	notify    chan struct{}
+}
+
+var _ mqttm.Client = (*Client)(nil)
+
+// *--------------------------------------------------------------------------------------
+// New (constructor)
+func New(hostname string) *Client {
+	return &Client{
+		hostname:  hostname,
+		clientID:  "mqttmtest",
+		inbound:   make(chan mqttm.Contents, mqttm.QUEUE_SIZE),
+		connected: true,
+		notify:    make(chan struct{}),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Hostname
+func (c *Client) Hostname() string {
+	return c.hostname
+}
+
+// *--------------------------------------------------------------------------------------
+// Subscription
+func (c *Client) Subscription() <-chan mqttm.Contents {
+	return c.inbound
+}
+
+// *--------------------------------------------------------------------------------------
+// Enqueue
+// DEV: Moduleと同じくトピック末尾にClient IDを付けて記録する
+func (c *Client) Enqueue(ctx context.Context, contents mqttm.Contents) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	contents.Topic = fmt.Sprintf("%s/%s", contents.Topic, c.clientID)
+	return c.record(contents)
+}
+
+// *--------------------------------------------------------------------------------------
+// Publish
+func (c *Client) Publish(topic string, qos byte, payload []byte) error {
+	return c.record(mqttm.Contents{
+		Timestamp: time.Now(),
+		Hostname:  c.hostname,
+		Topic:     topic,
+		ClientID:  c.clientID,
+		QoS:       qos,
+		Payload:   payload,
+	})
+}
+
+// *--------------------------------------------------------------------------------------
+// IsConnected
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+// *--------------------------------------------------------------------------------------
+// Push
+// DEV: 受信メッセージを台本として積む (Subscriptionから読まれる)
+func (c *Client) Push(topic string, payload []byte) {
+	c.inbound <- mqttm.Contents{
+		Timestamp: time.Now(),
+		Hostname:  c.hostname,
+		Topic:     topic,
+		ClientID:  c.clientID,
+		Payload:   payload,
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Script
+func (c *Client) Script(contents ...mqttm.Contents) {
+	for _, content := range contents {
+		if content.Hostname == "" {
+			content.Hostname = c.hostname
+		}
+		c.inbound <- content
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+// DEV: 受信ストリームを閉じる (Dispatcher側の監視が終了する)
+func (c *Client) Close() {
+	close(c.inbound)
+}
+
+// *--------------------------------------------------------------------------------------
+// SetConnected
+// DEV: 切断中の送信はErrNotConnectedになる
+func (c *Client) SetConnected(connected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = connected
+}
+
+// *--------------------------------------------------------------------------------------
+// FailNext
+// DEV: 次のn回の送信をerrで失敗させる
+func (c *Client) FailNext(err error, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < n; i++ {
+		c.failures = append(c.failures, err)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Published
+func (c *Client) Published() []mqttm.Contents {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]mqttm.Contents(nil), c.published...)
+}
+
+// *--------------------------------------------------------------------------------------
+// WaitPublished
+// DEV: n件以上送信されるまで待つ (タイムアウト時はそれまでの記録とエラー)
+func (c *Client) WaitPublished(n int, timeout time.Duration) ([]mqttm.Contents, error) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		c.mu.Lock()
+		published, notify := append([]mqttm.Contents(nil), c.published...), c.notify
+		c.mu.Unlock()
+		if len(published) >= n {
+			return published, nil
+		}
+
+		select {
+		case <-notify:
+		case <-deadline.C:
+			return published, fmt.Errorf("mqttmtest: %d of %d messages published within %s", len(published), n, timeout)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// record
+func (c *Client) record(contents mqttm.Contents) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return ErrNotConnected
+	}
+	if len(c.failures) > 0 {
+		err := c.failures[0]
+		c.failures = c.failures[1:]
+		return err
+	}
+	c.published = append(c.published, contents)
+
+	// DEV: WaitPublishedの待機を起こす
+	close(c.notify)
+	c.notify = make(chan struct{})
+	return nil
+}
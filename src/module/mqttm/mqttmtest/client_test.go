@@ -0,0 +1,178 @@
+package mqttmtest_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/broker"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm/mqttmtest"
+)
+
+// harness drives an mqttm.Client from the outside
+type harness struct {
+	client   mqttm.Client
+	clientID string
+	inject   func(topic string, payload []byte)         // 受信メッセージを届ける
+	sent     func(t *testing.T, n int) []mqttm.Contents // 送信されたメッセージを待つ
+}
+
+// testClientContract checks the behaviour the service layer relies on
+func testClientContract(t *testing.T, h harness) {
+	if h.client.Hostname() != "h" {
+		t.Errorf("Hostname() = %q, want h", h.client.Hostname())
+	}
+	if !h.client.IsConnected() {
+		t.Fatal("client is not connected")
+	}
+
+	h.inject("contract/in", []byte(`{"n":1}`))
+	select {
+	case contents := <-h.client.Subscription():
+		if contents.Topic != "contract/in" || string(contents.Payload) != `{"n":1}` || contents.Hostname != "h" {
+			t.Errorf("received %+v", contents)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing received on Subscription()")
+	}
+
+	if err := h.client.Publish("contract/sync", 1, []byte("sync")); err != nil {
+		t.Fatal(err)
+	}
+	// DEV: EnqueueはPubCh経由でトピック末尾にClient IDが付く
+	if err := h.client.Enqueue(context.Background(), mqttm.Contents{Topic: "contract/async", QoS: 1, Payload: []byte("async")}); err != nil {
+		t.Fatal(err)
+	}
+	topics := map[string]string{}
+	for _, contents := range h.sent(t, 2) {
+		topics[contents.Topic] = string(contents.Payload)
+	}
+	if topics["contract/sync"] != "sync" || topics["contract/async/"+h.clientID] != "async" {
+		t.Errorf("published %v", topics)
+	}
+}
+
+func TestFakeClientContract(t *testing.T) {
+	client := mqttmtest.New("h")
+	testClientContract(t, harness{
+		client:   client,
+		clientID: "mqttmtest",
+		inject:   client.Push,
+		sent: func(t *testing.T, n int) []mqttm.Contents {
+			published, err := client.WaitPublished(n, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return published
+		},
+	})
+}
+
+func TestModuleClientContract(t *testing.T) {
+	b := broker.New(broker.Config{Listen: "127.0.0.1:0"})
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	run := func(clientID string, topics map[string]byte) *mqttm.Module {
+		m, err := mqttm.New(ctx, clientID, "h", mqttm.Config{Endpoint: b.Addr(), SubscribeTopics: topics})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Run(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(m.Stop)
+		return m
+	}
+	module := run("contract", map[string]byte{"contract/in": 1})
+	peer := run("peer", map[string]byte{"contract/sync": 1, "contract/async/#": 1})
+
+	testClientContract(t, harness{
+		client:   module,
+		clientID: "contract",
+		inject: func(topic string, payload []byte) {
+			if err := peer.Publish(topic, 1, payload); err != nil {
+				t.Fatal(err)
+			}
+		},
+		sent: func(t *testing.T, n int) []mqttm.Contents {
+			var sent []mqttm.Contents
+			for len(sent) < n {
+				select {
+				case contents := <-peer.Subscription():
+					sent = append(sent, contents)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%d of %d messages received by the peer", len(sent), n)
+				}
+			}
+			return sent
+		},
+	})
+}
+
+func TestFakeInjectsFailures(t *testing.T) {
+	client := mqttmtest.New("h")
+	boom := errors.New("boom")
+	client.FailNext(boom, 2)
+	for i := 0; i < 2; i++ {
+		if err := client.Publish("t", 0, nil); !errors.Is(err, boom) {
+			t.Errorf("publish %d: err = %v, want boom", i, err)
+		}
+	}
+	if err := client.Publish("t", 0, []byte("ok")); err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetConnected(false)
+	if client.IsConnected() {
+		t.Error("IsConnected() after SetConnected(false)")
+	}
+	if err := client.Enqueue(context.Background(), mqttm.Contents{Topic: "t"}); !errors.Is(err, mqttmtest.ErrNotConnected) {
+		t.Errorf("err = %v, want ErrNotConnected", err)
+	}
+	if published := client.Published(); len(published) != 1 || string(published[0].Payload) != "ok" {
+		t.Errorf("published = %+v, want only the successful publish", published)
+	}
+}
+
+func TestFakeWaitPublished(t *testing.T) {
+	client := mqttmtest.New("h")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			client.Publish("t", 0, nil)
+		}
+	}()
+	if published, err := client.WaitPublished(3, 5*time.Second); err != nil || len(published) != 3 {
+		t.Errorf("WaitPublished = %d, %v", len(published), err)
+	}
+	wg.Wait()
+
+	if published, err := client.WaitPublished(4, 20*time.Millisecond); err == nil || len(published) != 3 {
+		t.Errorf("WaitPublished beyond the published count = %d, %v, want a timeout", len(published), err)
+	}
+}
+
+func TestFakeScriptAndClose(t *testing.T) {
+	client := mqttmtest.New("h")
+	client.Script(mqttm.Contents{Topic: "a"}, mqttm.Contents{Topic: "b", Hostname: "other"})
+	client.Close()
+
+	var got []mqttm.Contents
+	for contents := range client.Subscription() {
+		got = append(got, contents)
+	}
+	if len(got) != 2 || got[0].Hostname != "h" || got[1].Hostname != "other" {
+		t.Errorf("received %+v, want a then b with the hostname filled in", got)
+	}
+}
@@ -0,0 +1,88 @@
+package mqttm
+
+import (
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+)
+
+type (
+	// Option configures optional Module features
+	Option func(*Module)
+
+	// Will is the Last Will and Testament registered with each CONNECT
+	Will struct {
+		Topic   string
+		Payload []byte
+		QoS     byte
+		Retain  bool
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// WithWill
+// DEV: 接続毎にfnを呼び直してWillを作る (Sparkplugのように接続毎に内容が変わる場合)
+func WithWill(fn func() Will) Option {
+	return func(m *Module) {
+		m.will = fn
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// WithOnConnect
+// DEV: 購読の完了後に呼ばれる (再接続時も毎回)
+func WithOnConnect(fn func(m *Module)) Option {
+	return func(m *Module) {
+		m.onConnect = append(m.onConnect, fn)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// WithOnDisconnect
+// DEV: Stopで切断する直前に呼ばれる (正常切断ではWillが送られないため、オフライン通知などに使う)
+func WithOnDisconnect(fn func(m *Module)) Option {
+	return func(m *Module) {
+		m.onDisconnect = append(m.onDisconnect, fn)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// mqttClient
+func (m *Module) mqttClient() MQTT.Client {
+	m.clientMu.RLock()
+	defer m.clientMu.RUnlock()
+	return m.client
+}
+
+// *--------------------------------------------------------------------------------------
+// refreshWill
+// DEV: pahoのClientはWillを変更できないため、新しいWillでClientを作り直す
+func (m *Module) refreshWill() {
+	if m.will == nil {
+		return
+	}
+	will := m.will()
+	m.option.SetBinaryWill(will.Topic, will.Payload, will.QoS, will.Retain)
+	m.clientMu.Lock()
+	m.client = MQTT.NewClient(&m.option)
+	m.clientMu.Unlock()
+}
+
+// *--------------------------------------------------------------------------------------
+// redial
+// DEV: Will使用時はpahoの自動再接続を使わず、Willを更新しながら再接続する
+func (m *Module) redial() {
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(RECONNECT_INTERVAL_SEC):
+		}
+		if err := m.connectToBroker(); err != nil {
+			zap.S().Warnf("Failed to reconnect to MQTT broker %s: %v", m.hostName, err)
+			continue
+		}
+		return
+	}
+}
@@ -0,0 +1,82 @@
+// module/mqttm/pause.go
+// DEV: 下流の障害時 (サーキットブレーカーのopen中など) に一部の購読を一時的に止める
+package mqttm
+
+import (
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// *--------------------------------------------------------------------------------------
+// Pause
+// DEV: 購読を解除し、Resumeするまで再接続しても購読しない。topicsはsubscribe_topicsのフィルタと完全一致させる
+func (m *Module) Pause(topics ...string) error {
+	topics, err := m.changePaused(topics, true)
+	if err != nil || len(topics) == 0 || !m.IsConnected() {
+		return err
+	}
+	if token := m.mqttClient().Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to pause %v on %s: %w", topics, m.hostName, token.Error())
+	}
+	zap.S().Infof("Paused subscriptions on %s: %v", m.hostName, topics)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Resume
+// DEV: Drain中 (Unsubscribe後) は購読し直さない
+func (m *Module) Resume(topics ...string) error {
+	topics, err := m.changePaused(topics, false)
+	if err != nil || len(topics) == 0 || !m.IsConnected() || m.draining.Load() {
+		return err
+	}
+	filters := make(map[string]byte, len(topics))
+	for _, topic := range topics {
+		filters[topic] = m.conf.SubscribeTopics[topic]
+	}
+	if token := m.mqttClient().SubscribeMultiple(filters, m.subscribeFn); token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to resume %v on %s: %w", topics, m.hostName, token.Error())
+	}
+	zap.S().Infof("Resumed subscriptions on %s: %v", m.hostName, topics)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// changePaused
+// DEV: 状態が変わったトピックだけを返す
+func (m *Module) changePaused(topics []string, paused bool) ([]string, error) {
+	m.pausedMu.Lock()
+	defer m.pausedMu.Unlock()
+	for _, topic := range topics {
+		if _, ok := m.conf.SubscribeTopics[topic]; !ok {
+			return nil, fmt.Errorf("%s is not subscribed on %s", topic, m.hostName)
+		}
+	}
+	if m.paused == nil {
+		m.paused = make(map[string]bool)
+	}
+	changed := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if m.paused[topic] != paused {
+			m.paused[topic] = paused
+			changed = append(changed, topic)
+		}
+	}
+	return changed, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// activeSubscriptions
+// DEV: 接続時に購読するトピック (Pause中のものを除く)
+func (m *Module) activeSubscriptions(subTopics map[string]byte) map[string]byte {
+	m.pausedMu.Lock()
+	defer m.pausedMu.Unlock()
+	active := make(map[string]byte, len(subTopics))
+	for topic, qos := range subTopics {
+		if !m.paused[topic] {
+			active[topic] = qos
+		}
+	}
+	return active
+}
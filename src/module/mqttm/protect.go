@@ -0,0 +1,382 @@
+// module/mqttm/protect.go
+// DEV: ブローカーを跨いでも保護されるペイロード単位の暗号化・署名
+//
+//	encrypted : 0x00 'M' 'E' | len(keyID)(1byte) keyID | timestamp(8byte BE, unix ms) | nonce | AES-GCM ciphertext
+//	            AAD = header (nonceまで含まない) + topic
+//	signed    : 0x00 'M' 'S' | len(keyID)(1byte) keyID | timestamp(8byte BE, unix ms) | len(sig)(2byte BE) sig | body
+//	            署名対象は header (sigを除く) + topic + body。送信時は 圧縮 -> 暗号化 -> 署名 の順
+//
+// トピックを含めるため、別のトピックに複製されたペイロードは検証・復号に失敗する。
+// 受信時はtimestampがmax_age_secの範囲外のもの、範囲内で同じnonce・署名を受け取ったもの (再送信攻撃) を拒否する
+package mqttm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
+)
+
+const (
+	DEFAULT_PROTECTION_MAX_AGE_SEC int = 300
+
+	METRIC_REJECTED string = "mqttm_rejected_messages_total"
+)
+
+var (
+	encryptMagic = []byte{0x00, 'M', 'E'}
+	signMagic    = []byte{0x00, 'M', 'S'}
+)
+
+type (
+	// ProtectionConfig holds the keys and per-topic rules of payload protection
+	ProtectionConfig struct {
+		Keyring      string            `json:"keyring"`        // AES keys, "<key-id> <base64 key>" per line
+		SigningKey   string            `json:"signing_key"`    // PEM private key (Ed25519 / ECDSA)
+		SigningKeyID string            `json:"signing_key_id"` // Key ID announced in signatures
+		TrustedKeys  map[string]string `json:"trusted_keys"`   // Key ID -> PEM public key file
+		Rules        []ProtectionRule  `json:"rules"`          // First match wins
+		MaxAgeSec    int               `json:"max_age_sec"`    // Accepted clock difference of received payloads; replays are detected within it (default 300)
+	}
+
+	// ProtectionRule sets the protection of a topic filter in both directions
+	ProtectionRule struct {
+		Topic   string `json:"topic"`
+		Encrypt string `json:"encrypt"` // Key ID to encrypt publishes with; received payloads must be encrypted
+		Sign    bool   `json:"sign"`    // Sign publishes; received payloads must carry a trusted signature
+	}
+
+	// protection is the loaded ProtectionConfig
+	protection struct {
+		rules   []ProtectionRule
+		keys    map[string][]byte
+		signer  crypto.Signer
+		keyID   string
+		trusted map[string]crypto.PublicKey
+		replays *replayGuard
+	}
+
+	// replayGuard rejects stale payloads and payloads received twice
+	// DEV: 受け取ったnonce・署名のハッシュをmax_ageの間だけ覚えておく
+	replayGuard struct {
+		mu        sync.Mutex
+		maxAge    time.Duration
+		seen      map[[32]byte]time.Time // ハッシュ -> 忘れてよい時刻
+		nextPrune time.Time
+	}
+
+	// RejectedError is returned for payloads that fail verification or decryption
+	RejectedError struct {
+		Topic  string
+		Reason string
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Error
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("rejected payload on %s: %s", e.Topic, e.Reason)
+}
+
+// *--------------------------------------------------------------------------------------
+// loadProtection
+func loadProtection(conf *ProtectionConfig) (*protection, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	maxAge := time.Duration(conf.MaxAgeSec) * time.Second
+	if maxAge <= 0 {
+		maxAge = time.Duration(DEFAULT_PROTECTION_MAX_AGE_SEC) * time.Second
+	}
+	p := &protection{
+		rules:   conf.Rules,
+		keyID:   conf.SigningKeyID,
+		trusted: make(map[string]crypto.PublicKey),
+		replays: &replayGuard{maxAge: maxAge, seen: make(map[[32]byte]time.Time)},
+	}
+	if conf.Keyring != "" {
+		keys, err := secret.LoadKeyring(conf.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = keys
+	}
+	if conf.SigningKey != "" {
+		keyPEM, err := os.ReadFile(conf.SigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signing key: %w", err)
+		}
+		if p.signer, err = parsePrivateKey(keyPEM); err != nil {
+			return nil, err
+		}
+		if p.keyID == "" || len(p.keyID) > 255 {
+			return nil, fmt.Errorf("signing_key_id is required (max 255 bytes)")
+		}
+	}
+	for keyID, path := range conf.TrustedKeys {
+		key, err := loadPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("trusted key %s: %w", keyID, err)
+		}
+		p.trusted[keyID] = key
+	}
+
+	for _, rule := range p.rules {
+		if !ValidTopicFilter(rule.Topic) {
+			return nil, fmt.Errorf("invalid protection topic filter %q", rule.Topic)
+		}
+		if _, ok := p.keys[rule.Encrypt]; rule.Encrypt != "" && !ok {
+			return nil, fmt.Errorf("encryption key %s not found in keyring", rule.Encrypt)
+		}
+		if rule.Sign && p.signer == nil {
+			return nil, fmt.Errorf("signing %s requires signing_key", rule.Topic)
+		}
+	}
+	return p, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// rule
+func (p *protection) rule(topic string) ProtectionRule {
+	for _, rule := range p.rules {
+		if MatchTopic(rule.Topic, topic) {
+			return rule
+		}
+	}
+	return ProtectionRule{}
+}
+
+// *--------------------------------------------------------------------------------------
+// seal
+// DEV: 送信時 (圧縮後のペイロードを暗号化・署名する)
+func (p *protection) seal(topic string, payload []byte) ([]byte, error) {
+	rule := p.rule(topic)
+	stamp := time.Now().UnixMilli()
+	if rule.Encrypt != "" {
+		header := binary.BigEndian.AppendUint64(appendKeyID(append([]byte{}, encryptMagic...), rule.Encrypt), uint64(stamp))
+		aead, err := secret.NewGCM(p.keys[rule.Encrypt])
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		payload = aead.Seal(append(append([]byte{}, header...), nonce...), nonce, payload, boundData(header, topic))
+	}
+	if rule.Sign {
+		header := binary.BigEndian.AppendUint64(appendKeyID(append([]byte{}, signMagic...), p.keyID), uint64(stamp))
+		sig, err := p.sign(append(boundData(header, topic), payload...))
+		if err != nil {
+			return nil, err
+		}
+		signed := binary.BigEndian.AppendUint16(header, uint16(len(sig)))
+		payload = append(append(signed, sig...), payload...)
+	}
+	return payload, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// open
+// DEV: 受信時 (署名の検証 -> 復号)。ルールで必須の保護が無いものも拒否する
+func (p *protection) open(topic string, payload []byte) ([]byte, error) {
+	rule := p.rule(topic)
+
+	signed := bytes.HasPrefix(payload, signMagic)
+	if rule.Sign && !signed {
+		return nil, &RejectedError{Topic: topic, Reason: "missing signature"}
+	}
+	if signed {
+		body, err := p.verify(topic, payload)
+		if err != nil {
+			return nil, &RejectedError{Topic: topic, Reason: err.Error()}
+		}
+		payload = body
+	}
+
+	encrypted := bytes.HasPrefix(payload, encryptMagic)
+	if rule.Encrypt != "" && !encrypted {
+		return nil, &RejectedError{Topic: topic, Reason: "payload is not encrypted"}
+	}
+	if encrypted {
+		plaintext, err := p.decrypt(topic, payload)
+		if err != nil {
+			return nil, &RejectedError{Topic: topic, Reason: err.Error()}
+		}
+		payload = plaintext
+	}
+	return payload, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// sign
+func (p *protection) sign(message []byte) ([]byte, error) {
+	if _, ok := p.signer.(ed25519.PrivateKey); ok {
+		return p.signer.Sign(rand.Reader, message, crypto.Hash(0))
+	}
+	if _, ok := p.signer.Public().(*ecdsa.PublicKey); !ok {
+		return nil, fmt.Errorf("signing key must be Ed25519 or ECDSA")
+	}
+	digest := sha256.Sum256(message)
+	return p.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+// *--------------------------------------------------------------------------------------
+// verify
+func (p *protection) verify(topic string, payload []byte) ([]byte, error) {
+	keyID, rest, ok := readKeyID(payload[len(signMagic):])
+	if !ok || len(rest) < 8+2 {
+		return nil, fmt.Errorf("malformed signature header")
+	}
+	stamp := time.UnixMilli(int64(binary.BigEndian.Uint64(rest)))
+	rest = rest[8:]
+	sigLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+sigLen {
+		return nil, fmt.Errorf("malformed signature header")
+	}
+	sig, body := rest[2:2+sigLen], rest[2+sigLen:]
+	key, ok := p.trusted[keyID]
+	if !ok {
+		return nil, fmt.Errorf("untrusted signing key %s", keyID)
+	}
+
+	header := payload[:len(signMagic)+1+len(keyID)+8]
+	message := append(boundData(header, topic), body...)
+	valid := false
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(pub, message, sig)
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(message)
+		valid = ecdsa.VerifyASN1(pub, digest[:], sig)
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid signature by %s (tampered or signed for another topic)", keyID)
+	}
+	if err := p.replays.check(stamp, sig); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// decrypt
+func (p *protection) decrypt(topic string, payload []byte) ([]byte, error) {
+	keyID, rest, ok := readKeyID(payload[len(encryptMagic):])
+	if !ok || len(rest) < 8 {
+		return nil, fmt.Errorf("malformed encryption header")
+	}
+	stamp := time.UnixMilli(int64(binary.BigEndian.Uint64(rest)))
+	rest = rest[8:]
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %s not found in keyring", keyID)
+	}
+	aead, err := secret.NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted payload is too short")
+	}
+	header := payload[:len(encryptMagic)+1+len(keyID)+8]
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, boundData(header, topic))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %s (tampered or sealed for another topic): %w", keyID, err)
+	}
+	if err := p.replays.check(stamp, nonce); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// boundData
+// DEV: 認証の対象 (header + topic)。topicの長さも含めて境界を曖昧にしない
+func boundData(header []byte, topic string) []byte {
+	data := append([]byte{}, header...)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(topic)))
+	return append(data, topic...)
+}
+
+// *--------------------------------------------------------------------------------------
+// check
+// DEV: 検証に成功した後に呼ぶ (偽のペイロードで記録を埋められないようにする)
+func (g *replayGuard) check(stamp time.Time, id []byte) error {
+	now := time.Now()
+	if stamp.Before(now.Add(-g.maxAge)) || stamp.After(now.Add(g.maxAge)) {
+		return fmt.Errorf("payload timestamp %s is outside the accepted window of %v", stamp.Format(time.RFC3339), g.maxAge)
+	}
+	key := sha256.Sum256(id)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.After(g.nextPrune) {
+		for seen, expiry := range g.seen {
+			if now.After(expiry) {
+				delete(g.seen, seen)
+			}
+		}
+		g.nextPrune = now.Add(g.maxAge / 2)
+	}
+	if _, ok := g.seen[key]; ok {
+		return fmt.Errorf("replayed payload")
+	}
+	g.seen[key] = stamp.Add(g.maxAge)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// appendKeyID
+func appendKeyID(buf []byte, keyID string) []byte {
+	return append(append(buf, byte(len(keyID))), keyID...)
+}
+
+// *--------------------------------------------------------------------------------------
+// readKeyID
+func readKeyID(data []byte) (string, []byte, bool) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, false
+	}
+	return string(data[1 : 1+int(data[0])]), data[1+int(data[0]):], true
+}
+
+// *--------------------------------------------------------------------------------------
+// loadPublicKey
+// DEV: PKIX公開鍵または証明書 (PEM) を読み込む
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", path)
+	}
+	var key crypto.PublicKey
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	} else if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: only Ed25519 and ECDSA keys are supported", path)
+}
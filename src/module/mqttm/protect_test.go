@@ -0,0 +1,142 @@
+package mqttm
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProtection writes a keyring and an Ed25519 key pair and loads them like the config does
+func newTestProtection(t *testing.T, rules ...ProtectionRule) *protection {
+	t.Helper()
+	dir := t.TempDir()
+	key := make([]byte, 32)
+	rand.Read(key)
+	keyring := filepath.Join(dir, "payload.keyring")
+	writeTestFile(t, keyring, []byte("k1 "+base64.StdEncoding.EncodeToString(key)+"\n"))
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	signingKey := filepath.Join(dir, "sign.key")
+	trustedKey := filepath.Join(dir, "sign.pub")
+	writeTestFile(t, signingKey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}))
+	writeTestFile(t, trustedKey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+
+	p, err := loadProtection(&ProtectionConfig{
+		Keyring:      keyring,
+		SigningKey:   signingKey,
+		SigningKeyID: "dev01",
+		TrustedKeys:  map[string]string{"dev01": trustedKey},
+		Rules:        rules,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProtectionRoundTrip(t *testing.T) {
+	cases := []ProtectionRule{
+		{Topic: "a/#", Encrypt: "k1", Sign: true},
+		{Topic: "a/#", Encrypt: "k1"},
+		{Topic: "a/#", Sign: true},
+	}
+	for _, rule := range cases {
+		p := newTestProtection(t, rule)
+		payload := []byte(`{"temp": 21.5}`)
+		sealed, err := p.seal("a/1", payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Encrypt != "" && bytes.Contains(sealed, payload) {
+			t.Errorf("%+v: sealed payload contains the plaintext", rule)
+		}
+		opened, err := p.open("a/1", sealed)
+		if err != nil {
+			t.Fatalf("%+v: open = %v", rule, err)
+		}
+		if !bytes.Equal(opened, payload) {
+			t.Errorf("%+v: open = %q, want %q", rule, opened, payload)
+		}
+	}
+}
+
+func TestProtectionRejectsOtherTopic(t *testing.T) {
+	for _, rule := range []ProtectionRule{{Topic: "a/#", Encrypt: "k1"}, {Topic: "a/#", Sign: true}} {
+		p := newTestProtection(t, rule)
+		sealed, err := p.seal("a/1", []byte("open the valve"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rejected *RejectedError
+		if _, err := p.open("a/2", sealed); !errors.As(err, &rejected) {
+			t.Errorf("%+v: open on another topic = %v, want RejectedError", rule, err)
+		}
+	}
+}
+
+func TestProtectionRejectsReplay(t *testing.T) {
+	for _, rule := range []ProtectionRule{{Topic: "a/#", Encrypt: "k1"}, {Topic: "a/#", Sign: true}} {
+		p := newTestProtection(t, rule)
+		sealed, _ := p.seal("a/1", []byte("open the valve"))
+		if _, err := p.open("a/1", sealed); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.open("a/1", sealed); err == nil || !strings.Contains(err.Error(), "replayed") {
+			t.Errorf("%+v: second open = %v, want replay rejection", rule, err)
+		}
+	}
+}
+
+func TestProtectionRejectsTampering(t *testing.T) {
+	p := newTestProtection(t, ProtectionRule{Topic: "a/#", Encrypt: "k1", Sign: true})
+	sealed, _ := p.seal("a/1", []byte("open the valve"))
+	sealed[len(sealed)-1] ^= 0xFF
+	if _, err := p.open("a/1", sealed); err == nil {
+		t.Fatal("open of a tampered payload succeeded")
+	}
+}
+
+func TestProtectionRequiresRule(t *testing.T) {
+	p := newTestProtection(t, ProtectionRule{Topic: "a/#", Encrypt: "k1", Sign: true})
+	if _, err := p.open("a/1", []byte("plain")); err == nil {
+		t.Fatal("open of an unprotected payload succeeded")
+	}
+	// DEV: ルールに一致しないトピックはそのまま通す
+	if opened, err := p.open("b/1", []byte("plain")); err != nil || string(opened) != "plain" {
+		t.Fatalf("open on an unprotected topic = %q, %v", opened, err)
+	}
+}
+
+func TestReplayGuardWindow(t *testing.T) {
+	g := &replayGuard{maxAge: time.Minute, seen: make(map[[32]byte]time.Time)}
+	if err := g.check(time.Now().Add(-2*time.Minute), []byte("old")); err == nil {
+		t.Error("check accepted a stale timestamp")
+	}
+	if err := g.check(time.Now().Add(2*time.Minute), []byte("future")); err == nil {
+		t.Error("check accepted a timestamp from the future")
+	}
+	if err := g.check(time.Now(), []byte("fresh")); err != nil {
+		t.Errorf("check = %v, want nil", err)
+	}
+}
@@ -1,8 +1,13 @@
 package mqttm
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -10,8 +15,7 @@ import (
 func (m *Module) publishLoop() {
 	for {
 		select {
-		case <-m.PubCh:
-			close(m.PubCh)
+		case <-m.ctx.Done():
 			return
 
 		case contents, isNotClose := <-m.PubCh:
@@ -19,20 +23,117 @@ func (m *Module) publishLoop() {
 				return
 			}
 			topic := fmt.Sprintf("%s/%s", contents.Topic, m.clientID)
-			if err := m.publishFn(topic, contents.QoS, contents.Payload); err != nil {
+			ctx := tracing.Extract(m.ctx, contents.Trace)
+			if err := m.publish(ctx, topic, contents.QoS, false, contents.Payload); err != nil {
 				zap.S().Errorf("Failed to publish message: %v", err)
 			}
 		}
 	}
 }
 
+// *--------------------------------------------------------------------------------------
+// Enqueue
+// DEV: PubChへ積む (publishLoopがトピック末尾にClient IDを付けて送信する)
+func (m *Module) Enqueue(ctx context.Context, contents Contents) error {
+	select {
+	case m.PubCh <- contents:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-m.ctx.Done():
+		return fmt.Errorf("MQTT module %s is stopped", m.hostName)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Publish
+// DEV: PubChを経由せず、指定したトピックにそのまま同期で送信する
+func (m *Module) Publish(topic string, qos byte, payload []byte) error {
+	return m.publishFn(topic, qos, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// PublishContext
+// DEV: ctxのSpanを親にして送信する (trace_propagationに一致すればTrace Contextも送る)
+func (m *Module) PublishContext(ctx context.Context, topic string, qos byte, payload []byte) error {
+	return m.publish(ctx, topic, qos, false, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// PublishRetained
+// DEV: Retainフラグ付きで送信する (オンライン状態の通知など)
+func (m *Module) PublishRetained(topic string, qos byte, payload []byte) error {
+	return m.publish(context.Background(), topic, qos, true, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// PublishControl
+// DEV: 流量制限を通さずに送信する (SparkplugのBIRTH/DEATHのように、遅れる・捨てられる・順番が変わると困る制御用のメッセージ)
+func (m *Module) PublishControl(topic string, qos byte, retain bool, payload []byte) error {
+	return m.publishControl(topic, qos, retain, payload)
+}
+
 // *--------------------------------------------------------------------------------------
 func (m *Module) publishFn(topic string, qos byte, payload []byte) error {
+	return m.publish(context.Background(), topic, qos, false, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// publishControl
+// DEV: 接続状態の通知など制御用の送信は流量制限を通さない (制限で遅れる・捨てられるのを防ぐ)
+func (m *Module) publishControl(topic string, qos byte, retain bool, payload []byte) (err error) {
+	ctx, span := m.startSpan(context.Background(), SPAN_PUBLISH, trace.SpanKindProducer, topic, qos)
+	defer func() { tracing.End(span, err) }()
+	return m.send(ctx, topic, qos, retain, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+func (m *Module) publish(ctx context.Context, topic string, qos byte, retain bool, payload []byte) (err error) {
+	ctx, span := m.startSpan(ctx, SPAN_PUBLISH, trace.SpanKindProducer, topic, qos)
+	defer func() { tracing.End(span, err) }()
+
 	if qos > 2 {
 		zap.S().Warnf("QoS level %d is not supported, using QoS 0", qos)
 		qos = DEFAULT_QOS
 	}
-	token := m.client.Publish(topic, qos, false, payload)
+	// DEV: 送信制限は圧縮前のサイズで数える
+	action, err := m.throttle(ctx, topic, len(payload))
+	if err != nil {
+		return fmt.Errorf("rate limited publish to %s was cancelled: %w", topic, err)
+	}
+	switch action {
+	case ratelimit.ACTION_DROP:
+		span.SetAttributes(attribute.String("ratelimit.action", action))
+		zap.S().Debugf("Dropped message to %s (rate limited)", topic)
+		return nil
+	case ratelimit.ACTION_SPILL:
+		span.SetAttributes(attribute.String("ratelimit.action", action))
+		return m.spill(ctx, topic, qos, retain, payload)
+	}
+	return m.send(ctx, topic, qos, retain, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// send
+// DEV: 圧縮 -> 暗号化・署名 -> Trace Contextの封筒 の順に包んで送信する
+func (m *Module) send(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	payload = m.compressFor(topic, payload)
+	if m.protect != nil {
+		sealed, err := m.protect.seal(topic, payload)
+		if err != nil {
+			return fmt.Errorf("failed to protect payload for %s: %w", topic, err)
+		}
+		payload = sealed
+	}
+	// DEV: 封筒は最も外側に付ける (受信側は鍵が無くてもTrace Contextを読める)
+	if m.propagatesTrace(topic) {
+		wrapped, err := WrapTrace(tracing.Inject(ctx), payload)
+		if err != nil {
+			return fmt.Errorf("failed to attach trace context for %s: %w", topic, err)
+		}
+		payload = wrapped
+	}
+	token := m.mqttClient().Publish(topic, qos, retain, payload)
 	if token.Wait() && token.Error() != nil {
 		return fmt.Errorf("failed to publish message to topic %s: %w", topic, token.Error())
 	}
@@ -0,0 +1,191 @@
+// module/mqttm/ratelimit.go
+// DEV: ブローカーの送信クォータ超過で切断されないよう、Module全体とトピックのプレフィックス毎に送信を制限する。
+// spillは送信元を止めずに退避キューへ移し、トークンが貯まり次第バックグラウンドで再送する
+package mqttm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_SPILL_SIZE int = 1024
+
+	METRIC_SPILL_OVERFLOW string = "mqttm_spill_overflow_total"
+)
+
+type (
+	// RateLimitConfig limits the publishes of a Module
+	// DEV: 接続状態の通知 (on-line / off-line) など制御用の送信 (PublishControl) は制限しない
+	RateLimitConfig struct {
+		ratelimit.Config                  // Limits of the whole Module
+		Topics           []TopicRateLimit `json:"topics"`     // Limits per topic prefix (first match wins)
+		SpillSize        int              `json:"spill_size"` // Capacity of the queue of spilled publishes (default 1024)
+	}
+
+	// TopicRateLimit limits the publishes to a topic prefix
+	TopicRateLimit struct {
+		Prefix string `json:"prefix"`
+		ratelimit.Config
+	}
+
+	// publishLimits are the resolved limiters of a Module
+	publishLimits struct {
+		module *ratelimit.Limiter
+		topics []topicLimiter
+		spill  chan Contents
+	}
+
+	// topicLimiter is a resolved TopicRateLimit
+	topicLimiter struct {
+		prefix  string
+		limiter *ratelimit.Limiter
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// loadRateLimits
+func loadRateLimits(hostName string, conf *RateLimitConfig) (*publishLimits, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	module, err := ratelimit.New(hostName, conf.Config)
+	if err != nil {
+		return nil, err
+	}
+	limits := &publishLimits{module: module}
+	spill := conf.Action == ratelimit.ACTION_SPILL
+	for _, rule := range conf.Topics {
+		if rule.Prefix == "" {
+			return nil, fmt.Errorf("rate limit topic prefix is required")
+		}
+		limiter, err := ratelimit.New(hostName+":"+rule.Prefix, rule.Config)
+		if err != nil {
+			return nil, err
+		}
+		limits.topics = append(limits.topics, topicLimiter{prefix: rule.Prefix, limiter: limiter})
+		spill = spill || rule.Action == ratelimit.ACTION_SPILL
+	}
+	if spill {
+		size := conf.SpillSize
+		if size <= 0 {
+			size = DEFAULT_SPILL_SIZE
+		}
+		limits.spill = make(chan Contents, size)
+	}
+	return limits, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// limitersFor
+func (l *publishLimits) limitersFor(topic string) []*ratelimit.Limiter {
+	limiters := []*ratelimit.Limiter{l.module}
+	for _, rule := range l.topics {
+		if strings.HasPrefix(topic, rule.prefix) {
+			return append(limiters, rule.limiter)
+		}
+	}
+	return limiters
+}
+
+// *--------------------------------------------------------------------------------------
+// throttle
+// DEV: 通過なら "" を返す。waitの場合はトークンが貯まるまで戻らない
+func (m *Module) throttle(ctx context.Context, topic string, size int) (string, error) {
+	if m.limits == nil {
+		return "", nil
+	}
+	return ratelimit.Take(ctx, size, m.limits.limitersFor(topic)...)
+}
+
+// *--------------------------------------------------------------------------------------
+// spill
+// DEV: 退避キューが一杯の場合は破棄してエラーを返す
+func (m *Module) spill(ctx context.Context, topic string, qos byte, retain bool, payload []byte) error {
+	contents := Contents{
+		Timestamp: time.Now(),
+		Hostname:  m.hostName,
+		Topic:     topic,
+		ClientID:  m.clientID,
+		QoS:       qos,
+		Retained:  retain,
+		Payload:   payload,
+		Trace:     tracing.Inject(ctx),
+	}
+	select {
+	case m.limits.spill <- contents:
+		zap.S().Debugf("Spilled message to %s (rate limited)", topic)
+		return nil
+	default:
+		metrics.Counter(METRIC_SPILL_OVERFLOW, m.hostName).Add(1)
+		return fmt.Errorf("spill queue of %s is full, dropped message to %s", m.hostName, topic)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// spillLoop
+// DEV: 退避したメッセージをトークンが貯まるのを待ってから順に送る
+func (m *Module) spillLoop() {
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+
+		case contents := <-m.limits.spill:
+			if err := m.sendLimited(tracing.Extract(m.ctx, contents.Trace), contents); err != nil {
+				if m.ctx.Err() != nil {
+					zap.S().Warnf("Dropped spilled message to %s on stop", contents.Topic)
+					return
+				}
+				zap.S().Errorf("Failed to publish spilled message: %v", err)
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// drainSpill
+// DEV: 退避キューの残りをctxの期限まで送り、送れなかったものを返す
+func (m *Module) drainSpill(ctx context.Context) (flushed int, pending []Contents) {
+	if m.limits == nil || m.limits.spill == nil {
+		return 0, nil
+	}
+	for {
+		select {
+		case contents := <-m.limits.spill:
+			err := ctx.Err()
+			if err == nil {
+				err = m.sendLimited(tracing.Extract(ctx, contents.Trace), contents)
+			}
+			if err != nil {
+				pending = append(pending, contents)
+				continue
+			}
+			flushed++
+		default:
+			return flushed, pending
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// sendLimited
+// DEV: 超過時の動作に関わらずトークンが貯まるまで待ってから送る (退避したものの再送・停止時の送信)
+func (m *Module) sendLimited(ctx context.Context, contents Contents) (err error) {
+	ctx, span := m.startSpan(ctx, SPAN_PUBLISH, trace.SpanKindProducer, contents.Topic, contents.QoS)
+	defer func() { tracing.End(span, err) }()
+	if m.limits != nil {
+		if err := ratelimit.Wait(ctx, len(contents.Payload), m.limits.limitersFor(contents.Topic)...); err != nil {
+			return fmt.Errorf("rate limited publish to %s was cancelled: %w", contents.Topic, err)
+		}
+	}
+	return m.send(ctx, contents.Topic, contents.QoS, contents.Retained, contents.Payload)
+}
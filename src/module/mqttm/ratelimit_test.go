@@ -0,0 +1,32 @@
+package mqttm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+)
+
+func TestRetainedPublishIsLimited(t *testing.T) {
+	limits, err := loadRateLimits("h", &RateLimitConfig{Config: ratelimit.Config{MessagesPerSec: 0.001, Burst: 1, Action: ratelimit.ACTION_SPILL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Module{hostName: "h", limits: limits}
+	if action, err := m.throttle(context.Background(), "status/h", 1); action != "" || err != nil {
+		t.Fatalf("first publish = %q, %v, want it to pass", action, err)
+	}
+
+	// DEV: Retain付きでも制限され、退避キューではRetainフラグを保持する
+	if err := m.PublishRetained("status/h", 1, []byte("on")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case contents := <-limits.spill:
+		if contents.Topic != "status/h" || !contents.Retained || contents.QoS != 1 {
+			t.Errorf("spilled %+v, want the retained status", contents)
+		}
+	default:
+		t.Fatal("retained publish was not limited")
+	}
+}
@@ -4,16 +4,51 @@ import (
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 )
 
 // *--------------------------------------------------------------------------------------
 func (m *Module) subscribeFn(client MQTT.Client, contents MQTT.Message) {
+	// DEV: Trace Contextの封筒を外し、送信元のSpanを親にして受信のSpanを始める
+	payload := contents.Payload()
+	carrier, unwrapped, err := UnwrapTrace(payload)
+	if err != nil {
+		zap.S().Warnf("Failed to read trace context on %s: %v", contents.Topic(), err)
+	}
+	payload = unwrapped
+	ctx, span := m.startSpan(tracing.Extract(m.ctx, carrier), SPAN_RECEIVE, trace.SpanKindConsumer, contents.Topic(), contents.Qos())
+
+	// DEV: 署名の検証・復号に失敗したものはタスクに渡さない
+	if m.protect != nil {
+		opened, err := m.protect.open(contents.Topic(), payload)
+		if err != nil {
+			zap.S().Warnf("%v", err)
+			metrics.Counter(METRIC_REJECTED, m.hostName).Add(1)
+			tracing.End(span, err)
+			return
+		}
+		payload = opened
+	}
+
+	// DEV: 圧縮ヘッダ付きなら展開する (失敗時は受信したまま渡す)
+	decompressed, compressed, err := Decompress(payload)
+	if err != nil {
+		zap.S().Warnf("Failed to decompress payload on %s: %v", contents.Topic(), err)
+	} else if compressed {
+		zap.S().Debugf("Decompressed payload on %s (%d -> %d bytes)", contents.Topic(), len(payload), len(decompressed))
+		payload = decompressed
+	}
 	m.SubCh <- Contents{
 		Timestamp: time.Now(),
 		Hostname:  m.hostName,
 		Topic:     contents.Topic(),
 		ClientID:  m.clientID,
 		QoS:       contents.Qos(),
-		Payload:   contents.Payload(),
+		Payload:   payload,
+		Trace:     tracing.Inject(ctx),
 	}
+	tracing.End(span, nil)
 }
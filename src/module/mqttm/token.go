@@ -0,0 +1,178 @@
+package mqttm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
+)
+
+const (
+	JWT_RS256 string = "RS256"
+	JWT_ES256 string = "ES256"
+
+	DEFAULT_JWT_USERNAME string = "unused"
+)
+
+// *--------------------------------------------------------------------------------------
+// JWTProvider
+// DEV: デバイスの秘密鍵で署名したJWTをパスワードとして使う
+type JWTProvider struct {
+	Username  string
+	Algorithm string
+	Audience  string
+	Lifetime  time.Duration
+	KeyPEM    func() ([]byte, error)
+}
+
+// *--------------------------------------------------------------------------------------
+// Credentials
+func (p *JWTProvider) Credentials(ctx context.Context) (string, string, error) {
+	keyPEM, err := p.KeyPEM()
+	if err != nil {
+		return "", "", err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return "", "", err
+	}
+	if err := checkSigningKey(p.Algorithm, key); err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": p.Algorithm, "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(p.Lifetime).Unix(),
+		"aud": p.Audience,
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	switch p.Algorithm {
+	case JWT_RS256:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+
+	case JWT_ES256:
+		// DEV: JWSのES256はASN.1ではなく r||s (各32byte) の固定長
+		r, s, signErr := ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if signErr != nil {
+			return "", "", signErr
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	username := p.Username
+	if username == "" {
+		username = DEFAULT_JWT_USERNAME
+	}
+	return username, signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// checkSigningKey
+// DEV: ES256はP-256の鍵のみ (r・sが32byteに収まらない曲線は署名できない)
+func checkSigningKey(algorithm string, key crypto.Signer) error {
+	switch algorithm {
+	case JWT_RS256:
+		if _, ok := key.(*rsa.PrivateKey); !ok {
+			return fmt.Errorf("RS256 requires an RSA private key")
+		}
+	case JWT_ES256:
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return fmt.Errorf("ES256 requires an ECDSA P-256 private key")
+		}
+	default:
+		return fmt.Errorf("unsupported JWT algorithm %q", algorithm)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// SASProvider
+// DEV: 共有鍵のHMAC-SHA256で署名したShared Access Signatureを生成する
+type SASProvider struct {
+	Username    string
+	ResourceURI string
+	KeyName     string
+	Key         secret.Provider
+	Lifetime    time.Duration
+}
+
+// *--------------------------------------------------------------------------------------
+// Credentials
+func (p *SASProvider) Credentials(ctx context.Context) (string, string, error) {
+	encodedKey, err := p.Key.Fetch(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := base64.StdEncoding.DecodeString(string(encodedKey))
+	if err != nil {
+		return "", "", fmt.Errorf("sas key is not base64: %w", err)
+	}
+
+	return p.Username, sasToken(p.ResourceURI, p.KeyName, key, time.Now().Add(p.Lifetime)), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// sasToken
+func sasToken(resourceURI, keyName string, key []byte, expiry time.Time) string {
+	resource := url.QueryEscape(resourceURI)
+	se := strconv.FormatInt(expiry.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(resource + "\n" + se))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	token := fmt.Sprintf("SharedAccessSignature sr=%s&sig=%s&se=%s", resource, url.QueryEscape(signature), se)
+	if keyName != "" {
+		token += "&skn=" + url.QueryEscape(keyName)
+	}
+	return token
+}
+
+// *--------------------------------------------------------------------------------------
+// parsePrivateKey
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key format: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key cannot be used for signing")
+	}
+	return signer, nil
+}
@@ -0,0 +1,176 @@
+package mqttm
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/secret"
+)
+
+func ecKeyPEM(t *testing.T, curve elliptic.Curve) ([]byte, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), key
+}
+
+// splitJWT returns the signing input, the decoded claims and the signature
+func splitJWT(t *testing.T, token string) (string, map[string]interface{}, []byte) {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q does not have 3 parts", token)
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		t.Fatal(err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0] + "." + parts[1], claims, signature
+}
+
+func TestJWTES256Signature(t *testing.T) {
+	keyPEM, key := ecKeyPEM(t, elliptic.P256())
+	p := &JWTProvider{Algorithm: JWT_ES256, Audience: "project", Lifetime: time.Hour, KeyPEM: func() ([]byte, error) { return keyPEM, nil }}
+
+	// DEV: r・sの先頭が0の場合も固定長になることを確認するため繰り返す
+	for i := 0; i < 20; i++ {
+		username, token, err := p.Credentials(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if username != DEFAULT_JWT_USERNAME {
+			t.Errorf("username = %q, want %q", username, DEFAULT_JWT_USERNAME)
+		}
+		input, claims, signature := splitJWT(t, token)
+		if len(signature) != 64 {
+			t.Fatalf("signature is %d bytes, want 64 (r||s)", len(signature))
+		}
+		digest := sha256.Sum256([]byte(input))
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+			t.Fatal("signature does not verify as r||s")
+		}
+		if claims["aud"] != "project" || claims["exp"].(float64)-claims["iat"].(float64) != 3600 {
+			t.Errorf("claims = %v", claims)
+		}
+	}
+}
+
+func TestJWTRS256Signature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	p := &JWTProvider{Algorithm: JWT_RS256, Lifetime: time.Hour, KeyPEM: func() ([]byte, error) { return keyPEM, nil }}
+	_, token, err := p.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	input, _, signature := splitJWT(t, token)
+	digest := sha256.Sum256([]byte(input))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestJWTRejectsWrongKeys(t *testing.T) {
+	p384, _ := ecKeyPEM(t, elliptic.P384())
+	p256, _ := ecKeyPEM(t, elliptic.P256())
+	for _, tc := range []struct {
+		algorithm string
+		keyPEM    []byte
+	}{
+		{JWT_ES256, p384},
+		{JWT_RS256, p256},
+		{"HS256", p256},
+	} {
+		p := &JWTProvider{Algorithm: tc.algorithm, Lifetime: time.Hour, KeyPEM: func() ([]byte, error) { return tc.keyPEM, nil }}
+		if _, _, err := p.Credentials(context.Background()); err == nil {
+			t.Errorf("%s accepted the wrong key", tc.algorithm)
+		}
+
+		// DEV: 起動時 (New) にも検出される
+		path := filepath.Join(t.TempDir(), "key.pem")
+		if err := os.WriteFile(path, tc.keyPEM, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		conf := Config{PrivateKey: path, Auth: &AuthConfig{Type: AUTH_TYPE_JWT, Algorithm: tc.algorithm}}
+		m := &Module{ctx: context.Background(), conf: conf, creds: &credentials{}}
+		if _, err := m.newAuthProvider(conf); err == nil {
+			t.Errorf("%s auth was set up with the wrong key", tc.algorithm)
+		}
+	}
+}
+
+func TestSASTokenKnownVector(t *testing.T) {
+	// DEV: 期待値はPythonのhmac/hashlib/urllib.parse.quote_plusで独立に計算したもの
+	token := sasToken("myhub.azure-devices.net/devices/device01", "device", []byte("0123456789abcdef0123456789abcdef"), time.Unix(1700000000, 0))
+	want := "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fdevice01&sig=JTuj3EhGCuJl%2B7IwUUf%2Fc%2BhhePPlxEbsX43DYAyjj0U%3D&se=1700000000&skn=device"
+	if token != want {
+		t.Errorf("token =\n%s\nwant\n%s", token, want)
+	}
+}
+
+func TestSASProviderReadsKeySecret(t *testing.T) {
+	t.Setenv("SAS_TEST_KEY", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	key, err := secret.Parse("env:SAS_TEST_KEY", secret.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &SASProvider{Username: "device01", ResourceURI: "myhub.azure-devices.net/devices/device01", Key: key, Lifetime: time.Hour}
+	username, token, err := p.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username != "device01" || !strings.HasPrefix(token, "SharedAccessSignature sr=myhub.azure-devices.net%2Fdevices%2Fdevice01&sig=") {
+		t.Errorf("credentials = %q, %q", username, token)
+	}
+
+	t.Setenv("SAS_TEST_KEY", "not base64!")
+	if _, _, err := p.Credentials(context.Background()); err == nil {
+		t.Error("key that is not base64 was accepted")
+	}
+}
+
+func TestProvideCredentialsFallsBack(t *testing.T) {
+	m := &Module{ctx: context.Background(), creds: &credentials{username: "user", password: "pass"}}
+	m.SetAuthProvider(&JWTProvider{Algorithm: JWT_ES256, KeyPEM: func() ([]byte, error) { return nil, os.ErrNotExist }})
+	if username, password := m.provideCredentials(); username != "user" || password != "pass" {
+		t.Errorf("credentials = %q, %q, want the static ones", username, password)
+	}
+
+	m.creds.password = ""
+	if username, password := m.provideCredentials(); username != "" || password != "" {
+		t.Errorf("credentials = %q, %q, want none without a password", username, password)
+	}
+}
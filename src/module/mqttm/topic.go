@@ -0,0 +1,52 @@
+package mqttm
+
+import "strings"
+
+// *--------------------------------------------------------------------------------------
+// MatchTopic
+// DEV: MQTT 3.1.1のワイルドカード ('+' / '#') でトピック名を照合する
+func MatchTopic(filter, topic string) bool {
+	// DEV: '$'で始まるトピックは先頭のワイルドカードに一致させない
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// *--------------------------------------------------------------------------------------
+// ValidTopicFilter
+func ValidTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// ValidTopicName
+func ValidTopicName(topic string) bool {
+	return topic != "" && !strings.ContainsAny(topic, "+#")
+}
@@ -0,0 +1,109 @@
+// module/mqttm/trace.go
+// DEV: MQTT 3.1.1にはUser Propertyが無いため、W3C Trace Contextはペイロードの前に封筒として付ける
+//
+//	envelope : 0x00 'M' 'T' + header length(2byte, big endian) + header(JSON: traceparent / tracestate) + payload
+package mqttm
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SPAN_PUBLISH string = "mqtt publish"
+	SPAN_RECEIVE string = "mqtt receive"
+
+	MAX_TRACE_HEADER_SIZE int = 0xFFFF
+)
+
+var (
+	traceMagic = []byte{0x00, 'M', 'T'}
+)
+
+// *--------------------------------------------------------------------------------------
+// validateTracePropagation
+func validateTracePropagation(filters []string) error {
+	for _, filter := range filters {
+		if !ValidTopicFilter(filter) {
+			return fmt.Errorf("invalid trace propagation topic filter %q", filter)
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// WrapTrace
+// DEV: carrierが空ならペイロードをそのまま返す
+func WrapTrace(carrier map[string]string, payload []byte) ([]byte, error) {
+	if len(carrier) == 0 {
+		return payload, nil
+	}
+	header, err := json.Marshal(carrier)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) > MAX_TRACE_HEADER_SIZE {
+		return nil, fmt.Errorf("trace header is too large (%d bytes)", len(header))
+	}
+	wrapped := make([]byte, 0, len(traceMagic)+2+len(header)+len(payload))
+	wrapped = append(wrapped, traceMagic...)
+	wrapped = binary.BigEndian.AppendUint16(wrapped, uint16(len(header)))
+	wrapped = append(wrapped, header...)
+	return append(wrapped, payload...), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// UnwrapTrace
+// DEV: 封筒が無ければ (nil, payload, nil) を返す
+func UnwrapTrace(payload []byte) (map[string]string, []byte, error) {
+	if !bytes.HasPrefix(payload, traceMagic) {
+		return nil, payload, nil
+	}
+	rest := payload[len(traceMagic):]
+	if len(rest) < 2 {
+		return nil, payload, fmt.Errorf("truncated trace envelope")
+	}
+	size := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+size {
+		return nil, payload, fmt.Errorf("truncated trace envelope header")
+	}
+	carrier := map[string]string{}
+	if err := json.Unmarshal(rest[2:2+size], &carrier); err != nil {
+		return nil, payload, fmt.Errorf("invalid trace envelope header: %w", err)
+	}
+	return carrier, rest[2+size:], nil
+}
+
+// *--------------------------------------------------------------------------------------
+// propagatesTrace
+func (m *Module) propagatesTrace(topic string) bool {
+	for _, filter := range m.conf.TracePropagation {
+		if MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// startSpan
+// DEV: publish = Producer / receive = Consumer のSpanを作る
+func (m *Module) startSpan(ctx context.Context, name string, kind trace.SpanKind, topic string, qos byte) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.String("messaging.client.id", m.clientID),
+			attribute.Int("messaging.mqtt.qos", int(qos)),
+			attribute.String("mqtt.host", m.hostName),
+		),
+	)
+}
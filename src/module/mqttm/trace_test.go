@@ -0,0 +1,55 @@
+package mqttm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTraceEnvelopeRoundTrip(t *testing.T) {
+	carrier := map[string]string{
+		"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"tracestate":  "vendor=value",
+	}
+	payload := []byte(`{"temp": 21.5}`)
+	wrapped, err := WrapTrace(carrier, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, body, err := UnwrapTrace(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, payload) {
+		t.Errorf("body = %q, want %q", body, payload)
+	}
+	for key, value := range carrier {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestTraceEnvelopeEmptyCarrier(t *testing.T) {
+	payload := []byte("raw")
+	wrapped, err := WrapTrace(nil, payload)
+	if err != nil || !bytes.Equal(wrapped, payload) {
+		t.Fatalf("WrapTrace(nil) = %q, %v, want the payload unchanged", wrapped, err)
+	}
+}
+
+func TestTraceEnvelopeMissing(t *testing.T) {
+	payload := []byte("raw")
+	carrier, body, err := UnwrapTrace(payload)
+	if carrier != nil || err != nil || !bytes.Equal(body, payload) {
+		t.Fatalf("UnwrapTrace = %v, %q, %v, want the payload unchanged", carrier, body, err)
+	}
+}
+
+func TestTraceEnvelopeTruncated(t *testing.T) {
+	wrapped, _ := WrapTrace(map[string]string{"traceparent": "x"}, []byte("raw"))
+	for _, cut := range []int{len(traceMagic) + 1, len(traceMagic) + 4} {
+		if _, _, err := UnwrapTrace(wrapped[:cut]); err == nil {
+			t.Errorf("UnwrapTrace of %d bytes succeeded, want an error", cut)
+		}
+	}
+}
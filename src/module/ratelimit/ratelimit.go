@@ -0,0 +1,239 @@
+// module/ratelimit/ratelimit.go
+// DEV: メッセージ数/秒とバイト数/秒のトークンバケット。超過時の動作は wait / drop / spill から選ぶ
+//
+//	wait  : トークンが貯まるまで待つ (呼び出し元を止めて流量を抑える)
+//	drop  : 破棄する
+//	spill : 呼び出し元の退避先 (Dead-letterなど) に渡す
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+)
+
+const (
+	ACTION_WAIT  string = "wait"
+	ACTION_DROP  string = "drop"
+	ACTION_SPILL string = "spill"
+
+	METRIC_WAITS   string = "ratelimit_waits_total"
+	METRIC_WAIT_MS string = "ratelimit_wait_ms_total"
+	METRIC_DROPS   string = "ratelimit_drops_total"
+	METRIC_SPILLS  string = "ratelimit_spills_total"
+)
+
+type (
+	// Config holds the limits of one token bucket pair
+	Config struct {
+		MessagesPerSec float64 `json:"messages_per_sec"` // 0 = unlimited
+		BytesPerSec    float64 `json:"bytes_per_sec"`    // 0 = unlimited
+		Burst          int     `json:"burst"`            // Messages allowed at once (default = messages_per_sec, at least 1)
+		BurstBytes     int     `json:"burst_bytes"`      // Bytes allowed at once (default = bytes_per_sec)
+		Action         string  `json:"action"`           // wait / drop / spill (default wait)
+	}
+
+	// Limiter limits messages and bytes with a token bucket each
+	Limiter struct {
+		name     string
+		action   string
+		messages *bucket
+		bytes    *bucket
+	}
+
+	// bucket is a token bucket that may be reserved in advance (tokens below zero)
+	bucket struct {
+		mu     sync.Mutex
+		rate   float64
+		burst  float64
+		tokens float64
+		last   time.Time
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Enabled
+func (conf Config) Enabled() bool {
+	return conf.MessagesPerSec > 0 || conf.BytesPerSec > 0
+}
+
+// *--------------------------------------------------------------------------------------
+// New (constructor)
+// DEV: 制限が無い場合はnilを返す (nilのLimiterは常に通す)
+func New(name string, conf Config) (*Limiter, error) {
+	switch conf.Action {
+	case "":
+		conf.Action = ACTION_WAIT
+	case ACTION_WAIT, ACTION_DROP, ACTION_SPILL:
+	default:
+		return nil, fmt.Errorf("unknown rate limit action %q", conf.Action)
+	}
+	if conf.MessagesPerSec < 0 || conf.BytesPerSec < 0 {
+		return nil, fmt.Errorf("rate limit of %s must not be negative", name)
+	}
+	if !conf.Enabled() {
+		return nil, nil
+	}
+	l := &Limiter{name: name, action: conf.Action}
+	if conf.MessagesPerSec > 0 {
+		burst := conf.Burst
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(conf.MessagesPerSec)))
+		}
+		l.messages = newBucket(conf.MessagesPerSec, burst)
+	}
+	if conf.BytesPerSec > 0 {
+		burst := conf.BurstBytes
+		if burst <= 0 {
+			burst = max(1, int(math.Ceil(conf.BytesPerSec)))
+		}
+		l.bytes = newBucket(conf.BytesPerSec, burst)
+	}
+	return l, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Name
+func (l *Limiter) Name() string {
+	return l.name
+}
+
+// *--------------------------------------------------------------------------------------
+// Action
+func (l *Limiter) Action() string {
+	return l.action
+}
+
+// *--------------------------------------------------------------------------------------
+// Take
+// DEV: 全てのLimiterから1メッセージ (sizeバイト) 分を取る。通過なら "" を、拒否した場合はその動作 (drop / spill) を返す。
+// drop・spillのLimiterが1つでも超過していれば全て取り消す。waitのみの超過なら最も長い待ち時間だけ待つ
+func Take(ctx context.Context, size int, limiters ...*Limiter) (string, error) {
+	return take(ctx, size, false, limiters)
+}
+
+// *--------------------------------------------------------------------------------------
+// Wait
+// DEV: 動作の設定に関わらず、全てのLimiterのトークンが貯まるまで待つ (退避したものの再送など)
+func Wait(ctx context.Context, size int, limiters ...*Limiter) error {
+	_, err := take(ctx, size, true, limiters)
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// take
+func take(ctx context.Context, size int, wait bool, limiters []*Limiter) (string, error) {
+	now := time.Now()
+	var delay time.Duration
+	var refused *Limiter
+	taken := make([]*Limiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		d := l.reserve(now, size)
+		taken = append(taken, l)
+		if d <= 0 {
+			continue
+		}
+		if !wait && l.action != ACTION_WAIT && refused == nil {
+			refused = l
+		}
+		delay = max(delay, d)
+	}
+	if refused != nil {
+		for _, l := range taken {
+			l.cancel(size)
+		}
+		if refused.action == ACTION_DROP {
+			metrics.Counter(METRIC_DROPS, refused.name).Add(1)
+		} else {
+			metrics.Counter(METRIC_SPILLS, refused.name).Add(1)
+		}
+		return refused.action, nil
+	}
+	if delay <= 0 {
+		return "", nil
+	}
+
+	for _, l := range taken {
+		metrics.Counter(METRIC_WAITS, l.name).Add(1)
+		metrics.Counter(METRIC_WAIT_MS, l.name).Add(delay.Milliseconds())
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return "", nil
+	case <-ctx.Done():
+		for _, l := range taken {
+			l.cancel(size)
+		}
+		return "", ctx.Err()
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// reserve
+func (l *Limiter) reserve(now time.Time, size int) time.Duration {
+	var delay time.Duration
+	if l.messages != nil {
+		delay = max(delay, l.messages.reserve(now, 1))
+	}
+	if l.bytes != nil && size > 0 {
+		delay = max(delay, l.bytes.reserve(now, float64(size)))
+	}
+	return delay
+}
+
+// *--------------------------------------------------------------------------------------
+// cancel
+func (l *Limiter) cancel(size int) {
+	if l.messages != nil {
+		l.messages.cancel(1)
+	}
+	if l.bytes != nil && size > 0 {
+		l.bytes.cancel(float64(size))
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// newBucket (constructor)
+// DEV: 満タンの状態で始める
+func newBucket(rate float64, burst int) *bucket {
+	return &bucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// reserve
+// DEV: n個を先取りし、トークンが0以上に戻るまでの時間を返す (burstを超えるnは待てば通る)
+func (b *bucket) reserve(now time.Time, n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// *--------------------------------------------------------------------------------------
+// cancel
+func (b *bucket) cancel(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+n)
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func newLimiter(t *testing.T, name string, conf Config) *Limiter {
+	t.Helper()
+	l, err := New(name, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestTakeWithinBurst(t *testing.T) {
+	l := newLimiter(t, "burst", Config{MessagesPerSec: 1, Burst: 3, Action: ACTION_DROP})
+	for i := 0; i < 3; i++ {
+		if action, err := take(context.Background(), 0, false, []*Limiter{l}); action != "" || err != nil {
+			t.Fatalf("take #%d = %q, %v, want pass", i, action, err)
+		}
+	}
+	if action, _ := take(context.Background(), 0, false, []*Limiter{l}); action != ACTION_DROP {
+		t.Fatalf("take over burst = %q, want %q", action, ACTION_DROP)
+	}
+}
+
+func TestTakeNilLimiterPasses(t *testing.T) {
+	if action, err := take(context.Background(), 100, false, []*Limiter{nil}); action != "" || err != nil {
+		t.Fatalf("take = %q, %v, want pass", action, err)
+	}
+}
+
+func TestTakeRefusalCancelsOtherLimiters(t *testing.T) {
+	module := newLimiter(t, "module", Config{MessagesPerSec: 1, Burst: 1})
+	topic := newLimiter(t, "topic", Config{MessagesPerSec: 1, Burst: 1, Action: ACTION_SPILL})
+	if action, _ := take(context.Background(), 0, false, []*Limiter{module, topic}); action != "" {
+		t.Fatalf("first take = %q, want pass", action)
+	}
+	if action, _ := take(context.Background(), 0, false, []*Limiter{topic}); action != ACTION_SPILL {
+		t.Fatalf("take on empty topic limiter = %q, want %q", action, ACTION_SPILL)
+	}
+
+	// DEV: spillで拒否された分はmoduleのトークンも返す
+	other := newLimiter(t, "other", Config{MessagesPerSec: 1, Burst: 1})
+	if action, _ := take(context.Background(), 0, false, []*Limiter{other, topic}); action != ACTION_SPILL {
+		t.Fatalf("take = %q, want %q", action, ACTION_SPILL)
+	}
+	if delay := other.reserve(time.Now(), 0); delay > 0 {
+		t.Fatalf("refused take kept a token of the other limiter (delay %v)", delay)
+	}
+}
+
+func TestTakeWaits(t *testing.T) {
+	l := newLimiter(t, "wait", Config{MessagesPerSec: 20, Burst: 1})
+	take(context.Background(), 0, false, []*Limiter{l})
+	started := time.Now()
+	if action, err := take(context.Background(), 0, false, []*Limiter{l}); action != "" || err != nil {
+		t.Fatalf("take = %q, %v, want pass after waiting", action, err)
+	}
+	if waited := time.Since(started); waited < 30*time.Millisecond {
+		t.Fatalf("waited %v, want about 50ms", waited)
+	}
+}
+
+func TestTakeWaitCancelled(t *testing.T) {
+	l := newLimiter(t, "cancel", Config{MessagesPerSec: 1, Burst: 1})
+	take(context.Background(), 0, false, []*Limiter{l})
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := take(ctx, 0, false, []*Limiter{l}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("take = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// DEV: キャンセルした分のトークンは返される (1つ目の分だけ待てばよい)
+	if delay := l.reserve(time.Now(), 0); delay > time.Second {
+		t.Fatalf("cancelled take kept its token (delay %v)", delay)
+	}
+}
+
+func TestTakeBytes(t *testing.T) {
+	l := newLimiter(t, "bytes", Config{BytesPerSec: 100, BurstBytes: 100, Action: ACTION_DROP})
+	if action, _ := take(context.Background(), 80, false, []*Limiter{l}); action != "" {
+		t.Fatalf("take 80 bytes = %q, want pass", action)
+	}
+	if action, _ := take(context.Background(), 80, false, []*Limiter{l}); action != ACTION_DROP {
+		t.Fatalf("take 160 bytes = %q, want %q", action, ACTION_DROP)
+	}
+}
+
+func TestWaitIgnoresAction(t *testing.T) {
+	l := newLimiter(t, "force", Config{MessagesPerSec: 50, Burst: 1, Action: ACTION_DROP})
+	take(context.Background(), 0, false, []*Limiter{l})
+	if err := Wait(context.Background(), 0, l); err != nil {
+		t.Fatalf("Wait = %v, want nil", err)
+	}
+}
@@ -0,0 +1,136 @@
+package secret
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// *--------------------------------------------------------------------------------------
+// EncryptedFileProvider
+// DEV: Keyringファイルの鍵で暗号化されたファイルを復号する
+//
+//	keyring file : "<key-id> <base64 AES key>" per line ('#' starts a comment)
+//	secret file  : "<key-id>:<base64 nonce||ciphertext>" (AES-GCM)
+type EncryptedFileProvider struct {
+	Path    string
+	Keyring string
+}
+
+// *--------------------------------------------------------------------------------------
+// Fetch
+func (p *EncryptedFileProvider) Fetch(ctx context.Context) ([]byte, error) {
+	keys, err := LoadKeyring(p.Keyring)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readPrivateFile(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(keys, data)
+}
+
+// *--------------------------------------------------------------------------------------
+// String
+func (p *EncryptedFileProvider) String() string {
+	return SCHEME_ENC + ":" + p.Path
+}
+
+// *--------------------------------------------------------------------------------------
+// LoadKeyring
+func LoadKeyring(path string) (map[string][]byte, error) {
+	data, err := readPrivateFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	keys := make(map[string][]byte)
+	scan := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scan.Scan(); line++ {
+		text := strings.TrimSpace(scan.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyring %s line %d: expected \"<key-id> <base64 key>\"", path, line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("keyring %s line %d: %w", path, line, err)
+		}
+		if l := len(key); l != 16 && l != 24 && l != 32 {
+			return nil, fmt.Errorf("keyring %s line %d: invalid AES key length %d", path, line, l)
+		}
+		keys[fields[0]] = key
+	}
+	return keys, scan.Err()
+}
+
+// *--------------------------------------------------------------------------------------
+// Encrypt
+// DEV: Decryptで読めるシークレットファイルの内容を生成する (ツール用)
+func Encrypt(keys map[string][]byte, keyID string, plaintext []byte) ([]byte, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in keyring", keyID)
+	}
+	aead, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(keyID))
+	return []byte(keyID + ":" + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Decrypt
+func Decrypt(keys map[string][]byte, data []byte) ([]byte, error) {
+	keyID, encoded, ok := strings.Cut(strings.TrimSpace(string(data)), ":")
+	if !ok {
+		return nil, fmt.Errorf("encrypted secret is missing the key id")
+	}
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key %s not found in keyring", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted secret is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret with key %s: %w", keyID, err)
+	}
+	return plaintext, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// NewGCM
+// DEV: Keyringの鍵でAES-GCMを作る (mqttmのペイロード暗号化でも使う)
+func NewGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,71 @@
+package secret
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+)
+
+// *--------------------------------------------------------------------------------------
+// EnvProvider
+type EnvProvider struct {
+	Name string
+}
+
+// *--------------------------------------------------------------------------------------
+// Fetch
+func (p *EnvProvider) Fetch(ctx context.Context) ([]byte, error) {
+	value, ok := os.LookupEnv(p.Name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", p.Name)
+	}
+	return []byte(value), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// String
+func (p *EnvProvider) String() string {
+	return SCHEME_ENV + ":" + p.Name
+}
+
+// *--------------------------------------------------------------------------------------
+// FileProvider
+// DEV: グループ・その他ユーザーから読めるファイルは拒否する
+type FileProvider struct {
+	Path string
+}
+
+// *--------------------------------------------------------------------------------------
+// Fetch
+func (p *FileProvider) Fetch(ctx context.Context) ([]byte, error) {
+	return readPrivateFile(p.Path)
+}
+
+// *--------------------------------------------------------------------------------------
+// String
+func (p *FileProvider) String() string {
+	return SCHEME_FILE + ":" + p.Path
+}
+
+// *--------------------------------------------------------------------------------------
+// readPrivateFile
+func readPrivateFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return nil, fmt.Errorf("%s has insecure permissions %#o, expected 0600 or stricter", path, perm)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// DEV: エディタ等が付与する末尾の改行を取り除く
+	return bytes.TrimRight(data, "\r\n"), nil
+}
@@ -0,0 +1,158 @@
+// module/secret/provider.go
+// DEV: 認証情報・鍵などの秘密情報の取得元を抽象化する
+package secret
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	SCHEME_ENV   string = "env"   // env:NAME
+	SCHEME_FILE  string = "file"  // file:/path/to/secret
+	SCHEME_ENC   string = "enc"   // enc:/path/to/secret.enc
+	SCHEME_VAULT string = "vault" // vault:secret/data/mqtt#password
+
+	DEFAULT_REFRESH_SEC int = 300
+)
+
+type (
+	// Provider is a source of a single secret value
+	Provider interface {
+		Fetch(ctx context.Context) ([]byte, error)
+		String() string // Secret識別子 (値は含めない)
+	}
+
+	// Config holds the settings shared by the providers
+	Config struct {
+		Keyring string      `json:"keyring"` // Keyring file used by "enc:" references
+		Vault   VaultConfig `json:"vault"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Parse
+// DEV: "scheme:value" 形式の参照文字列からProviderを生成する
+func Parse(ref string, conf Config) (Provider, error) {
+	scheme, value, ok := strings.Cut(ref, ":")
+	if !ok || value == "" {
+		return nil, fmt.Errorf("invalid secret reference %q: expected scheme:value", ref)
+	}
+
+	switch scheme {
+	case SCHEME_ENV:
+		return &EnvProvider{Name: value}, nil
+	case SCHEME_FILE:
+		return &FileProvider{Path: value}, nil
+	case SCHEME_ENC:
+		if conf.Keyring == "" {
+			return nil, fmt.Errorf("secret reference %q requires a keyring", ref)
+		}
+		return &EncryptedFileProvider{Path: value, Keyring: conf.Keyring}, nil
+	case SCHEME_VAULT:
+		path, field, _ := strings.Cut(value, "#")
+		return NewVaultProvider(conf.Vault, path, field)
+	default:
+		return nil, fmt.Errorf("unsupported secret scheme %q", scheme)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Watcher
+// DEV: 複数のProviderを定期的に再取得し、値が変わった場合に通知する
+type Watcher struct {
+	providers map[string]Provider
+	interval  time.Duration
+	onChange  func(values map[string][]byte)
+
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+// *--------------------------------------------------------------------------------------
+// NewWatcher (constructor)
+func NewWatcher(providers map[string]Provider, interval time.Duration, onChange func(values map[string][]byte)) *Watcher {
+	if interval <= 0 {
+		interval = time.Duration(DEFAULT_REFRESH_SEC) * time.Second
+	}
+	return &Watcher{
+		providers: providers,
+		interval:  interval,
+		onChange:  onChange,
+		values:    make(map[string][]byte),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Load
+// DEV: 全てのProviderから値を取得する (初回読み込み用)
+func (w *Watcher) Load(ctx context.Context) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(w.providers))
+	for name, provider := range w.providers {
+		value, err := provider.Fetch(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load secret %s from %s: %w", name, provider.String(), err)
+		}
+		values[name] = value
+	}
+
+	w.mu.Lock()
+	w.values = values
+	w.mu.Unlock()
+	return values, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Run
+// DEV: ctxが終了するまで定期的に再取得する
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			w.refresh(ctx)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// refresh
+func (w *Watcher) refresh(ctx context.Context) {
+	values := make(map[string][]byte, len(w.providers))
+	for name, provider := range w.providers {
+		value, err := provider.Fetch(ctx)
+		if err != nil {
+			// DEV: 取得に失敗した場合は前回の値を維持する
+			zap.S().Warnf("Failed to refresh secret %s from %s: %v", name, provider.String(), err)
+			return
+		}
+		values[name] = value
+	}
+
+	w.mu.Lock()
+	changed := len(values) != len(w.values)
+	for name, value := range values {
+		if !bytes.Equal(w.values[name], value) {
+			changed = true
+		}
+	}
+	if changed {
+		w.values = values
+	}
+	w.mu.Unlock()
+
+	if changed && w.onChange != nil {
+		zap.S().Infof("Secrets have been rotated")
+		w.onChange(values)
+	}
+}
@@ -0,0 +1,159 @@
+package secret
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	// DEV: umaskの影響を受けないように明示的に設定する
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func fetch(t *testing.T, ref string, conf Config) ([]byte, error) {
+	t.Helper()
+	provider, err := Parse(ref, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider.Fetch(context.Background())
+}
+
+func TestParseRejectsInvalidReferences(t *testing.T) {
+	for _, ref := range []string{"password", "file:", "ftp:/etc/passwd", "enc:/secret.enc", "vault:secret/mqtt"} {
+		if _, err := Parse(ref, Config{}); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", ref)
+		}
+	}
+}
+
+func TestFileRejectsReadableByOthers(t *testing.T) {
+	for _, perm := range []os.FileMode{0o640, 0o604, 0o644, 0o660} {
+		path := writeFile(t, "password", "s3cret", perm)
+		if _, err := fetch(t, "file:"+path, Config{}); err == nil || !strings.Contains(err.Error(), "insecure permissions") {
+			t.Errorf("perm %#o: err = %v, want insecure permissions", perm, err)
+		}
+	}
+
+	path := writeFile(t, "password", "s3cret\n", 0o600)
+	value, err := fetch(t, "file:"+path, Config{})
+	if err != nil || string(value) != "s3cret" {
+		t.Errorf("fetch = %q, %v, want s3cret", value, err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("SECRET_TEST_PASSWORD", "from-env")
+	if value, err := fetch(t, "env:SECRET_TEST_PASSWORD", Config{}); err != nil || string(value) != "from-env" {
+		t.Errorf("fetch = %q, %v", value, err)
+	}
+	if _, err := fetch(t, "env:SECRET_TEST_UNSET", Config{}); err == nil {
+		t.Error("unset variable was accepted")
+	}
+}
+
+func TestEncryptedFileRoundTrip(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	keyring := writeFile(t, "keyring", "# keys\nk1 "+key+"\n", 0o600)
+	keys, err := LoadKeyring(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := Encrypt(keys, "k1", []byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeFile(t, "password.enc", string(sealed), 0o600)
+
+	value, err := fetch(t, "enc:"+path, Config{Keyring: keyring})
+	if err != nil || string(value) != "s3cret" {
+		t.Fatalf("fetch = %q, %v, want s3cret", value, err)
+	}
+
+	// DEV: 鍵IDは認証データに含まれるため書き換えると復号できない
+	keys["k2"] = keys["k1"]
+	tampered := "k2" + strings.TrimPrefix(string(sealed), "k1")
+	if _, err := Decrypt(keys, []byte(tampered)); err == nil {
+		t.Error("secret relabelled with another key id was decrypted")
+	}
+
+	insecure := writeFile(t, "keyring", "k1 "+key+"\n", 0o644)
+	if _, err := fetch(t, "enc:"+path, Config{Keyring: insecure}); err == nil {
+		t.Error("keyring readable by others was accepted")
+	}
+}
+
+func TestLoadKeyringRejectsBadKeys(t *testing.T) {
+	for _, content := range []string{
+		"k1",
+		"k1 not-base64!",
+		"k1 " + base64.StdEncoding.EncodeToString(make([]byte, 20)),
+	} {
+		if _, err := LoadKeyring(writeFile(t, "keyring", content, 0o600)); err == nil {
+			t.Errorf("keyring %q was accepted", content)
+		}
+	}
+}
+
+func TestVaultKV(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/mqtt":
+			w.Write([]byte(`{"data":{"data":{"password":"v2"}}}`))
+		case "/v1/kv/mqtt":
+			w.Write([]byte(`{"data":{"value":"v1"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	conf := Config{Vault: VaultConfig{Address: server.URL, TokenFile: writeFile(t, "token", "token", 0o600)}}
+
+	for ref, want := range map[string]string{"vault:secret/data/mqtt#password": "v2", "vault:kv/mqtt": "v1"} {
+		if value, err := fetch(t, ref, conf); err != nil || string(value) != want {
+			t.Errorf("%s = %q, %v, want %s", ref, value, err, want)
+		}
+	}
+	if _, err := fetch(t, "vault:secret/data/mqtt#missing", conf); err == nil {
+		t.Error("missing field was accepted")
+	}
+}
+
+func TestWatcherNotifiesOnChange(t *testing.T) {
+	path := writeFile(t, "password", "one", 0o600)
+	provider, _ := Parse("file:"+path, Config{})
+	var notified []string
+	w := NewWatcher(map[string]Provider{"password": provider}, 0, func(values map[string][]byte) {
+		notified = append(notified, string(values["password"]))
+	})
+	if _, err := w.Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	w.refresh(context.Background())
+	if err := os.WriteFile(path, []byte("two"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w.refresh(context.Background())
+	if len(notified) != 1 || notified[0] != "two" {
+		t.Errorf("notified = %v, want only the rotated value", notified)
+	}
+}
@@ -0,0 +1,124 @@
+package secret
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	VAULT_TOKEN_ENV     string = "VAULT_TOKEN"
+	DEFAULT_VAULT_FIELD string = "value"
+	VAULT_TIMEOUT_SEC   int    = 10
+)
+
+type (
+	// VaultConfig holds the settings of a Vault compatible HTTP endpoint
+	VaultConfig struct {
+		Address   string `json:"address"`    // e.g. http://127.0.0.1:8200
+		TokenFile string `json:"token_file"` // Token file (falls back to $VAULT_TOKEN)
+	}
+
+	// VaultProvider reads a field of a KV (v1 or v2) secret
+	VaultProvider struct {
+		conf   VaultConfig
+		path   string
+		field  string
+		client *http.Client
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewVaultProvider (constructor)
+func NewVaultProvider(conf VaultConfig, path, field string) (*VaultProvider, error) {
+	if conf.Address == "" {
+		return nil, fmt.Errorf("vault address is required for secret %s", path)
+	}
+	if field == "" {
+		field = DEFAULT_VAULT_FIELD
+	}
+	return &VaultProvider{
+		conf:   conf,
+		path:   strings.Trim(path, "/"),
+		field:  field,
+		client: &http.Client{Timeout: time.Duration(VAULT_TIMEOUT_SEC) * time.Second},
+	}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Fetch
+func (p *VaultProvider) Fetch(ctx context.Context) ([]byte, error) {
+	token, err := p.token()
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := url.JoinPath(p.conf.Address, "v1", p.path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %s for %s", resp.Status, p.path)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode vault response: %w", err)
+	}
+
+	// DEV: KV v2 は data.data に、KV v1 は data に値が入る
+	data := body.Data
+	if nested, ok := body.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return nil, fmt.Errorf("failed to decode vault kv v2 data: %w", err)
+		}
+	}
+	raw, ok := data[p.field]
+	if !ok {
+		return nil, fmt.Errorf("field %s not found in vault secret %s", p.field, p.path)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("field %s of vault secret %s is not a string", p.field, p.path)
+	}
+	return []byte(value), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// String
+func (p *VaultProvider) String() string {
+	return SCHEME_VAULT + ":" + p.path + "#" + p.field
+}
+
+// *--------------------------------------------------------------------------------------
+// token
+func (p *VaultProvider) token() (string, error) {
+	if p.conf.TokenFile != "" {
+		token, err := readPrivateFile(p.conf.TokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read vault token: %w", err)
+		}
+		return string(token), nil
+	}
+	if token := os.Getenv(VAULT_TOKEN_ENV); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("vault token is not configured (token_file or $%s)", VAULT_TOKEN_ENV)
+}
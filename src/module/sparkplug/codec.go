@@ -0,0 +1,85 @@
+package sparkplug
+
+import (
+	"fmt"
+)
+
+const (
+	CODEC_SPARKPLUG string = "sparkplug"
+	CONTENT_TYPE    string = "application/x-sparkplug-b"
+)
+
+// Codec converts Sparkplug B payloads for the codec registry
+// DEV: codec.Codecを満たす (registry.Register(sparkplug.Codec{}) で登録する)
+type Codec struct{}
+
+// *--------------------------------------------------------------------------------------
+// Name
+func (Codec) Name() string { return CODEC_SPARKPLUG }
+
+// *--------------------------------------------------------------------------------------
+// ContentType
+func (Codec) ContentType() string { return CONTENT_TYPE }
+
+// *--------------------------------------------------------------------------------------
+// Decode
+// DEV: JSONと同じ形 (map[string]interface{}) にする
+func (Codec) Decode(data []byte) (interface{}, error) {
+	payload, err := Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return payload.Map(), nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Encode
+func (Codec) Encode(v interface{}) ([]byte, error) {
+	switch p := v.(type) {
+	case *Payload:
+		return p.Marshal()
+	case Payload:
+		return p.Marshal()
+	}
+	return nil, fmt.Errorf("sparkplug codec cannot encode %T", v)
+}
+
+// *--------------------------------------------------------------------------------------
+// Map
+func (p *Payload) Map() map[string]interface{} {
+	metrics := make([]interface{}, 0, len(p.Metrics))
+	for _, metric := range p.Metrics {
+		m := map[string]interface{}{
+			"name":     metric.Name,
+			"datatype": metric.DataType.String(),
+			"value":    metric.Value,
+		}
+		if metric.Alias != nil {
+			m["alias"] = *metric.Alias
+		}
+		if metric.Timestamp != 0 {
+			m["timestamp"] = metric.Timestamp
+		}
+		if metric.IsNull {
+			m["is_null"] = true
+		}
+		if metric.IsHistorical {
+			m["is_historical"] = true
+		}
+		metrics = append(metrics, m)
+	}
+	value := map[string]interface{}{
+		"timestamp": p.Timestamp,
+		"metrics":   metrics,
+	}
+	if p.Seq != nil {
+		value["seq"] = *p.Seq
+	}
+	if p.UUID != "" {
+		value["uuid"] = p.UUID
+	}
+	if p.Body != nil {
+		value["body"] = p.Body
+	}
+	return value
+}
@@ -0,0 +1,404 @@
+package sparkplug
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	SEQ_MODULO uint64 = 256
+	CMD_QOS    byte   = 1
+	DEATH_QOS  byte   = 1
+)
+
+type (
+	// EdgeConfig holds the Edge Node identity
+	EdgeConfig struct {
+		GroupID    string `json:"group_id"`
+		EdgeNodeID string `json:"edge_node_id"`
+		UseAliases bool   `json:"use_aliases"` // DATAではメトリクス名の代わりにAliasを送る
+	}
+
+	// Command is a received NCMD / DCMD
+	Command struct {
+		Topic   Topic
+		Metrics []Metric // Aliasは名前に解決済み
+	}
+
+	// EdgeNode publishes BIRTH / DATA / DEATH messages for a node and its devices
+	EdgeNode struct {
+		conf   EdgeConfig
+		ctx    context.Context
+		module *mqttm.Module
+
+		mu        sync.Mutex
+		bdSeq     uint64 // 次の接続で使うbdSeq
+		birthSeq  uint64 // 現在の接続のbdSeq
+		seq       uint64
+		online    bool
+		node      *metricSet
+		devices   map[string]*metricSet
+		order     []string          // DBIRTHの送信順
+		aliases   map[uint64]string // Alias -> "<device>/<name>" (Edge Node内で一意)
+		nextAlias uint64
+
+		// OnCommand receives NCMD / DCMD other than the rebirth request
+		OnCommand func(Command)
+	}
+
+	// metricSet holds the metrics announced in a BIRTH and their latest values
+	metricSet struct {
+		metrics []Metric
+		index   map[string]int
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewEdgeNode (constructor)
+// DEV: NCMD/DCMDを購読し、NDEATHをWillに設定したmqttm.Moduleを作る
+func NewEdgeNode(ctx context.Context, clientID, hostname string, mqttConf mqttm.Config, conf EdgeConfig) (*EdgeNode, error) {
+	if conf.GroupID == "" || conf.EdgeNodeID == "" {
+		return nil, fmt.Errorf("sparkplug group_id and edge_node_id are required")
+	}
+	e := &EdgeNode{
+		conf:    conf,
+		ctx:     ctx,
+		node:    newMetricSet(),
+		devices: make(map[string]*metricSet),
+		aliases: make(map[uint64]string),
+	}
+
+	topics := make(map[string]byte, len(mqttConf.SubscribeTopics)+2)
+	for topic, qos := range mqttConf.SubscribeTopics {
+		topics[topic] = qos
+	}
+	topics[NodeTopic(conf.GroupID, NCMD, conf.EdgeNodeID)] = CMD_QOS
+	topics[DeviceTopic(conf.GroupID, DCMD, conf.EdgeNodeID, "+")] = CMD_QOS
+	mqttConf.SubscribeTopics = topics
+
+	module, err := mqttm.New(ctx, clientID, hostname, mqttConf,
+		mqttm.WithWill(e.deathWill),
+		mqttm.WithOnConnect(func(*mqttm.Module) {
+			if err := e.Rebirth(); err != nil {
+				zap.S().Errorf("Failed to publish sparkplug birth: %v", err)
+			}
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	e.module = module
+	return e, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Module
+func (e *EdgeNode) Module() *mqttm.Module {
+	return e.module
+}
+
+// *--------------------------------------------------------------------------------------
+// SetNodeMetrics
+// DEV: NBIRTHで通知するメトリクス (DataTypeと初期値が必要)。接続中なら再BIRTHする
+func (e *EdgeNode) SetNodeMetrics(metrics []Metric) error {
+	e.mu.Lock()
+	e.node = e.define("", metrics)
+	online := e.online
+	e.mu.Unlock()
+	if online {
+		return e.Rebirth()
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// AddDevice
+// DEV: 接続中ならすぐにDBIRTHを送る
+func (e *EdgeNode) AddDevice(deviceID string, metrics []Metric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.devices[deviceID]; !ok {
+		e.order = append(e.order, deviceID)
+	}
+	e.devices[deviceID] = e.define(deviceID, metrics)
+	if !e.online {
+		return nil
+	}
+	return e.publishLocked(DeviceTopic(e.conf.GroupID, DBIRTH, e.conf.EdgeNodeID, deviceID), e.devices[deviceID].birth(), true)
+}
+
+// *--------------------------------------------------------------------------------------
+// RemoveDevice
+func (e *EdgeNode) RemoveDevice(deviceID string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.devices[deviceID]; !ok {
+		return fmt.Errorf("unknown sparkplug device %s", deviceID)
+	}
+	delete(e.devices, deviceID)
+	for i, id := range e.order {
+		if id == deviceID {
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			break
+		}
+	}
+	if !e.online {
+		return nil
+	}
+	return e.publishLocked(DeviceTopic(e.conf.GroupID, DDEATH, e.conf.EdgeNodeID, deviceID), nil, true)
+}
+
+// *--------------------------------------------------------------------------------------
+// Run
+func (e *EdgeNode) Run() error {
+	go e.commandLoop()
+	return e.module.Run()
+}
+
+// *--------------------------------------------------------------------------------------
+// Stop
+// DEV: 正常切断ではWillが送られないため、NDEATHを明示的に送ってから切断する
+func (e *EdgeNode) Stop() {
+	e.mu.Lock()
+	if e.online {
+		death := e.death(e.birthSeq)
+		payload, err := death.Marshal()
+		if err == nil {
+			err = e.module.PublishControl(NodeTopic(e.conf.GroupID, NDEATH, e.conf.EdgeNodeID), DEATH_QOS, false, payload)
+		}
+		if err != nil {
+			zap.S().Errorf("Failed to publish sparkplug NDEATH: %v", err)
+		}
+		e.online = false
+	}
+	e.mu.Unlock()
+	e.module.Stop()
+}
+
+// *--------------------------------------------------------------------------------------
+// Rebirth
+// DEV: seqを0に戻してNBIRTHと全デバイスのDBIRTHを送り直す
+func (e *EdgeNode) Rebirth() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.seq = 0
+	birth := e.node.birth()
+	birth.Metrics = append(birth.Metrics,
+		Metric{Name: METRIC_BDSEQ, DataType: TypeInt64, Value: e.birthSeq},
+		Metric{Name: METRIC_REBIRTH, DataType: TypeBoolean, Value: false},
+	)
+	if err := e.publishLocked(NodeTopic(e.conf.GroupID, NBIRTH, e.conf.EdgeNodeID), birth, false); err != nil {
+		return err
+	}
+	e.online = true
+	for _, deviceID := range e.order {
+		topic := DeviceTopic(e.conf.GroupID, DBIRTH, e.conf.EdgeNodeID, deviceID)
+		if err := e.publishLocked(topic, e.devices[deviceID].birth(), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// PublishNodeData
+// DEV: 値はNBIRTHで通知したメトリクス名で指定する
+func (e *EdgeNode) PublishNodeData(metrics []Metric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data, err := e.data(e.node, metrics)
+	if err != nil {
+		return err
+	}
+	return e.publishLocked(NodeTopic(e.conf.GroupID, NDATA, e.conf.EdgeNodeID), data, true)
+}
+
+// *--------------------------------------------------------------------------------------
+// PublishDeviceData
+func (e *EdgeNode) PublishDeviceData(deviceID string, metrics []Metric) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	set, ok := e.devices[deviceID]
+	if !ok {
+		return fmt.Errorf("unknown sparkplug device %s", deviceID)
+	}
+	data, err := e.data(set, metrics)
+	if err != nil {
+		return err
+	}
+	return e.publishLocked(DeviceTopic(e.conf.GroupID, DDATA, e.conf.EdgeNodeID, deviceID), data, true)
+}
+
+// *--------------------------------------------------------------------------------------
+// deathWill
+// DEV: 接続毎にbdSeqを進め、同じbdSeqを持つNDEATHをWillにする
+func (e *EdgeNode) deathWill() mqttm.Will {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.birthSeq = e.bdSeq
+	e.bdSeq = (e.bdSeq + 1) % SEQ_MODULO
+	e.online = false
+
+	payload, err := e.death(e.birthSeq).Marshal()
+	if err != nil {
+		zap.S().Errorf("Failed to encode sparkplug NDEATH: %v", err)
+	}
+	return mqttm.Will{
+		Topic:   NodeTopic(e.conf.GroupID, NDEATH, e.conf.EdgeNodeID),
+		Payload: payload,
+		QoS:     DEATH_QOS,
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// death
+func (e *EdgeNode) death(bdSeq uint64) *Payload {
+	return &Payload{
+		Timestamp: Now(),
+		Metrics:   []Metric{{Name: METRIC_BDSEQ, DataType: TypeInt64, Value: bdSeq}},
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// define (e.mu must be held)
+// DEV: 新しいメトリクス名にだけAliasを割り当てる (既存のAliasは維持)
+func (e *EdgeNode) define(scope string, metrics []Metric) *metricSet {
+	known := make(map[string]uint64, len(e.aliases))
+	for alias, key := range e.aliases {
+		known[key] = alias
+	}
+	set := newMetricSet()
+	for _, metric := range metrics {
+		key := scope + "/" + metric.Name
+		alias, ok := known[key]
+		if !ok {
+			alias = e.nextAlias
+			e.nextAlias++
+			e.aliases[alias] = key
+		}
+		metric.Alias = &alias
+		set.index[metric.Name] = len(set.metrics)
+		set.metrics = append(set.metrics, metric)
+	}
+	return set
+}
+
+// *--------------------------------------------------------------------------------------
+// data (e.mu must be held)
+func (e *EdgeNode) data(set *metricSet, metrics []Metric) (*Payload, error) {
+	payload := &Payload{Timestamp: Now()}
+	for _, metric := range metrics {
+		i, ok := set.index[metric.Name]
+		if !ok {
+			return nil, fmt.Errorf("metric %q was not announced in the birth certificate", metric.Name)
+		}
+		birth := &set.metrics[i]
+		if metric.DataType == TypeUnknown {
+			metric.DataType = birth.DataType
+		}
+		birth.Value, birth.IsNull, birth.Timestamp = metric.Value, metric.IsNull, metric.Timestamp
+		if e.conf.UseAliases {
+			metric.Name = ""
+			metric.Alias = birth.Alias
+		}
+		payload.Metrics = append(payload.Metrics, metric)
+	}
+	return payload, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// publishLocked (e.mu must be held)
+// DEV: seqの欠落・順序の入れ替わりはHostの再BIRTH要求になるため、流量制限を通さずに送る
+func (e *EdgeNode) publishLocked(topic string, payload *Payload, next bool) error {
+	if payload == nil {
+		payload = &Payload{Timestamp: Now()}
+	}
+	if next {
+		e.seq = (e.seq + 1) % SEQ_MODULO
+	}
+	seq := e.seq
+	payload.Seq = &seq
+	data, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	return e.module.PublishControl(topic, mqttm.DEFAULT_QOS, false, data)
+}
+
+// *--------------------------------------------------------------------------------------
+// commandLoop
+func (e *EdgeNode) commandLoop() {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+
+		case contents, ok := <-e.module.Subscription():
+			if !ok {
+				return
+			}
+			topic, err := ParseTopic(contents.Topic)
+			if err != nil || (topic.MessageType != NCMD && topic.MessageType != DCMD) {
+				zap.S().Debugf("Sparkplug edge node ignoring message on %s", contents.Topic)
+				continue
+			}
+			payload, err := Unmarshal(contents.Payload)
+			if err != nil {
+				zap.S().Warnf("Invalid sparkplug command on %s: %v", contents.Topic, err)
+				continue
+			}
+			e.handleCommand(topic, payload)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// handleCommand
+func (e *EdgeNode) handleCommand(topic Topic, payload *Payload) {
+	e.mu.Lock()
+	for i := range payload.Metrics {
+		metric := &payload.Metrics[i]
+		if metric.Name != "" || metric.Alias == nil {
+			continue
+		}
+		if name, ok := strings.CutPrefix(e.aliases[*metric.Alias], topic.DeviceID+"/"); ok {
+			metric.Name = name
+		}
+	}
+	e.mu.Unlock()
+
+	if topic.MessageType == NCMD {
+		for _, metric := range payload.Metrics {
+			if metric.Name == METRIC_REBIRTH && metric.Value == true {
+				zap.S().Infof("Sparkplug rebirth requested for %s", topic.EdgeNodeID)
+				if err := e.Rebirth(); err != nil {
+					zap.S().Errorf("Failed to publish sparkplug birth: %v", err)
+				}
+				return
+			}
+		}
+	}
+	if e.OnCommand != nil {
+		e.OnCommand(Command{Topic: topic, Metrics: payload.Metrics})
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// newMetricSet (constructor)
+func newMetricSet() *metricSet {
+	return &metricSet{index: make(map[string]int)}
+}
+
+// *--------------------------------------------------------------------------------------
+// birth
+func (s *metricSet) birth() *Payload {
+	payload := &Payload{Timestamp: Now(), Metrics: make([]Metric, len(s.metrics))}
+	copy(payload.Metrics, s.metrics)
+	return payload
+}
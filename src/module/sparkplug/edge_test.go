@@ -0,0 +1,160 @@
+package sparkplug
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/broker"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+func TestDeathWillBdSeqWrapsAround(t *testing.T) {
+	e := &EdgeNode{conf: EdgeConfig{GroupID: "g", EdgeNodeID: "e"}, bdSeq: SEQ_MODULO - 1, online: true}
+	for _, want := range []uint64{255, 0, 1} {
+		will := e.deathWill()
+		if will.Topic != NodeTopic("g", NDEATH, "e") || will.QoS != DEATH_QOS {
+			t.Errorf("will = %+v", will)
+		}
+		payload, err := Unmarshal(will.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(payload.Metrics) != 1 || payload.Metrics[0].Name != METRIC_BDSEQ || payload.Metrics[0].Value != int64(want) {
+			t.Errorf("NDEATH metrics = %+v, want bdSeq %d", payload.Metrics, want)
+		}
+		// DEV: NBIRTHはWillと同じbdSeqを通知する
+		if e.birthSeq != want || e.online {
+			t.Errorf("birthSeq = %d, online = %v, want %d and offline", e.birthSeq, e.online, want)
+		}
+	}
+}
+
+func TestHandleCommandResolvesAliases(t *testing.T) {
+	e := &EdgeNode{conf: EdgeConfig{GroupID: "g", EdgeNodeID: "e"}, aliases: make(map[uint64]string)}
+	e.node = e.define("", []Metric{{Name: "setpoint", DataType: TypeDouble, Value: 0.0}})
+	e.devices = map[string]*metricSet{"d": e.define("d", []Metric{{Name: "on", DataType: TypeBoolean, Value: false}})}
+
+	var commands []Command
+	e.OnCommand = func(command Command) { commands = append(commands, command) }
+	e.handleCommand(Topic{GroupID: "g", MessageType: NCMD, EdgeNodeID: "e"}, &Payload{Metrics: []Metric{{Alias: ptr(0), Value: 1.5}}})
+	e.handleCommand(Topic{GroupID: "g", MessageType: DCMD, EdgeNodeID: "e", DeviceID: "d"}, &Payload{Metrics: []Metric{{Alias: ptr(1), Value: true}, {Alias: ptr(0), Value: 2.0}}})
+
+	if len(commands) != 2 {
+		t.Fatalf("%d commands, want 2", len(commands))
+	}
+	if commands[0].Metrics[0].Name != "setpoint" {
+		t.Errorf("NCMD alias resolved to %q, want setpoint", commands[0].Metrics[0].Name)
+	}
+	// DEV: 他のスコープ (ノード) のAliasはデバイス宛てのコマンドでは解決しない
+	if commands[1].Metrics[0].Name != "on" || commands[1].Metrics[1].Name != "" {
+		t.Errorf("DCMD metrics = %+v, want on and an unresolved alias", commands[1].Metrics)
+	}
+}
+
+func TestEdgeNodeSequence(t *testing.T) {
+	b := broker.New(broker.Config{Listen: "127.0.0.1:0"})
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	peer, err := mqttm.New(ctx, "peer", "h", mqttm.Config{Endpoint: b.Addr(), SubscribeTopics: map[string]byte{NAMESPACE + "/g/+/e/#": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(peer.Stop)
+	next := func(messageType string) *Payload {
+		t.Helper()
+		for {
+			select {
+			case contents := <-peer.Subscription():
+				topic, err := ParseTopic(contents.Topic)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if topic.MessageType == NCMD || topic.MessageType == DCMD {
+					continue // peerが送ったコマンド
+				}
+				if topic.MessageType != messageType {
+					t.Fatalf("received %s, want %s", contents.Topic, messageType)
+				}
+				payload, err := Unmarshal(contents.Payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return payload
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %s received", messageType)
+			}
+		}
+	}
+
+	edge, err := NewEdgeNode(ctx, "edge", "h", mqttm.Config{Endpoint: b.Addr()}, EdgeConfig{GroupID: "g", EdgeNodeID: "e", UseAliases: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := edge.SetNodeMetrics([]Metric{{Name: "n", DataType: TypeInt32, Value: int32(0)}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := edge.AddDevice("d", []Metric{{Name: "on", DataType: TypeBoolean, Value: false}}); err != nil {
+		t.Fatal(err)
+	}
+	commands := make(chan Command, 1)
+	edge.OnCommand = func(command Command) { commands <- command }
+	if err := edge.Run(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(edge.Stop)
+
+	nbirth := next(NBIRTH)
+	if *nbirth.Seq != 0 || nbirth.Metrics[1].Name != METRIC_BDSEQ || nbirth.Metrics[1].Value != int64(0) {
+		t.Errorf("NBIRTH = %+v, want seq 0 and bdSeq 0", nbirth)
+	}
+	if dbirth := next(DBIRTH); *dbirth.Seq != 1 || dbirth.Metrics[0].Name != "on" {
+		t.Errorf("DBIRTH = %+v, want seq 1", dbirth)
+	}
+
+	// DEV: seqは255の次に0へ戻る。DATAはAliasだけで送られる
+	for i := 0; i < 300; i++ {
+		if err := edge.PublishNodeData([]Metric{{Name: "n", Value: int32(i)}}); err != nil {
+			t.Fatal(err)
+		}
+		ndata := next(NDATA)
+		if want := uint64(i+2) % SEQ_MODULO; *ndata.Seq != want {
+			t.Fatalf("NDATA %d seq = %d, want %d", i, *ndata.Seq, want)
+		}
+		if metric := ndata.Metrics[0]; metric.Name != "" || metric.Alias == nil || *metric.Alias != 0 || metric.Value != int32(i) {
+			t.Fatalf("NDATA %d metric = %+v", i, metric)
+		}
+	}
+
+	rebirth, _ := (&Payload{Metrics: []Metric{{Name: METRIC_REBIRTH, DataType: TypeBoolean, Value: true}}}).Marshal()
+	if err := peer.Publish(NodeTopic("g", NCMD, "e"), 1, rebirth); err != nil {
+		t.Fatal(err)
+	}
+	if nbirth := next(NBIRTH); *nbirth.Seq != 0 {
+		t.Errorf("NBIRTH after the rebirth request has seq %d, want 0", *nbirth.Seq)
+	}
+	if dbirth := next(DBIRTH); *dbirth.Seq != 1 {
+		t.Errorf("DBIRTH after the rebirth request has seq %d, want 1", *dbirth.Seq)
+	}
+
+	command, _ := (&Payload{Metrics: []Metric{{Alias: ptr(1), DataType: TypeBoolean, Value: true}}}).Marshal()
+	if err := peer.Publish(DeviceTopic("g", DCMD, "e", "d"), 1, command); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case received := <-commands:
+		if received.Topic.DeviceID != "d" || received.Metrics[0].Name != "on" || received.Metrics[0].Value != true {
+			t.Errorf("command = %+v", received)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DCMD was not delivered to OnCommand")
+	}
+}
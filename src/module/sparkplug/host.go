@@ -0,0 +1,319 @@
+package sparkplug
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	REBIRTH_INTERVAL time.Duration = 5 * time.Second // 同じEdge Nodeへの再BIRTH要求の最小間隔
+
+	METRIC_SEQ_GAPS         string = "sparkplug_seq_gaps_total"
+	METRIC_REBIRTH_REQUESTS string = "sparkplug_rebirth_requests_total"
+)
+
+type (
+	// HostConfig holds the Host Application settings
+	HostConfig struct {
+		Broker string   `json:"broker"`  // Name of the MQTT config to consume from
+		HostID string   `json:"host_id"` // Publishes spBv1.0/STATE/<host_id> when set
+		Groups []string `json:"groups"`  // Group IDs to consume (empty = all)
+	}
+
+	// Host consumes Sparkplug messages of an mqttm.Client and forwards them with aliases resolved
+	// DEV: mqttm.Clientとして振る舞うため、そのままDispatcherの入力にできる
+	Host struct {
+		mqttm.Client
+		conf HostConfig
+		out  chan mqttm.Contents
+
+		mu    sync.Mutex
+		nodes map[string]*nodeState // "<group>/<edge>"
+	}
+
+	// nodeState is what the host knows about an Edge Node since its last NBIRTH
+	nodeState struct {
+		online      bool
+		bdSeq       uint64
+		seq         uint64
+		aliases     map[uint64]string   // Alias -> metric name
+		types       map[string]DataType // "<device>/<name>" -> DataType
+		lastRebirth time.Time
+	}
+
+	// statePayload is the Sparkplug 3.0 STATE message
+	statePayload struct {
+		Online    bool   `json:"online"`
+		Timestamp uint64 `json:"timestamp"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Topics
+// DEV: mqttm.ConfigのSubscribeTopicsに追加する購読
+func (conf HostConfig) Topics() map[string]byte {
+	if len(conf.Groups) == 0 {
+		return map[string]byte{NAMESPACE + "/#": CMD_QOS}
+	}
+	topics := make(map[string]byte, len(conf.Groups))
+	for _, group := range conf.Groups {
+		topics[fmt.Sprintf("%s/%s/#", NAMESPACE, group)] = CMD_QOS
+	}
+	return topics
+}
+
+// *--------------------------------------------------------------------------------------
+// ModuleOptions
+// DEV: host_id指定時はSTATE (オンライン/オフライン) をRetainで通知する
+func (conf HostConfig) ModuleOptions() []mqttm.Option {
+	if conf.HostID == "" {
+		return nil
+	}
+	topic := StateTopic(conf.HostID)
+	return []mqttm.Option{
+		mqttm.WithWill(func() mqttm.Will {
+			payload, _ := json.Marshal(statePayload{Online: false, Timestamp: Now()})
+			return mqttm.Will{Topic: topic, Payload: payload, QoS: DEATH_QOS, Retain: true}
+		}),
+		mqttm.WithOnConnect(func(m *mqttm.Module) {
+			payload, _ := json.Marshal(statePayload{Online: true, Timestamp: Now()})
+			if err := m.PublishControl(topic, DEATH_QOS, true, payload); err != nil {
+				zap.S().Errorf("Failed to publish sparkplug STATE: %v", err)
+			}
+		}),
+		// DEV: 正常切断ではWillが送られないため、切断前にオフラインを通知する
+		mqttm.WithOnDisconnect(func(m *mqttm.Module) {
+			payload, _ := json.Marshal(statePayload{Online: false, Timestamp: Now()})
+			if err := m.PublishControl(topic, DEATH_QOS, true, payload); err != nil {
+				zap.S().Errorf("Failed to publish sparkplug STATE: %v", err)
+			}
+		}),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// NewHost (constructor)
+func NewHost(ctx context.Context, client mqttm.Client, conf HostConfig) *Host {
+	h := &Host{
+		Client: client,
+		conf:   conf,
+		out:    make(chan mqttm.Contents, mqttm.QUEUE_SIZE),
+		nodes:  make(map[string]*nodeState),
+	}
+	go h.consume(ctx)
+	return h
+}
+
+// *--------------------------------------------------------------------------------------
+// Subscription
+// DEV: SparkplugのメッセージはAliasを名前に解決し、CONTENT_TYPEを付けて流す
+func (h *Host) Subscription() <-chan mqttm.Contents {
+	return h.out
+}
+
+// *--------------------------------------------------------------------------------------
+// Online
+func (h *Host) Online(groupID, edgeNodeID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	node, ok := h.nodes[groupID+"/"+edgeNodeID]
+	return ok && node.online
+}
+
+// *--------------------------------------------------------------------------------------
+// RequestRebirth
+func (h *Host) RequestRebirth(groupID, edgeNodeID string) error {
+	payload := &Payload{
+		Timestamp: Now(),
+		Metrics:   []Metric{{Name: METRIC_REBIRTH, DataType: TypeBoolean, Value: true}},
+	}
+	data, err := payload.Marshal()
+	if err != nil {
+		return err
+	}
+	metrics.Counter(METRIC_REBIRTH_REQUESTS, groupID+"/"+edgeNodeID).Add(1)
+	return h.Client.Publish(NodeTopic(groupID, NCMD, edgeNodeID), CMD_QOS, data)
+}
+
+// *--------------------------------------------------------------------------------------
+// consume
+func (h *Host) consume(ctx context.Context) {
+	defer close(h.out)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case contents, ok := <-h.Client.Subscription():
+			if !ok {
+				return
+			}
+			forward, ok := h.handle(contents)
+			if !ok {
+				continue
+			}
+			select {
+			case h.out <- forward:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// handle
+// DEV: 転送しないメッセージ (古いNDEATH・BIRTH前のDATAなど) はfalseを返す
+func (h *Host) handle(contents mqttm.Contents) (mqttm.Contents, bool) {
+	topic, err := ParseTopic(contents.Topic)
+	if err != nil || topic.MessageType == STATE {
+		return contents, true
+	}
+	payload, err := Unmarshal(contents.Payload)
+	if err != nil || topic.MessageType == NCMD || topic.MessageType == DCMD {
+		// DEV: コマンドはそのまま流し、デコードエラーはDispatcherのDead-letterに任せる
+		contents.ContentType = CONTENT_TYPE
+		return contents, true
+	}
+
+	h.mu.Lock()
+	rebirth, forward := h.track(topic, payload)
+	h.mu.Unlock()
+	if rebirth {
+		if err := h.RequestRebirth(topic.GroupID, topic.EdgeNodeID); err != nil {
+			zap.S().Errorf("Failed to request sparkplug rebirth from %s/%s: %v", topic.GroupID, topic.EdgeNodeID, err)
+		}
+	}
+	if !forward {
+		return contents, false
+	}
+
+	data, err := payload.Marshal()
+	if err != nil {
+		zap.S().Warnf("Failed to re-encode sparkplug payload on %s: %v", contents.Topic, err)
+		return contents, false
+	}
+	contents.Payload = data
+	contents.ContentType = CONTENT_TYPE
+	return contents, true
+}
+
+// *--------------------------------------------------------------------------------------
+// track (h.mu must be held)
+// DEV: BIRTHでAlias・型を覚え、seqの連続性を確認してDATAのAliasを名前に戻す
+func (h *Host) track(topic Topic, payload *Payload) (rebirth, forward bool) {
+	key := topic.GroupID + "/" + topic.EdgeNodeID
+	node := h.nodes[key]
+
+	switch topic.MessageType {
+	case NBIRTH:
+		node = &nodeState{
+			online:  true,
+			aliases: make(map[uint64]string),
+			types:   make(map[string]DataType),
+		}
+		if previous := h.nodes[key]; previous != nil {
+			node.lastRebirth = previous.lastRebirth
+		}
+		h.nodes[key] = node
+		for _, metric := range payload.Metrics {
+			if metric.Name == METRIC_BDSEQ {
+				node.bdSeq, _ = toUint64(metric.Value)
+			}
+		}
+		node.learn("", payload)
+		if payload.Seq != nil {
+			node.seq = *payload.Seq
+		}
+		zap.S().Infof("Sparkplug edge node %s is online (bdSeq %d)", key, node.bdSeq)
+		return false, true
+
+	case NDEATH:
+		if node == nil {
+			return false, true
+		}
+		for _, metric := range payload.Metrics {
+			if bdSeq, err := toUint64(metric.Value); metric.Name == METRIC_BDSEQ && err == nil && bdSeq != node.bdSeq {
+				zap.S().Debugf("Ignoring stale sparkplug NDEATH for %s (bdSeq %d)", key, bdSeq)
+				return false, false
+			}
+		}
+		node.online = false
+		zap.S().Infof("Sparkplug edge node %s is offline", key)
+		return false, true
+	}
+
+	if node == nil || !node.online {
+		return h.rebirthDue(key), false
+	}
+	if payload.Seq != nil {
+		expected := (node.seq + 1) % SEQ_MODULO
+		node.seq = *payload.Seq
+		if *payload.Seq != expected {
+			zap.S().Warnf("Sparkplug seq gap from %s: expected %d, got %d", key, expected, *payload.Seq)
+			metrics.Counter(METRIC_SEQ_GAPS, key).Add(1)
+			rebirth = h.rebirthDue(key)
+		}
+	}
+	if topic.MessageType == DBIRTH {
+		node.learn(topic.DeviceID, payload)
+	}
+	if !node.resolve(topic.DeviceID, payload) {
+		zap.S().Warnf("Sparkplug message from %s uses an unknown alias", key)
+		return h.rebirthDue(key), false
+	}
+	return rebirth, true
+}
+
+// *--------------------------------------------------------------------------------------
+// rebirthDue (h.mu must be held)
+func (h *Host) rebirthDue(key string) bool {
+	node := h.nodes[key]
+	if node == nil {
+		node = &nodeState{aliases: make(map[uint64]string), types: make(map[string]DataType)}
+		h.nodes[key] = node
+	}
+	if time.Since(node.lastRebirth) < REBIRTH_INTERVAL {
+		return false
+	}
+	node.lastRebirth = time.Now()
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// learn
+func (n *nodeState) learn(deviceID string, payload *Payload) {
+	for _, metric := range payload.Metrics {
+		if metric.Alias != nil {
+			n.aliases[*metric.Alias] = metric.Name
+		}
+		n.types[deviceID+"/"+metric.Name] = metric.DataType
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// resolve
+// DEV: Aliasを名前に戻し、DataTypeの無いメトリクスはBIRTHの型で解釈し直す
+func (n *nodeState) resolve(deviceID string, payload *Payload) bool {
+	for i := range payload.Metrics {
+		metric := &payload.Metrics[i]
+		if metric.Name == "" && metric.Alias != nil {
+			name, ok := n.aliases[*metric.Alias]
+			if !ok {
+				return false
+			}
+			metric.Name = name
+		}
+		if dataType, ok := n.types[deviceID+"/"+metric.Name]; ok {
+			metric.retype(dataType)
+		}
+	}
+	return true
+}
@@ -0,0 +1,189 @@
+package sparkplug
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm/mqttmtest"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// hostHarness feeds Sparkplug messages to a Host over the fake client
+type hostHarness struct {
+	t      *testing.T
+	client *mqttmtest.Client
+	host   *Host
+}
+
+func newHostHarness(t *testing.T) *hostHarness {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	client := mqttmtest.New("h")
+	return &hostHarness{t: t, client: client, host: NewHost(ctx, client, HostConfig{})}
+}
+
+// send pushes a message and returns what the host forwarded (nil if it was dropped)
+func (h *hostHarness) send(topic string, data []byte) *Payload {
+	h.t.Helper()
+	h.client.Push(topic, data)
+	// DEV: 転送されないメッセージを確認するため、目印のSTATEを続けて流す
+	h.client.Push(StateTopic("marker"), nil)
+
+	var forwarded *Payload
+	var err error
+	for {
+		select {
+		case contents := <-h.host.Subscription():
+			if contents.Topic == StateTopic("marker") {
+				return forwarded
+			}
+			if contents.ContentType != CONTENT_TYPE {
+				h.t.Errorf("content type = %q", contents.ContentType)
+			}
+			if forwarded, err = Unmarshal(contents.Payload); err != nil {
+				h.t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			h.t.Fatalf("host did not consume %s", topic)
+		}
+	}
+}
+
+// encode marshals a payload with the metrics given in full
+func (h *hostHarness) encode(payload *Payload) []byte {
+	h.t.Helper()
+	data, err := payload.Marshal()
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return data
+}
+
+// aliasData encodes a DATA payload whose metrics carry the alias and value only, as edge nodes send them
+func (h *hostHarness) aliasData(seq uint64, metrics ...Metric) []byte {
+	h.t.Helper()
+	data := protowire.AppendTag(nil, fieldPayloadSeq, protowire.VarintType)
+	data = protowire.AppendVarint(data, seq)
+	for _, metric := range metrics {
+		data = protowire.AppendTag(data, fieldPayloadMetrics, protowire.BytesType)
+		data = protowire.AppendBytes(data, withoutDataType(h.t, metric))
+	}
+	return data
+}
+
+// rebirths counts the rebirth requests published to the edge node
+func (h *hostHarness) rebirths() int {
+	n := 0
+	for _, contents := range h.client.Published() {
+		if contents.Topic == NodeTopic("g", NCMD, "e") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHostTracksEdgeNode(t *testing.T) {
+	h := newHostHarness(t)
+	nbirth := NodeTopic("g", NBIRTH, "e")
+	ndata := NodeTopic("g", NDATA, "e")
+	ddata := DeviceTopic("g", DDATA, "e", "d")
+
+	if forwarded := h.send(ndata, h.aliasData(1, Metric{Alias: ptr(0), DataType: TypeInt16, Value: int16(1)})); forwarded != nil {
+		t.Error("DATA before the birth was forwarded")
+	}
+	if h.rebirths() != 1 {
+		t.Fatalf("%d rebirth requests for DATA before the birth, want 1", h.rebirths())
+	}
+
+	h.send(nbirth, h.encode(&Payload{Seq: ptr(0), Metrics: []Metric{
+		{Name: "temp", Alias: ptr(0), DataType: TypeInt16, Value: int16(1)},
+		{Name: METRIC_BDSEQ, DataType: TypeInt64, Value: uint64(7)},
+	}}))
+	if !h.host.Online("g", "e") {
+		t.Fatal("edge node is not online after NBIRTH")
+	}
+	h.send(DeviceTopic("g", DBIRTH, "e", "d"), h.encode(&Payload{Seq: ptr(1), Metrics: []Metric{
+		{Name: "on", Alias: ptr(1), DataType: TypeBoolean, Value: false},
+	}}))
+
+	// DEV: Aliasだけのメトリクスは名前とBIRTHの型に戻して転送される
+	forwarded := h.send(ndata, h.aliasData(2, Metric{Alias: ptr(0), DataType: TypeInt16, Value: int16(-3)}))
+	if forwarded == nil || forwarded.Metrics[0].Name != "temp" || forwarded.Metrics[0].Value != int16(-3) {
+		t.Errorf("NDATA forwarded as %+v", forwarded)
+	}
+	forwarded = h.send(ddata, h.aliasData(3, Metric{Alias: ptr(1), DataType: TypeBoolean, Value: true}))
+	if forwarded == nil || forwarded.Metrics[0].Name != "on" || forwarded.Metrics[0].Value != true {
+		t.Errorf("DDATA forwarded as %+v", forwarded)
+	}
+
+	// DEV: seqの欠落は転送した上で再BIRTHを要求する (REBIRTH_INTERVAL内は1回だけ)
+	h.host.mu.Lock()
+	h.host.nodes["g/e"].lastRebirth = time.Time{}
+	h.host.mu.Unlock()
+	if forwarded := h.send(ndata, h.aliasData(5, Metric{Alias: ptr(0), DataType: TypeInt16, Value: int16(4)})); forwarded == nil {
+		t.Error("DATA after a seq gap was not forwarded")
+	}
+	if forwarded := h.send(ndata, h.aliasData(7, Metric{Alias: ptr(0), DataType: TypeInt16, Value: int16(5)})); forwarded == nil {
+		t.Error("DATA after a second seq gap was not forwarded")
+	}
+	if h.rebirths() != 2 {
+		t.Errorf("%d rebirth requests, want 2 (one for the DATA before the birth, one for the seq gaps)", h.rebirths())
+	}
+
+	if forwarded := h.send(ndata, h.aliasData(8, Metric{Alias: ptr(42), DataType: TypeInt16, Value: int16(1)})); forwarded != nil {
+		t.Error("DATA with an unknown alias was forwarded")
+	}
+
+	// DEV: 前の接続のNDEATH (Willの遅延配信) は無視する
+	if forwarded := h.send(NodeTopic("g", NDEATH, "e"), h.encode(&Payload{Metrics: []Metric{{Name: METRIC_BDSEQ, DataType: TypeInt64, Value: uint64(6)}}})); forwarded != nil {
+		t.Error("stale NDEATH was forwarded")
+	}
+	if !h.host.Online("g", "e") {
+		t.Fatal("stale NDEATH took the edge node offline")
+	}
+	if forwarded := h.send(NodeTopic("g", NDEATH, "e"), h.encode(&Payload{Metrics: []Metric{{Name: METRIC_BDSEQ, DataType: TypeInt64, Value: uint64(7)}}})); forwarded == nil {
+		t.Error("NDEATH was not forwarded")
+	}
+	if h.host.Online("g", "e") {
+		t.Error("edge node is online after its NDEATH")
+	}
+
+	for _, contents := range h.client.Published() {
+		payload, err := Unmarshal(contents.Payload)
+		if err != nil || len(payload.Metrics) != 1 || payload.Metrics[0].Name != METRIC_REBIRTH || payload.Metrics[0].Value != true || contents.QoS != CMD_QOS {
+			t.Errorf("rebirth request %+v, %+v", contents, payload)
+		}
+	}
+}
+
+func TestHostSeqWrapsAround(t *testing.T) {
+	h := newHostHarness(t)
+	h.send(NodeTopic("g", NBIRTH, "e"), h.encode(&Payload{Seq: ptr(254), Metrics: []Metric{{Name: "n", DataType: TypeInt32, Value: int32(0)}}}))
+	for _, seq := range []uint64{255, 0, 1} {
+		h.send(NodeTopic("g", NDATA, "e"), h.encode(&Payload{Seq: ptr(seq), Metrics: []Metric{{Name: "n", DataType: TypeInt32, Value: int32(seq)}}}))
+	}
+	if h.rebirths() != 0 {
+		t.Errorf("%d rebirth requests across the seq wraparound", h.rebirths())
+	}
+}
+
+func TestHostPassesOtherMessages(t *testing.T) {
+	h := newHostHarness(t)
+	h.client.Script(
+		mqttm.Contents{Topic: "plain/topic", Payload: []byte("x")},
+		mqttm.Contents{Topic: NodeTopic("g", NDATA, "e"), Payload: []byte{0xff}},
+	)
+	for _, want := range []string{"plain/topic", NodeTopic("g", NDATA, "e")} {
+		select {
+		case contents := <-h.host.Subscription():
+			// DEV: デコードできないSparkplugメッセージはDispatcherのDead-letterに任せる
+			if contents.Topic != want {
+				t.Errorf("forwarded %s, want %s", contents.Topic, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not forwarded", want)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+// module/sparkplug/payload.go
+// DEV: Sparkplug B (sparkplug_b.proto) のペイロードをprotowireで直接エンコード/デコードする
+// DataSet / Template / PropertySet / MetaData は未対応 (デコード時は読み飛ばす)
+package sparkplug
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is the Sparkplug B metric data type
+type DataType uint32
+
+const (
+	TypeUnknown  DataType = 0
+	TypeInt8     DataType = 1
+	TypeInt16    DataType = 2
+	TypeInt32    DataType = 3
+	TypeInt64    DataType = 4
+	TypeUInt8    DataType = 5
+	TypeUInt16   DataType = 6
+	TypeUInt32   DataType = 7
+	TypeUInt64   DataType = 8
+	TypeFloat    DataType = 9
+	TypeDouble   DataType = 10
+	TypeBoolean  DataType = 11
+	TypeString   DataType = 12
+	TypeDateTime DataType = 13
+	TypeText     DataType = 14
+	TypeUUID     DataType = 15
+	TypeBytes    DataType = 17
+)
+
+// Payload field numbers
+const (
+	fieldPayloadTimestamp protowire.Number = 1
+	fieldPayloadMetrics   protowire.Number = 2
+	fieldPayloadSeq       protowire.Number = 3
+	fieldPayloadUUID      protowire.Number = 4
+	fieldPayloadBody      protowire.Number = 5
+)
+
+// Metric field numbers
+const (
+	fieldMetricName       protowire.Number = 1
+	fieldMetricAlias      protowire.Number = 2
+	fieldMetricTimestamp  protowire.Number = 3
+	fieldMetricDataType   protowire.Number = 4
+	fieldMetricHistorical protowire.Number = 5
+	fieldMetricTransient  protowire.Number = 6
+	fieldMetricNull       protowire.Number = 7
+	fieldMetricInt        protowire.Number = 10
+	fieldMetricLong       protowire.Number = 11
+	fieldMetricFloat      protowire.Number = 12
+	fieldMetricDouble     protowire.Number = 13
+	fieldMetricBoolean    protowire.Number = 14
+	fieldMetricString     protowire.Number = 15
+	fieldMetricBytes      protowire.Number = 16
+)
+
+var dataTypeNames = map[DataType]string{
+	TypeInt8: "Int8", TypeInt16: "Int16", TypeInt32: "Int32", TypeInt64: "Int64",
+	TypeUInt8: "UInt8", TypeUInt16: "UInt16", TypeUInt32: "UInt32", TypeUInt64: "UInt64",
+	TypeFloat: "Float", TypeDouble: "Double", TypeBoolean: "Boolean", TypeString: "String",
+	TypeDateTime: "DateTime", TypeText: "Text", TypeUUID: "UUID", TypeBytes: "Bytes",
+}
+
+type (
+	// Payload is a Sparkplug B payload
+	Payload struct {
+		Timestamp uint64 // ms since epoch
+		Metrics   []Metric
+		Seq       *uint64 // NDEATHには付かない
+		UUID      string
+		Body      []byte
+	}
+
+	// Metric is a single Sparkplug B metric
+	Metric struct {
+		Name         string
+		Alias        *uint64
+		Timestamp    uint64
+		DataType     DataType
+		IsHistorical bool
+		IsTransient  bool
+		IsNull       bool
+		Value        interface{} // int8..uint64 / float32 / float64 / bool / string / []byte
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// String
+func (t DataType) String() string {
+	if name, ok := dataTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("DataType(%d)", uint32(t))
+}
+
+// *--------------------------------------------------------------------------------------
+// Now
+// DEV: Sparkplugのタイムスタンプ (UTCのミリ秒)
+func Now() uint64 {
+	return uint64(time.Now().UnixMilli())
+}
+
+// *--------------------------------------------------------------------------------------
+// Marshal
+func (p *Payload) Marshal() ([]byte, error) {
+	var buf []byte
+	if p.Timestamp != 0 {
+		buf = protowire.AppendTag(buf, fieldPayloadTimestamp, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, p.Timestamp)
+	}
+	for i := range p.Metrics {
+		metric, err := p.Metrics[i].marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = protowire.AppendTag(buf, fieldPayloadMetrics, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, metric)
+	}
+	if p.Seq != nil {
+		buf = protowire.AppendTag(buf, fieldPayloadSeq, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, *p.Seq)
+	}
+	if p.UUID != "" {
+		buf = protowire.AppendTag(buf, fieldPayloadUUID, protowire.BytesType)
+		buf = protowire.AppendString(buf, p.UUID)
+	}
+	if p.Body != nil {
+		buf = protowire.AppendTag(buf, fieldPayloadBody, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, p.Body)
+	}
+	return buf, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Unmarshal
+func Unmarshal(data []byte) (*Payload, error) {
+	p := &Payload{}
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case fieldPayloadTimestamp:
+			p.Timestamp = v
+		case fieldPayloadMetrics:
+			metric, err := unmarshalMetric(b)
+			if err != nil {
+				return err
+			}
+			p.Metrics = append(p.Metrics, metric)
+		case fieldPayloadSeq:
+			seq := v
+			p.Seq = &seq
+		case fieldPayloadUUID:
+			p.UUID = string(b)
+		case fieldPayloadBody:
+			p.Body = append([]byte(nil), b...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid sparkplug payload: %w", err)
+	}
+	return p, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// marshal (Metric)
+func (m *Metric) marshal() ([]byte, error) {
+	var buf []byte
+	if m.Name != "" {
+		buf = protowire.AppendTag(buf, fieldMetricName, protowire.BytesType)
+		buf = protowire.AppendString(buf, m.Name)
+	}
+	if m.Alias != nil {
+		buf = protowire.AppendTag(buf, fieldMetricAlias, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, *m.Alias)
+	}
+	if m.Timestamp != 0 {
+		buf = protowire.AppendTag(buf, fieldMetricTimestamp, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, m.Timestamp)
+	}
+	if m.DataType != TypeUnknown {
+		buf = protowire.AppendTag(buf, fieldMetricDataType, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(m.DataType))
+	}
+	buf = appendBool(buf, fieldMetricHistorical, m.IsHistorical)
+	buf = appendBool(buf, fieldMetricTransient, m.IsTransient)
+	if m.IsNull || m.Value == nil {
+		return appendBool(buf, fieldMetricNull, true), nil
+	}
+
+	switch m.DataType {
+	case TypeInt8, TypeInt16, TypeInt32:
+		n, err := toInt64(m.Value)
+		if err != nil {
+			return nil, m.valueError(err)
+		}
+		buf = protowire.AppendTag(buf, fieldMetricInt, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(uint32(int32(n))))
+	case TypeUInt8, TypeUInt16, TypeUInt32:
+		n, err := toInt64(m.Value)
+		if err != nil {
+			return nil, m.valueError(err)
+		}
+		buf = protowire.AppendTag(buf, fieldMetricInt, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, uint64(uint32(n)))
+	case TypeInt64, TypeUInt64, TypeDateTime:
+		n, err := toUint64(m.Value)
+		if err != nil {
+			return nil, m.valueError(err)
+		}
+		buf = protowire.AppendTag(buf, fieldMetricLong, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, n)
+	case TypeFloat:
+		f, err := toFloat64(m.Value)
+		if err != nil {
+			return nil, m.valueError(err)
+		}
+		buf = protowire.AppendTag(buf, fieldMetricFloat, protowire.Fixed32Type)
+		buf = protowire.AppendFixed32(buf, math.Float32bits(float32(f)))
+	case TypeDouble:
+		f, err := toFloat64(m.Value)
+		if err != nil {
+			return nil, m.valueError(err)
+		}
+		buf = protowire.AppendTag(buf, fieldMetricDouble, protowire.Fixed64Type)
+		buf = protowire.AppendFixed64(buf, math.Float64bits(f))
+	case TypeBoolean:
+		b, ok := m.Value.(bool)
+		if !ok {
+			return nil, m.valueError(fmt.Errorf("%T is not a bool", m.Value))
+		}
+		buf = protowire.AppendTag(buf, fieldMetricBoolean, protowire.VarintType)
+		buf = protowire.AppendVarint(buf, protowire.EncodeBool(b))
+	case TypeString, TypeText, TypeUUID:
+		s, ok := m.Value.(string)
+		if !ok {
+			return nil, m.valueError(fmt.Errorf("%T is not a string", m.Value))
+		}
+		buf = protowire.AppendTag(buf, fieldMetricString, protowire.BytesType)
+		buf = protowire.AppendString(buf, s)
+	case TypeBytes:
+		b, ok := m.Value.([]byte)
+		if !ok {
+			return nil, m.valueError(fmt.Errorf("%T is not []byte", m.Value))
+		}
+		buf = protowire.AppendTag(buf, fieldMetricBytes, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, b)
+	default:
+		return nil, m.valueError(fmt.Errorf("unsupported data type %s", m.DataType))
+	}
+	return buf, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// valueError
+func (m *Metric) valueError(err error) error {
+	return fmt.Errorf("metric %q (%s): %w", m.Name, m.DataType, err)
+}
+
+// *--------------------------------------------------------------------------------------
+// unmarshalMetric
+// DEV: 値はDataTypeに合わせたGoの型に戻す (Int8..Int32は符号を復元)
+func unmarshalMetric(data []byte) (Metric, error) {
+	var m Metric
+	var raw uint64
+	var rawBytes []byte
+	hasValue := false
+	err := walkFields(data, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		switch num {
+		case fieldMetricName:
+			m.Name = string(b)
+		case fieldMetricAlias:
+			alias := v
+			m.Alias = &alias
+		case fieldMetricTimestamp:
+			m.Timestamp = v
+		case fieldMetricDataType:
+			m.DataType = DataType(v)
+		case fieldMetricHistorical:
+			m.IsHistorical = v != 0
+		case fieldMetricTransient:
+			m.IsTransient = v != 0
+		case fieldMetricNull:
+			m.IsNull = v != 0
+		case fieldMetricInt, fieldMetricLong, fieldMetricFloat, fieldMetricDouble, fieldMetricBoolean:
+			raw, hasValue = v, true
+		case fieldMetricString, fieldMetricBytes:
+			rawBytes, hasValue = append([]byte(nil), b...), true
+		}
+		return nil
+	})
+	if err != nil || m.IsNull || !hasValue {
+		return m, err
+	}
+
+	m.Value = decodeValue(m.DataType, raw, rawBytes)
+	return m, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// decodeValue
+// DEV: 数値はint_value/long_value等の生の値、文字列・バイト列はrawBytesから型を戻す
+func decodeValue(dataType DataType, raw uint64, rawBytes []byte) interface{} {
+	switch dataType {
+	case TypeInt8:
+		return int8(raw)
+	case TypeInt16:
+		return int16(raw)
+	case TypeInt32:
+		return int32(raw)
+	case TypeInt64:
+		return int64(raw)
+	case TypeUInt8:
+		return uint8(raw)
+	case TypeUInt16:
+		return uint16(raw)
+	case TypeUInt32:
+		return uint32(raw)
+	case TypeUInt64, TypeDateTime:
+		return raw
+	case TypeFloat:
+		return math.Float32frombits(uint32(raw))
+	case TypeDouble:
+		return math.Float64frombits(raw)
+	case TypeBoolean:
+		return raw != 0
+	case TypeString, TypeText, TypeUUID:
+		return string(rawBytes)
+	case TypeBytes:
+		return rawBytes
+	}
+	// DEV: DataTypeはBIRTHにしか付かないことがあるため、型は後でretypeで解決する
+	if rawBytes != nil {
+		return rawBytes
+	}
+	return raw
+}
+
+// *--------------------------------------------------------------------------------------
+// retype
+// DEV: DataType無しでデコードしたメトリクスを、BIRTHで分かった型で解釈し直す
+func (m *Metric) retype(dataType DataType) {
+	if m.DataType != TypeUnknown || m.IsNull {
+		return
+	}
+	m.DataType = dataType
+	switch v := m.Value.(type) {
+	case uint64:
+		m.Value = decodeValue(dataType, v, nil)
+	case []byte:
+		m.Value = decodeValue(dataType, 0, v)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// walkFields
+// DEV: fixed32/fixed64もvに入れて渡す (float/doubleの復元用)
+func walkFields(data []byte, fn func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		var v uint64
+		var b []byte
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.Fixed32Type:
+			var v32 uint32
+			v32, n = protowire.ConsumeFixed32(data)
+			v = uint64(v32)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(data)
+		case protowire.BytesType:
+			b, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+		if err := fn(num, typ, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// appendBool
+func appendBool(buf []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return buf
+	}
+	buf = protowire.AppendTag(buf, num, protowire.VarintType)
+	return protowire.AppendVarint(buf, 1)
+}
+
+// *--------------------------------------------------------------------------------------
+// toInt64
+func toInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int8:
+		return int64(n), nil
+	case int16:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case uint:
+		return int64(n), nil
+	case uint8:
+		return int64(n), nil
+	case uint16:
+		return int64(n), nil
+	case uint32:
+		return int64(n), nil
+	case uint64:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	}
+	return 0, fmt.Errorf("%T is not an integer", v)
+}
+
+// *--------------------------------------------------------------------------------------
+// toUint64
+func toUint64(v interface{}) (uint64, error) {
+	switch n := v.(type) {
+	case uint64:
+		return n, nil
+	case time.Time:
+		return uint64(n.UnixMilli()), nil
+	}
+	n, err := toInt64(v)
+	return uint64(n), err
+}
+
+// *--------------------------------------------------------------------------------------
+// toFloat64
+func toFloat64(v interface{}) (float64, error) {
+	switch f := v.(type) {
+	case float32:
+		return float64(f), nil
+	case float64:
+		return f, nil
+	}
+	n, err := toInt64(v)
+	return float64(n), err
+}
@@ -0,0 +1,173 @@
+package sparkplug
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func ptr(v uint64) *uint64 { return &v }
+
+func TestPayloadKnownBytes(t *testing.T) {
+	// DEV: sparkplug_b.protoのフィールド番号から手で組み立てたバイト列
+	// timestamp=1, metrics[0]={name:"temp", alias:3, datatype:Int8, int_value:-2}, metrics[1]={name:"v", datatype:Double, double_value:1.5}, seq=5
+	known := "0801" +
+		"1210" + "0a0474656d70" + "1003" + "2001" + "50feffffff0f" +
+		"120e" + "0a0176" + "200a" + "69000000000000f83f" +
+		"1805"
+	payload := &Payload{
+		Timestamp: 1,
+		Metrics: []Metric{
+			{Name: "temp", Alias: ptr(3), DataType: TypeInt8, Value: int8(-2)},
+			{Name: "v", DataType: TypeDouble, Value: 1.5},
+		},
+		Seq: ptr(5),
+	}
+
+	data, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(data); got != known {
+		t.Errorf("Marshal =\n%s\nwant\n%s", got, known)
+	}
+
+	raw, _ := hex.DecodeString(known)
+	decoded, err := Unmarshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		t.Errorf("Unmarshal = %+v, want %+v", decoded, payload)
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	metrics := []Metric{
+		{Name: "i8", DataType: TypeInt8, Value: int8(math.MinInt8)},
+		{Name: "i16", DataType: TypeInt16, Value: int16(-300)},
+		{Name: "i32", DataType: TypeInt32, Value: int32(math.MinInt32)},
+		{Name: "i64", DataType: TypeInt64, Value: int64(math.MinInt64)},
+		{Name: "u8", DataType: TypeUInt8, Value: uint8(math.MaxUint8)},
+		{Name: "u16", DataType: TypeUInt16, Value: uint16(math.MaxUint16)},
+		{Name: "u32", DataType: TypeUInt32, Value: uint32(math.MaxUint32)},
+		{Name: "u64", DataType: TypeUInt64, Value: uint64(math.MaxUint64)},
+		{Name: "f", DataType: TypeFloat, Value: float32(-0.25)},
+		{Name: "d", DataType: TypeDouble, Value: math.Pi},
+		{Name: "b", DataType: TypeBoolean, Value: true},
+		{Name: "s", DataType: TypeString, Value: "text"},
+		{Name: "dt", DataType: TypeDateTime, Value: uint64(1700000000000), Timestamp: 1700000000001},
+		{Name: "bytes", DataType: TypeBytes, Value: []byte{0x00, 0xff}},
+		{Name: "null", DataType: TypeInt32, IsNull: true},
+		{Name: "hist", DataType: TypeBoolean, Value: false, IsHistorical: true, IsTransient: true},
+	}
+	payload := &Payload{Timestamp: 1700000000000, Metrics: metrics, Seq: ptr(255), UUID: "uuid", Body: []byte("body")}
+	data, err := payload.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, payload) {
+		for i := range metrics {
+			if i < len(decoded.Metrics) && !reflect.DeepEqual(decoded.Metrics[i], metrics[i]) {
+				t.Errorf("metric %s = %+v, want %+v", metrics[i].Name, decoded.Metrics[i], metrics[i])
+			}
+		}
+		t.Fatalf("Unmarshal = %+v, want %+v", decoded, payload)
+	}
+
+	// DEV: NDEATHのようにseqの無いペイロードはnilのまま
+	if decoded, err := Unmarshal(nil); err != nil || decoded.Seq != nil {
+		t.Errorf("empty payload = %+v, %v", decoded, err)
+	}
+}
+
+func TestPayloadRejectsBadValues(t *testing.T) {
+	for _, metric := range []Metric{
+		{Name: "b", DataType: TypeBoolean, Value: "true"},
+		{Name: "s", DataType: TypeString, Value: 1},
+		{Name: "i", DataType: TypeInt32, Value: "1"},
+		{Name: "unknown", DataType: TypeUnknown, Value: 1},
+	} {
+		if _, err := (&Payload{Metrics: []Metric{metric}}).Marshal(); err == nil {
+			t.Errorf("metric %+v was encoded", metric)
+		}
+	}
+
+	data, _ := (&Payload{Timestamp: 1, UUID: "uuid"}).Marshal()
+	for size := 1; size < len(data); size++ {
+		if size == 2 {
+			continue // timestampの直後 (フィールドの境界)
+		}
+		if _, err := Unmarshal(data[:size]); err == nil {
+			t.Errorf("payload truncated to %d bytes was decoded", size)
+		}
+	}
+}
+
+func TestMetricRetype(t *testing.T) {
+	// DEV: DATAにDataTypeが無い場合 (Aliasのみ) はBIRTHの型で解釈し直す
+	var data []byte
+	for _, metric := range []Metric{
+		{Alias: ptr(1), DataType: TypeInt16, Value: int16(-5)},
+		{Alias: ptr(2), DataType: TypeString, Value: "on"},
+		{Alias: ptr(3), DataType: TypeFloat, Value: float32(2.5)},
+	} {
+		data = protowire.AppendTag(data, fieldPayloadMetrics, protowire.BytesType)
+		data = protowire.AppendBytes(data, withoutDataType(t, metric))
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, dataType := range []DataType{TypeInt16, TypeString, TypeFloat} {
+		decoded.Metrics[i].retype(dataType)
+	}
+	want := []interface{}{int16(-5), "on", float32(2.5)}
+	for i, metric := range decoded.Metrics {
+		if metric.Value != want[i] {
+			t.Errorf("metric %d = %#v, want %#v", i, metric.Value, want[i])
+		}
+	}
+
+	// DEV: 型が付いているメトリクスは変えない
+	metric := Metric{DataType: TypeInt8, Value: int8(1)}
+	metric.retype(TypeString)
+	if metric.DataType != TypeInt8 || metric.Value != int8(1) {
+		t.Errorf("typed metric was retyped: %+v", metric)
+	}
+}
+
+// withoutDataType encodes a metric without its datatype field, as a DATA message may send it
+func withoutDataType(t *testing.T, metric Metric) []byte {
+	t.Helper()
+	encoded, err := metric.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []byte
+	walkFields(encoded, func(num protowire.Number, typ protowire.Type, v uint64, b []byte) error {
+		if num == fieldMetricDataType {
+			return nil
+		}
+		out = protowire.AppendTag(out, num, typ)
+		switch typ {
+		case protowire.VarintType:
+			out = protowire.AppendVarint(out, v)
+		case protowire.Fixed32Type:
+			out = protowire.AppendFixed32(out, uint32(v))
+		case protowire.Fixed64Type:
+			out = protowire.AppendFixed64(out, v)
+		case protowire.BytesType:
+			out = protowire.AppendBytes(out, b)
+		}
+		return nil
+	})
+	return out
+}
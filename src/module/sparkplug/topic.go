@@ -0,0 +1,75 @@
+package sparkplug
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	NAMESPACE string = "spBv1.0"
+
+	NBIRTH string = "NBIRTH"
+	NDEATH string = "NDEATH"
+	DBIRTH string = "DBIRTH"
+	DDEATH string = "DDEATH"
+	NDATA  string = "NDATA"
+	DDATA  string = "DDATA"
+	NCMD   string = "NCMD"
+	DCMD   string = "DCMD"
+	STATE  string = "STATE"
+
+	METRIC_BDSEQ   string = "bdSeq"
+	METRIC_REBIRTH string = "Node Control/Rebirth"
+)
+
+// Topic is a parsed Sparkplug B topic
+// spBv1.0/<group_id>/<message_type>/<edge_node_id>[/<device_id>]
+type Topic struct {
+	GroupID     string
+	MessageType string
+	EdgeNodeID  string
+	DeviceID    string
+}
+
+// *--------------------------------------------------------------------------------------
+// ParseTopic
+func ParseTopic(topic string) (Topic, error) {
+	levels := strings.Split(topic, "/")
+	if len(levels) < 4 || len(levels) > 5 || levels[0] != NAMESPACE {
+		return Topic{}, fmt.Errorf("%q is not a sparkplug topic", topic)
+	}
+	t := Topic{GroupID: levels[1], MessageType: levels[2], EdgeNodeID: levels[3]}
+	if len(levels) == 5 {
+		t.DeviceID = levels[4]
+	}
+	return t, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// String
+func (t Topic) String() string {
+	topic := fmt.Sprintf("%s/%s/%s/%s", NAMESPACE, t.GroupID, t.MessageType, t.EdgeNodeID)
+	if t.DeviceID != "" {
+		topic += "/" + t.DeviceID
+	}
+	return topic
+}
+
+// *--------------------------------------------------------------------------------------
+// NodeTopic
+func NodeTopic(groupID, messageType, edgeNodeID string) string {
+	return Topic{GroupID: groupID, MessageType: messageType, EdgeNodeID: edgeNodeID}.String()
+}
+
+// *--------------------------------------------------------------------------------------
+// DeviceTopic
+func DeviceTopic(groupID, messageType, edgeNodeID, deviceID string) string {
+	return Topic{GroupID: groupID, MessageType: messageType, EdgeNodeID: edgeNodeID, DeviceID: deviceID}.String()
+}
+
+// *--------------------------------------------------------------------------------------
+// StateTopic
+// DEV: Host Applicationのオンライン状態 (Sparkplug 3.0)
+func StateTopic(hostID string) string {
+	return fmt.Sprintf("%s/%s/%s", NAMESPACE, STATE, hostID)
+}
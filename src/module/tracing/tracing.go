@@ -0,0 +1,172 @@
+// module/tracing/tracing.go
+// DEV: OpenTelemetryのTracerProviderとW3C Trace Contextの伝搬を設定する
+//
+//	exporter : otlp (OTLP/HTTP, ローカルのCollectorなど) / stdout / file (JSON Lines)
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	EXPORTER_OTLP   string = "otlp"
+	EXPORTER_STDOUT string = "stdout"
+	EXPORTER_FILE   string = "file"
+
+	INSTRUMENTATION_NAME string = "github.com/tinayla696/mqtt_protocol_golang"
+	DEFAULT_SERVICE_NAME string = "mqtt_protocol_golang"
+)
+
+type (
+	// Config holds the tracing exporter settings
+	Config struct {
+		Exporter    string  `json:"exporter"`     // otlp / stdout / file (empty = disabled, trace context is still propagated)
+		Endpoint    string  `json:"endpoint"`     // OTLP/HTTP endpoint, e.g. 127.0.0.1:4318 (default = OTEL_EXPORTER_OTLP_ENDPOINT)
+		Insecure    bool    `json:"insecure"`     // Use plain HTTP for the OTLP endpoint
+		Path        string  `json:"path"`         // Output file of the file exporter
+		ServiceName string  `json:"service_name"` // service.name resource attribute
+		SampleRatio float64 `json:"sample_ratio"` // Ratio of new traces to sample (0 = all)
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Enabled
+func (conf Config) Enabled() bool {
+	return conf.Exporter != ""
+}
+
+// *--------------------------------------------------------------------------------------
+// Setup
+// DEV: グローバルのTracerProviderとPropagatorを設定する。shutdownで未送信のSpanを送り切る
+func Setup(ctx context.Context, conf Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if !conf.Enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closer, err := newExporter(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	serviceName := conf.ServiceName
+	if serviceName == "" {
+		serviceName = DEFAULT_SERVICE_NAME
+	}
+	sampler := sdktrace.AlwaysSample()
+	if conf.SampleRatio > 0 && conf.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(conf.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	zap.S().Infof("Tracing enabled (exporter %s, service %s)", conf.Exporter, serviceName)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			closer.Close()
+		}
+		return err
+	}, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// newExporter
+func newExporter(ctx context.Context, conf Config) (sdktrace.SpanExporter, io.Closer, error) {
+	switch conf.Exporter {
+	case EXPORTER_OTLP:
+		var opts []otlptracehttp.Option
+		if conf.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		return exporter, nil, nil
+
+	case EXPORTER_STDOUT:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exporter, nil, nil
+
+	case EXPORTER_FILE:
+		if conf.Path == "" {
+			return nil, nil, fmt.Errorf("file exporter requires a path")
+		}
+		file, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file %s: %w", conf.Path, err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(file))
+		if err != nil {
+			file.Close()
+			return nil, nil, fmt.Errorf("failed to create file exporter: %w", err)
+		}
+		return exporter, file, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown trace exporter %q", conf.Exporter)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Tracer
+func Tracer() trace.Tracer {
+	return otel.Tracer(INSTRUMENTATION_NAME)
+}
+
+// *--------------------------------------------------------------------------------------
+// Inject
+// DEV: ctxのSpanをtraceparent / tracestateのMapにする (Spanが無ければnil)
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// *--------------------------------------------------------------------------------------
+// Extract
+// DEV: Injectで作ったMapから親のSpanを復元したContextを返す
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// *--------------------------------------------------------------------------------------
+// End
+// DEV: エラーがあればSpanに記録してから終了する
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
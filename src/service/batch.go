@@ -0,0 +1,388 @@
+// service/batch.go
+// DEV: ルートに一致したMQTTメッセージをタスクにせずに溜め、件数・バイト数・時間のいずれかで
+// BatchTaskとしてbatchプールに投入する。失敗した要素だけを次のバッチに戻し、上限回数で Dead-letter に退避する
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_BATCH string = "batch" // バッチ処理に上限回数まで失敗した要素
+
+	DEFAULT_BATCH_MAX_ITEMS    int = 100
+	DEFAULT_BATCH_MAX_WAIT_MS  int = 1000
+	DEFAULT_BATCH_MAX_ATTEMPTS int = 3
+	DEFAULT_BATCH_QUEUE_SIZE   int = 64 // batchプールが未設定の場合のキュー長 (満杯のバッチは退避される)
+
+	BATCH_HANDLER_LOG  string = "log"
+	BATCH_HANDLER_FILE string = "file"
+
+	METRIC_BATCHES            string = "service_batches_total"
+	METRIC_BATCH_ITEMS        string = "service_batch_items_total"
+	METRIC_BATCH_RETRIED      string = "service_batch_retried_items_total"
+	METRIC_BATCH_DEAD_LETTERS string = "service_batch_failed_items_total"
+)
+
+type (
+	// BatchConfig accumulates the MQTT messages of a route into batches
+	BatchConfig struct {
+		Name        string   `json:"name"`
+		Topics      []string `json:"topics"`       // Topic filters of the route (first matching route wins)
+		Handler     string   `json:"handler"`      // log / file / name of a registered handler (default log)
+		Path        string   `json:"path"`         // Output of the file handler (JSON lines)
+		MaxItems    int      `json:"max_items"`    // Flush at this many items (default 100)
+		MaxBytes    int      `json:"max_bytes"`    // Flush before the payloads exceed this size (0 = unlimited)
+		MaxWaitMs   int      `json:"max_wait_ms"`  // Flush this long after the first item (default 1000)
+		MaxAttempts int      `json:"max_attempts"` // Attempts of an item before it is dead-lettered (default 3)
+		TimeoutMs   int      `json:"timeout_ms"`   // Execution timeout of a batch (default = timeout_ms of the batch pool)
+	}
+
+	// Batcher accumulates the MQTT messages of each route until a batch is full
+	Batcher struct {
+		routes  []*batchRoute
+		byName  map[string]*batchRoute
+		files   []*fileBatchHandler
+		nextID  atomic.Int64
+		stopped atomic.Bool
+
+		emit   func(task.Task) error                 // バッチの投入先 (Dispatcher.Submit)
+		reject func([]task.BatchItem, string, error) // 処理できなかった要素の退避先
+	}
+
+	// batchRoute is the accumulator of one route
+	batchRoute struct {
+		conf    BatchConfig
+		handler task.BatchHandler
+
+		mu     sync.Mutex
+		items  []task.BatchItem
+		bytes  int
+		timer  *time.Timer
+		gen    int  // 溜め始める毎に進める (期限切れの古いタイマーを無視する)
+		closed bool // Batcherの停止後は溜めない
+	}
+
+	// fileBatchHandler appends the items of each batch to a JSON lines file
+	fileBatchHandler struct {
+		mu   sync.Mutex
+		file *os.File
+	}
+
+	// batchRecord is a line written by fileBatchHandler
+	batchRecord struct {
+		Timestamp time.Time   `json:"timestamp"`
+		Hostname  string      `json:"hostname"`
+		Topic     string      `json:"topic"`
+		Value     interface{} `json:"value"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewBatcher (constructor)
+// DEV: 設定が無い場合はnilを返す。handlersはコードから登録するハンドラー (log / file より優先)
+func NewBatcher(confs []BatchConfig, handlers map[string]task.BatchHandler) (*Batcher, error) {
+	if len(confs) == 0 {
+		return nil, nil
+	}
+	b := &Batcher{byName: make(map[string]*batchRoute)}
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return nil, fmt.Errorf("batch name is required")
+		}
+		if _, ok := b.byName[conf.Name]; ok {
+			return nil, fmt.Errorf("duplicate batch %q", conf.Name)
+		}
+		if len(conf.Topics) == 0 {
+			return nil, fmt.Errorf("batch %s needs topics", conf.Name)
+		}
+		for _, filter := range conf.Topics {
+			if !mqttm.ValidTopicFilter(filter) {
+				return nil, fmt.Errorf("invalid topic filter %q in batch %s", filter, conf.Name)
+			}
+		}
+		if conf.MaxItems <= 0 {
+			conf.MaxItems = DEFAULT_BATCH_MAX_ITEMS
+		}
+		if conf.MaxWaitMs <= 0 {
+			conf.MaxWaitMs = DEFAULT_BATCH_MAX_WAIT_MS
+		}
+		if conf.MaxAttempts <= 0 {
+			conf.MaxAttempts = DEFAULT_BATCH_MAX_ATTEMPTS
+		}
+		handler, err := b.handlerFor(conf, handlers)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+		route := &batchRoute{conf: conf, handler: handler}
+		b.routes = append(b.routes, route)
+		b.byName[conf.Name] = route
+	}
+	return b, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// handlerFor
+func (b *Batcher) handlerFor(conf BatchConfig, handlers map[string]task.BatchHandler) (task.BatchHandler, error) {
+	if handler, ok := handlers[conf.Handler]; ok {
+		return handler, nil
+	}
+	switch conf.Handler {
+	case "", BATCH_HANDLER_LOG:
+		return logBatch, nil
+
+	case BATCH_HANDLER_FILE:
+		if conf.Path == "" {
+			return nil, fmt.Errorf("file handler of batch %s requires a path", conf.Name)
+		}
+		file, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open batch file of %s: %w", conf.Name, err)
+		}
+		handler := &fileBatchHandler{file: file}
+		b.files = append(b.files, handler)
+		return handler.handle, nil
+
+	default:
+		return nil, fmt.Errorf("unknown handler %q of batch %s", conf.Handler, conf.Name)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// WithBatcher
+// DEV: batchプールが設定されていなければ既定のプールを作る
+func WithBatcher(b *Batcher) Option {
+	return func(d *Dispatcher) {
+		if b == nil {
+			return
+		}
+		d.batcher = b
+		b.emit = d.Submit
+		b.reject = d.rejectBatch
+		if _, ok := d.poolConfs[task.BatchTaskType]; !ok {
+			d.poolConfs[task.BatchTaskType] = PoolConfig{QueueSize: DEFAULT_BATCH_QUEUE_SIZE}
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Add
+// DEV: ルートに一致すればバッチに溜めてtrueを返す (一致しなければMqttTaskとして処理する)
+func (b *Batcher) Add(contents mqttm.Contents, value interface{}) bool {
+	for _, route := range b.routes {
+		for _, filter := range route.conf.Topics {
+			if mqttm.MatchTopic(filter, contents.Topic) {
+				b.add(route, task.BatchItem{Contents: contents, Value: value})
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// add
+func (b *Batcher) add(route *batchRoute, items ...task.BatchItem) {
+	for _, item := range items {
+		full, ok := route.put(item, b.expire)
+		if !ok {
+			b.reject([]task.BatchItem{item}, DEAD_LETTER_SHUTDOWN, fmt.Errorf("batch %s is stopped", route.conf.Name))
+			continue
+		}
+		for _, batch := range full {
+			b.flush(route, batch)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// put
+// DEV: 溜まったバッチを返す。max_bytesを超える場合は追加する前に溜まっていた分を区切る
+func (r *batchRoute) put(item task.BatchItem, expire func(*batchRoute, int)) (full [][]task.BatchItem, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, false
+	}
+	size := len(item.Contents.Payload)
+	if r.conf.MaxBytes > 0 && len(r.items) > 0 && r.bytes+size > r.conf.MaxBytes {
+		full = append(full, r.take())
+	}
+	r.items = append(r.items, item)
+	r.bytes += size
+	if len(r.items) >= r.conf.MaxItems {
+		return append(full, r.take()), true
+	}
+	if len(r.items) == 1 {
+		gen := r.gen
+		r.timer = time.AfterFunc(time.Duration(r.conf.MaxWaitMs)*time.Millisecond, func() { expire(r, gen) })
+	}
+	return full, true
+}
+
+// *--------------------------------------------------------------------------------------
+// take
+// DEV: r.muを取得して呼ぶこと
+func (r *batchRoute) take() []task.BatchItem {
+	items := r.items
+	r.items = nil
+	r.bytes = 0
+	r.gen++
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	return items
+}
+
+// *--------------------------------------------------------------------------------------
+// expire
+// DEV: max_wait_msの経過時に溜まっている分を投入する
+func (b *Batcher) expire(route *batchRoute, gen int) {
+	route.mu.Lock()
+	if route.closed || route.gen != gen || len(route.items) == 0 {
+		route.mu.Unlock()
+		return
+	}
+	items := route.take()
+	route.mu.Unlock()
+	b.flush(route, items)
+}
+
+// *--------------------------------------------------------------------------------------
+// flush
+// DEV: 投入できなかった要素は退避する (停止中は reason=shutdown)
+func (b *Batcher) flush(route *batchRoute, items []task.BatchItem) {
+	t := &task.BatchTask{
+		ID:      int(b.nextID.Add(1)),
+		Route:   route.conf.Name,
+		Items:   items,
+		Handler: route.handler,
+		Timeout: time.Duration(route.conf.TimeoutMs) * time.Millisecond,
+		Failed:  b.failed,
+	}
+	if err := b.emit(t); err != nil {
+		reason := DEAD_LETTER_BATCH
+		if b.stopped.Load() {
+			reason = DEAD_LETTER_SHUTDOWN
+		}
+		b.reject(items, reason, fmt.Errorf("batch %s was not queued: %w", route.conf.Name, err))
+		return
+	}
+	metrics.Counter(METRIC_BATCHES, route.conf.Name).Add(1)
+	metrics.Counter(METRIC_BATCH_ITEMS, route.conf.Name).Add(int64(len(items)))
+}
+
+// *--------------------------------------------------------------------------------------
+// failed
+// DEV: BatchTaskから呼ばれる。失敗した要素だけを次のバッチに戻し、max_attemptsに達したものは退避する
+func (b *Batcher) failed(t *task.BatchTask, items []task.BatchItem, causes []error) {
+	route, ok := b.byName[t.Route]
+	if !ok {
+		return
+	}
+	var retry []task.BatchItem
+	for i, item := range items {
+		item.Attempts++
+		if item.Attempts >= route.conf.MaxAttempts {
+			metrics.Counter(METRIC_BATCH_DEAD_LETTERS, route.conf.Name).Add(1)
+			b.reject([]task.BatchItem{item}, DEAD_LETTER_BATCH, fmt.Errorf("batch %s failed %d times: %w", route.conf.Name, item.Attempts, causes[i]))
+			continue
+		}
+		retry = append(retry, item)
+	}
+	if len(retry) > 0 {
+		zap.S().Warnf("Retrying %d of %d items of %s", len(retry), len(t.Items), t.String())
+		metrics.Counter(METRIC_BATCH_RETRIED, route.conf.Name).Add(int64(len(retry)))
+		b.add(route, retry...)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// stop
+// DEV: Dispatcherが受信を止めた後、キューを閉じる前に呼ぶ。溜まっている分を投入し、以降は溜めない
+func (b *Batcher) stop() {
+	b.stopped.Store(true)
+	for _, route := range b.routes {
+		route.mu.Lock()
+		route.closed = true
+		items := route.take()
+		route.mu.Unlock()
+		if len(items) > 0 {
+			b.flush(route, items)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Close
+// DEV: fileハンドラーのファイルを閉じる (Dispatcher.Stopの後に呼ぶ)
+func (b *Batcher) Close() error {
+	var firstErr error
+	for _, handler := range b.files {
+		if err := handler.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// *--------------------------------------------------------------------------------------
+// rejectBatch
+func (d *Dispatcher) rejectBatch(items []task.BatchItem, reason string, cause error) {
+	for _, item := range items {
+		d.deadLetter(item.Contents, reason, cause)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// logBatch
+// DEV: 既定のハンドラー (件数のみをログに出す)
+func logBatch(ctx context.Context, route string, items []task.BatchItem) error {
+	zap.S().Infof("Batch %s: %d items", route, len(items))
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// handle (fileBatchHandler)
+// DEV: バッチ全体を1回で書き込む。エンコードできない要素だけを失敗として返す
+func (f *fileBatchHandler) handle(ctx context.Context, route string, items []task.BatchItem) error {
+	var buf bytes.Buffer
+	failed := make(map[int]error)
+	for i, item := range items {
+		line, err := json.Marshal(batchRecord{
+			Timestamp: item.Contents.Timestamp,
+			Hostname:  item.Contents.Hostname,
+			Topic:     item.Contents.Topic,
+			Value:     item.Value,
+		})
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+		buf.Write(append(line, '\n'))
+	}
+	f.mu.Lock()
+	_, err := f.file.Write(buf.Bytes())
+	f.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write batch %s: %w", route, err)
+	}
+	if len(failed) > 0 {
+		return &task.BatchError{Failed: failed}
+	}
+	return nil
+}
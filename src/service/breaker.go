@@ -0,0 +1,376 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/admin"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	BREAKER_CLOSED    BreakerState = "closed"
+	BREAKER_OPEN      BreakerState = "open"
+	BREAKER_HALF_OPEN BreakerState = "half-open"
+
+	BREAKER_MIDDLEWARE_PREFIX string = "breaker:" // Middleware名 = breaker:<name>
+
+	DEFAULT_BREAKER_FAILURES  int = 5
+	DEFAULT_BREAKER_OPEN_SEC  int = 30
+	DEFAULT_BREAKER_HALF_OPEN int = 1
+
+	DEAD_LETTER_CIRCUIT_OPEN string = "circuit_open" // サーキットブレーカーのopen中に実行しなかったタスク
+
+	METRIC_BREAKER_STATE    string = "service_breaker_state" // 0 = closed, 1 = half-open, 2 = open
+	METRIC_BREAKER_REJECTED string = "service_breaker_rejected_total"
+	METRIC_BREAKER_OPENED   string = "service_breaker_opened_total"
+)
+
+var (
+	// ErrCircuitOpen is returned instead of running a call while the breaker is open
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	breakerStateValues = map[BreakerState]float64{
+		BREAKER_CLOSED:    0,
+		BREAKER_HALF_OPEN: 1,
+		BREAKER_OPEN:      2,
+	}
+)
+
+type (
+	// BreakerState is the state of a CircuitBreaker
+	BreakerState string
+
+	// BreakerConfig holds the thresholds of a CircuitBreaker
+	// DEV: タスクへの適用はMiddlewareのuse / types / routesで breaker:<name> を指定する
+	BreakerConfig struct {
+		Name             string        `json:"name"`
+		FailureThreshold int           `json:"failure_threshold"` // Consecutive failures that open the breaker (default 5)
+		OpenSec          int           `json:"open_sec"`          // Time the breaker stays open before a trial (default 30)
+		HalfOpenMax      int           `json:"half_open_max"`     // Trial calls in half-open, all must succeed to close (default 1)
+		Pause            *BreakerPause `json:"pause"`             // Subscriptions paused while the breaker is open
+	}
+
+	// BreakerPause names the subscriptions of an MQTT client to pause while open
+	BreakerPause struct {
+		Host   string   `json:"host"`
+		Topics []string `json:"topics"` // Filters as written in subscribe_topics
+	}
+
+	// CircuitBreaker stops calls to a failing dependency for a while
+	// DEV: closed -> (連続失敗) -> open -> (open_sec経過) -> half-open -> (試行が全て成功) -> closed / (失敗) -> open
+	CircuitBreaker struct {
+		conf BreakerConfig
+
+		mu        sync.Mutex
+		state     BreakerState
+		failures  int       // closed中の連続失敗数
+		openedAt  time.Time // openになった時刻
+		trials    int       // half-open中に許可した試行数
+		successes int       // half-open中の成功数
+		listeners []func(name string, from, to BreakerState)
+		notifyMu  sync.Mutex // 通知を1つずつ行う (遷移の順序の入れ替わりを防ぐ)
+	}
+
+	// BreakerStatus is the state reported by the admin API
+	BreakerStatus struct {
+		State    BreakerState `json:"state"`
+		Failures int          `json:"failures"`
+		OpenedAt *time.Time   `json:"opened_at,omitempty"`
+	}
+
+	// Pauser is implemented by MQTT clients that can pause subscriptions (mqttm.Module)
+	Pauser interface {
+		Pause(topics ...string) error
+		Resume(topics ...string) error
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewCircuitBreaker (constructor)
+func NewCircuitBreaker(conf BreakerConfig) *CircuitBreaker {
+	if conf.FailureThreshold <= 0 {
+		conf.FailureThreshold = DEFAULT_BREAKER_FAILURES
+	}
+	if conf.OpenSec <= 0 {
+		conf.OpenSec = DEFAULT_BREAKER_OPEN_SEC
+	}
+	if conf.HalfOpenMax <= 0 {
+		conf.HalfOpenMax = DEFAULT_BREAKER_HALF_OPEN
+	}
+	b := &CircuitBreaker{conf: conf, state: BREAKER_CLOSED}
+	metrics.Gauge(METRIC_BREAKER_STATE, conf.Name).Set(breakerStateValues[BREAKER_CLOSED])
+	return b
+}
+
+// *--------------------------------------------------------------------------------------
+// NewCircuitBreakers (constructor)
+// DEV: 名前毎のBreakerと、それぞれのMiddleware (breaker:<name>) を返す
+func NewCircuitBreakers(confs []BreakerConfig) (map[string]*CircuitBreaker, map[string]Middleware, error) {
+	breakers := make(map[string]*CircuitBreaker, len(confs))
+	middlewares := make(map[string]Middleware, len(confs))
+	for _, conf := range confs {
+		if conf.Name == "" {
+			return nil, nil, fmt.Errorf("circuit breaker name is required")
+		}
+		if _, ok := breakers[conf.Name]; ok {
+			return nil, nil, fmt.Errorf("duplicate circuit breaker %q", conf.Name)
+		}
+		if conf.Pause != nil {
+			for _, topic := range conf.Pause.Topics {
+				if !mqttm.ValidTopicFilter(topic) {
+					return nil, nil, fmt.Errorf("invalid pause topic filter %q of circuit breaker %s", topic, conf.Name)
+				}
+			}
+		}
+		b := NewCircuitBreaker(conf)
+		breakers[conf.Name] = b
+		middlewares[BREAKER_MIDDLEWARE_PREFIX+conf.Name] = b.Middleware()
+	}
+	return breakers, middlewares, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Name
+func (b *CircuitBreaker) Name() string {
+	return b.conf.Name
+}
+
+// *--------------------------------------------------------------------------------------
+// Config
+func (b *CircuitBreaker) Config() BreakerConfig {
+	return b.conf
+}
+
+// *--------------------------------------------------------------------------------------
+// State
+func (b *CircuitBreaker) State() BreakerState {
+	return b.Status().State
+}
+
+// *--------------------------------------------------------------------------------------
+// Status
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	notify := b.advance(time.Now())
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state != BREAKER_CLOSED {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	b.mu.Unlock()
+	notify()
+	return status
+}
+
+// *--------------------------------------------------------------------------------------
+// OnStateChange
+// DEV: 状態の遷移毎に呼ばれる (Breakerのロック外で、遷移を起こしたGoroutineから呼ばれる)
+func (b *CircuitBreaker) OnStateChange(fn func(name string, from, to BreakerState)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.listeners = append(b.listeners, fn)
+}
+
+// *--------------------------------------------------------------------------------------
+// Allow
+// DEV: 呼び出してよければnilを返す。nilの場合は結果を必ずDoneで報告すること
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	notify := b.advance(time.Now())
+	var err error
+	switch b.state {
+	case BREAKER_OPEN:
+		err = ErrCircuitOpen
+	case BREAKER_HALF_OPEN:
+		if b.trials >= b.conf.HalfOpenMax {
+			err = ErrCircuitOpen
+		} else {
+			b.trials++
+		}
+	}
+	b.mu.Unlock()
+	notify()
+	if err != nil {
+		metrics.Counter(METRIC_BREAKER_REJECTED, b.conf.Name).Add(1)
+		return fmt.Errorf("%s: %w", b.conf.Name, err)
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Done
+// DEV: Allowで許可された呼び出しの結果を報告する。停止によるキャンセルは成功・失敗のどちらにも数えない
+func (b *CircuitBreaker) Done(err error) {
+	failed := err != nil
+	b.mu.Lock()
+	if errors.Is(err, context.Canceled) {
+		if b.state == BREAKER_HALF_OPEN && b.trials > 0 {
+			b.trials--
+		}
+		b.mu.Unlock()
+		return
+	}
+	var notify func()
+	switch b.state {
+	case BREAKER_CLOSED:
+		if !failed {
+			b.failures = 0
+		} else if b.failures++; b.failures >= b.conf.FailureThreshold {
+			notify = b.transition(BREAKER_OPEN, time.Now())
+		}
+	case BREAKER_HALF_OPEN:
+		if failed {
+			notify = b.transition(BREAKER_OPEN, time.Now())
+		} else if b.successes++; b.successes >= b.conf.HalfOpenMax {
+			notify = b.transition(BREAKER_CLOSED, time.Now())
+		}
+	}
+	b.mu.Unlock()
+	if notify != nil {
+		notify()
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Do
+// DEV: タスクから下流の呼び出しを包んで使う
+func (b *CircuitBreaker) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+	err := fn(ctx)
+	b.Done(err)
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// Middleware
+// DEV: open中のタスクはErrCircuitOpenで実行せずに返す (WorkerがDead-letterに退避する)
+func (b *CircuitBreaker) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			return b.Do(ctx, func(ctx context.Context) error {
+				return next(ctx, t)
+			})
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// advance
+// DEV: open_secを過ぎたopenをhalf-openにする (ロック中に呼ぶ)
+func (b *CircuitBreaker) advance(now time.Time) func() {
+	if b.state == BREAKER_OPEN && now.Sub(b.openedAt) >= time.Duration(b.conf.OpenSec)*time.Second {
+		return b.transition(BREAKER_HALF_OPEN, now)
+	}
+	return func() {}
+}
+
+// *--------------------------------------------------------------------------------------
+// current
+// DEV: 時間経過による遷移を起こさずに現在の状態を返す (リスナーの中から呼ぶ)
+func (b *CircuitBreaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// *--------------------------------------------------------------------------------------
+// wake
+// DEV: 古いタイマー (再度openになる前のもの) はadvanceの経過時間の判定で無視される
+func (b *CircuitBreaker) wake() {
+	b.mu.Lock()
+	notify := b.advance(time.Now())
+	b.mu.Unlock()
+	notify()
+}
+
+// *--------------------------------------------------------------------------------------
+// transition
+// DEV: ロック中に呼び、リスナーへの通知はロックを外してから返り値の関数で行う
+func (b *CircuitBreaker) transition(to BreakerState, now time.Time) func() {
+	from := b.state
+	b.state = to
+	b.trials = 0
+	b.successes = 0
+	switch to {
+	case BREAKER_OPEN:
+		b.openedAt = now
+		metrics.Counter(METRIC_BREAKER_OPENED, b.conf.Name).Add(1)
+		// DEV: 購読を止めているとAllowが呼ばれないため、タイマーでhalf-openに進める
+		time.AfterFunc(time.Duration(b.conf.OpenSec)*time.Second, b.wake)
+	case BREAKER_CLOSED:
+		b.failures = 0
+	}
+	metrics.Gauge(METRIC_BREAKER_STATE, b.conf.Name).Set(breakerStateValues[to])
+	listeners := append([]func(string, BreakerState, BreakerState){}, b.listeners...)
+	return func() {
+		b.notifyMu.Lock()
+		defer b.notifyMu.Unlock()
+		if to == BREAKER_OPEN {
+			zap.S().Warnf("Circuit breaker %s %s -> %s", b.conf.Name, from, to)
+		} else {
+			zap.S().Infof("Circuit breaker %s %s -> %s", b.conf.Name, from, to)
+		}
+		for _, fn := range listeners {
+			fn(b.conf.Name, from, to)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// PauseWhileOpen
+// DEV: open中は購読を止め、half-openになったら試行のために購読し直す。
+// 通知が前後しても最終的な状態に合わせるよう、通知時点の状態で判定する (Pause・Resumeは冪等)
+func PauseWhileOpen(b *CircuitBreaker, client Pauser, topics ...string) {
+	b.OnStateChange(func(name string, from, to BreakerState) {
+		var err error
+		if b.current() == BREAKER_OPEN {
+			err = client.Pause(topics...)
+		} else {
+			err = client.Resume(topics...)
+		}
+		if err != nil {
+			zap.S().Errorf("Circuit breaker %s failed to toggle subscriptions %v: %v", name, topics, err)
+		}
+	})
+}
+
+// *--------------------------------------------------------------------------------------
+// circuitOpen
+// DEV: open中に実行しなかったMqttTask・BatchTaskの受信内容はDead-letterに退避する (replayで再投入できる)。それ以外は破棄する
+func (d *Dispatcher) circuitOpen(t task.Task, cause error) {
+	contents := contentsOf(t)
+	if contents == nil {
+		zap.S().Warnf("Dropped task %s: %v", t.String(), cause)
+		return
+	}
+	for _, c := range contents {
+		d.deadLetter(c, DEAD_LETTER_CIRCUIT_OPEN, cause)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// BreakersHandler
+// DEV: GET = 全Breakerの状態
+func BreakersHandler(breakers map[string]*CircuitBreaker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		status := make(map[string]BreakerStatus, len(breakers))
+		for name, b := range breakers {
+			status[name] = b.Status()
+		}
+		admin.WriteJSON(w, http.StatusOK, status)
+	})
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDownstream = errors.New("downstream failed")
+
+// expireOpen moves the open time back so that the next call sees open_sec elapsed
+func expireOpen(b *CircuitBreaker) {
+	b.mu.Lock()
+	b.openedAt = b.openedAt.Add(-time.Duration(b.conf.OpenSec) * time.Second)
+	b.mu.Unlock()
+}
+
+func failTimes(t *testing.T, b *CircuitBreaker, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("Allow #%d = %v, want nil", i, err)
+		}
+		b.Done(errDownstream)
+	}
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{Name: "open", FailureThreshold: 3})
+	failTimes(t, b, 2)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("state = %s after 2 failures, want closed", b.State())
+	}
+	// DEV: 成功で連続失敗数は0に戻る
+	b.Allow()
+	b.Done(nil)
+	failTimes(t, b, 2)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("state = %s, a success should reset the count", b.State())
+	}
+	failTimes(t, b, 1)
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("state = %s after 3 consecutive failures, want open", b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow while open = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestBreakerHalfOpenCloses(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{Name: "close", FailureThreshold: 1, HalfOpenMax: 2})
+	failTimes(t, b, 1)
+	expireOpen(b)
+	if b.State() != BREAKER_HALF_OPEN {
+		t.Fatalf("state = %s after open_sec, want half-open", b.State())
+	}
+
+	// DEV: half-openではhalf_open_max回だけ試行を許可する
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("trial #%d = %v, want nil", i, err)
+		}
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Allow over half_open_max = %v, want ErrCircuitOpen", err)
+	}
+	b.Done(nil)
+	if b.State() != BREAKER_HALF_OPEN {
+		t.Fatalf("state = %s after 1 of 2 trials, want half-open", b.State())
+	}
+	b.Done(nil)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("state = %s after all trials succeeded, want closed", b.State())
+	}
+}
+
+func TestBreakerHalfOpenFailureReopens(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{Name: "reopen", FailureThreshold: 1})
+	failTimes(t, b, 1)
+	expireOpen(b)
+	failTimes(t, b, 1)
+	if b.State() != BREAKER_OPEN {
+		t.Fatalf("state = %s after a failed trial, want open", b.State())
+	}
+}
+
+func TestBreakerIgnoresCancellation(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{Name: "cancel", FailureThreshold: 1})
+	b.Allow()
+	b.Done(context.Canceled)
+	if b.State() != BREAKER_CLOSED {
+		t.Fatalf("state = %s after a cancelled call, want closed", b.State())
+	}
+
+	failTimes(t, b, 1)
+	expireOpen(b)
+	b.Allow()
+	b.Done(context.Canceled)
+	// DEV: キャンセルされた試行は数えず、もう一度試行できる
+	if err := b.Allow(); err != nil {
+		t.Fatalf("Allow after a cancelled trial = %v, want nil", err)
+	}
+}
+
+func TestBreakerNotifiesTransitions(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{Name: "notify", FailureThreshold: 1})
+	var transitions []string
+	b.OnStateChange(func(name string, from, to BreakerState) {
+		transitions = append(transitions, string(from)+"->"+string(to))
+	})
+	failTimes(t, b, 1)
+	expireOpen(b)
+	b.Allow()
+	b.Done(nil)
+
+	want := []string{"closed->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Fatalf("transitions = %v, want %v", transitions, want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_DECODE     string = "decode"     // ペイロードのデコード失敗
+	DEAD_LETTER_QUEUE_FULL string = "queue_full" // 受信したメッセージをキューに積めなかった
+
+	METRIC_DEAD_LETTERS string = "service_dead_letters_total"
+)
+
+type (
+	// DeadLetter stores messages that could not be processed
+	DeadLetter interface {
+		Put(ctx context.Context, entry DeadLetterEntry) error
+	}
+
+	// DeadLetterEntry is a single dead-lettered message
+	DeadLetterEntry struct {
+		Timestamp time.Time      `json:"timestamp"`
+		Reason    string         `json:"reason"`
+		Error     string         `json:"error"`
+		Contents  mqttm.Contents `json:"contents"`
+	}
+
+	// DeadLetterConfig holds the dead-letter destinations
+	DeadLetterConfig struct {
+		Path  string `json:"path"`  // JSON lines file
+		Host  string `json:"host"`  // MQTT client to republish with
+		Topic string `json:"topic"` // Topic to republish to
+	}
+
+	// fileDeadLetter appends entries to a JSON lines file
+	fileDeadLetter struct {
+		mu   sync.Mutex
+		file *os.File
+	}
+
+	// topicDeadLetter republishes entries to an MQTT topic
+	topicDeadLetter struct {
+		client mqttm.Client
+		topic  string
+	}
+
+	// multiDeadLetter fans an entry out to several stores
+	multiDeadLetter []DeadLetter
+
+	// logDeadLetter only logs the entry (default)
+	logDeadLetter struct{}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewDeadLetter (constructor)
+// DEV: 設定が無い場合はログ出力のみ
+func NewDeadLetter(conf DeadLetterConfig, clients map[string]mqttm.Client) (DeadLetter, error) {
+	var stores multiDeadLetter
+	if conf.Path != "" {
+		file, err := os.OpenFile(conf.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open dead-letter file: %w", err)
+		}
+		stores = append(stores, &fileDeadLetter{file: file})
+	}
+	if conf.Topic != "" {
+		client, ok := clients[conf.Host]
+		if !ok {
+			return nil, fmt.Errorf("dead-letter host %q is not a configured MQTT client", conf.Host)
+		}
+		stores = append(stores, &topicDeadLetter{client: client, topic: conf.Topic})
+	}
+	if len(stores) == 0 {
+		return logDeadLetter{}, nil
+	}
+	return stores, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Put (fileDeadLetter)
+func (f *fileDeadLetter) Put(ctx context.Context, entry DeadLetterEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = f.file.Write(append(line, '\n'))
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// Put (topicDeadLetter)
+func (t *topicDeadLetter) Put(ctx context.Context, entry DeadLetterEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return t.client.Publish(t.topic, mqttm.DEFAULT_QOS, payload)
+}
+
+// *--------------------------------------------------------------------------------------
+// Put (multiDeadLetter)
+func (m multiDeadLetter) Put(ctx context.Context, entry DeadLetterEntry) error {
+	var firstErr error
+	for _, store := range m {
+		if err := store.Put(ctx, entry); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// *--------------------------------------------------------------------------------------
+// Put (logDeadLetter)
+func (logDeadLetter) Put(ctx context.Context, entry DeadLetterEntry) error {
+	zap.S().Warnf("Dead-letter (%s) %s: %s", entry.Reason, entry.Contents.Topic, entry.Error)
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// deadLetter
+// DEV: Dispatcher/Workerから呼ばれる共通の退避処理
+func (d *Dispatcher) deadLetter(contents mqttm.Contents, reason string, cause error) {
+	d.divert(d.deadLetters, contents, reason, cause)
+}
+
+// *--------------------------------------------------------------------------------------
+// contentsOf
+// DEV: タスクの元になった受信内容 (MqttTaskは1件、BatchTaskは全ての要素、それ以外はnil)
+func contentsOf(t task.Task) []mqttm.Contents {
+	switch t := t.(type) {
+	case *task.MqttTask:
+		return []mqttm.Contents{t.Contents}
+	case *task.BatchTask:
+		contents := make([]mqttm.Contents, 0, len(t.Items))
+		for _, item := range t.Items {
+			contents = append(contents, item.Contents)
+		}
+		return contents
+	default:
+		return nil
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// divert
+// DEV: storeがnilの場合はDead-letterに退避する
+func (d *Dispatcher) divert(store DeadLetter, contents mqttm.Contents, reason string, cause error) {
+	if store == nil {
+		store = d.deadLetters
+	}
+	metrics.Counter(METRIC_DEAD_LETTERS, reason).Add(1)
+	entry := DeadLetterEntry{
+		Timestamp: time.Now(),
+		Reason:    reason,
+		Error:     cause.Error(),
+		Contents:  contents,
+	}
+	if err := store.Put(d.ctx, entry); err != nil {
+		zap.S().Errorf("Failed to store %s rejection for %s: %v", reason, contents.Topic, err)
+	}
+}
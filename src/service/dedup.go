@@ -0,0 +1,373 @@
+package service
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	DEDUP_KEY_HASH     string = "hash"      // トピック + ペイロードのSHA-256 (同じ値の正当な繰り返しも捨てる)
+	DEDUP_KEY_FIELD    string = "field:"    // デコード済みペイロードのフィールド (例: field:meta.id)
+	DEDUP_KEY_PROPERTY string = "property:" // MQTT 5のUser Property
+
+	DEFAULT_DEDUP_WINDOW_SEC int = 300
+	DEFAULT_DEDUP_SIZE       int = 10000
+
+	METRIC_DEDUP_HITS string = "service_dedup_hits_total"
+)
+
+type (
+	// DedupConfig holds the deduplication settings
+	DedupConfig struct {
+		Enabled   bool     `json:"enabled"`
+		Key       string   `json:"key"`        // field:<path> / hash (required)
+		WindowSec int      `json:"window_sec"` // How long a message ID is remembered (default 300)
+		Size      int      `json:"size"`       // Max remembered IDs (default 10000)
+		Path      string   `json:"path"`       // On-disk store (empty = in-memory)
+		Topics    []string `json:"topics"`     // Topic filters to deduplicate (empty = all)
+	}
+
+	// Deduplicator drops messages whose ID was seen within the window
+	Deduplicator struct {
+		field  []string // field:の場合のパス
+		topics []string
+		store  dedupStore
+	}
+
+	// dedupStore remembers message IDs for a time window
+	dedupStore interface {
+		seen(key string, now time.Time) bool // 記録済みならtrue、未記録なら記録してfalse
+		forget(key string)                   // 記録を取り消す
+	}
+
+	// lruStore is a bounded in-memory store evicting the oldest IDs first
+	lruStore struct {
+		mu     sync.Mutex
+		window time.Duration
+		size   int
+		order  *list.List               // 古い順
+		index  map[string]*list.Element // key -> *dedupEntry
+	}
+
+	// dedupEntry is a remembered message ID
+	dedupEntry struct {
+		key  string
+		seen time.Time
+	}
+
+	// fileStore persists the lruStore to an append-only file
+	fileStore struct {
+		*lruStore
+		path    string
+		file    *os.File
+		written int
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewDeduplicator (constructor)
+// DEV: 無効の場合はnilを返す
+func NewDeduplicator(conf DedupConfig) (*Deduplicator, error) {
+	if !conf.Enabled {
+		return nil, nil
+	}
+	if conf.WindowSec <= 0 {
+		conf.WindowSec = DEFAULT_DEDUP_WINDOW_SEC
+	}
+	if conf.Size <= 0 {
+		conf.Size = DEFAULT_DEDUP_SIZE
+	}
+
+	d := &Deduplicator{topics: conf.Topics}
+	switch {
+	case conf.Key == "":
+		// DEV: hashを既定にすると、同じ値を繰り返し送るセンサーのメッセージを黙って捨ててしまう
+		return nil, fmt.Errorf("dedup key is required when dedup is enabled (field:<path> or hash)")
+	case conf.Key == DEDUP_KEY_HASH:
+	case strings.HasPrefix(conf.Key, DEDUP_KEY_FIELD):
+		path := strings.TrimPrefix(conf.Key, DEDUP_KEY_FIELD)
+		if path == "" {
+			return nil, fmt.Errorf("dedup key %q has no field path", conf.Key)
+		}
+		d.field = strings.Split(path, ".")
+	case strings.HasPrefix(conf.Key, DEDUP_KEY_PROPERTY):
+		return nil, fmt.Errorf("dedup key %q needs MQTT 5 user properties, which the MQTT 3.1.1 client does not provide", conf.Key)
+	default:
+		return nil, fmt.Errorf("unknown dedup key %q", conf.Key)
+	}
+
+	store := newLRUStore(time.Duration(conf.WindowSec)*time.Second, conf.Size)
+	if conf.Path == "" {
+		d.store = store
+		return d, nil
+	}
+	fs, err := openFileStore(conf.Path, store)
+	if err != nil {
+		return nil, err
+	}
+	d.store = fs
+	return d, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Duplicate
+// DEV: IDを取り出せないメッセージは重複とみなさない
+func (d *Deduplicator) Duplicate(contents mqttm.Contents, value interface{}) bool {
+	if len(d.topics) > 0 && !matchAny(d.topics, contents.Topic) {
+		return false
+	}
+	key, ok := d.key(contents, value)
+	if !ok {
+		return false
+	}
+	if !d.store.seen(key, time.Now()) {
+		return false
+	}
+	metrics.Counter(METRIC_DEDUP_HITS, contents.Hostname).Add(1)
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// Forget
+// DEV: Duplicateで記録した後にキューへ積めなかったメッセージの記録を取り消す (再送を重複扱いしない)
+func (d *Deduplicator) Forget(contents mqttm.Contents, value interface{}) {
+	if len(d.topics) > 0 && !matchAny(d.topics, contents.Topic) {
+		return
+	}
+	if key, ok := d.key(contents, value); ok {
+		d.store.forget(key)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// key
+func (d *Deduplicator) key(contents mqttm.Contents, value interface{}) (string, bool) {
+	id := contents.Payload
+	if d.field != nil {
+		field, ok := lookupField(value, d.field)
+		if !ok {
+			return "", false
+		}
+		id = []byte(fmt.Sprint(field))
+	}
+	// DEV: 別トピックで同じIDが使われても衝突しないようトピックを含めてハッシュする
+	sum := sha256.New()
+	sum.Write([]byte(contents.Topic))
+	sum.Write([]byte{0})
+	sum.Write(id)
+	return hex.EncodeToString(sum.Sum(nil)), true
+}
+
+// *--------------------------------------------------------------------------------------
+// lookupField
+// DEV: デコード済みペイロードから "a.b.c" のパスで値を取り出す (nilは未設定扱い)
+func lookupField(value interface{}, path []string) (interface{}, bool) {
+	for _, name := range path {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = fields[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// *--------------------------------------------------------------------------------------
+// matchAny
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if mqttm.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// newLRUStore (constructor)
+func newLRUStore(window time.Duration, size int) *lruStore {
+	return &lruStore{
+		window: window,
+		size:   size,
+		order:  list.New(),
+		index:  make(map[string]*list.Element),
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// seen (lruStore)
+func (s *lruStore) seen(key string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.check(key, now)
+}
+
+// *--------------------------------------------------------------------------------------
+// forget (lruStore)
+func (s *lruStore) forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.drop(key)
+}
+
+// *--------------------------------------------------------------------------------------
+// check (s.mu must be held)
+func (s *lruStore) check(key string, now time.Time) bool {
+	s.expire(now)
+	if _, ok := s.index[key]; ok {
+		return true
+	}
+	s.add(key, now)
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// drop (s.mu must be held)
+func (s *lruStore) drop(key string) {
+	if e, ok := s.index[key]; ok {
+		s.remove(e)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// add (s.mu must be held)
+func (s *lruStore) add(key string, at time.Time) {
+	s.index[key] = s.order.PushBack(&dedupEntry{key: key, seen: at})
+	for s.order.Len() > s.size {
+		s.remove(s.order.Front())
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// expire (s.mu must be held)
+func (s *lruStore) expire(now time.Time) {
+	for front := s.order.Front(); front != nil; front = s.order.Front() {
+		if now.Sub(front.Value.(*dedupEntry).seen) < s.window {
+			return
+		}
+		s.remove(front)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// remove (s.mu must be held)
+func (s *lruStore) remove(e *list.Element) {
+	s.order.Remove(e)
+	delete(s.index, e.Value.(*dedupEntry).key)
+}
+
+// *--------------------------------------------------------------------------------------
+// openFileStore
+// DEV: "<unix ns> <key>" の行を追記する (取り消しは "<unix ns> -<key>")。起動時にウィンドウ内の行を読み戻す
+func openFileStore(path string, store *lruStore) (*fileStore, error) {
+	fs := &fileStore{lruStore: store, path: path}
+	if file, err := os.Open(path); err == nil {
+		now := time.Now()
+		scan := bufio.NewScanner(file)
+		for scan.Scan() {
+			stamp, key, ok := strings.Cut(scan.Text(), " ")
+			nanos, err := strconv.ParseInt(stamp, 10, 64)
+			if !ok || err != nil {
+				continue
+			}
+			if forgotten, ok := strings.CutPrefix(key, "-"); ok {
+				store.drop(forgotten)
+				continue
+			}
+			if at := time.Unix(0, nanos); now.Sub(at) < store.window {
+				if _, dup := store.index[key]; !dup {
+					store.add(key, at)
+				}
+			}
+		}
+		file.Close()
+	}
+	if err := fs.compact(); err != nil {
+		return nil, fmt.Errorf("failed to open dedup store %s: %w", path, err)
+	}
+	return fs, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// seen (fileStore)
+// DEV: 記録と追記を同じロックで行う (間にforgetやcompactが入るとファイルとメモリの内容がずれる)
+func (fs *fileStore) seen(key string, now time.Time) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.check(key, now) {
+		return true
+	}
+	fs.append(now, key)
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// forget (fileStore)
+func (fs *fileStore) forget(key string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.drop(key)
+	fs.append(time.Now(), "-"+key)
+}
+
+// *--------------------------------------------------------------------------------------
+// append (fs.mu must be held)
+func (fs *fileStore) append(now time.Time, line string) {
+	if _, err := fmt.Fprintf(fs.file, "%d %s\n", now.UnixNano(), line); err != nil {
+		zap.S().Errorf("Failed to write dedup store %s: %v", fs.path, err)
+	}
+	fs.written++
+	// DEV: 追記が保持件数の2倍を超えたら、保持中のIDだけで書き直す
+	if fs.written > 2*fs.size {
+		if err := fs.compact(); err != nil {
+			zap.S().Errorf("Failed to compact dedup store %s: %v", fs.path, err)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// compact (fs.mu must be held, or during open)
+func (fs *fileStore) compact() error {
+	tmp := fs.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for e := fs.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*dedupEntry)
+		fmt.Fprintf(w, "%d %s\n", entry.seen.UnixNano(), entry.key)
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+	if fs.file != nil {
+		fs.file.Close()
+	}
+	if fs.file, err = os.OpenFile(fs.path, os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+		return err
+	}
+	fs.written = fs.order.Len()
+	return nil
+}
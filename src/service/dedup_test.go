@@ -0,0 +1,109 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeduplicatorRequiresKey(t *testing.T) {
+	for _, conf := range []DedupConfig{
+		{Enabled: true},
+		{Enabled: true, Key: "field:"},
+		{Enabled: true, Key: "property:id"},
+		{Enabled: true, Key: "payload"},
+	} {
+		if _, err := NewDeduplicator(conf); err == nil {
+			t.Errorf("config %+v was accepted", conf)
+		}
+	}
+	if d, err := NewDeduplicator(DedupConfig{}); d != nil || err != nil {
+		t.Errorf("disabled dedup = %v, %v, want nil", d, err)
+	}
+	for _, key := range []string{DEDUP_KEY_HASH, "field:meta.id"} {
+		if _, err := NewDeduplicator(DedupConfig{Enabled: true, Key: key}); err != nil {
+			t.Errorf("key %s: %v", key, err)
+		}
+	}
+}
+
+func TestLRUStoreWindowAndSize(t *testing.T) {
+	store := newLRUStore(time.Minute, 2)
+	now := time.Unix(1700000000, 0)
+	if store.seen("a", now) || !store.seen("a", now.Add(time.Second)) {
+		t.Fatal("a was not remembered")
+	}
+	if store.seen("a", now.Add(time.Minute)) {
+		t.Error("a is remembered beyond the window")
+	}
+	store.seen("b", now.Add(time.Minute))
+	store.seen("c", now.Add(time.Minute))
+	if store.seen("a", now.Add(time.Minute)) {
+		t.Error("a was not evicted beyond the size")
+	}
+}
+
+func TestFileStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	fs, err := openFileStore(path, newLRUStore(time.Hour, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	fs.seen("kept", now)
+	fs.seen("forgotten", now)
+	fs.forget("forgotten")
+	fs.file.Close()
+
+	reopened, err := openFileStore(path, newLRUStore(time.Hour, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.file.Close()
+	if !reopened.seen("kept", now) {
+		t.Error("kept was not restored")
+	}
+	if reopened.seen("forgotten", now) {
+		t.Error("forgotten was restored")
+	}
+}
+
+func TestFileStoreMatchesMemoryUnderConcurrency(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	// DEV: 追記が多くcompactも並行して起きる大きさにする
+	fs, err := openFileStore(path, newLRUStore(time.Hour, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				key := fmt.Sprintf("k%d", (worker*7+i)%60)
+				if !fs.seen(key, time.Now()) && i%3 == 0 {
+					fs.forget(key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+	fs.file.Close()
+
+	reopened, err := openFileStore(path, newLRUStore(time.Hour, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.file.Close()
+	if len(reopened.index) != len(fs.index) {
+		t.Fatalf("restored %d keys, %d in memory", len(reopened.index), len(fs.index))
+	}
+	for key := range fs.index {
+		if _, ok := reopened.index[key]; !ok {
+			t.Errorf("%s is in memory but was not restored", key)
+		}
+	}
+}
@@ -4,9 +4,16 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/tinayla696/mqtt_protocol_golang/module/codec"
 	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
 	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -14,10 +21,11 @@ import (
 // Dispatcher
 type Dispatcher struct {
 	// Input Channels
-	MqttClients map[string]*mqttm.Module // MQTT Clients
+	MqttClients map[string]mqttm.Client // MQTT Clients
 
 	// Workers Queue
-	taskQue chan task.Task
+	taskQue    chan task.Task
+	workerQues []chan task.Task // キー付き分配時のWorker毎のキュー
 
 	// quit     chan struct{}
 	ctx      context.Context
@@ -29,22 +37,196 @@ type Dispatcher struct {
 	numMqttWorkers int
 
 	nextTaskID int // 次のタスクID
+
+	codecs      *codec.Registry // ペイロードのデコード
+	deadLetters DeadLetter      // 処理できなかったメッセージの退避先
+
+	schemas    *SchemaValidator // ペイロードの検証 (nil = 検証しない)
+	rejections DeadLetter       // 検証エラーの退避先 (nil = deadLetters)
+
+	dedup *Deduplicator // 重複メッセージの除外 (nil = 無効)
+
+	ordering *OrderKey // 同じキーのタスクを同じWorkerで順に実行する (nil = 共有キュー)
+	lanes    *Lanes    // 優先度別のキュー (nil = 単一のFIFO)。taskQueへはスケジューラが渡す
+
+	batcher *Batcher // ルート毎にまとめて処理するメッセージ (nil = 無効)
+
+	poolConfs map[task.TaskType]PoolConfig         // TaskType毎のWorker数・キュー長・タイムアウト
+	pools     map[task.TaskType]*WorkerPool        // TaskType毎の共有キューのWorker (キー付き分配のMQTTは含まない)
+	limiters  map[task.TaskType]*ratelimit.Limiter // TaskType毎のタスク実行の流量制限 (無ければ制限しない)
+
+	submitMu sync.RWMutex // Submitとキューのクローズの排他
+	stopped  bool
+
+	timeouts []TimeoutRule // トピック毎のタスクのタイムアウト
+
+	middleware *MiddlewareChain // タスク実行を包むMiddleware (nil = Recoverのみ)
+
+	backpressure bool // 受信したタスクはキューの空きを待って積む (false = 満杯なら破棄)
+
+	drainCh    chan struct{} // Drain開始の通知 (受信の停止)
+	drainOnce  sync.Once
+	draining   atomic.Bool
+	drainStats drainStats
+	pending    atomic.Int64  // キューに積まれ、扱いが決まっていないタスク数 (実行中を含む)
+	idle       chan struct{} // pendingが0になった通知 (Drainの完了判定)
+}
+
+// *--------------------------------------------------------------------------------------------------
+// Option configures optional Dispatcher features
+type Option func(*Dispatcher)
+
+// *--------------------------------------------------------------------------------------------------
+// WithCodecs
+func WithCodecs(registry *codec.Registry) Option {
+	return func(d *Dispatcher) {
+		d.codecs = registry
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithSchemas
+// DEV: rejectがnilなら検証エラーはDead-letterに送る
+func WithSchemas(validator *SchemaValidator, reject DeadLetter) Option {
+	return func(d *Dispatcher) {
+		d.schemas = validator
+		d.rejections = reject
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithDedup
+func WithDedup(dedup *Deduplicator) Option {
+	return func(d *Dispatcher) {
+		d.dedup = dedup
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithOrdering
+func WithOrdering(key *OrderKey) Option {
+	return func(d *Dispatcher) {
+		d.ordering = key
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithBackpressure
+// DEV: 受信側を待たせてもよい場合 (replayなど) に使う。キューが満杯でも破棄せず、停止時のみ諦める
+func WithBackpressure() Option {
+	return func(d *Dispatcher) {
+		d.backpressure = true
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithPriority
+// DEV: MQTTタスクを優先度別のレーンに積む (order_keyとは併用できない)
+func WithPriority(lanes *Lanes) Option {
+	return func(d *Dispatcher) {
+		d.lanes = lanes
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithPool
+// DEV: MQTTタスクのプール (Workers はNewDispatcherの引数が優先)
+func WithPool(conf PoolConfig) Option {
+	return WithTaskPool(task.MqttTaskType, conf)
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithTaskPool
+func WithTaskPool(taskType task.TaskType, conf PoolConfig) Option {
+	return func(d *Dispatcher) {
+		d.poolConfs[taskType] = conf
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithMiddleware
+func WithMiddleware(chain *MiddlewareChain) Option {
+	return func(d *Dispatcher) {
+		d.middleware = chain
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// WithDeadLetter
+func WithDeadLetter(deadLetters DeadLetter) Option {
+	return func(d *Dispatcher) {
+		d.deadLetters = deadLetters
+	}
 }
 
 // *--------------------------------------------------------------------------------------------------
 // NewDispatcher (constructor)
-func NewDispatcher(parentCtx context.Context, mqttClients map[string]*mqttm.Module, mqttWorkers int) *Dispatcher {
+func NewDispatcher(parentCtx context.Context, mqttClients map[string]mqttm.Client, mqttWorkers int, opts ...Option) *Dispatcher {
 	ctx, cancelFn := context.WithCancel(parentCtx) // コンテキストのキャンセル関数を作成
-	return &Dispatcher{
+	d := &Dispatcher{
 		MqttClients:    mqttClients,
-		taskQue:        make(chan task.Task, mqttWorkers),
 		ctx:            ctx,
 		cancelFn:       cancelFn,
 		wg:             &sync.WaitGroup{},
 		workerWg:       &sync.WaitGroup{},
 		numMqttWorkers: mqttWorkers,
 		nextTaskID:     0,
+		deadLetters:    logDeadLetter{},
+		drainCh:        make(chan struct{}),
+		idle:           make(chan struct{}, 1),
+		poolConfs:      map[task.TaskType]PoolConfig{task.MqttTaskType: {}},
+		pools:          make(map[task.TaskType]*WorkerPool),
+		limiters:       make(map[task.TaskType]*ratelimit.Limiter),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	// DEV: Registry未指定時はJSONのみ (従来の動作)
+	if d.codecs == nil {
+		d.codecs, _ = codec.NewRegistry(codec.Config{})
 	}
+	if d.ordering != nil && d.lanes != nil {
+		zap.S().Warn("Ignoring priority lanes, they cannot be combined with order_key")
+		d.lanes = nil
+	}
+	mqttConf := d.poolConfs[task.MqttTaskType]
+	mqttConf.Workers = mqttWorkers
+	d.poolConfs[task.MqttTaskType] = mqttConf
+
+	// DEV: TaskType毎にキューとWorkerPoolを作る
+	for taskType, conf := range d.poolConfs {
+		conf = conf.normalize()
+		d.poolConfs[taskType] = conf
+		if limiter, err := ratelimit.New(RateLimitName(taskType), conf.RateLimit); err != nil {
+			zap.S().Errorf("Ignoring rate limit of %s tasks: %v", taskType, err)
+		} else if limiter != nil {
+			d.limiters[taskType] = limiter
+		}
+		queue := make(chan task.Task, conf.QueueSize)
+		if taskType == task.MqttTaskType {
+			d.taskQue = queue
+			d.numMqttWorkers = conf.Workers
+			if d.ordering != nil {
+				continue
+			}
+			// DEV: レーンがある場合、taskQueはスケジューラからWorkerへの受け渡し (バッファ無し)
+			if d.lanes != nil {
+				d.lanes.open(conf.QueueSize)
+				queue = make(chan task.Task)
+				d.taskQue = queue
+			}
+		}
+		d.pools[taskType] = newWorkerPool(conf, queue, ctx.Done(), d.workerWg, taskType, d.setupWorker)
+		if taskType == task.MqttTaskType {
+			d.pools[taskType].lanes = d.lanes
+		}
+	}
+	if d.ordering != nil {
+		for i := 0; i < d.numMqttWorkers; i++ {
+			d.workerQues = append(d.workerQues, make(chan task.Task, DEFAULT_WORKER_QUEUE_SIZE))
+		}
+	}
+	return d
 }
 
 // *--------------------------------------------------------------------------------------------------
@@ -52,9 +234,25 @@ func NewDispatcher(parentCtx context.Context, mqttClients map[string]*mqttm.Modu
 func (d *Dispatcher) Start() {
 	zap.S().Info("Starting Dispatcher...")
 
-	// DEV: 各Workerを起動
-	if len(d.MqttClients) > 0 {
-		d.launchWorkers(d.numMqttWorkers, d.taskQue, task.MqttTaskType)
+	// DEV: 各Workerを起動 (MQTTのWorkerはクライアントがある場合のみ)
+	for taskType, pool := range d.pools {
+		if taskType == task.MqttTaskType && len(d.MqttClients) == 0 {
+			continue
+		}
+		pool.start(d.ctx)
+	}
+	if len(d.MqttClients) > 0 && d.lanes != nil {
+		d.workerWg.Add(1)
+		go d.lanes.run(d.ctx, d.taskQue, d.workerWg, d.abandon)
+	}
+	if len(d.MqttClients) > 0 && d.ordering != nil {
+		for i, que := range d.workerQues {
+			w := NewWorker(i+1, que, d.ctx.Done(), d.workerWg, task.MqttTaskType)
+			w.timeout = d.poolConfs[task.MqttTaskType].timeout()
+			d.setupWorker(w)
+			d.workerWg.Add(1)
+			go w.Start()
+		}
 	}
 
 	// MQTT Subscription Loop
@@ -65,18 +263,75 @@ func (d *Dispatcher) Start() {
 }
 
 // *--------------------------------------------------------------------------------------------------
-// lanchWorkers
-func (d *Dispatcher) launchWorkers(numWorkers int, taskCh <-chan task.Task, workerType task.TaskType) {
-	for i := 0; i < numWorkers; i++ {
-		d.workerWg.Add(1)
-		w := NewWorker(i+1, taskCh, d.ctx.Done(), d.workerWg, workerType)
-		go w.Start()
+// setupWorker
+// DEV: 全てのWorkerに共通の設定 (Context・結果の振り分け・タイムアウトと停止時の退避)
+func (d *Dispatcher) setupWorker(w *Worker) {
+	w.parent = d.ctx
+	w.route = d.route
+	w.timedOut = d.taskTimedOut
+	w.finished = d.finish
+	w.settled = d.settle
+	w.abandoned = d.abandon
+	w.middleware = d.middleware
+	w.limiter = d.limiters[w.workerType]
+	w.spilled = d.spill
+	w.rejected = d.circuitOpen
+}
+
+// *--------------------------------------------------------------------------------------------------
+// Pools
+func (d *Dispatcher) Pools() map[task.TaskType]PoolStatus {
+	pools := make(map[task.TaskType]PoolStatus, len(d.pools)+1)
+	for taskType, pool := range d.pools {
+		pools[taskType] = pool.Status()
+	}
+	if d.ordering != nil {
+		status := PoolStatus{Workers: len(d.workerQues), MinWorkers: len(d.workerQues), MaxWorkers: len(d.workerQues)}
+		for _, que := range d.workerQues {
+			status.QueueDepth += len(que)
+			status.QueueCapacity += cap(que)
+		}
+		pools[task.MqttTaskType] = status
+	}
+	return pools
+}
+
+// *--------------------------------------------------------------------------------------------------
+// Resize
+// DEV: キー付き分配ではキーとWorkerの対応が変わり順序を保てないため変更できない
+func (d *Dispatcher) Resize(taskType task.TaskType, workers int) error {
+	if taskType == task.MqttTaskType && d.ordering != nil {
+		return fmt.Errorf("workers cannot be resized while order_key is set")
+	}
+	pool, ok := d.pools[taskType]
+	if !ok {
+		return fmt.Errorf("no worker pool for task type %s", taskType)
+	}
+	return pool.Resize(workers)
+}
+
+// *--------------------------------------------------------------------------------------------------
+// Submit
+// DEV: MQTT以外の生産者 (タイマー・HTTP・ファイル監視など) からタスクを投入する。キューが満杯ならエラー
+func (d *Dispatcher) Submit(t task.Task) error {
+	d.submitMu.RLock()
+	defer d.submitMu.RUnlock()
+	if d.stopped {
+		return fmt.Errorf("dispatcher is stopped, task %s not assigned", t.String())
+	}
+	if mqttTask, ok := t.(*task.MqttTask); ok && (d.ordering != nil || d.lanes != nil) {
+		return d.assignTaskToQue(t, d.queueFor(mqttTask.Contents, mqttTask.Value), task.MqttTaskType)
 	}
+	pool, ok := d.pools[t.Type()]
+	if !ok {
+		return fmt.Errorf("no worker pool for task type %s, task %s not assigned", t.Type(), t.String())
+	}
+	return d.assignTaskToQue(t, pool.queue, t.Type())
 }
 
 // *--------------------------------------------------------------------------------------------------
 // monitorMqttSubscription
-func (d *Dispatcher) monitorMqttSubscription(hostname string, client *mqttm.Module) {
+func (d *Dispatcher) monitorMqttSubscription(hostname string, client mqttm.Client) {
 	defer d.wg.Done()
 	zap.S().Infof("Monitoring MQTT subscription on channel: %s", hostname)
 	for {
@@ -85,23 +340,124 @@ func (d *Dispatcher) monitorMqttSubscription(hostname string, client *mqttm.Modu
 			zap.S().Warn("Dispatcher received quit signal, stopping MQTT subscription monitoring")
 			return
 
-		case subContents, ok := <-client.SubCh:
+		case <-d.drainCh:
+			// DEV: Drain時は受信済み (SubChに残った) メッセージだけタスクにして終了する
+			for {
+				select {
+				case subContents, ok := <-client.Subscription():
+					if !ok {
+						return
+					}
+					d.dispatch(subContents)
+				default:
+					zap.S().Infof("Stopped MQTT subscription monitoring on %s for drain", hostname)
+					return
+				}
+			}
+
+		case subContents, ok := <-client.Subscription():
 			if !ok {
 				zap.S().Warn("MQTT subscription channel closed, stopping monitoring")
 				return
 			}
-			d.nextTaskID++
-			taskContents := &task.MqttTask{
-				Contents: subContents,
-				ID:       d.nextTaskID,
-			}
-			if err := d.assignTaskToQue(taskContents, d.taskQue, task.MqttTaskType); err != nil {
-				zap.S().Errorf("Failed to assign task to queue: %v", err)
-			}
+			d.dispatch(subContents)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// dispatch
+// DEV: デコード・検証・重複除外を経てMqttTaskをキューに積む
+func (d *Dispatcher) dispatch(subContents mqttm.Contents) {
+	// DEV: 受信のSpanの子としてキュー投入までのSpanを作り、タスクには投入のSpanを引き継ぐ
+	_, span := startEnqueueSpan(subContents)
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	value, c, err := d.codecs.Decode(subContents)
+	if err != nil {
+		d.deadLetter(subContents, DEAD_LETTER_DECODE, err)
+		return
+	}
+	if !d.validate(subContents, value) {
+		span.SetAttributes(attribute.Bool("mqtt.rejected", true))
+		return
+	}
+	if d.dedup != nil && d.dedup.Duplicate(subContents, value) {
+		zap.S().Debugf("Dropped duplicate message on %s", subContents.Topic)
+		span.SetAttributes(attribute.Bool("mqtt.duplicate", true))
+		return
+	}
+	subContents.Trace = tracing.Inject(trace.ContextWithSpan(d.ctx, span))
+	if d.batcher != nil && d.batcher.Add(subContents, value) {
+		span.SetAttributes(attribute.Bool("mqtt.batched", true))
+		return
+	}
+	d.nextTaskID++
+	taskContents := &task.MqttTask{
+		Contents: subContents,
+		ID:       d.nextTaskID,
+		Value:    value,
+		Codec:    c.Name(),
+		Timeout:  time.Duration(d.timeoutFor(subContents.Topic)) * time.Millisecond,
+	}
+	if err = d.enqueue(taskContents, d.queueFor(subContents, value)); err != nil {
+		zap.S().Errorf("Failed to assign task to queue: %v", err)
+		reason := DEAD_LETTER_QUEUE_FULL
+		if d.ctx.Err() != nil {
+			reason = DEAD_LETTER_SHUTDOWN
+		}
+		d.deadLetter(subContents, reason, err)
+		// DEV: 積めなかったメッセージの再送を重複として捨てないよう、記録を取り消す
+		if d.dedup != nil {
+			d.dedup.Forget(subContents, value)
 		}
 	}
 }
 
+// *--------------------------------------------------------------------------------------------------
+// enqueue
+// DEV: 受信したMqttTaskを積む。backpressure・キー付き分配の場合はキューの空きを待つ
+// (キー付き分配でWorkerのキューが満杯の時に捨てると、同じキーの後続だけが処理され順序が崩れる)
+func (d *Dispatcher) enqueue(t *task.MqttTask, queue chan task.Task) error {
+	if !d.backpressure && d.ordering == nil {
+		return d.assignTaskToQue(t, queue, task.MqttTaskType)
+	}
+	select {
+	case queue <- t:
+		d.enqueued(queue, task.MqttTaskType)
+		return nil
+	case <-d.ctx.Done():
+		return fmt.Errorf("dispatcher is quitting, task %s not assigned", t.String())
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// enqueued
+// DEV: 投入後にレーンのスケジューラを起こし、キューの深さのメトリクスを更新する
+func (d *Dispatcher) enqueued(queue chan task.Task, taskType task.TaskType) {
+	d.pending.Add(1)
+	if d.lanes != nil {
+		d.lanes.enqueued(queue)
+	}
+	if pool, ok := d.pools[taskType]; ok {
+		pool.queued()
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// queueFor
+// DEV: キー付き分配の場合はキーのハッシュでWorkerのキューを、優先度がある場合はレーンを選ぶ
+func (d *Dispatcher) queueFor(contents mqttm.Contents, value interface{}) chan task.Task {
+	if d.lanes != nil {
+		return d.lanes.queueFor(contents, value)
+	}
+	if d.ordering == nil || len(d.workerQues) == 0 {
+		return d.taskQue
+	}
+	return d.workerQues[d.ordering.Slot(contents, value, len(d.workerQues))]
+}
+
 // *--------------------------------------------------------------------------------------------------
 // assignTaskToQue
 func (d *Dispatcher) assignTaskToQue(task task.Task, queue chan task.Task, expectedType task.TaskType) error {
@@ -111,6 +467,7 @@ func (d *Dispatcher) assignTaskToQue(task task.Task, queue chan task.Task, expec
 	select {
 	case queue <- task:
 		zap.S().Debug("Task assigned to queue:", zap.String("task", task.String()))
+		d.enqueued(queue, expectedType)
 		return nil
 	case <-d.ctx.Done():
 		return fmt.Errorf("dispatcher is quitting, task %s not assigned", task.String())
@@ -129,10 +486,55 @@ func (d *Dispatcher) Stop() {
 	// DEV: No.2 taskQueに書き込むProducer Goroutineを全て終了する
 	d.wg.Wait()
 
-	// DEV: No.3 taskQueを閉じる
-	close(d.taskQue)
+	// DEV: No.3 まとめ途中のメッセージをバッチとして投入する
+	if d.batcher != nil {
+		d.batcher.stop()
+	}
+
+	// DEV: No.4 Submitを止めてから各キューを閉じる (WorkerPoolの増減も止める)
+	d.closeQueues()
 
-	// DEV: No.4 Worker全体の終了待機
+	// DEV: No.5 Worker全体の終了待機
 	d.workerWg.Wait()
+
+	// DEV: No.6 実行されずに残ったタスクを退避する
+	d.abandonQueued()
 	zap.S().Info("Dispatcher stopped successfully")
 }
+
+// *--------------------------------------------------------------------------------------------------
+// closeQueues
+// DEV: Drain後のStopでも呼ばれるため、2回目以降は何もしない
+func (d *Dispatcher) closeQueues() {
+	d.submitMu.Lock()
+	defer d.submitMu.Unlock()
+	if d.stopped {
+		return
+	}
+	d.stopped = true
+	for _, pool := range d.pools {
+		pool.stop()
+	}
+	for _, queue := range d.queues() {
+		close(queue)
+	}
+	if d.lanes != nil {
+		close(d.lanes.wake)
+	}
+}
+
+// *--------------------------------------------------------------------------------------------------
+// queues
+// DEV: レーンがある場合のtaskQueはスケジューラが閉じる
+func (d *Dispatcher) queues() []chan task.Task {
+	queues := append([]chan task.Task{d.taskQue}, d.workerQues...)
+	if d.lanes != nil {
+		queues = d.lanes.queues()
+	}
+	for taskType, pool := range d.pools {
+		if taskType != task.MqttTaskType {
+			queues = append(queues, pool.queue)
+		}
+	}
+	return queues
+}
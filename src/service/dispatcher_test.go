@@ -0,0 +1,294 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm/mqttmtest"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+// executions records the MQTT tasks run by the workers
+type executions struct {
+	mu    sync.Mutex
+	tasks []*task.MqttTask
+}
+
+func (e *executions) middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			if mqttTask, ok := t.(*task.MqttTask); ok {
+				e.mu.Lock()
+				e.tasks = append(e.tasks, mqttTask)
+				e.mu.Unlock()
+			}
+			return next(ctx, t)
+		}
+	}
+}
+
+func (e *executions) payloads() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	payloads := make([]string, 0, len(e.tasks))
+	for _, t := range e.tasks {
+		payloads = append(payloads, string(t.Contents.Payload))
+	}
+	return payloads
+}
+
+// deadLetters captures dead-lettered messages
+type deadLetters struct {
+	mu      sync.Mutex
+	entries []DeadLetterEntry
+}
+
+func (d *deadLetters) Put(ctx context.Context, entry DeadLetterEntry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.entries = append(d.entries, entry)
+	return nil
+}
+
+func (d *deadLetters) reasons() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	reasons := map[string]int{}
+	for _, entry := range d.entries {
+		reasons[entry.Reason]++
+	}
+	return reasons
+}
+
+// runDispatcher starts a Dispatcher on a fake client and returns a function that drains it
+func runDispatcher(t *testing.T, client *mqttmtest.Client, workers int, opts ...Option) func() DrainReport {
+	t.Helper()
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{client.Hostname(): client}, workers, opts...)
+	d.Start()
+	t.Cleanup(d.Stop)
+	return func() DrainReport {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return d.Drain(ctx)
+	}
+}
+
+func recording(e *executions) Option {
+	chain := &MiddlewareChain{}
+	chain.Use(e.middleware())
+	return WithMiddleware(chain)
+}
+
+func TestDispatcherOrderingPerKey(t *testing.T) {
+	client := mqttmtest.New("h")
+	ordering, err := NewOrderKey("segment:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e executions
+	delay := Middleware(func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			time.Sleep(time.Millisecond)
+			return next(ctx, t)
+		}
+	})
+	chain := &MiddlewareChain{}
+	chain.Use(e.middleware(), delay)
+	drain := runDispatcher(t, client, 4, WithOrdering(ordering), WithMiddleware(chain),
+		WithPool(PoolConfig{QueueSize: 2}))
+
+	keys := []string{"a", "b", "c", "d", "e"}
+	for seq := 0; seq < 20; seq++ {
+		for _, key := range keys {
+			client.Push("devices/"+key+"/telemetry", []byte(fmt.Sprintf(`{"seq": %d}`, seq)))
+		}
+	}
+	report := drain()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// DEV: キュー (2件) より多く積んでも、空きを待つため1件も失われない
+	if len(e.tasks) != 100 || report.Persisted != 0 {
+		t.Fatalf("executed %d (%s), want all 100 messages", len(e.tasks), report)
+	}
+	next := map[string]float64{}
+	for _, executed := range e.tasks {
+		key := ordering.Of(executed.Contents, executed.Value)
+		seq := executed.Value.(map[string]interface{})["seq"].(float64)
+		if seq != next[key] {
+			t.Fatalf("key %s ran seq %v, want %v", key, seq, next[key])
+		}
+		next[key]++
+	}
+}
+
+func TestDispatcherDedup(t *testing.T) {
+	client := mqttmtest.New("h")
+	dedup, err := NewDeduplicator(DedupConfig{Enabled: true, Key: "field:id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e executions
+	drain := runDispatcher(t, client, 1, WithDedup(dedup), recording(&e), WithPool(PoolConfig{QueueSize: 16}))
+
+	client.Push("a", []byte(`{"id": 1, "v": "first"}`))
+	client.Push("a", []byte(`{"id": 1, "v": "redelivered"}`))
+	client.Push("b", []byte(`{"id": 1, "v": "other topic"}`))
+	client.Push("a", []byte(`{"v": "no id"}`))
+	client.Push("a", []byte(`{"v": "no id"}`))
+	drain()
+
+	got := e.payloads()
+	want := []string{`{"id": 1, "v": "first"}`, `{"id": 1, "v": "other topic"}`, `{"v": "no id"}`, `{"v": "no id"}`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("executed %v, want %v", got, want)
+	}
+}
+
+func TestDispatcherDedupForgetsUnqueued(t *testing.T) {
+	dedup, _ := NewDeduplicator(DedupConfig{Enabled: true, Key: DEDUP_KEY_HASH})
+	dead := &deadLetters{}
+	// DEV: Workerを起動しないため、2件目はキューが満杯で積めない
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1,
+		WithDedup(dedup), WithDeadLetter(dead), WithPool(PoolConfig{QueueSize: 1}))
+	t.Cleanup(d.Stop)
+
+	queued := mqttm.Contents{Topic: "a", Payload: []byte(`{"v": 1}`)}
+	unqueued := mqttm.Contents{Topic: "a", Payload: []byte(`{"v": 2}`)}
+	d.dispatch(queued)
+	d.dispatch(unqueued)
+	if reasons := dead.reasons(); reasons[DEAD_LETTER_QUEUE_FULL] != 1 {
+		t.Fatalf("dead letters = %v, want the second message stored with reason queue_full", reasons)
+	}
+	if !dedup.Duplicate(queued, nil) {
+		t.Error("the queued message was forgotten")
+	}
+	if dedup.Duplicate(unqueued, nil) {
+		t.Error("the unqueued message is still remembered, its redelivery would be dropped")
+	}
+}
+
+func TestDispatcherDrainExecutesReceived(t *testing.T) {
+	client := mqttmtest.New("h")
+	var e executions
+	slow := Middleware(func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			time.Sleep(5 * time.Millisecond)
+			return next(ctx, t)
+		}
+	})
+	chain := &MiddlewareChain{}
+	chain.Use(e.middleware(), slow)
+	drain := runDispatcher(t, client, 2, WithMiddleware(chain), WithPool(PoolConfig{QueueSize: 16}))
+	for i := 0; i < 10; i++ {
+		client.Push("a", []byte(fmt.Sprintf(`{"n": %d}`, i)))
+	}
+	report := drain()
+	if executed := len(e.payloads()); executed != 10 || report.Persisted != 0 || report.Dropped != 0 {
+		t.Fatalf("executed %d (%s), want all 10 received messages", executed, report)
+	}
+}
+
+func TestDispatcherSubmitToTaskPool(t *testing.T) {
+	// DEV: MQTTクライアントが無くても、MQTT以外のプールは起動する
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1,
+		WithTaskPool(task.OtherTaskType, PoolConfig{Workers: 2, QueueSize: 2}))
+	d.Start()
+	if status := d.Pools()[task.OtherTaskType]; status.Workers != 2 || status.QueueCapacity != 2 {
+		t.Errorf("other pool = %+v, want 2 workers and a queue of 2", status)
+	}
+
+	g := newGate()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := d.Submit(g.task(name, task.OtherTaskType)); err != nil {
+			t.Fatalf("Submit(%s): %v", name, err)
+		}
+		if name == "b" {
+			g.waitStarted(t, 2, 0)
+		}
+	}
+	if err := d.Submit(g.task("e", task.OtherTaskType)); err == nil {
+		t.Error("task was accepted by a full queue")
+	}
+	if err := d.Submit(g.task("http", task.TaskType("http"))); err == nil {
+		t.Error("task without a pool was accepted")
+	}
+	close(g.open)
+	g.waitStarted(t, 2, 50*time.Millisecond)
+
+	d.Stop()
+	if err := d.Submit(g.task("late", task.OtherTaskType)); err == nil {
+		t.Error("task was accepted after Stop")
+	}
+}
+
+func TestDispatcherBatchRetry(t *testing.T) {
+	client := mqttmtest.New("h")
+	dead := &deadLetters{}
+
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	succeeded := map[string]bool{}
+	handler := task.BatchHandler(func(ctx context.Context, route string, items []task.BatchItem) error {
+		mu.Lock()
+		defer mu.Unlock()
+		failed := map[int]error{}
+		for i, item := range items {
+			payload := item.Value.(string)
+			attempts[payload]++
+			// DEV: flakyは1回目だけ、poisonは毎回失敗する
+			if payload == "poison" || (payload == "flaky" && attempts[payload] == 1) {
+				failed[i] = fmt.Errorf("cannot store %s", payload)
+				continue
+			}
+			succeeded[payload] = true
+		}
+		if len(failed) > 0 {
+			return &task.BatchError{Failed: failed}
+		}
+		return nil
+	})
+	batcher, err := NewBatcher([]BatchConfig{{
+		Name: "store", Topics: []string{"raw/#"}, Handler: "store", MaxItems: 2, MaxWaitMs: 20, MaxAttempts: 3,
+	}}, map[string]task.BatchHandler{"store": handler})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain := runDispatcher(t, client, 1, WithBatcher(batcher), WithDeadLetter(dead))
+
+	for _, payload := range []string{"ok1", "flaky", "poison", "ok2"} {
+		client.Push("raw/a", []byte(`"`+payload+`"`))
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := len(succeeded) == 3 && attempts["poison"] == 3
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	drain()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, payload := range []string{"ok1", "flaky", "ok2"} {
+		if !succeeded[payload] {
+			t.Errorf("%s was not stored (attempts %d)", payload, attempts[payload])
+		}
+	}
+	if attempts["ok1"] != 1 || attempts["ok2"] != 1 || attempts["flaky"] != 2 {
+		t.Errorf("attempts = %v, only failed items should be retried", attempts)
+	}
+	if attempts["poison"] != 3 {
+		t.Errorf("poison attempts = %d, want max_attempts (3)", attempts["poison"])
+	}
+	if reasons := dead.reasons(); reasons[DEAD_LETTER_BATCH] != 1 || len(reasons) != 1 {
+		t.Errorf("dead letters = %v, want only poison with reason batch", reasons)
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_SHUTDOWN string = "shutdown" // 停止時に実行・送信できなかったもの
+
+	DEFAULT_DRAIN_TIMEOUT_SEC int = 10
+)
+
+type (
+	// DrainReport counts what happened to the pending work during Drain
+	DrainReport struct {
+		Queued    int64 // Tasks queued when intake stopped
+		Executed  int64 // Tasks executed during the drain
+		Persisted int64 // Messages stored in the dead-letter destination (each item of a batch counts)
+		Dropped   int64 // Tasks that could not be persisted (non-MQTT tasks)
+	}
+
+	// drainStats are the counters behind DrainReport
+	drainStats struct {
+		executed  atomic.Int64
+		persisted atomic.Int64
+		dropped   atomic.Int64
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// String
+func (r DrainReport) String() string {
+	return fmt.Sprintf("queued %d, executed %d, persisted %d, dropped %d", r.Queued, r.Executed, r.Persisted, r.Dropped)
+}
+
+// *--------------------------------------------------------------------------------------
+// Drain
+// DEV: 受信を止め、キューのタスクと実行中のタスクが投入する後続タスクをctxの期限まで実行する。
+// 全て終わるか期限を過ぎたらキューを閉じる。期限を過ぎた場合は実行中のタスクをキャンセルし、
+// 残り (閉じた後に投入された後続タスクを含む) はDead-letterに reason=shutdown で退避する。MQTTモジュールはこの後で停止すること
+func (d *Dispatcher) Drain(ctx context.Context) DrainReport {
+	var report DrainReport
+	d.drainOnce.Do(func() {
+		zap.S().Info("Draining Dispatcher...")
+		d.draining.Store(true)
+		close(d.drainCh)
+		d.wg.Wait()
+		if d.batcher != nil {
+			d.batcher.stop()
+		}
+
+		for _, queue := range d.queues() {
+			report.Queued += int64(len(queue))
+		}
+		// DEV: キューを開いたまま待つ (ResultTaskの後続タスクをSubmitで受け付けるため)
+		expired := !d.waitIdle(ctx)
+		d.closeQueues()
+
+		done := make(chan struct{})
+		go func() {
+			d.workerWg.Wait()
+			close(done)
+		}()
+		if expired {
+			zap.S().Warnf("Drain deadline exceeded, cancelling running tasks")
+			d.cancelFn()
+		}
+		<-done
+		d.abandonQueued()
+		d.cancelFn()
+	})
+	report.Executed = d.drainStats.executed.Load()
+	report.Persisted = d.drainStats.persisted.Load()
+	report.Dropped = d.drainStats.dropped.Load()
+	return report
+}
+
+// *--------------------------------------------------------------------------------------
+// waitIdle
+// DEV: キューが空で実行中のタスクも無くなればtrue、ctxの期限を過ぎればfalse
+func (d *Dispatcher) waitIdle(ctx context.Context) bool {
+	for d.pending.Load() > 0 {
+		select {
+		case <-d.idle:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// settle
+// DEV: Workerがタスクの扱いを決めた時に呼ぶ。後続タスクは親より先に数えられるため、0なら未処理のタスクは無い
+func (d *Dispatcher) settle(t task.Task) {
+	if d.pending.Add(-1) > 0 {
+		return
+	}
+	select {
+	case d.idle <- struct{}{}:
+	default:
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// PersistUnsent
+// DEV: MQTTモジュールのDrainで送信できなかったメッセージを退避する
+func (d *Dispatcher) PersistUnsent(pending []mqttm.Contents) {
+	for _, contents := range pending {
+		d.deadLetter(contents, DEAD_LETTER_SHUTDOWN, fmt.Errorf("message to %s was not published before shutdown", contents.Topic))
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// abandonQueued
+// DEV: 閉じたキューに残ったタスクを退避する (Workerが居ないプールを含む)
+func (d *Dispatcher) abandonQueued() {
+	for _, queue := range d.queues() {
+		for t := range queue {
+			d.abandon(t)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// abandon
+// DEV: MqttTask・BatchTaskは受信内容をDead-letterに残す。それ以外のタスクは復元できないため破棄する。
+// 退避数はメッセージ単位で数える (BatchTaskは要素数)
+func (d *Dispatcher) abandon(t task.Task) {
+	contents := contentsOf(t)
+	if contents == nil {
+		zap.S().Warnf("Dropped task %s on shutdown", t.String())
+		d.drainStats.dropped.Add(1)
+		return
+	}
+	for _, c := range contents {
+		d.deadLetter(c, DEAD_LETTER_SHUTDOWN, fmt.Errorf("task %s was not executed before shutdown", t.String()))
+	}
+	d.drainStats.persisted.Add(int64(len(contents)))
+}
+
+// *--------------------------------------------------------------------------------------
+// finish
+func (d *Dispatcher) finish(t task.Task) {
+	if d.draining.Load() {
+		d.drainStats.executed.Add(1)
+	}
+}
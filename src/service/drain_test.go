@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+// chainTask produces a follow-up until depth reaches 0
+type chainTask struct {
+	depth int
+	delay time.Duration
+	runs  *atomic.Int64
+}
+
+func (t *chainTask) Execute(ctx context.Context) error {
+	_, err := t.Produce(ctx)
+	return err
+}
+
+func (t *chainTask) Produce(ctx context.Context) (*task.Result, error) {
+	select {
+	case <-time.After(t.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	t.runs.Add(1)
+	if t.depth == 0 {
+		return nil, nil
+	}
+	return &task.Result{Next: []task.Task{&chainTask{depth: t.depth - 1, delay: t.delay, runs: t.runs}}}, nil
+}
+
+func (t *chainTask) String() string      { return fmt.Sprintf("chainTask{depth: %d}", t.depth) }
+func (t *chainTask) Type() task.TaskType { return task.OtherTaskType }
+
+func newDrainDispatcher(t *testing.T) *Dispatcher {
+	t.Helper()
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1,
+		WithTaskPool(task.OtherTaskType, PoolConfig{Workers: 1, QueueSize: 8}))
+	d.Start()
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func TestDrainRunsFollowUps(t *testing.T) {
+	d := newDrainDispatcher(t)
+	var runs atomic.Int64
+	if err := d.Submit(&chainTask{depth: 4, delay: 20 * time.Millisecond, runs: &runs}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	report := d.Drain(ctx)
+	if runs.Load() != 5 {
+		t.Errorf("runs = %d, want 5 (the task and its 4 follow-ups)", runs.Load())
+	}
+	if report.Executed != 5 || report.Persisted != 0 || report.Dropped != 0 {
+		t.Errorf("report = %s, want executed 5 and nothing left", report)
+	}
+}
+
+func TestDrainDeadlineCountsLeftovers(t *testing.T) {
+	d := newDrainDispatcher(t)
+	var runs atomic.Int64
+	if err := d.Submit(&chainTask{depth: 100, delay: 30 * time.Millisecond, runs: &runs}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	report := d.Drain(ctx)
+	if runs.Load() >= 100 {
+		t.Fatalf("runs = %d, the deadline did not stop the chain", runs.Load())
+	}
+	// DEV: 期限で中断されたタスクか、閉じた後に投入された後続タスクのどちらかが破棄として数えられる
+	if report.Dropped == 0 {
+		t.Errorf("report = %s, want the unfinished chain counted as dropped", report)
+	}
+}
+
+func TestAbandonCountsBatchItems(t *testing.T) {
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1)
+	items := []task.BatchItem{
+		{Contents: mqttm.Contents{Topic: "a"}},
+		{Contents: mqttm.Contents{Topic: "b"}},
+		{Contents: mqttm.Contents{Topic: "c"}},
+	}
+	d.abandon(&task.BatchTask{Route: "r", Items: items})
+	if persisted := d.drainStats.persisted.Load(); persisted != 3 {
+		t.Errorf("persisted = %d, want 3", persisted)
+	}
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	MIDDLEWARE_LOGGING string = "logging"
+	MIDDLEWARE_TIMING  string = "timing"
+	MIDDLEWARE_TRACING string = "tracing"
+
+	METRIC_TASK_PANICS      string = "service_task_panics_total"
+	METRIC_TASK_RUNS        string = "service_task_runs_total"
+	METRIC_TASK_DURATION_MS string = "service_task_duration_ms_total"
+)
+
+type (
+	// Handler executes a task (the innermost Handler is the Worker's execution)
+	Handler func(ctx context.Context, t task.Task) error
+
+	// Middleware wraps a Handler with a cross-cutting concern
+	Middleware func(next Handler) Handler
+
+	// MiddlewareConfig selects built-in or registered middlewares by name
+	// DEV: 外側から use -> types -> routes の順に適用する (Recoverは常に最も外側)
+	MiddlewareConfig struct {
+		Use    []string                   `json:"use"`    // Applied to every task
+		Types  map[task.TaskType][]string `json:"types"`  // Applied per TaskType
+		Routes []MiddlewareRoute          `json:"routes"` // Applied to MQTT tasks of a topic filter
+	}
+
+	// MiddlewareRoute applies middlewares to the MQTT tasks of a topic filter
+	MiddlewareRoute struct {
+		Topic string   `json:"topic"`
+		Use   []string `json:"use"`
+	}
+
+	// MiddlewareChain composes the middlewares of each task
+	MiddlewareChain struct {
+		global []Middleware
+		types  map[task.TaskType][]Middleware
+		routes []middlewareRoute
+	}
+
+	// middlewareRoute is a resolved MiddlewareRoute
+	middlewareRoute struct {
+		filter      string
+		middlewares []Middleware
+	}
+
+	// Tracer is the hook of the tracing middleware
+	// DEV: Startで作ったContextがタスクに渡され、endは実行結果と共に呼ばれる
+	Tracer interface {
+		Start(ctx context.Context, t task.Task) (context.Context, func(err error))
+	}
+
+	// LogTracer is a Tracer that logs span boundaries with a random span ID
+	LogTracer struct{}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewMiddlewareChain (constructor)
+// DEV: namedで独自のMiddleware (認証チェックなど) を名前で追加・上書きできる
+func NewMiddlewareChain(conf MiddlewareConfig, named map[string]Middleware) (*MiddlewareChain, error) {
+	available := map[string]Middleware{
+		MIDDLEWARE_LOGGING: Logging(),
+		MIDDLEWARE_TIMING:  Timing(),
+		MIDDLEWARE_TRACING: Tracing(LogTracer{}),
+	}
+	for name, mw := range named {
+		available[name] = mw
+	}
+	resolve := func(names []string) ([]Middleware, error) {
+		middlewares := make([]Middleware, 0, len(names))
+		for _, name := range names {
+			mw, ok := available[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown middleware %q", name)
+			}
+			middlewares = append(middlewares, mw)
+		}
+		return middlewares, nil
+	}
+
+	c := &MiddlewareChain{}
+	global, err := resolve(conf.Use)
+	if err != nil {
+		return nil, err
+	}
+	c.Use(global...)
+	for taskType, names := range conf.Types {
+		middlewares, err := resolve(names)
+		if err != nil {
+			return nil, err
+		}
+		c.UseFor(taskType, middlewares...)
+	}
+	for _, route := range conf.Routes {
+		if !mqttm.ValidTopicFilter(route.Topic) {
+			return nil, fmt.Errorf("invalid middleware topic filter %q", route.Topic)
+		}
+		middlewares, err := resolve(route.Use)
+		if err != nil {
+			return nil, err
+		}
+		c.UseRoute(route.Topic, middlewares...)
+	}
+	return c, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Use
+func (c *MiddlewareChain) Use(middlewares ...Middleware) {
+	c.global = append(c.global, middlewares...)
+}
+
+// *--------------------------------------------------------------------------------------
+// UseFor
+func (c *MiddlewareChain) UseFor(taskType task.TaskType, middlewares ...Middleware) {
+	if c.types == nil {
+		c.types = make(map[task.TaskType][]Middleware)
+	}
+	c.types[taskType] = append(c.types[taskType], middlewares...)
+}
+
+// *--------------------------------------------------------------------------------------
+// UseRoute
+// DEV: 一致する全てのルートを設定順に適用する
+func (c *MiddlewareChain) UseRoute(filter string, middlewares ...Middleware) {
+	c.routes = append(c.routes, middlewareRoute{filter: filter, middlewares: middlewares})
+}
+
+// *--------------------------------------------------------------------------------------
+// Wrap
+// DEV: タスク毎にチェーンを組み立てる。nilのChainでもRecoverは適用する
+func (c *MiddlewareChain) Wrap(t task.Task, next Handler) Handler {
+	var middlewares []Middleware
+	if c != nil {
+		middlewares = append(middlewares, c.global...)
+		middlewares = append(middlewares, c.types[t.Type()]...)
+		if mqttTask, ok := t.(*task.MqttTask); ok {
+			for _, route := range c.routes {
+				if mqttm.MatchTopic(route.filter, mqttTask.Contents.Topic) {
+					middlewares = append(middlewares, route.middlewares...)
+				}
+			}
+		}
+	}
+	handler := next
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return Recover()(handler)
+}
+
+// *--------------------------------------------------------------------------------------
+// Recover
+// DEV: タスクのpanicをエラーに変換し、プロセス全体が落ちないようにする
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					zap.S().Errorf("Task %s panicked: %v\n%s", t.String(), r, debug.Stack())
+					metrics.Counter(METRIC_TASK_PANICS, string(t.Type())).Add(1)
+					err = fmt.Errorf("task %s panicked: %v", t.String(), r)
+				}
+			}()
+			return next(ctx, t)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Timing
+// DEV: 実行回数と合計時間をTaskType毎に数える (平均 = duration / runs)
+func Timing() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			started := time.Now()
+			err := next(ctx, t)
+			metrics.Counter(METRIC_TASK_RUNS, string(t.Type())).Add(1)
+			metrics.Counter(METRIC_TASK_DURATION_MS, string(t.Type())).Add(time.Since(started).Milliseconds())
+			return err
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Logging
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			started := time.Now()
+			err := next(ctx, t)
+			fields := []interface{}{"task", t.String(), "type", t.Type(), "elapsed", time.Since(started)}
+			if mqttTask, ok := t.(*task.MqttTask); ok {
+				fields = append(fields, "topic", mqttTask.Contents.Topic, "host", mqttTask.Contents.Hostname)
+			}
+			if err != nil {
+				zap.S().Warnw("Task failed", append(fields, "error", err)...)
+			} else {
+				zap.S().Infow("Task completed", fields...)
+			}
+			return err
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Tracing
+func Tracing(tracer Tracer) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			ctx, end := tracer.Start(ctx, t)
+			err := next(ctx, t)
+			end(err)
+			return err
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Start (LogTracer)
+func (LogTracer) Start(ctx context.Context, t task.Task) (context.Context, func(err error)) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	spanID := hex.EncodeToString(id)
+	started := time.Now()
+	zap.S().Debugw("Span started", "span", spanID, "task", t.String())
+	return ctx, func(err error) {
+		zap.S().Debugw("Span ended", "span", spanID, "task", t.String(), "elapsed", time.Since(started), "error", err)
+	}
+}
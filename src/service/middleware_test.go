@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+func TestRecoverTurnsPanicIntoError(t *testing.T) {
+	boom := &funcTask{name: "boom", taskType: task.OtherTaskType, run: func(context.Context) error { panic("boom") }}
+	err := Recover()(func(ctx context.Context, t task.Task) error { return t.Execute(ctx) })(context.Background(), boom)
+	if err == nil || !strings.Contains(err.Error(), "task boom panicked: boom") {
+		t.Errorf("err = %v, want the panic as an error", err)
+	}
+
+	// DEV: panicしないタスクのエラーはそのまま返す
+	failure := errors.New("failure")
+	failing := &funcTask{name: "failing", taskType: task.OtherTaskType, run: func(context.Context) error { return failure }}
+	if err := Recover()(func(ctx context.Context, t task.Task) error { return t.Execute(ctx) })(context.Background(), failing); err != failure {
+		t.Errorf("err = %v, want %v", err, failure)
+	}
+}
+
+func TestWorkerSurvivesPanic(t *testing.T) {
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1,
+		WithTaskPool(task.OtherTaskType, PoolConfig{Workers: 1, QueueSize: 2}))
+	d.Start()
+	t.Cleanup(d.Stop)
+
+	ran := make(chan struct{})
+	if err := d.Submit(&funcTask{name: "boom", taskType: task.OtherTaskType, run: func(context.Context) error { panic("boom") }}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Submit(&funcTask{name: "after", taskType: task.OtherTaskType, run: func(context.Context) error {
+		close(ran)
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the only worker did not run a task after a panic")
+	}
+}
+
+func TestMiddlewareChainOrder(t *testing.T) {
+	var calls []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, t task.Task) error {
+				calls = append(calls, name)
+				return next(ctx, t)
+			}
+		}
+	}
+	chain, err := NewMiddlewareChain(MiddlewareConfig{
+		Use:    []string{"global"},
+		Types:  map[task.TaskType][]string{task.MqttTaskType: {"type"}},
+		Routes: []MiddlewareRoute{{Topic: "sensors/#", Use: []string{"route"}}, {Topic: "other/#", Use: []string{"other"}}},
+	}, map[string]Middleware{"global": mark("global"), "type": mark("type"), "route": mark("route"), "other": mark("other")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	run := func(ctx context.Context, t task.Task) error {
+		calls = append(calls, "task")
+		return nil
+	}
+
+	mqttTask := &task.MqttTask{Contents: mqttm.Contents{Topic: "sensors/a"}}
+	chain.Wrap(mqttTask, run)(context.Background(), mqttTask)
+	if got := strings.Join(calls, ","); got != "global,type,route,task" {
+		t.Errorf("MQTT task ran %s, want global,type,route,task", got)
+	}
+	calls = nil
+	other := &funcTask{name: "other", taskType: task.OtherTaskType}
+	chain.Wrap(other, run)(context.Background(), other)
+	if got := strings.Join(calls, ","); got != "global,task" {
+		t.Errorf("other task ran %s, want global,task", got)
+	}
+
+	for _, conf := range []MiddlewareConfig{
+		{Use: []string{"missing"}},
+		{Routes: []MiddlewareRoute{{Topic: "a/#/b", Use: []string{MIDDLEWARE_TIMING}}}},
+	} {
+		if _, err := NewMiddlewareChain(conf, nil); err == nil {
+			t.Errorf("config %+v was accepted", conf)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+const (
+	ORDER_KEY_TOPIC   string = "topic"    // トピック全体
+	ORDER_KEY_SEGMENT string = "segment:" // トピックのN番目 (0始まり) の階層 (例: segment:1 = devices/<id>/...)
+	ORDER_KEY_FIELD   string = "field:"   // デコード済みペイロードのフィールド (例: field:meta.device)
+
+	DEFAULT_WORKER_QUEUE_SIZE int = 16 // キー付き分配時のWorker毎のキュー長
+)
+
+type (
+	// OrderKey selects the key whose messages are executed in order by the same worker
+	OrderKey struct {
+		segment int      // segment:の場合の階層 (-1 = トピック全体)
+		field   []string // field:の場合のパス
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewOrderKey (constructor)
+// DEV: 空文字の場合はnilを返す (順序保証なし)
+func NewOrderKey(key string) (*OrderKey, error) {
+	switch {
+	case key == "":
+		return nil, nil
+	case key == ORDER_KEY_TOPIC:
+		return &OrderKey{segment: -1}, nil
+	case strings.HasPrefix(key, ORDER_KEY_SEGMENT):
+		segment, err := strconv.Atoi(strings.TrimPrefix(key, ORDER_KEY_SEGMENT))
+		if err != nil || segment < 0 {
+			return nil, fmt.Errorf("order key %q needs a topic segment index >= 0", key)
+		}
+		return &OrderKey{segment: segment}, nil
+	case strings.HasPrefix(key, ORDER_KEY_FIELD):
+		path := strings.TrimPrefix(key, ORDER_KEY_FIELD)
+		if path == "" {
+			return nil, fmt.Errorf("order key %q has no field path", key)
+		}
+		return &OrderKey{segment: -1, field: strings.Split(path, ".")}, nil
+	}
+	return nil, fmt.Errorf("unknown order key %q", key)
+}
+
+// *--------------------------------------------------------------------------------------
+// Of
+// DEV: キーを取り出せない場合はトピック全体をキーにする
+func (k *OrderKey) Of(contents mqttm.Contents, value interface{}) string {
+	if k.field != nil {
+		if field, ok := lookupField(value, k.field); ok {
+			return fmt.Sprint(field)
+		}
+		return contents.Topic
+	}
+	if k.segment >= 0 {
+		if segments := strings.Split(contents.Topic, "/"); k.segment < len(segments) {
+			return segments[k.segment]
+		}
+	}
+	return contents.Topic
+}
+
+// *--------------------------------------------------------------------------------------
+// Slot
+// DEV: 同じキーは常に同じWorkerに割り当てる
+func (k *OrderKey) Slot(contents mqttm.Contents, value interface{}, workers int) int {
+	h := fnv.New32a()
+	h.Write([]byte(contents.Hostname))
+	h.Write([]byte{0})
+	h.Write([]byte(k.Of(contents, value)))
+	return int(h.Sum32() % uint32(workers))
+}
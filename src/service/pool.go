@@ -0,0 +1,326 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/admin"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEFAULT_TASK_TIMEOUT_MS    int     = 5000
+	DEFAULT_SCALE_INTERVAL_SEC int     = 5
+	DEFAULT_SCALE_UP_DEPTH     float64 = 0.75 // キューの使用率がこれ以上なら増やす
+	SCALE_DOWN_CALM_TICKS      int     = 2    // キューが空の状態がこの回数続いたら減らす
+	LATENCY_EWMA_WEIGHT        float64 = 0.2
+
+	METRIC_WORKERS      string = "service_workers"
+	METRIC_QUEUE_DEPTH  string = "service_task_queue_depth"
+	METRIC_TASK_LATENCY string = "service_task_latency_ms"
+)
+
+type (
+	// DispatchConfig holds the worker pool settings
+	// DEV: 埋め込みのPoolConfigはMQTTタスクのプール、PoolsはそれぞれのTaskTypeのプール
+	DispatchConfig struct {
+		OrderKey string                       `json:"order_key"` // topic / segment:<n> / field:<path> (empty = shared queue, no ordering)
+		Pools    map[task.TaskType]PoolConfig `json:"pools"`     // Pools of non-MQTT task types
+		Timeouts []TimeoutRule                `json:"timeouts"`  // Per-topic timeouts of MQTT tasks (first match wins)
+		Priority PriorityConfig               `json:"priority"`  // Priority lanes of MQTT tasks (cannot be combined with order_key)
+		Batches  []BatchConfig                `json:"batches"`   // Routes whose MQTT messages run as batches on the batch pool
+
+		DrainTimeoutSec int `json:"drain_timeout_sec"` // Deadline of the shutdown drain (default 10)
+		PoolConfig
+	}
+
+	// PoolConfig holds the worker pool size, limits and autoscaling settings
+	PoolConfig struct {
+		Workers          int     `json:"workers"`             // Initial number of workers (default 1)
+		MinWorkers       int     `json:"min_workers"`         // Lower bound (default = workers)
+		MaxWorkers       int     `json:"max_workers"`         // Upper bound (default = workers)
+		QueueSize        int     `json:"queue_size"`          // Queue capacity (default = max_workers)
+		TimeoutMs        int     `json:"timeout_ms"`          // Per-task execution timeout (default 5000)
+		ScaleIntervalSec int     `json:"scale_interval_sec"`  // Autoscaling period (default 5)
+		ScaleUpDepth     float64 `json:"scale_up_depth"`      // Queue fill ratio that adds a worker (default 0.75)
+		ScaleUpLatencyMs int     `json:"scale_up_latency_ms"` // Average task latency that adds a worker while tasks wait (0 = disabled)
+
+		RateLimit ratelimit.Config `json:"rate_limit"` // Token bucket limit of task executions (bytes = MQTT payload size)
+	}
+
+	// WorkerPool runs a resizable set of workers on a shared queue
+	// DEV: 縮小時は退役通知を送り、実行中のタスクを終えたWorkerから抜ける
+	WorkerPool struct {
+		conf       PoolConfig
+		queue      chan task.Task
+		quit       <-chan struct{}
+		wg         *sync.WaitGroup
+		workerType task.TaskType
+		setup      func(*Worker) // Dispatcherが共通の設定 (結果の振り分け・Context) を行う
+		lanes      *Lanes        // 優先度別のキュー (queueはスケジューラからの受け渡しのみ)
+
+		mu      sync.Mutex
+		retire  []chan struct{} // 稼働中Workerの退役通知 (後から起動した順に退役)
+		nextID  int
+		latency float64 // タスク実行時間の移動平均 (ms)
+		stopped bool
+	}
+
+	// PoolStatus is the state reported by the admin API
+	PoolStatus struct {
+		Workers       int     `json:"workers"`
+		MinWorkers    int     `json:"min_workers"`
+		MaxWorkers    int     `json:"max_workers"`
+		QueueDepth    int     `json:"queue_depth"`
+		QueueCapacity int     `json:"queue_capacity"`
+		LatencyMs     float64 `json:"latency_ms"`
+		Resizable     bool    `json:"resizable"`
+
+		Lanes []LaneStatus `json:"lanes,omitempty"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// normalize
+// DEV: 未指定の上下限は初期Worker数に合わせる (固定サイズ)
+func (conf PoolConfig) normalize() PoolConfig {
+	if conf.Workers <= 0 {
+		conf.Workers = 1
+	}
+	if conf.MinWorkers <= 0 {
+		conf.MinWorkers = conf.Workers
+		if conf.MaxWorkers > 0 {
+			conf.MinWorkers = min(conf.Workers, conf.MaxWorkers)
+		}
+	}
+	if conf.MaxWorkers < conf.MinWorkers {
+		conf.MaxWorkers = max(conf.Workers, conf.MinWorkers)
+	}
+	conf.Workers = min(max(conf.Workers, conf.MinWorkers), conf.MaxWorkers)
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = conf.MaxWorkers
+	}
+	if conf.TimeoutMs <= 0 {
+		conf.TimeoutMs = DEFAULT_TASK_TIMEOUT_MS
+	}
+	if conf.ScaleIntervalSec <= 0 {
+		conf.ScaleIntervalSec = DEFAULT_SCALE_INTERVAL_SEC
+	}
+	if conf.ScaleUpDepth <= 0 {
+		conf.ScaleUpDepth = DEFAULT_SCALE_UP_DEPTH
+	}
+	return conf
+}
+
+// *--------------------------------------------------------------------------------------
+// timeout
+func (conf PoolConfig) timeout() time.Duration {
+	return time.Duration(conf.TimeoutMs) * time.Millisecond
+}
+
+// *--------------------------------------------------------------------------------------
+// newWorkerPool (constructor)
+func newWorkerPool(conf PoolConfig, queue chan task.Task, quit <-chan struct{}, wg *sync.WaitGroup, workerType task.TaskType, setup func(*Worker)) *WorkerPool {
+	return &WorkerPool{
+		conf:       conf,
+		queue:      queue,
+		quit:       quit,
+		wg:         wg,
+		workerType: workerType,
+		setup:      setup,
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// start
+// DEV: 上限と下限が異なる場合のみオートスケールする
+func (p *WorkerPool) start(ctx context.Context) {
+	if err := p.Resize(p.conf.Workers); err != nil {
+		zap.S().Errorf("Failed to start worker pool: %v", err)
+	}
+	if p.conf.MaxWorkers > p.conf.MinWorkers {
+		go p.autoscale(ctx)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// stop
+// DEV: Dispatcher.Stopがキューを閉じる前に呼び、以降のResizeを拒否する
+func (p *WorkerPool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+}
+
+// *--------------------------------------------------------------------------------------
+// Resize
+func (p *WorkerPool) Resize(workers int) error {
+	if workers < p.conf.MinWorkers || workers > p.conf.MaxWorkers {
+		return fmt.Errorf("worker count %d is outside [%d, %d]", workers, p.conf.MinWorkers, p.conf.MaxWorkers)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return fmt.Errorf("worker pool is stopped")
+	}
+	for len(p.retire) < workers {
+		p.nextID++
+		retire := make(chan struct{})
+		w := NewWorker(p.nextID, p.queue, p.quit, p.wg, p.workerType)
+		w.retire = retire
+		w.observe = p.observe
+		w.timeout = p.conf.timeout()
+		if p.setup != nil {
+			p.setup(w)
+		}
+		p.retire = append(p.retire, retire)
+		p.wg.Add(1)
+		go w.Start()
+	}
+	for len(p.retire) > workers {
+		last := len(p.retire) - 1
+		close(p.retire[last])
+		p.retire = p.retire[:last]
+	}
+	metrics.Gauge(METRIC_WORKERS, string(p.workerType)).Set(float64(workers))
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Status
+// DEV: レーンがある場合のキューの深さはレーンの合計
+func (p *WorkerPool) Status() PoolStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PoolStatus{
+		Workers:    len(p.retire),
+		MinWorkers: p.conf.MinWorkers,
+		MaxWorkers: p.conf.MaxWorkers,
+		LatencyMs:  p.latency,
+		Resizable:  true,
+	}
+	status.QueueDepth, status.QueueCapacity = p.depth()
+	if p.lanes != nil {
+		status.Lanes = p.lanes.Status()
+	}
+	metrics.Gauge(METRIC_QUEUE_DEPTH, string(p.workerType)).Set(float64(status.QueueDepth))
+	return status
+}
+
+// *--------------------------------------------------------------------------------------
+// depth
+func (p *WorkerPool) depth() (depth, capacity int) {
+	if p.lanes != nil {
+		return p.lanes.depth()
+	}
+	return len(p.queue), cap(p.queue)
+}
+
+// *--------------------------------------------------------------------------------------
+// queued
+// DEV: キューの深さのメトリクスを更新する (投入時・実行後に呼ぶ。オートスケールが無効でも最新にする)
+func (p *WorkerPool) queued() {
+	depth, _ := p.depth()
+	metrics.Gauge(METRIC_QUEUE_DEPTH, string(p.workerType)).Set(float64(depth))
+}
+
+// *--------------------------------------------------------------------------------------
+// observe
+// DEV: Workerがタスク実行毎に呼ぶ
+func (p *WorkerPool) observe(elapsed time.Duration) {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	p.mu.Lock()
+	if p.latency == 0 {
+		p.latency = ms
+	} else {
+		p.latency += LATENCY_EWMA_WEIGHT * (ms - p.latency)
+	}
+	latency := p.latency
+	p.mu.Unlock()
+	metrics.Gauge(METRIC_TASK_LATENCY, string(p.workerType)).Set(latency)
+	p.queued()
+}
+
+// *--------------------------------------------------------------------------------------
+// autoscale
+// DEV: キューが溜まっている (使用率・待ち中の実行時間) なら1つ増やし、空が続けば1つ減らす
+func (p *WorkerPool) autoscale(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(p.conf.ScaleIntervalSec) * time.Second)
+	defer ticker.Stop()
+	calm := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			status := p.Status()
+			busy := float64(status.QueueDepth) >= p.conf.ScaleUpDepth*float64(status.QueueCapacity)
+			slow := p.conf.ScaleUpLatencyMs > 0 && status.QueueDepth > 0 && status.LatencyMs >= float64(p.conf.ScaleUpLatencyMs)
+
+			target := status.Workers
+			switch {
+			case busy || slow:
+				calm = 0
+				target++
+			case status.QueueDepth == 0:
+				if calm++; calm >= SCALE_DOWN_CALM_TICKS {
+					calm = 0
+					target--
+				}
+			default:
+				calm = 0
+			}
+			if target == status.Workers || target < p.conf.MinWorkers || target > p.conf.MaxWorkers {
+				continue
+			}
+			if err := p.Resize(target); err != nil {
+				zap.S().Warnf("Failed to autoscale %s workers: %v", p.workerType, err)
+				continue
+			}
+			zap.S().Infof("Autoscaled %s workers %d -> %d (queue %d/%d, latency %.1fms)",
+				p.workerType, status.Workers, target, status.QueueDepth, status.QueueCapacity, status.LatencyMs)
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// AdminHandler
+// DEV: GET = 全プールの状態 / PUT・POST {"type": "mqtt", "workers": n} = Worker数の変更 (type省略時はmqtt)
+func (d *Dispatcher) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			admin.WriteJSON(w, http.StatusOK, d.Pools())
+
+		case http.MethodPut, http.MethodPost:
+			var req struct {
+				Type    task.TaskType `json:"type"`
+				Workers int           `json:"workers"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				admin.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			if req.Type == "" {
+				req.Type = task.MqttTaskType
+			}
+			if err := d.Resize(req.Type, req.Workers); err != nil {
+				admin.WriteError(w, http.StatusConflict, err.Error())
+				return
+			}
+			zap.S().Infof("Resized %s workers to %d via admin API", req.Type, req.Workers)
+			admin.WriteJSON(w, http.StatusOK, d.Pools()[req.Type])
+
+		default:
+			admin.WriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+// funcTask is a task running a function
+type funcTask struct {
+	name     string
+	taskType task.TaskType
+	run      func(ctx context.Context) error
+}
+
+func (t *funcTask) Execute(ctx context.Context) error { return t.run(ctx) }
+func (t *funcTask) String() string                    { return t.name }
+func (t *funcTask) Type() task.TaskType               { return t.taskType }
+
+// gate holds tasks until it is opened and reports the tasks that started
+type gate struct {
+	started chan string
+	open    chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{started: make(chan string, 100), open: make(chan struct{})}
+}
+
+func (g *gate) task(name string, taskType task.TaskType) *funcTask {
+	return &funcTask{name: name, taskType: taskType, run: func(ctx context.Context) error {
+		g.started <- name
+		select {
+		case <-g.open:
+		case <-ctx.Done():
+		}
+		return nil
+	}}
+}
+
+// waitStarted waits for n tasks to start and fails if another one starts within settle
+func (g *gate) waitStarted(t *testing.T, n int, settle time.Duration) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-g.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d tasks started", i, n)
+		}
+	}
+	select {
+	case name := <-g.started:
+		t.Fatalf("%s started beyond the %d expected", name, n)
+	case <-time.After(settle):
+	}
+}
+
+func newTestPool(t *testing.T, conf PoolConfig) (*WorkerPool, chan task.Task) {
+	t.Helper()
+	conf = conf.normalize()
+	quit := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	queue := make(chan task.Task, conf.QueueSize)
+	t.Cleanup(func() {
+		close(quit)
+		wg.Wait()
+	})
+	return newWorkerPool(conf, queue, quit, wg, task.OtherTaskType, nil), queue
+}
+
+func TestPoolConfigNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		conf PoolConfig
+		want [4]int // workers, min, max, queue
+	}{
+		{PoolConfig{}, [4]int{1, 1, 1, 1}},
+		{PoolConfig{Workers: 4}, [4]int{4, 4, 4, 4}},
+		{PoolConfig{Workers: 2, MaxWorkers: 8}, [4]int{2, 2, 8, 8}},
+		{PoolConfig{Workers: 10, MinWorkers: 1, MaxWorkers: 4, QueueSize: 16}, [4]int{4, 1, 4, 16}},
+		{PoolConfig{Workers: 1, MinWorkers: 3}, [4]int{3, 3, 3, 3}},
+	} {
+		conf := tc.conf.normalize()
+		if got := [4]int{conf.Workers, conf.MinWorkers, conf.MaxWorkers, conf.QueueSize}; got != tc.want {
+			t.Errorf("%+v normalized to %v, want %v", tc.conf, got, tc.want)
+		}
+	}
+}
+
+func TestWorkerPoolResize(t *testing.T) {
+	pool, queue := newTestPool(t, PoolConfig{Workers: 1, MinWorkers: 1, MaxWorkers: 4, QueueSize: 8})
+	if err := pool.Resize(4); err != nil {
+		t.Fatal(err)
+	}
+	g := newGate()
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		queue <- g.task(name, task.OtherTaskType)
+	}
+	g.waitStarted(t, 4, 50*time.Millisecond)
+	close(g.open)
+	g.waitStarted(t, 1, 0)
+
+	// DEV: 待機中のWorkerは退役通知ですぐに抜け、残った1つだけがタスクを実行する
+	// (実行中のWorkerは手元のタスクを終えてから抜けるため、全員が待機に戻るのを待つ)
+	time.Sleep(100 * time.Millisecond)
+	if err := pool.Resize(1); err != nil {
+		t.Fatal(err)
+	}
+	if status := pool.Status(); status.Workers != 1 {
+		t.Errorf("status = %+v, want 1 worker", status)
+	}
+	g = newGate()
+	queue <- g.task("f", task.OtherTaskType)
+	queue <- g.task("g", task.OtherTaskType)
+	g.waitStarted(t, 1, 100*time.Millisecond)
+	close(g.open)
+	g.waitStarted(t, 1, 0)
+
+	for _, workers := range []int{0, 5} {
+		if err := pool.Resize(workers); err == nil {
+			t.Errorf("Resize(%d) outside [1, 4] was accepted", workers)
+		}
+	}
+	pool.stop()
+	if err := pool.Resize(2); err == nil {
+		t.Error("stopped pool was resized")
+	}
+}
+
+func TestWorkerPoolAutoscale(t *testing.T) {
+	pool, queue := newTestPool(t, PoolConfig{Workers: 1, MinWorkers: 1, MaxWorkers: 3, QueueSize: 4, ScaleIntervalSec: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool.start(ctx)
+
+	g := newGate()
+	for i := 0; i < 5; i++ {
+		queue <- g.task("t", task.OtherTaskType)
+	}
+	waitWorkers := func(done func(int) bool, what string) int {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if workers := pool.Status().Workers; done(workers) {
+				return workers
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("workers = %d, want %s", pool.Status().Workers, what)
+		return 0
+	}
+	// DEV: キューが溜まっている間は増え、空が続くと減る
+	peak := waitWorkers(func(n int) bool { return n >= 2 }, "a scale up")
+	close(g.open)
+	waitWorkers(func(n int) bool { return n < peak }, "a scale down")
+	if workers := pool.Status().Workers; workers < 1 || workers > 3 {
+		t.Errorf("workers = %d, outside [1, 3]", workers)
+	}
+}
@@ -0,0 +1,302 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+const (
+	METRIC_LANE_DEPTH string = "service_lane_queue_depth"
+	METRIC_LANE_TASKS string = "service_lane_tasks_total"
+)
+
+type (
+	// PriorityConfig assigns MQTT tasks to priority lanes
+	PriorityConfig struct {
+		Lanes   []LaneConfig   `json:"lanes"`   // Lanes, highest priority first (empty = single FIFO queue)
+		Rules   []PriorityRule `json:"rules"`   // Topic filter -> lane (first match wins)
+		Field   string         `json:"field"`   // Payload field naming the lane, e.g. meta.priority (overrides rules)
+		Default string         `json:"default"` // Lane of unmatched messages (default = last lane)
+	}
+
+	// LaneConfig is a priority lane
+	LaneConfig struct {
+		Name      string `json:"name"`
+		Weight    int    `json:"weight"`     // Share of the workers while lanes compete (default = lanes below it + 1, e.g. 3/2/1)
+		QueueSize int    `json:"queue_size"` // Lane capacity (default = queue_size of the pool)
+	}
+
+	// PriorityRule assigns the MQTT tasks of a topic filter to a lane
+	PriorityRule struct {
+		Topic string `json:"topic"`
+		Lane  string `json:"lane"`
+	}
+
+	// Lanes queues MQTT tasks per priority and feeds the workers by weighted fair scheduling
+	// DEV: Smooth Weighted Round Robin。待ちのあるレーンだけで重みを配分するため、高優先が先に出るが低優先も止まらない
+	Lanes struct {
+		lanes  []*lane
+		byName map[string]*lane
+		rules  []PriorityRule
+		field  []string
+		def    *lane
+		wake   chan struct{} // 投入の通知 (スケジューラの待機解除)
+	}
+
+	// lane is the queue of one priority class
+	lane struct {
+		conf    LaneConfig
+		queue   chan task.Task
+		current int  // SWRRの現在値
+		closed  bool // スケジューラだけが参照する
+	}
+
+	// LaneStatus is the state of a lane reported by the admin API
+	LaneStatus struct {
+		Name          string `json:"name"`
+		Weight        int    `json:"weight"`
+		QueueDepth    int    `json:"queue_depth"`
+		QueueCapacity int    `json:"queue_capacity"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// NewLanes (constructor)
+// DEV: レーンが無い場合はnilを返す (従来の単一FIFO)。キューはDispatcherがopenで作る
+func NewLanes(conf PriorityConfig) (*Lanes, error) {
+	if len(conf.Lanes) == 0 {
+		if len(conf.Rules) > 0 || conf.Field != "" {
+			return nil, fmt.Errorf("priority rules need lanes")
+		}
+		return nil, nil
+	}
+	l := &Lanes{byName: make(map[string]*lane), wake: make(chan struct{}, 1)}
+	for i, laneConf := range conf.Lanes {
+		if laneConf.Name == "" {
+			return nil, fmt.Errorf("priority lane name is required")
+		}
+		if _, ok := l.byName[laneConf.Name]; ok {
+			return nil, fmt.Errorf("duplicate priority lane %q", laneConf.Name)
+		}
+		// DEV: 既定の重みは位置から決める (全て1だと優先度の差が無くなる)
+		if laneConf.Weight <= 0 {
+			laneConf.Weight = len(conf.Lanes) - i
+		}
+		ln := &lane{conf: laneConf}
+		l.lanes = append(l.lanes, ln)
+		l.byName[laneConf.Name] = ln
+	}
+	for _, rule := range conf.Rules {
+		if !mqttm.ValidTopicFilter(rule.Topic) {
+			return nil, fmt.Errorf("invalid priority topic filter %q", rule.Topic)
+		}
+		if _, ok := l.byName[rule.Lane]; !ok {
+			return nil, fmt.Errorf("unknown priority lane %q for %s", rule.Lane, rule.Topic)
+		}
+	}
+	l.rules = conf.Rules
+	if conf.Field != "" {
+		l.field = strings.Split(conf.Field, ".")
+	}
+	l.def = l.lanes[len(l.lanes)-1]
+	if conf.Default != "" {
+		def, ok := l.byName[conf.Default]
+		if !ok {
+			return nil, fmt.Errorf("unknown default priority lane %q", conf.Default)
+		}
+		l.def = def
+	}
+	return l, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// open
+// DEV: レーン毎のキューを作る
+func (l *Lanes) open(queueSize int) {
+	for _, ln := range l.lanes {
+		size := ln.conf.QueueSize
+		if size <= 0 {
+			size = queueSize
+		}
+		ln.queue = make(chan task.Task, size)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// Classify
+// DEV: ペイロードのフィールド > トピックのルール > 既定のレーン の順に決める
+func (l *Lanes) Classify(contents mqttm.Contents, value interface{}) string {
+	return l.classify(contents, value).conf.Name
+}
+
+// *--------------------------------------------------------------------------------------
+// classify
+func (l *Lanes) classify(contents mqttm.Contents, value interface{}) *lane {
+	if l.field != nil {
+		if field, ok := lookupField(value, l.field); ok {
+			if ln, ok := l.byName[fmt.Sprint(field)]; ok {
+				return ln
+			}
+		}
+	}
+	for _, rule := range l.rules {
+		if mqttm.MatchTopic(rule.Topic, contents.Topic) {
+			return l.byName[rule.Lane]
+		}
+	}
+	return l.def
+}
+
+// *--------------------------------------------------------------------------------------
+// queueFor
+func (l *Lanes) queueFor(contents mqttm.Contents, value interface{}) chan task.Task {
+	return l.classify(contents, value).queue
+}
+
+// *--------------------------------------------------------------------------------------
+// signal
+// DEV: スケジューラが待機中なら起こす
+func (l *Lanes) signal() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// queues
+// DEV: Dispatcherの停止時にレーンを閉じる。スケジューラは残りを渡し切ってからtaskQueを閉じる
+func (l *Lanes) queues() []chan task.Task {
+	queues := make([]chan task.Task, 0, len(l.lanes))
+	for _, ln := range l.lanes {
+		queues = append(queues, ln.queue)
+	}
+	return queues
+}
+
+// *--------------------------------------------------------------------------------------
+// depth
+// DEV: WorkerPoolのオートスケールはレーン全体の使用率で判定する
+func (l *Lanes) depth() (depth, capacity int) {
+	for _, ln := range l.lanes {
+		depth += len(ln.queue)
+		capacity += cap(ln.queue)
+	}
+	return depth, capacity
+}
+
+// *--------------------------------------------------------------------------------------
+// Status
+func (l *Lanes) Status() []LaneStatus {
+	status := make([]LaneStatus, 0, len(l.lanes))
+	for _, ln := range l.lanes {
+		status = append(status, LaneStatus{
+			Name:          ln.conf.Name,
+			Weight:        ln.conf.Weight,
+			QueueDepth:    len(ln.queue),
+			QueueCapacity: cap(ln.queue),
+		})
+	}
+	return status
+}
+
+// *--------------------------------------------------------------------------------------
+// run
+// DEV: Workerが受け取れる時に1つずつ渡す (outはバッファ無し)。
+// 全てのレーンが閉じて空になったらoutを閉じる。停止時に渡せなかったタスクはabandonに渡す
+func (l *Lanes) run(ctx context.Context, out chan<- task.Task, wg *sync.WaitGroup, abandon func(task.Task)) {
+	defer wg.Done()
+	defer close(out)
+	for {
+		t, open := l.next()
+		if !open {
+			return
+		}
+		if t == nil {
+			select {
+			case <-l.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		select {
+		case out <- t:
+		case <-ctx.Done():
+			abandon(t)
+			return
+		}
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// next
+// DEV: 待ちのあるレーンからSWRRで選ぶ。全て空ならnil、全て閉じて空ならopen = false
+func (l *Lanes) next() (t task.Task, open bool) {
+	total := 0
+	var chosen *lane
+	for _, ln := range l.lanes {
+		if len(ln.queue) == 0 {
+			continue
+		}
+		ln.current += ln.conf.Weight
+		total += ln.conf.Weight
+		if chosen == nil || ln.current > chosen.current {
+			chosen = ln
+		}
+	}
+	if chosen != nil {
+		chosen.current -= total
+		if t, ok := <-chosen.queue; ok {
+			l.taken(chosen)
+			return t, true
+		}
+		chosen.closed = true
+	}
+
+	// DEV: 空のレーンが閉じているかを確認する
+	open = false
+	for _, ln := range l.lanes {
+		if ln.closed {
+			continue
+		}
+		select {
+		case t, ok := <-ln.queue:
+			if !ok {
+				ln.closed = true
+				continue
+			}
+			l.taken(ln)
+			return t, true
+		default:
+			open = true
+		}
+	}
+	return nil, open
+}
+
+// *--------------------------------------------------------------------------------------
+// taken
+func (l *Lanes) taken(ln *lane) {
+	metrics.Counter(METRIC_LANE_TASKS, ln.conf.Name).Add(1)
+	metrics.Gauge(METRIC_LANE_DEPTH, ln.conf.Name).Set(float64(len(ln.queue)))
+}
+
+// *--------------------------------------------------------------------------------------
+// enqueued
+// DEV: レーン以外のキュー (MQTT以外のタスク) の場合は何もしない
+func (l *Lanes) enqueued(queue chan task.Task) {
+	for _, ln := range l.lanes {
+		if ln.queue == queue {
+			metrics.Gauge(METRIC_LANE_DEPTH, ln.conf.Name).Set(float64(len(ln.queue)))
+			l.signal()
+			return
+		}
+	}
+}
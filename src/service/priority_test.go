@@ -0,0 +1,127 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+func newTestLanes(t *testing.T, conf PriorityConfig, size int) *Lanes {
+	t.Helper()
+	l, err := NewLanes(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.open(size)
+	return l
+}
+
+func fillLane(l *Lanes, name string, n int) {
+	for i := 0; i < n; i++ {
+		l.byName[name].queue <- &task.MqttTask{ID: i, Contents: mqttm.Contents{Topic: name}}
+	}
+}
+
+// takeLanes returns the lane of each of the next n tasks
+func takeLanes(t *testing.T, l *Lanes, n int) map[string]int {
+	t.Helper()
+	counts := map[string]int{}
+	for i := 0; i < n; i++ {
+		next, open := l.next()
+		if next == nil || !open {
+			t.Fatalf("next #%d = %v, %v, want a task", i, next, open)
+		}
+		counts[next.(*task.MqttTask).Contents.Topic]++
+	}
+	return counts
+}
+
+func TestLanesNextWeighted(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{Lanes: []LaneConfig{{Name: "high", Weight: 3}, {Name: "low", Weight: 1}}}, 100)
+	fillLane(l, "high", 50)
+	fillLane(l, "low", 50)
+
+	counts := takeLanes(t, l, 40)
+	if counts["high"] != 30 || counts["low"] != 10 {
+		t.Fatalf("counts = %v, want high 30 and low 10", counts)
+	}
+}
+
+func TestLanesNextSmooth(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{Lanes: []LaneConfig{{Name: "high", Weight: 3}, {Name: "low", Weight: 1}}}, 100)
+	fillLane(l, "high", 10)
+	fillLane(l, "low", 10)
+
+	// DEV: SWRRは高優先をまとめて出さず、4つ毎に低優先を1つ挟む
+	for round := 0; round < 3; round++ {
+		if counts := takeLanes(t, l, 4); counts["low"] != 1 {
+			t.Fatalf("round %d = %v, want one low task every 4", round, counts)
+		}
+	}
+}
+
+func TestLanesNextDefaultWeights(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{Lanes: []LaneConfig{{Name: "a"}, {Name: "b"}, {Name: "c"}}}, 100)
+	fillLane(l, "a", 60)
+	fillLane(l, "b", 60)
+	fillLane(l, "c", 60)
+
+	counts := takeLanes(t, l, 60)
+	if counts["a"] != 30 || counts["b"] != 20 || counts["c"] != 10 {
+		t.Fatalf("counts = %v, want a 30, b 20 and c 10 (weights 3/2/1)", counts)
+	}
+}
+
+func TestLanesNextIdleLaneYields(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{Lanes: []LaneConfig{{Name: "high", Weight: 8}, {Name: "low", Weight: 1}}}, 100)
+	fillLane(l, "low", 5)
+
+	if counts := takeLanes(t, l, 5); counts["low"] != 5 {
+		t.Fatalf("counts = %v, want all tasks from low while high is empty", counts)
+	}
+	if next, open := l.next(); next != nil || !open {
+		t.Fatalf("next on empty lanes = %v, %v, want nil and open", next, open)
+	}
+}
+
+func TestLanesNextClosed(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{Lanes: []LaneConfig{{Name: "high"}, {Name: "low"}}}, 10)
+	fillLane(l, "low", 1)
+	for _, queue := range l.queues() {
+		close(queue)
+	}
+
+	// DEV: 閉じた後も残りは渡し、全て空になってからopen = false
+	if next, open := l.next(); next == nil || !open {
+		t.Fatalf("next = %v, %v, want the remaining task", next, open)
+	}
+	if next, open := l.next(); next != nil || open {
+		t.Fatalf("next = %v, %v, want nil and closed", next, open)
+	}
+}
+
+func TestLanesClassify(t *testing.T) {
+	l := newTestLanes(t, PriorityConfig{
+		Lanes:   []LaneConfig{{Name: "high"}, {Name: "normal"}, {Name: "bulk"}},
+		Rules:   []PriorityRule{{Topic: "cmd/#", Lane: "high"}},
+		Field:   "meta.priority",
+		Default: "normal",
+	}, 10)
+
+	cases := []struct {
+		topic string
+		value interface{}
+		want  string
+	}{
+		{"cmd/reboot", nil, "high"},
+		{"telemetry/a", nil, "normal"},
+		{"telemetry/a", map[string]interface{}{"meta": map[string]interface{}{"priority": "bulk"}}, "bulk"},
+		{"cmd/reboot", map[string]interface{}{"meta": map[string]interface{}{"priority": "unknown"}}, "high"},
+	}
+	for _, c := range cases {
+		if got := l.Classify(mqttm.Contents{Topic: c.topic}, c.value); got != c.want {
+			t.Errorf("Classify(%s, %v) = %s, want %s", c.topic, c.value, got, c.want)
+		}
+	}
+}
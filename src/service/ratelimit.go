@@ -0,0 +1,48 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_RATE_LIMIT string = "rate_limit" // 流量制限でspillされたタスク
+)
+
+// *--------------------------------------------------------------------------------------
+// RateLimitName
+// DEV: タスクの流量制限のメトリクスのラベル
+func RateLimitName(taskType task.TaskType) string {
+	return "task:" + string(taskType)
+}
+
+// *--------------------------------------------------------------------------------------
+// ValidateRateLimits
+func ValidateRateLimits(conf DispatchConfig) error {
+	if _, err := ratelimit.New(RateLimitName(task.MqttTaskType), conf.RateLimit); err != nil {
+		return err
+	}
+	for taskType, pool := range conf.Pools {
+		if _, err := ratelimit.New(RateLimitName(taskType), pool.RateLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// spill
+// DEV: MqttTask・BatchTaskは受信内容をDead-letterに reason=rate_limit で退避する (replayで再投入できる)。それ以外は破棄する
+func (d *Dispatcher) spill(t task.Task) {
+	contents := contentsOf(t)
+	if contents == nil {
+		zap.S().Warnf("Dropped task %s (rate limited, cannot be spilled)", t.String())
+		return
+	}
+	for _, c := range contents {
+		d.deadLetter(c, DEAD_LETTER_RATE_LIMIT, fmt.Errorf("task %s exceeded the rate limit of %s tasks", t.String(), t.Type()))
+	}
+}
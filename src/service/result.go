@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_PUBLISH string = "publish" // タスク結果の送信失敗
+
+	METRIC_RESULT_MESSAGES string = "service_result_messages_total"
+	METRIC_RESULT_TASKS    string = "service_result_tasks_total"
+	METRIC_RESULT_REJECTED string = "service_result_rejected_total"
+)
+
+type (
+	// contextPublisher is implemented by clients that trace publishes (mqttm.Module)
+	contextPublisher interface {
+		PublishContext(ctx context.Context, topic string, qos byte, payload []byte) error
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// route
+// DEV: Workerから呼ばれる。出力メッセージを送信し、後続タスクを各プールに投入する
+func (d *Dispatcher) route(ctx context.Context, from task.Task, result *task.Result) {
+	if result == nil {
+		return
+	}
+	if len(result.Metadata) > 0 {
+		zap.S().Debugw("Task result", "task", from.String(), "metadata", result.Metadata)
+	}
+	for _, msg := range result.Messages {
+		if err := d.publishResult(ctx, msg); err != nil {
+			zap.S().Errorf("Failed to publish result of %s to %s: %v", from.String(), msg.Topic, err)
+			d.deadLetter(mqttm.Contents{Hostname: msg.Host, Topic: msg.Topic, QoS: msg.QoS, Payload: msg.Payload}, DEAD_LETTER_PUBLISH, err)
+			continue
+		}
+		metrics.Counter(METRIC_RESULT_MESSAGES, msg.Host).Add(1)
+	}
+	for _, next := range result.Next {
+		inheritTrace(ctx, next)
+		if err := d.Submit(next); err != nil {
+			zap.S().Errorf("Failed to enqueue follow-up of %s: %v", from.String(), err)
+			d.rejectFollowUp(next, err)
+			continue
+		}
+		metrics.Counter(METRIC_RESULT_TASKS, string(next.Type())).Add(1)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// rejectFollowUp
+// DEV: 停止中はabandon (Drainの集計に含める)、それ以外はDead-letterに退避する。MQTT以外のタスクは復元できないため破棄する
+func (d *Dispatcher) rejectFollowUp(next task.Task, cause error) {
+	metrics.Counter(METRIC_RESULT_REJECTED, string(next.Type())).Add(1)
+	if d.draining.Load() || d.ctx.Err() != nil {
+		d.abandon(next)
+		return
+	}
+	contents := contentsOf(next)
+	if contents == nil {
+		zap.S().Warnf("Dropped follow-up task %s", next.String())
+		return
+	}
+	for _, c := range contents {
+		d.deadLetter(c, DEAD_LETTER_QUEUE_FULL, cause)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// publishResult
+// DEV: Moduleの場合はタスクのSpanを親にして送信する
+func (d *Dispatcher) publishResult(ctx context.Context, msg task.Message) error {
+	client, ok := d.MqttClients[msg.Host]
+	if !ok {
+		return fmt.Errorf("unknown MQTT client %q", msg.Host)
+	}
+	payload := msg.Payload
+	if payload == nil && msg.Value != nil {
+		encoded, err := d.codecs.Encode(msg.Topic, msg.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode payload for %s: %w", msg.Topic, err)
+		}
+		payload = encoded
+	}
+	if publisher, ok := client.(contextPublisher); ok {
+		return publisher.PublishContext(ctx, msg.Topic, msg.QoS, payload)
+	}
+	return client.Publish(msg.Topic, msg.QoS, payload)
+}
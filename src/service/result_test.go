@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm/mqttmtest"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+// resultTask is a task returning a fixed result
+type resultTask struct {
+	funcTask
+	result *task.Result
+}
+
+func (t *resultTask) Produce(ctx context.Context) (*task.Result, error) {
+	return t.result, t.run(ctx)
+}
+
+func newResultTask(name string, result *task.Result) *resultTask {
+	return &resultTask{
+		funcTask: funcTask{name: name, taskType: task.OtherTaskType, run: func(context.Context) error { return nil }},
+		result:   result,
+	}
+}
+
+func TestResultRouting(t *testing.T) {
+	client := mqttmtest.New("h")
+	dead := &deadLetters{}
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{"h": client}, 1,
+		WithTaskPool(task.OtherTaskType, PoolConfig{Workers: 1, QueueSize: 4}), WithDeadLetter(dead))
+	d.Start()
+	t.Cleanup(d.Stop)
+
+	followed := make(chan struct{})
+	err := d.Submit(newResultTask("producer", &task.Result{
+		Messages: []task.Message{
+			{Host: "h", Topic: "out/raw", QoS: 1, Payload: []byte("raw")},
+			{Host: "h", Topic: "out/value", Value: map[string]interface{}{"n": 1}},
+			{Host: "missing", Topic: "out/lost", Payload: []byte("lost")},
+		},
+		Next: []task.Task{&funcTask{name: "next", taskType: task.OtherTaskType, run: func(context.Context) error {
+			close(followed)
+			return nil
+		}}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-followed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("follow-up task was not executed")
+	}
+	published, err := client.WaitPublished(2, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published[0].Topic != "out/raw" || string(published[0].Payload) != "raw" || published[0].QoS != 1 {
+		t.Errorf("first message = %+v", published[0])
+	}
+	// DEV: Payloadの無いメッセージはトピックのCodec (既定はJSON) でエンコードされる
+	var value map[string]interface{}
+	if err := json.Unmarshal(published[1].Payload, &value); err != nil || published[1].Topic != "out/value" || value["n"] != 1.0 {
+		t.Errorf("second message = %+v (%v)", published[1], err)
+	}
+	if reasons := dead.reasons(); reasons[DEAD_LETTER_PUBLISH] != 1 || len(reasons) != 1 {
+		t.Errorf("dead letters = %v, want the message to the unknown client with reason publish", reasons)
+	}
+}
+
+func TestRejectedFollowUpsAreDeadLettered(t *testing.T) {
+	dead := &deadLetters{}
+	// DEV: MQTTクライアントが無いためMQTTのWorkerは起動せず、キュー (1件) は2件目で満杯になる
+	d := NewDispatcher(context.Background(), map[string]mqttm.Client{}, 1,
+		WithPool(PoolConfig{QueueSize: 1}),
+		WithTaskPool(task.OtherTaskType, PoolConfig{Workers: 1, QueueSize: 4}), WithDeadLetter(dead))
+	d.Start()
+	t.Cleanup(d.Stop)
+
+	producer := newResultTask("producer", &task.Result{Next: []task.Task{
+		&task.MqttTask{Contents: mqttm.Contents{Topic: "queued", Payload: []byte("1")}},
+		&task.MqttTask{Contents: mqttm.Contents{Topic: "rejected", Payload: []byte("2")}},
+		&funcTask{name: "no pool", taskType: task.TaskType("http"), run: func(context.Context) error { return nil }},
+	}})
+	if err := d.Submit(producer); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dead.reasons()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dead.mu.Lock()
+	defer dead.mu.Unlock()
+	// DEV: 復元できるMQTTタスクだけがDead-letterに残る (他の種別は破棄)
+	if len(dead.entries) != 1 || dead.entries[0].Reason != DEAD_LETTER_QUEUE_FULL || dead.entries[0].Contents.Topic != "rejected" {
+		t.Errorf("dead letters = %+v, want the rejected MQTT follow-up with reason queue_full", dead.entries)
+	}
+}
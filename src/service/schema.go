@@ -0,0 +1,203 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_SCHEMA string = "schema" // JSON Schemaの検証エラー
+
+	DEFAULT_MAX_VIOLATIONS int = 3
+
+	METRIC_SCHEMA_INVALID string = "service_schema_invalid_total"
+)
+
+type (
+	// SchemaConfig maps topic filters to JSON Schema files
+	SchemaConfig struct {
+		Rules         []SchemaRule     `json:"rules"`          // Evaluated in order, first match wins
+		MaxViolations int              `json:"max_violations"` // Violations kept in the log / rejection (default 3)
+		Reject        DeadLetterConfig `json:"reject"`         // Rejection destination (empty = DeadLetter)
+	}
+
+	// SchemaRule assigns a JSON Schema to a topic filter
+	SchemaRule struct {
+		Topic  string `json:"topic"`
+		Schema string `json:"schema"` // Path of the schema file
+	}
+
+	// SchemaValidator validates decoded payloads against the schema of their topic
+	SchemaValidator struct {
+		rules         []schemaRule
+		maxViolations int
+	}
+
+	// schemaRule is a compiled SchemaRule
+	schemaRule struct {
+		filter string
+		path   string
+		schema *jsonschema.Schema
+	}
+
+	// SchemaError lists the first violations of an invalid payload
+	SchemaError struct {
+		Topic      string
+		Schema     string
+		Violations []string
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Error
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("payload on %s does not match %s: %s", e.Topic, e.Schema, strings.Join(e.Violations, "; "))
+}
+
+// *--------------------------------------------------------------------------------------
+// NewSchemaValidator (constructor)
+// DEV: 起動時に全スキーマをコンパイルし、設定ミスはここでエラーにする
+func NewSchemaValidator(conf SchemaConfig) (*SchemaValidator, error) {
+	v := &SchemaValidator{maxViolations: conf.MaxViolations}
+	if v.maxViolations <= 0 {
+		v.maxViolations = DEFAULT_MAX_VIOLATIONS
+	}
+	compiler := jsonschema.NewCompiler()
+	for _, rule := range conf.Rules {
+		if !mqttm.ValidTopicFilter(rule.Topic) {
+			return nil, fmt.Errorf("invalid schema topic filter %q", rule.Topic)
+		}
+		schema, err := compiler.Compile(rule.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile schema %s: %w", rule.Schema, err)
+		}
+		v.rules = append(v.rules, schemaRule{filter: rule.Topic, path: rule.Schema, schema: schema})
+	}
+	return v, nil
+}
+
+// *--------------------------------------------------------------------------------------
+// Validate
+// DEV: 一致するルールが無いトピックは検証しない
+func (v *SchemaValidator) Validate(topic string, value interface{}) error {
+	for _, rule := range v.rules {
+		if !mqttm.MatchTopic(rule.filter, topic) {
+			continue
+		}
+		normalized, err := jsonValue(value)
+		if err == nil {
+			err = rule.schema.Validate(normalized)
+		}
+		if err == nil {
+			return nil
+		}
+		metrics.Counter(METRIC_SCHEMA_INVALID, rule.filter).Add(1)
+		schemaErr := &SchemaError{Topic: topic, Schema: rule.path}
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			schemaErr.Violations = []string{err.Error()}
+			return schemaErr
+		}
+		for _, cause := range validationErr.BasicOutput().Errors {
+			if cause.Error == "" || strings.HasPrefix(cause.Error, "doesn't validate with") {
+				continue
+			}
+			schemaErr.Violations = append(schemaErr.Violations, fmt.Sprintf("%s: %s", instancePath(cause.InstanceLocation), cause.Error))
+			if len(schemaErr.Violations) >= v.maxViolations {
+				break
+			}
+		}
+		return schemaErr
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// instancePath
+func instancePath(location string) string {
+	if location == "" {
+		return "/"
+	}
+	return location
+}
+
+// *--------------------------------------------------------------------------------------
+// validate
+// DEV: 不正なメッセージはタスクにせず、Reject先 (無ければDead-letter) に退避する
+func (d *Dispatcher) validate(contents mqttm.Contents, value interface{}) bool {
+	if d.schemas == nil {
+		return true
+	}
+	err := d.schemas.Validate(contents.Topic, value)
+	if err == nil {
+		return true
+	}
+	zap.S().Warnf("Rejected message: %v", err)
+	d.divert(d.rejections, contents, DEAD_LETTER_SCHEMA, err)
+	return false
+}
+
+// *--------------------------------------------------------------------------------------
+// jsonValue
+// DEV: CBOR・msgpack・protobufでデコードした値をJSONの型 (map[string]interface{}・json.Numberなど) に揃える。
+// JSONの型はそのまま使い、それ以外はencoding/jsonで変換し直す
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, string, json.Number, float64:
+		return v, nil
+
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = converted
+		}
+		return out, nil
+
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = converted
+		}
+		return out, nil
+
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			converted, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out[fmt.Sprint(key)] = converted
+		}
+		return out, nil
+
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("payload of type %T cannot be validated as JSON: %w", v, err)
+		}
+		decoder := json.NewDecoder(bytes.NewReader(encoded))
+		decoder.UseNumber()
+		var out interface{}
+		if err := decoder.Decode(&out); err != nil {
+			return nil, err
+		}
+		return out, nil
+	}
+}
@@ -0,0 +1,114 @@
+// service/task/batch.go
+// DEV: 受信メッセージをルート毎にまとめて1回で処理するタスク (DBへの一括書き込みなど)
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+)
+
+type (
+	// BatchItem is a received message accumulated into a batch
+	BatchItem struct {
+		Contents mqttm.Contents
+		Value    interface{} // Dispatcherでデコード済みのペイロード
+		Attempts int         // 失敗した回数
+	}
+
+	// BatchHandler processes the items of a batch at once
+	// DEV: 一部の要素だけ失敗した場合は *BatchError を返す。それ以外のエラーは全ての要素の失敗として扱う
+	BatchHandler func(ctx context.Context, route string, items []BatchItem) error
+
+	// BatchError reports the items of a batch that failed (index in the batch -> cause)
+	BatchError struct {
+		Failed map[int]error
+	}
+
+	// BatchTask runs a BatchHandler on the accumulated items of a route
+	BatchTask struct {
+		ID      int
+		Route   string
+		Items   []BatchItem
+		Handler BatchHandler
+		Timeout time.Duration // ルート毎のタイムアウト (0 = プールの設定)
+
+		Failed func(t *BatchTask, items []BatchItem, causes []error) // 失敗した要素の通知先 (nil = 破棄)
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// Error (BatchError)
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Failed))
+	for index := range e.Failed {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	causes := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		causes = append(causes, fmt.Sprintf("#%d: %v", index, e.Failed[index]))
+	}
+	return fmt.Sprintf("%d batch items failed (%s)", len(e.Failed), strings.Join(causes, ", "))
+}
+
+// *--------------------------------------------------------------------------------------
+// Execute
+// DEV: キャンセル・タイムアウトの場合はWorkerが扱うため、失敗の通知はしない
+func (t *BatchTask) Execute(ctx context.Context) error {
+	err := t.Handler(ctx, t.Route, t.Items)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	if t.Failed != nil {
+		items, causes := t.failures(err)
+		t.Failed(t, items, causes)
+	}
+	return err
+}
+
+// *--------------------------------------------------------------------------------------
+// failures
+// DEV: BatchErrorの範囲外の添字は無視する
+func (t *BatchTask) failures(err error) ([]BatchItem, []error) {
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		causes := make([]error, len(t.Items))
+		for i := range causes {
+			causes[i] = err
+		}
+		return t.Items, causes
+	}
+	items := make([]BatchItem, 0, len(batchErr.Failed))
+	causes := make([]error, 0, len(batchErr.Failed))
+	for i, item := range t.Items {
+		if cause, ok := batchErr.Failed[i]; ok {
+			items = append(items, item)
+			causes = append(causes, cause)
+		}
+	}
+	return items, causes
+}
+
+// * --------------------------------------------------------------------------------------
+// String
+func (t *BatchTask) String() string {
+	return fmt.Sprintf("BatchTask{Route: %s, ID: %d, Items: %d}", t.Route, t.ID, len(t.Items))
+}
+
+// *--------------------------------------------------------------------------------------
+// TaskTimeout
+func (t *BatchTask) TaskTimeout() time.Duration {
+	return t.Timeout
+}
+
+// *--------------------------------------------------------------------------------------
+// Type
+func (t *BatchTask) Type() TaskType {
+	return BatchTaskType
+}
@@ -2,7 +2,10 @@
 // DEV: Workerプロセスの共通部の定義
 package task
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 // *--------------------------------------------------------------------------------------
 // Task
@@ -13,6 +16,14 @@ type Task interface {
 	Type() TaskType // Task種別
 }
 
+// *--------------------------------------------------------------------------------------
+// TimeoutTask
+// DEV: プールの設定と異なるタイムアウトを持つタスク (0 = プールの設定)
+type TimeoutTask interface {
+	Task
+	TaskTimeout() time.Duration
+}
+
 // *--------------------------------------------------------------------------------------
 // TaskType
 // DEV: タスクの種別を定義
@@ -20,5 +31,6 @@ type TaskType string
 
 const (
 	MqttTaskType  TaskType = "mqtt"  // MQTTタスク
+	BatchTaskType TaskType = "batch" // まとめて処理するMQTTメッセージ
 	OtherTaskType TaskType = "other" // その他のタスク (例: HTTP, DB, etc.
 )
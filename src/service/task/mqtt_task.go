@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
 	"go.uber.org/zap"
@@ -14,6 +15,9 @@ import (
 type MqttTask struct {
 	ID       int
 	Contents mqttm.Contents
+	Value    interface{}   // Dispatcherでデコード済みのペイロード
+	Codec    string        // デコードに使ったCodec名
+	Timeout  time.Duration // トピック毎のタイムアウト (0 = プールの設定)
 }
 
 // *--------------------------------------------------------------------------------------
@@ -26,6 +30,12 @@ func (t *MqttTask) Execute(ctx context.Context) error {
 		// Execute the MQTT task
 		zap.S().Debugf("Executing MqttTask ID: %d, Topic: %s", t.ID, t.Contents.Topic)
 
+		if t.Value != nil {
+			zap.S().Infof("Payload (%s): %+v", t.Codec, t.Value)
+			return nil
+		}
+
+		// DEV: デコードされていない場合はJSONとして扱う
 		var jsonPayload map[string]interface{}
 		if err := json.Unmarshal(t.Contents.Payload, &jsonPayload); err != nil {
 			zap.S().Errorf("Failed to unmarshal payload for MqttTask ID: %d, Error: %v", t.ID, err)
@@ -43,6 +53,12 @@ func (t *MqttTask) String() string {
 	return fmt.Sprintf("MqttTask{Topic: %s, ID: %d}", t.Contents.Topic, t.ID)
 }
 
+// *--------------------------------------------------------------------------------------
+// TaskTimeout
+func (t *MqttTask) TaskTimeout() time.Duration {
+	return t.Timeout
+}
+
 // *--------------------------------------------------------------------------------------
 // Type
 func (t *MqttTask) Type() TaskType {
@@ -0,0 +1,30 @@
+// service/task/result.go
+// DEV: エラー以外の出力を返すタスク (出力メッセージ・後続タスク・メタデータ) はWorkerが自動で振り分ける
+package task
+
+import "context"
+
+type (
+	// ResultTask is a Task that produces a Result; Workers call Produce instead of Execute
+	ResultTask interface {
+		Task
+		Produce(ctx context.Context) (*Result, error)
+	}
+
+	// Result is the output of a ResultTask
+	Result struct {
+		Messages []Message              // Published through the named MQTT client
+		Next     []Task                 // Enqueued to the pool of their TaskType
+		Metadata map[string]interface{} // Logged with the task (e.g. timings, counts)
+	}
+
+	// Message is an output message of a Result
+	// DEV: Payloadが無い場合はValueをトピックのCodecでエンコードする
+	Message struct {
+		Host    string // Name of the MQTT client (MQTT config key)
+		Topic   string
+		QoS     byte
+		Payload []byte
+		Value   interface{}
+	}
+)
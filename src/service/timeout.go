@@ -0,0 +1,73 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.uber.org/zap"
+)
+
+const (
+	DEAD_LETTER_TIMEOUT string = "timeout" // タスクの実行タイムアウト
+
+	METRIC_TASK_TIMEOUTS  string = "service_task_timeouts_total"
+	METRIC_TASK_CANCELLED string = "service_task_cancelled_total"
+	METRIC_TASK_ERRORS    string = "service_task_errors_total"
+)
+
+type (
+	// TimeoutRule overrides the pool timeout for MQTT tasks of a topic filter
+	TimeoutRule struct {
+		Topic     string `json:"topic"`
+		TimeoutMs int    `json:"timeout_ms"`
+	}
+)
+
+// *--------------------------------------------------------------------------------------
+// ValidateTimeouts
+func ValidateTimeouts(rules []TimeoutRule) error {
+	for _, rule := range rules {
+		if !mqttm.ValidTopicFilter(rule.Topic) {
+			return fmt.Errorf("invalid timeout topic filter %q", rule.Topic)
+		}
+		if rule.TimeoutMs <= 0 {
+			return fmt.Errorf("timeout of %s must be positive", rule.Topic)
+		}
+	}
+	return nil
+}
+
+// *--------------------------------------------------------------------------------------
+// WithTimeouts
+// DEV: 最初に一致したルールのタイムアウトをMqttTaskに設定する (ValidateTimeoutsで検証済みのこと)
+func WithTimeouts(rules []TimeoutRule) Option {
+	return func(d *Dispatcher) {
+		d.timeouts = rules
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// timeoutFor
+func (d *Dispatcher) timeoutFor(topic string) int {
+	for _, rule := range d.timeouts {
+		if mqttm.MatchTopic(rule.Topic, topic) {
+			return rule.TimeoutMs
+		}
+	}
+	return 0
+}
+
+// *--------------------------------------------------------------------------------------
+// taskTimedOut
+// DEV: タイムアウトしたタスクはDead-letterに reason=timeout で残す (受信内容の無いタスクはタスク名のみ)
+func (d *Dispatcher) taskTimedOut(t task.Task, cause error) {
+	contents := contentsOf(t)
+	if contents == nil {
+		contents = []mqttm.Contents{{}}
+	}
+	zap.S().Debugf("Dead-lettering timed out task %s", t.String())
+	for _, c := range contents {
+		d.deadLetter(c, DEAD_LETTER_TIMEOUT, fmt.Errorf("task %s: %w", t.String(), cause))
+	}
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm/mqttmtest"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+func TestValidateTimeouts(t *testing.T) {
+	if err := ValidateTimeouts([]TimeoutRule{{Topic: "slow/#", TimeoutMs: 50}}); err != nil {
+		t.Error(err)
+	}
+	for _, rule := range []TimeoutRule{{Topic: "slow/#/x", TimeoutMs: 50}, {Topic: "slow/#", TimeoutMs: 0}} {
+		if err := ValidateTimeouts([]TimeoutRule{rule}); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
+
+func TestTopicTimeoutsAreDeadLettered(t *testing.T) {
+	client := mqttmtest.New("h")
+	dead := &deadLetters{}
+
+	var mu sync.Mutex
+	budgets := map[string]time.Duration{}
+	behave := Middleware(func(next Handler) Handler {
+		return func(ctx context.Context, t task.Task) error {
+			topic := t.(*task.MqttTask).Contents.Topic
+			deadline, _ := ctx.Deadline()
+			mu.Lock()
+			budgets[topic] = time.Until(deadline)
+			mu.Unlock()
+			switch topic {
+			case "slow/stuck":
+				<-ctx.Done()
+				return ctx.Err()
+			case "slow/late":
+				// DEV: 期限を過ぎても成功したタスクはタイムアウト扱いしない
+				time.Sleep(100 * time.Millisecond)
+				return nil
+			}
+			return next(ctx, t)
+		}
+	})
+	chain := &MiddlewareChain{}
+	chain.Use(behave)
+	drain := runDispatcher(t, client, 1, WithMiddleware(chain), WithDeadLetter(dead),
+		WithTimeouts([]TimeoutRule{{Topic: "slow/#", TimeoutMs: 50}}), WithPool(PoolConfig{QueueSize: 4}))
+
+	for _, topic := range []string{"slow/stuck", "slow/late", "fast/a"} {
+		client.Push(topic, []byte(`{}`))
+	}
+	drain()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if budgets["slow/stuck"] > 50*time.Millisecond || budgets["fast/a"] < time.Second {
+		t.Errorf("task budgets = %v, want 50ms for slow/# and the pool timeout otherwise", budgets)
+	}
+	dead.mu.Lock()
+	defer dead.mu.Unlock()
+	if len(dead.entries) != 1 || dead.entries[0].Reason != DEAD_LETTER_TIMEOUT || dead.entries[0].Contents.Topic != "slow/stuck" {
+		t.Errorf("dead letters = %+v, want slow/stuck with reason timeout", dead.entries)
+	}
+}
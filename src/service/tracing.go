@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"slices"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/module/tracing"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	SPAN_ENQUEUE string = "dispatch enqueue"
+	SPAN_TASK    string = "task execute"
+)
+
+type (
+	// OtelTracer is a Tracer that records task executions as OpenTelemetry spans
+	// DEV: MQTTタスクは受信・キュー投入のSpanの子になる。バッチは各要素のSpanにリンクする
+	OtelTracer struct{}
+)
+
+// *--------------------------------------------------------------------------------------
+// Start (OtelTracer)
+func (OtelTracer) Start(ctx context.Context, t task.Task) (context.Context, func(err error)) {
+	attrs := []attribute.KeyValue{
+		attribute.String("task.name", t.String()),
+		attribute.String("task.type", string(t.Type())),
+	}
+	if mqttTask, ok := t.(*task.MqttTask); ok {
+		ctx = tracing.Extract(ctx, mqttTask.Contents.Trace)
+		attrs = append(attrs,
+			attribute.String("messaging.destination.name", mqttTask.Contents.Topic),
+			attribute.String("mqtt.host", mqttTask.Contents.Hostname),
+			attribute.String("task.codec", mqttTask.Codec),
+		)
+	}
+	var links []trace.Link
+	if batchTask, ok := t.(*task.BatchTask); ok {
+		// DEV: バッチは複数のトレースにまたがるため、親にせず各要素のSpanへのリンクにする
+		attrs = append(attrs,
+			attribute.String("batch.route", batchTask.Route),
+			attribute.Int("batch.size", len(batchTask.Items)),
+		)
+		for _, item := range batchTask.Items {
+			if spanCtx := trace.SpanContextFromContext(tracing.Extract(context.Background(), item.Contents.Trace)); spanCtx.IsValid() {
+				links = append(links, trace.Link{SpanContext: spanCtx})
+			}
+		}
+	}
+	ctx, span := tracing.Tracer().Start(ctx, SPAN_TASK, trace.WithAttributes(attrs...), trace.WithLinks(links...))
+	return ctx, func(err error) {
+		tracing.End(span, err)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// WithTracing (MiddlewareConfig)
+// DEV: トレース有効時は設定に関わらず全タスクにSpanを付ける。useの先頭 (Recoverの直内側) に置き、
+// types/routesの指定は二重のSpanにならないよう取り除く
+func (conf MiddlewareConfig) WithTracing() MiddlewareConfig {
+	isTracing := func(name string) bool { return name == MIDDLEWARE_TRACING }
+	traced := MiddlewareConfig{
+		Use:    append([]string{MIDDLEWARE_TRACING}, slices.DeleteFunc(slices.Clone(conf.Use), isTracing)...),
+		Routes: make([]MiddlewareRoute, 0, len(conf.Routes)),
+	}
+	if conf.Types != nil {
+		traced.Types = make(map[task.TaskType][]string, len(conf.Types))
+		for taskType, names := range conf.Types {
+			traced.Types[taskType] = slices.DeleteFunc(slices.Clone(names), isTracing)
+		}
+	}
+	for _, route := range conf.Routes {
+		traced.Routes = append(traced.Routes, MiddlewareRoute{Topic: route.Topic, Use: slices.DeleteFunc(slices.Clone(route.Use), isTracing)})
+	}
+	return traced
+}
+
+// *--------------------------------------------------------------------------------------
+// startEnqueueSpan
+func startEnqueueSpan(contents mqttm.Contents) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(tracing.Extract(context.Background(), contents.Trace), SPAN_ENQUEUE,
+		trace.WithAttributes(
+			attribute.String("messaging.destination.name", contents.Topic),
+			attribute.String("mqtt.host", contents.Hostname),
+		),
+	)
+}
+
+// *--------------------------------------------------------------------------------------
+// inheritTrace
+// DEV: 後続のMQTTタスクにTrace Contextが無ければ、元のタスクのSpanを引き継ぐ
+func inheritTrace(ctx context.Context, next task.Task) {
+	if mqttTask, ok := next.(*task.MqttTask); ok && len(mqttTask.Contents.Trace) == 0 {
+		mqttTask.Contents.Trace = tracing.Inject(ctx)
+	}
+}
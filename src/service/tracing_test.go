@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tinayla696/mqtt_protocol_golang/module/mqttm"
+	"github.com/tinayla696/mqtt_protocol_golang/service/task"
+)
+
+func TestWithTracingWrapsEveryTaskOnce(t *testing.T) {
+	conf := MiddlewareConfig{
+		Use:    []string{MIDDLEWARE_LOGGING, MIDDLEWARE_TRACING},
+		Types:  map[task.TaskType][]string{task.MqttTaskType: {MIDDLEWARE_TRACING}},
+		Routes: []MiddlewareRoute{{Topic: "sensors/#", Use: []string{MIDDLEWARE_TRACING, "route"}}},
+	}
+	traced := conf.WithTracing()
+	if got := strings.Join(traced.Use, ","); got != "tracing,logging" {
+		t.Errorf("use = %s, want tracing,logging", got)
+	}
+	if len(traced.Types[task.MqttTaskType]) != 0 || strings.Join(traced.Routes[0].Use, ",") != "route" {
+		t.Errorf("types = %v, routes = %+v, want tracing removed", traced.Types, traced.Routes)
+	}
+	// DEV: 元の設定は変更しない
+	if strings.Join(conf.Use, ",") != "logging,tracing" || len(conf.Types[task.MqttTaskType]) != 1 {
+		t.Errorf("config was modified: %+v", conf)
+	}
+
+	var calls []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, t task.Task) error {
+				calls = append(calls, name)
+				return next(ctx, t)
+			}
+		}
+	}
+	chain, err := NewMiddlewareChain(traced, map[string]Middleware{
+		MIDDLEWARE_TRACING: mark("span"), MIDDLEWARE_LOGGING: mark("log"), "route": mark("route"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mqttTask := &task.MqttTask{Contents: mqttm.Contents{Topic: "sensors/a"}}
+	chain.Wrap(mqttTask, func(context.Context, task.Task) error { return nil })(context.Background(), mqttTask)
+	if got := strings.Join(calls, ","); got != "span,log,route" {
+		t.Errorf("MQTT task ran %s, want span,log,route", got)
+	}
+
+	// DEV: 何も指定が無くてもSpanは付く
+	calls = nil
+	chain, err = NewMiddlewareChain(MiddlewareConfig{}.WithTracing(), map[string]Middleware{MIDDLEWARE_TRACING: mark("span")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &funcTask{name: "other", taskType: task.OtherTaskType}
+	chain.Wrap(other, func(context.Context, task.Task) error { return nil })(context.Background(), other)
+	if got := strings.Join(calls, ","); got != "span" {
+		t.Errorf("other task ran %s, want span", got)
+	}
+}
@@ -2,9 +2,12 @@ package service
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
+	"github.com/tinayla696/mqtt_protocol_golang/module/metrics"
+	"github.com/tinayla696/mqtt_protocol_golang/module/ratelimit"
 	"github.com/tinayla696/mqtt_protocol_golang/service/task"
 	"go.uber.org/zap"
 )
@@ -17,6 +20,24 @@ type Worker struct {
 	quit       <-chan struct{}
 	wg         *sync.WaitGroup
 	workerType task.TaskType
+
+	retire  <-chan struct{}                                // WorkerPoolの縮小通知 (nil = 退役しない)
+	observe func(time.Duration)                            // タスク実行時間の通知先 (nil = 通知しない)
+	timeout time.Duration                                  // タスク毎の実行タイムアウト (0 = DEFAULT_TASK_TIMEOUT_MS)
+	route   func(context.Context, task.Task, *task.Result) // ResultTaskの結果の振り分け先 (nil = 破棄)
+
+	parent    context.Context        // タスクのContextの親 (nil = context.Background)
+	timedOut  func(task.Task, error) // タイムアウトしたタスクの通知先 (nil = ログのみ)
+	finished  func(task.Task)        // 実行を終えたタスクの通知先 (nil = 通知しない)
+	settled   func(task.Task)        // 受け取ったタスクの扱いが決まった通知先 (実行・退避・破棄のいずれも。nil = 通知しない)
+	abandoned func(task.Task)        // 停止により実行されなかったタスクの通知先 (nil = 破棄)
+
+	middleware *MiddlewareChain // タスク実行を包むMiddleware (nil = Recoverのみ)
+
+	limiter *ratelimit.Limiter // タスク実行の流量制限 (nil = 制限しない)
+	spilled func(task.Task)    // 流量制限でspillされたタスクの退避先 (nil = 破棄)
+
+	rejected func(task.Task, error) // サーキットブレーカーのopen中に実行しなかったタスクの通知先 (nil = ログのみ)
 }
 
 // *--------------------------------------------------------------------------------------
@@ -42,21 +63,154 @@ func (w *Worker) Start() {
 			zap.S().Infof("Worker %d quitting", w.id)
 			return
 
+		case <-w.retire:
+			zap.S().Infof("Worker %d retired", w.id)
+			return
+
 		case task, ok := <-w.taskCh:
 			if !ok {
 				zap.S().Infof("Worker %d: task channel closed", w.id)
 				return
 			}
-			zap.S().Debugf("Worker %d received task: %s", w.id, task.String())
+			if !w.handle(task) {
+				zap.S().Infof("Worker %d quitting", w.id)
+				return
+			}
+		}
+	}
+}
 
-			// Create a context for the task execution
-			ctx, cancelFn := context.WithTimeout(context.Background(), 5000*time.Millisecond)
-			err := task.Execute(ctx)
-			cancelFn()
+// *--------------------------------------------------------------------------------------
+// handle
+// DEV: 受け取ったタスクを実行する。停止後に受け取った場合は実行せずに返してfalseを返す。
+// どの経路で終わってもsettledに通知する (Drainが未処理のタスクを数えるため)
+func (w *Worker) handle(task task.Task) bool {
+	if w.settled != nil {
+		defer w.settled(task)
+	}
+	zap.S().Debugf("Worker %d received task: %s", w.id, task.String())
 
-			if err != nil {
-				zap.S().Errorf("Worker %d failed to execute task %s: %v", w.id, task.String(), err)
-			}
+	// DEV: 停止後に受け取ったタスクは実行せずに返す
+	select {
+	case <-w.quit:
+		w.abandon(task)
+		return false
+	default:
+	}
+
+	if !w.throttle(task) {
+		return true
+	}
+
+	// Create a context for the task execution
+	// DEV: 親はDispatcherのContextのため、停止時には実行中のタスクもキャンセルされる
+	timeout := w.timeoutOf(task)
+	ctx, cancelFn := context.WithTimeout(w.parentContext(), timeout)
+	started := time.Now()
+	err := w.middleware.Wrap(task, w.execute)(ctx, task)
+	// DEV: 期限の直前に成功したタスクはタイムアウトとして扱わない
+	expired := err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+	cancelFn()
+	if w.observe != nil {
+		w.observe(time.Since(started))
+	}
+
+	switch {
+	case expired:
+		zap.S().Warnf("Worker %d: task %s timed out after %v", w.id, task.String(), timeout)
+		metrics.Counter(METRIC_TASK_TIMEOUTS, string(w.workerType)).Add(1)
+		if w.timedOut != nil {
+			w.timedOut(task, context.DeadlineExceeded)
+		}
+	case err != nil && w.parentContext().Err() != nil:
+		zap.S().Warnf("Worker %d: task %s cancelled by shutdown: %v", w.id, task.String(), err)
+		metrics.Counter(METRIC_TASK_CANCELLED, string(w.workerType)).Add(1)
+		w.abandon(task)
+		return true
+	case errors.Is(err, ErrCircuitOpen):
+		zap.S().Debugf("Worker %d: task %s not executed: %v", w.id, task.String(), err)
+		if w.rejected != nil {
+			w.rejected(task, err)
+		}
+	case err != nil:
+		zap.S().Errorf("Worker %d failed to execute task %s: %v", w.id, task.String(), err)
+		metrics.Counter(METRIC_TASK_ERRORS, string(w.workerType)).Add(1)
+	}
+	if w.finished != nil {
+		w.finished(task)
+	}
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// abandon
+func (w *Worker) abandon(t task.Task) {
+	if w.abandoned != nil {
+		w.abandoned(t)
+	}
+}
+
+// *--------------------------------------------------------------------------------------
+// throttle
+// DEV: 実行してよければtrueを返す。waitで待っている間に停止した場合は実行せずに返す
+func (w *Worker) throttle(t task.Task) bool {
+	if w.limiter == nil {
+		return true
+	}
+	size := 0
+	if mqttTask, ok := t.(*task.MqttTask); ok {
+		size = len(mqttTask.Contents.Payload)
+	}
+	action, err := ratelimit.Take(w.parentContext(), size, w.limiter)
+	switch {
+	case err != nil:
+		w.abandon(t)
+		return false
+	case action == ratelimit.ACTION_DROP:
+		zap.S().Debugf("Worker %d dropped task %s (rate limited)", w.id, t.String())
+		return false
+	case action == ratelimit.ACTION_SPILL:
+		if w.spilled != nil {
+			w.spilled(t)
 		}
+		return false
+	}
+	return true
+}
+
+// *--------------------------------------------------------------------------------------
+// parentContext
+func (w *Worker) parentContext() context.Context {
+	if w.parent == nil {
+		return context.Background()
+	}
+	return w.parent
+}
+
+// *--------------------------------------------------------------------------------------
+// timeoutOf
+// DEV: タスク自身のタイムアウト (ルート毎) > プールのタイムアウト > 既定値
+func (w *Worker) timeoutOf(t task.Task) time.Duration {
+	if timed, ok := t.(task.TimeoutTask); ok && timed.TaskTimeout() > 0 {
+		return timed.TaskTimeout()
+	}
+	if w.timeout > 0 {
+		return w.timeout
+	}
+	return time.Duration(DEFAULT_TASK_TIMEOUT_MS) * time.Millisecond
+}
+
+// *--------------------------------------------------------------------------------------
+// execute
+// DEV: ResultTaskは結果を振り分ける (エラー時も途中までの結果は振り分ける)
+func (w *Worker) execute(ctx context.Context, t task.Task) error {
+	producer, ok := t.(task.ResultTask)
+	if !ok {
+		return t.Execute(ctx)
+	}
+	result, err := producer.Produce(ctx)
+	if w.route != nil {
+		w.route(ctx, t, result)
 	}
+	return err
 }